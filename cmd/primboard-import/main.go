@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/mirisbowring/primboard/importer"
+	log "github.com/sirupsen/logrus"
+)
+
+func main() {
+	var conf importer.Config
+	flag.StringVar(&conf.Dir, "dir", "", "directory to import (e.g. an extracted google takeout)")
+	flag.StringVar(&conf.StateFile, "state", "primboard-import.state", "state file to resume an interrupted import")
+	flag.StringVar(&conf.GatewayURL, "gateway", "", "url of the api gateway")
+	flag.StringVar(&conf.NodeURL, "node", "", "api endpoint of the node to upload to")
+	flag.StringVar(&conf.Username, "user", "", "user to import as")
+	flag.StringVar(&conf.CaCert, "ca-cert", "", "ca certificate to verify gateway and node")
+	flag.BoolVar(&conf.TLSInsecure, "tls-insecure", false, "skip certificate verification")
+	flag.IntVar(&conf.BatchSize, "batch", 100, "number of files that are checked for duplicates at once")
+	flag.BoolVar(&conf.FolderEvents, "folder-events", false, "map folders without album metadata to events by their name")
+	flag.StringVar(&conf.Keycloak.URL, "keycloak-url", "", "url of the keycloak")
+	flag.StringVar(&conf.Keycloak.Realm, "keycloak-realm", "", "keycloak realm")
+	flag.StringVar(&conf.Keycloak.ClientID, "keycloak-client-id", "", "keycloak client to log in with")
+	logLevel := flag.String("log", "info", `Set Log Level
+	debug - useful debugging information
+	info - (default) everything noteworthy
+	warn - only warnings are displayed - have an eye on them
+	error - only errors are shown
+	fatal - only log the fatal message before quitting`)
+	help := flag.Bool("h", false, "shows the help page")
+	flag.Parse()
+
+	if *help {
+		flag.PrintDefaults()
+		return
+	}
+
+	log.SetOutput(os.Stdout)
+
+	level, err := log.ParseLevel(*logLevel)
+	if err != nil {
+		log.Fatal("unknown log level specified")
+	}
+	log.SetLevel(level)
+
+	// secrets are not passed as flags to keep them out of the process list
+	conf.Password = os.Getenv("PRIMBOARD_PASSWORD")
+	conf.Keycloak.Secret = os.Getenv("KEYCLOAK_SECRET")
+
+	imp, err := importer.New(conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	stats, err := imp.Run()
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.WithFields(log.Fields{
+		"uploaded": stats.Uploaded,
+		"skipped":  stats.Skipped,
+		"failed":   stats.Failed,
+	}).Info("import finished")
+}
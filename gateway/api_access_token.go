@@ -0,0 +1,155 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	_http "github.com/mirisbowring/primboard/helper/http"
+	"github.com/mirisbowring/primboard/models"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// maxAccessTokens limits the active access tokens per user
+const maxAccessTokens = 50
+
+// accessTokenScopes maps the routes, that can be called with a personal access
+// token, to the required scope. All other routes require a jwt.
+var accessTokenScopes = map[string]string{
+	"GET /api/v1/event/{id}":         models.ScopeMediaRead,
+	"GET /api/v1/events":             models.ScopeMediaRead,
+	"GET /api/v1/events/{title}":     models.ScopeMediaRead,
+	"POST /api/v1/export":            models.ScopeMediaRead,
+	"GET /api/v1/media":              models.ScopeMediaRead,
+	"GET /api/v1/media/{id}":         models.ScopeMediaRead,
+	"GET /api/v1/media/geo":          models.ScopeMediaRead,
+	"GET /api/v1/media/geo/clusters": models.ScopeMediaRead,
+	"POST /api/v1/media/bysha1s":     models.ScopeMediaRead,
+	"GET /api/v1/media/byids":        models.ScopeMediaRead,
+	"GET /api/v1/tag/{id}":           models.ScopeMediaRead,
+	"GET /api/v1/tags":               models.ScopeMediaRead,
+	"GET /api/v1/tags/{name}":        models.ScopeMediaRead,
+	"POST /api/v1/media/upload":      models.ScopeMediaUpload,
+	"POST /api/v1/media/maptags":     models.ScopeTagsManage,
+	"POST /api/v1/media/{id}/tag":    models.ScopeTagsManage,
+	"POST /api/v1/media/{id}/tags":   models.ScopeTagsManage,
+	"POST /api/v1/tag":               models.ScopeTagsManage,
+	"PUT /api/v1/tag/{id}":           models.ScopeTagsManage,
+}
+
+// verifyAccessToken verifies the personal access token and its scope for the
+// current route. Responds with an error if the token cannot be used.
+func (g *AppGateway) verifyAccessToken(w http.ResponseWriter, r *http.Request, bearer string, introspect bool) (string, bool) {
+	t, err := models.GetActiveAccessToken(g.DB, bearer)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Error("could not select access token")
+		}
+		_http.RespondWithError(w, http.StatusUnauthorized, "Your session is invalid")
+		return "", false
+	}
+
+	// revocation sensitive routes require a jwt
+	scope := ""
+	if route := mux.CurrentRoute(r); route != nil && !introspect {
+		if template, err := route.GetPathTemplate(); err == nil {
+			scope = accessTokenScopes[r.Method+" "+template]
+		}
+	}
+	if scope == "" || !t.HasScope(scope) {
+		log.WithFields(log.Fields{
+			"token":  t.ID.Hex(),
+			"owner":  t.Owner,
+			"method": r.Method,
+			"uri":    r.RequestURI,
+		}).Warn("access token is not allowed to access route")
+		_http.RespondWithError(w, http.StatusForbidden, "Your access token is not allowed to access this resource")
+		return "", false
+	}
+
+	// prepare the session of the user (the token itself is not stored)
+	if s := g.Sessions.GetByUser(t.Owner); s == nil {
+		g.prepareUsersession(t.Owner, "pat:"+t.Hash)
+	}
+	return t.Owner, true
+}
+
+// createAccessToken issues a personal access token for the current user. The
+// token is only returned once.
+func (g *AppGateway) createAccessToken(w http.ResponseWriter, r *http.Request) {
+	var t models.AccessToken
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&t); err != nil {
+		_http.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if err := t.IsValid(); err != nil {
+		_http.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	t.Owner = _http.GetUsernameFromHeader(w)
+
+	count, err := models.CountAccessTokens(g.DB, t.Owner)
+	if err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if count >= maxAccessTokens {
+		_http.RespondWithError(w, http.StatusTooManyRequests, "too many access tokens")
+		return
+	}
+
+	if err := t.Create(g.DB); err != nil {
+		log.WithFields(log.Fields{
+			"owner": t.Owner,
+			"error": err.Error(),
+		}).Error("could not create access token")
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not create access token")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"owner":  t.Owner,
+		"token":  t.ID.Hex(),
+		"scopes": t.Scopes,
+	}).Info("created access token")
+	_http.RespondWithJSON(w, http.StatusCreated, t)
+}
+
+// getAccessTokens lists the access tokens of the current user
+func (g *AppGateway) getAccessTokens(w http.ResponseWriter, r *http.Request) {
+	tokens, err := models.GetAccessTokens(g.DB, _http.GetUsernameFromHeader(w))
+	if err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	_http.RespondWithJSON(w, http.StatusOK, tokens)
+}
+
+// revokeAccessToken revokes an access token of the current user
+func (g *AppGateway) revokeAccessToken(w http.ResponseWriter, r *http.Request) {
+	id := parseID(w, r)
+	if id.IsZero() {
+		return
+	}
+	t := models.AccessToken{ID: id, Owner: _http.GetUsernameFromHeader(w)}
+	if err := t.Revoke(g.DB); err != nil {
+		if err == mongo.ErrNoDocuments {
+			_http.RespondWithError(w, http.StatusNotFound, "Access token not found")
+			return
+		}
+		_http.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"owner": t.Owner,
+		"token": t.ID.Hex(),
+	}).Info("revoked access token")
+	_http.RespondWithJSON(w, http.StatusOK, "revoked access token")
+}
@@ -0,0 +1,63 @@
+package gateway
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	_http "github.com/mirisbowring/primboard/helper/http"
+	"github.com/mirisbowring/primboard/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// defaultAuditPageSize is the page size of the audit log if not specified
+const defaultAuditPageSize = 50
+
+// getAuditLog returns a page of the audit log entries of the resources owned
+// by the current user
+func (g *AppGateway) getAuditLog(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	query := models.AuditQuery{
+		Actor:  values.Get("actor"),
+		Action: values.Get("action"),
+		Target: values.Get("target"),
+	}
+
+	if before := values.Get("before"); before != "" {
+		id, err := primitive.ObjectIDFromHex(before)
+		if err != nil {
+			_http.RespondWithError(w, http.StatusBadRequest, "could not parse query param 'before'")
+			return
+		}
+		query.Before = id
+	}
+	for key, value := range map[string]*time.Time{"from": &query.From, "until": &query.Until} {
+		if tmp := values.Get(key); tmp != "" {
+			unix, err := strconv.ParseInt(tmp, 10, 64)
+			if err != nil {
+				_http.RespondWithError(w, http.StatusBadRequest, "could not parse query param '"+key+"'")
+				return
+			}
+			*value = time.Unix(unix, 0)
+		}
+	}
+	if size := values.Get("size"); size != "" {
+		tmp, err := strconv.Atoi(size)
+		if err != nil {
+			_http.RespondWithError(w, http.StatusBadRequest, "could not parse query param 'size'")
+			return
+		}
+		query.Size = tmp
+	}
+	if err := query.IsValid(defaultAuditPageSize); err != nil {
+		_http.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	entries, err := models.GetAuditEntries(g.DB, _http.GetUsernameFromHeader(w), query)
+	if err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	_http.RespondWithJSON(w, http.StatusOK, entries)
+}
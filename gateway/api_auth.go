@@ -0,0 +1,131 @@
+package gateway
+
+import (
+	"net/http"
+	"net/url"
+
+	_http "github.com/mirisbowring/primboard/helper/http"
+	"github.com/mirisbowring/primboard/internal/identity"
+	log "github.com/sirupsen/logrus"
+)
+
+// the following endpoints turn the gateway into a minimal openid provider for
+// its nodes if the local identity provider is configured
+
+// localIdentity returns the local provider or responds with not found
+func (g *AppGateway) localIdentity(w http.ResponseWriter) (*identity.Local, bool) {
+	local, ok := g.Identity.(*identity.Local)
+	if !ok {
+		_http.RespondWithError(w, http.StatusNotFound, "local identity provider is not enabled")
+	}
+	return local, ok
+}
+
+// getOpenIDConfiguration returns the provider metadata for the discovery
+func (g *AppGateway) getOpenIDConfiguration(w http.ResponseWriter, r *http.Request) {
+	local, ok := g.localIdentity(w)
+	if !ok {
+		return
+	}
+	_http.RespondWithJSON(w, http.StatusOK, local.Metadata())
+}
+
+// getCerts returns the public signing key as jwks
+func (g *AppGateway) getCerts(w http.ResponseWriter, r *http.Request) {
+	local, ok := g.localIdentity(w)
+	if !ok {
+		return
+	}
+	_http.RespondWithJSON(w, http.StatusOK, local.KeySet())
+}
+
+// issueToken is the token endpoint (client credentials grant for nodes,
+// password and refresh token grant for local users)
+func (g *AppGateway) issueToken(w http.ResponseWriter, r *http.Request) {
+	local, ok := g.localIdentity(w)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		_http.RespondWithError(w, http.StatusBadRequest, "invalid_request")
+		return
+	}
+
+	var token *identity.Token
+	var err error
+	subject := ""
+	switch r.PostForm.Get("grant_type") {
+	case "client_credentials":
+		if subject, ok = authenticateClient(w, r, local); !ok {
+			return
+		}
+		token, err = local.IssueClientToken(subject)
+	case "password":
+		subject = r.PostForm.Get("username")
+		if !g.matchesUserPassword(subject, r.PostForm.Get("password")) {
+			_http.RespondWithError(w, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+		token, err = local.IssueUserToken(subject)
+	case "refresh_token":
+		if token, err = local.RefreshUserToken(r.PostForm.Get("refresh_token")); err != nil {
+			_http.RespondWithError(w, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+	default:
+		_http.RespondWithError(w, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"subject": subject,
+			"error":   err.Error(),
+		}).Error("could not issue token")
+		_http.RespondWithError(w, http.StatusInternalServerError, "server_error")
+		return
+	}
+	_http.RespondWithJSON(w, http.StatusOK, token)
+}
+
+// introspect is the introspection endpoint (RFC 7662)
+func (g *AppGateway) introspect(w http.ResponseWriter, r *http.Request) {
+	local, ok := g.localIdentity(w)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		_http.RespondWithError(w, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	if _, ok := authenticateClient(w, r, local); !ok {
+		return
+	}
+	result, _ := local.Introspect(r.Context(), r.PostForm.Get("token"))
+	res := map[string]interface{}{"active": result.Active}
+	if result.Active {
+		res["exp"] = result.Expiry.Unix()
+	}
+	_http.RespondWithJSON(w, http.StatusOK, res)
+}
+
+// authenticateClient verifies the client credentials passed via basic auth or
+// within the form
+func authenticateClient(w http.ResponseWriter, r *http.Request, local *identity.Local) (string, bool) {
+	clientID, secret, ok := r.BasicAuth()
+	if ok {
+		// credentials are form encoded within basic auth (RFC 6749 2.3.1)
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+	if err := local.AuthenticateClient(clientID, secret); err != nil {
+		log.WithFields(log.Fields{
+			"clientID": clientID,
+		}).Warn("client failed to authenticate")
+		_http.RespondWithError(w, http.StatusUnauthorized, "invalid_client")
+		return "", false
+	}
+	return clientID, true
+}
@@ -128,9 +128,10 @@ func (g *AppGateway) MapTagsToEvents(w http.ResponseWriter, r *http.Request) {
 		}
 		IDs = append(IDs, e.ID)
 	}
+	g.auditTargets(r, "event", IDs...)
 
 	// execute bulk update
-	_, err := models.BulkAddTagEvent(g.DB, tem.Tags, IDs, g.GetUserPermissionW(w, false))
+	_, err := models.BulkAddTagEvent(g.DB, tem.Tags, IDs, g.GetUserPermissionRoleW(w, models.RoleContributor))
 	if err != nil {
 		_http.RespondWithError(w, http.StatusInternalServerError, "Could not bulk update documents!")
 		return
@@ -166,7 +167,7 @@ func (g *AppGateway) UpdateEventByID(w http.ResponseWriter, r *http.Request) {
 	}
 	// trying to update model with requested body
 	e := models.Event{ID: id}
-	_, err := e.UpdateEvent(g.DB, ue, g.GetUserPermissionW(w, true))
+	_, err := e.UpdateEvent(g.DB, ue, g.GetUserPermissionRoleW(w, models.RoleContributor))
 	if err != nil {
 		// Error occured during update
 		_http.RespondWithError(w, http.StatusInternalServerError, err.Error())
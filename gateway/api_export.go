@@ -0,0 +1,190 @@
+package gateway
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"time"
+
+	_http "github.com/mirisbowring/primboard/helper/http"
+	"github.com/mirisbowring/primboard/internal/handler"
+	"github.com/mirisbowring/primboard/models"
+	"github.com/mirisbowring/primboard/models/maps"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// exportSidecar is the name of the json sidecar within an export
+const exportSidecar = "media.json"
+
+// exportMedia streams an archive of the selected media, events or the whole
+// library of the user. The files are pulled from the nodes and a json sidecar
+// with titles, tags, comments and events is appended.
+func (g *AppGateway) exportMedia(w http.ResponseWriter, r *http.Request) {
+	var req models.ExportRequest
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&req); err != nil {
+		_http.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if err := req.IsValid(); err != nil {
+		_http.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	aw, err := handler.NewArchiveWriter(req.Format, w)
+	if err != nil {
+		_http.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// the whole library contains owned media only
+	var mediaIDs, eventIDs []primitive.ObjectID
+	if !req.All {
+		if mediaIDs, err = ParseIDs(req.MediaIDs); err != nil {
+			_http.RespondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if eventIDs, err = ParseIDs(req.EventIDs); err != nil {
+			_http.RespondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	media, err := models.GetMediaForExport(g.DB, mediaIDs, eventIDs, g.GetUserPermissionW(w, req.All))
+	if err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not select media from database")
+		return
+	}
+	if len(media) == 0 {
+		_http.RespondWithError(w, http.StatusNotFound, "no media found to export")
+		return
+	}
+
+	// map files to the nodes they are pulled from
+	sidecar := models.MediaExport{Timestamp: time.Now().Unix()}
+	requests := make(map[primitive.ObjectID][]maps.ArchiveFile)
+	var events []primitive.ObjectID
+	for _, m := range media {
+		sidecar.Media = append(sidecar.Media, m.ExportCopy())
+		events = append(events, m.Events...)
+		nodeID, ok := g.selectExportNode(m)
+		if !ok {
+			sidecar.Missing = append(sidecar.Missing, m.FileName)
+			continue
+		}
+		requests[nodeID] = append(requests[nodeID], maps.ArchiveFile{
+			Username: m.Creator,
+			Filename: m.FileName,
+			Name:     path.Join("media", m.FileName),
+		})
+	}
+
+	// the status cannot be changed after the first file has been written
+	w.Header().Set("Content-Type", handler.ArchiveContentType(req.Format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"export.%s\"", handler.ArchiveExtension(req.Format)))
+	w.WriteHeader(http.StatusOK)
+
+	for nodeID, files := range requests {
+		node, _ := g.getNode(nodeID)
+		added := g.copyNodeArchive(aw, &node, files)
+		for _, file := range files {
+			if !added[file.Name] {
+				sidecar.Missing = append(sidecar.Missing, file.Filename)
+			}
+		}
+	}
+
+	// append sidecar with all metadata
+	if len(events) > 0 {
+		sidecar.Events, _ = models.GetEventsByIDs(g.DB, events, g.GetUserPermissionW(w, false))
+	}
+	data, err := json.MarshalIndent(sidecar, "", "  ")
+	if err == nil {
+		err = aw.Add(exportSidecar, int64(len(data)), time.Now(), bytes.NewReader(data))
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Error("could not add sidecar to export")
+	}
+
+	if err := aw.Close(); err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Error("could not finish export")
+		return
+	}
+	log.WithFields(log.Fields{
+		"user":    _http.GetUsernameFromHeader(w),
+		"media":   len(media),
+		"missing": len(sidecar.Missing),
+	}).Info("exported media")
+}
+
+// selectExportNode returns the first online node, the media is stored on
+func (g *AppGateway) selectExportNode(m models.Media) (primitive.ObjectID, bool) {
+	for _, node := range m.Nodes {
+		if g.isNodeOnline(node.ID) {
+			return node.ID, true
+		}
+	}
+	return primitive.NilObjectID, false
+}
+
+// copyNodeArchive requests the files as tar stream from the node and copies
+// every entry into the archive. Returns the names of all added entries.
+func (g *AppGateway) copyNodeArchive(aw handler.ArchiveWriter, node *models.Node, files []maps.ArchiveFile) map[string]bool {
+	added := make(map[string]bool)
+
+	body := new(bytes.Buffer)
+	json.NewEncoder(body).Encode(maps.ArchiveRequest{Format: handler.ArchiveFormatTar, Files: files})
+
+	endpoint := fmt.Sprintf("%s/api/v1/archive", node.APIEndpoint)
+	logfields := log.Fields{
+		"node":     node.ID.Hex(),
+		"endpoint": endpoint,
+	}
+
+	// refresh keycloaktoken in neccessary
+	g.refreshServiceToken()
+
+	res, status, msg := _http.SendRequest(g.nodeClient(node.ID), http.MethodPost, endpoint, g.ServiceToken.AccessToken, body, "application/json")
+	if status > 0 {
+		logfields["error"] = msg
+		log.WithFields(logfields).Error("could not send request")
+		return added
+	}
+	defer res.Body.Close()
+
+	logfields["status-code"] = res.StatusCode
+	if res.StatusCode != http.StatusOK {
+		log.WithFields(logfields).Error("unexpected status code")
+		return added
+	}
+
+	tr := tar.NewReader(res.Body)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logfields["error"] = err.Error()
+			log.WithFields(logfields).Error("could not read archive from node")
+			break
+		}
+		if err := aw.Add(header.Name, header.Size, header.ModTime, tr); err != nil {
+			logfields["error"] = err.Error()
+			log.WithFields(logfields).Error("could not copy file into export")
+			break
+		}
+		added[header.Name] = true
+	}
+	return added
+}
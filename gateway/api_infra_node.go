@@ -2,19 +2,25 @@ package gateway
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
-	"github.com/Nerzal/gocloak/v7"
 	_http "github.com/mirisbowring/primboard/helper/http"
 	"github.com/mirisbowring/primboard/internal/handler"
 
 	"github.com/mirisbowring/primboard/models"
+	"github.com/mirisbowring/primboard/models/maps"
 	log "github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// maxNodeStructureSize limits the page size of the node structure
+const maxNodeStructureSize = 1000
+
 // AuthenticateNode selects the specified node from db and verifies the psk
 func (g *AppGateway) authenticateNode(w http.ResponseWriter, r *http.Request) {
 	id := w.Header().Get("clientID")
@@ -63,9 +69,23 @@ func (g *AppGateway) authenticateNode(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// the node verifies the signed file urls with its key
+	if err := node.EnsureSigningKey(g.DB); err != nil {
+		log.WithFields(log.Fields{
+			"node":  node.ID,
+			"error": err.Error(),
+		}).Error("could not create signing key")
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not create signing key")
+		return
+	}
+
 	// append node if not in list already
-	if n := g.Nodes[node.ID]; n == nil {
-		g.Nodes[node.ID] = &node
+	if n, ok := g.getNode(node.ID); !ok {
+		node.LastSeen = time.Now().Unix()
+		g.setNode(&node)
+	} else if n.SigningKey != node.SigningKey {
+		n.SigningKey = node.SigningKey
+		g.setNode(&n)
 	}
 
 	log.WithFields(log.Fields{
@@ -75,7 +95,62 @@ func (g *AppGateway) authenticateNode(w http.ResponseWriter, r *http.Request) {
 
 	// go g.syncUserAuthentication(node)
 
-	// respond with ok
+	_http.RespondWithJSON(w, http.StatusOK, maps.NodeAuthentication{
+		SigningKey:      node.SigningKey,
+		GatewayClientID: g.Config.Keycloak.ClientID,
+	})
+}
+
+// nodeHeartbeat stores the health reported by the node and marks it as online
+func (g *AppGateway) nodeHeartbeat(w http.ResponseWriter, r *http.Request) {
+	id := w.Header().Get("clientID")
+	nodeID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		_http.RespondWithError(w, http.StatusBadRequest, "could not parse ObjectID from clientID")
+		return
+	}
+
+	var health models.NodeHealth
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&health); err != nil {
+		_http.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	node, ok := g.getNode(nodeID)
+	if !ok {
+		// node is not authenticated (yet) or has been offline
+		node = models.Node{ID: nodeID}
+		if err := node.GetNode(g.DB, bson.M{"_id": node.ID}, models.NodeProjectInternal); err != nil {
+			log.WithFields(log.Fields{
+				"node":  id,
+				"error": err.Error(),
+			}).Error("could not select node from database")
+			_http.RespondWithError(w, http.StatusUnauthorized, "could not authenticate node")
+			return
+		}
+	}
+
+	wasOffline, err := node.UpdateHealth(g.DB, health)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"node":  id,
+			"error": err.Error(),
+		}).Error("could not save node health")
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not save node health")
+		return
+	}
+	g.setNode(&node)
+
+	if wasOffline {
+		log.WithFields(log.Fields{
+			"node": id,
+		}).Info("node is online")
+		go g.refreshMediaAvailability()
+		// deliver the operations, the node has missed
+		g.notifyOutbox()
+	}
 	_http.RespondWithJSON(w, http.StatusOK, "")
 }
 
@@ -94,62 +169,46 @@ func (g *AppGateway) registerNode(w http.ResponseWriter, r *http.Request) {
 
 	ctx, cancel := context.WithCancel(g.Ctx)
 	defer cancel()
-	//prepare new keycloak client for node
-	client := gocloak.Client{
-		ClientID:                  gocloak.StringP(node.ID.Hex()),
-		ClientAuthenticatorType:   gocloak.StringP("client-secret"),
-		Enabled:                   gocloak.BoolP(true),
-		FrontChannelLogout:        gocloak.BoolP(false),
-		Protocol:                  gocloak.StringP("openid-connect"),
-		StandardFlowEnabled:       gocloak.BoolP(true),
-		ImplicitFlowEnabled:       gocloak.BoolP(false),
-		DirectAccessGrantsEnabled: gocloak.BoolP(true),
-		ServiceAccountsEnabled:    gocloak.BoolP(true),
-		PublicClient:              gocloak.BoolP(false),
-		BearerOnly:                gocloak.BoolP(false),
-		Attributes: &(map[string]string{
-			"backchannel.logout.session.required":      "false",
-			"backchannel.logout.revoke.offline.tokens": "false",
-			"access.token.signed.response.alg":         "RS256",
-			"id.token.signed.response.alg":             "RS256",
-		}),
-	}
-
-	// refresh keycloaktoken
-	g.keycloakRefreshToken()
-
-	// create client on keycloak
-	id, err := g.KeycloakClient.CreateClient(ctx, g.KeycloakToken.AccessToken, g.Config.Keycloak.Realm, client)
+	// issue client credentials for the node at the identity provider
+	credentials, err := g.Identity.RegisterNode(ctx, node.ID.Hex())
 	if err != nil {
 		log.WithFields(log.Fields{
+			"node":  node.ID.Hex(),
 			"error": err.Error(),
-		}).Error("could not create client on keycloak")
+		}).Error("could not register node at identity provider")
 		_http.RespondWithError(w, http.StatusInternalServerError, "could not create node on server")
 		return
 	}
 
-	// refresh token to display
-	secret, err := g.KeycloakClient.RegenerateClientSecret(ctx, g.KeycloakToken.AccessToken, g.Config.Keycloak.Realm, id)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"error": err.Error(),
-		}).Error("could not create a secret for client")
-	}
-
-	// assign secret to node
-	node.Secret = *secret.Value
+	// assign credentials to node
+	node.KeycloakID = credentials.ID
+	node.Secret = credentials.Secret
 	if status := node.Replace(g.DB); status > 0 {
 		_http.RespondWithError(w, http.StatusInternalServerError, "could not save the secret for the node")
 		return
 	}
 
+	// issue the mtls certificate of the node (returned only once)
+	var bundle *models.CertificateBundle
+	if g.mtls != nil {
+		if bundle, err = g.issueNodeCertificate(&node); err != nil {
+			log.WithFields(log.Fields{
+				"node":  node.ID.Hex(),
+				"error": err.Error(),
+			}).Error("could not issue node certificate")
+			_http.RespondWithError(w, http.StatusInternalServerError, "could not issue certificate for the node")
+			return
+		}
+	}
+
 	// retrieve the node without secret
 	node.GetNode(g.DB, g.GetUserPermissionW(w, false), models.NodeProject)
+	node.Bundle = bundle
 
 	_http.RespondWithJSON(w, http.StatusCreated, node)
 }
 
-// refreshNodeSecret generates a new keycloak secret for the node
+// refreshNodeSecret generates a new secret for the node at the identity provider
 func (g *AppGateway) refreshNodeSecret(w http.ResponseWriter, r *http.Request) {
 	// parse id from path
 	id := _http.ParsePathID(w, r, "id")
@@ -172,23 +231,25 @@ func (g *AppGateway) refreshNodeSecret(w http.ResponseWriter, r *http.Request) {
 
 	ctx, cancel := context.WithCancel(g.Ctx)
 	defer cancel()
-	// refresh token to display
-	log.Warn(node.KeycloakID)
-	secret, err := g.KeycloakClient.RegenerateClientSecret(ctx, g.KeycloakToken.AccessToken, g.Config.Keycloak.Realm, node.KeycloakID)
+	// issue a new secret at the identity provider
+	secret, err := g.Identity.RotateNodeSecret(ctx, node.KeycloakID)
 	if err != nil {
 		log.WithFields(log.Fields{
+			"node":  node.ID.Hex(),
 			"error": err.Error(),
 		}).Error("could not create a secret for client")
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not create a new secret")
+		return
 	}
 
 	// assign new secret to node
-	if status := node.UpdateNodeSecret(g.DB, g.GetUserPermissionW(w, true), *secret.Value); status > 1 {
+	if status := node.UpdateNodeSecret(g.DB, g.GetUserPermissionW(w, true), secret); status > 1 {
 		_http.RespondWithError(w, http.StatusInternalServerError, "could not write new secret to db")
 		return
 	}
 
 	if ret {
-		_http.RespondWithJSON(w, http.StatusOK, *secret.Value)
+		_http.RespondWithJSON(w, http.StatusOK, secret)
 	} else {
 		_http.RespondWithJSON(w, http.StatusOK, "refreshed secret")
 	}
@@ -218,7 +279,135 @@ func (g *AppGateway) retrieveNodeSecret(w http.ResponseWriter, r *http.Request)
 
 // parseNodeStructure returns information about a file and its shares for the node to build the access tree
 func (g *AppGateway) parseNodeStructure(w http.ResponseWriter, r *http.Request) {
-	_http.RespondWithJSON(w, http.StatusNotImplemented, "currently not supported")
+	nodeID, ok := g.requireNodeClient(w, r)
+	if !ok {
+		return
+	}
+
+	var after primitive.ObjectID
+	if param := r.URL.Query().Get("after"); param != "" {
+		var err error
+		if after, err = primitive.ObjectIDFromHex(param); err != nil {
+			_http.RespondWithError(w, http.StatusBadRequest, "query param 'after' must be a media id")
+			return
+		}
+	}
+	size, err := strconv.Atoi(r.URL.Query().Get("size"))
+	if err != nil || size <= 0 || size > maxNodeStructureSize {
+		_http.RespondWithError(w, http.StatusBadRequest, fmt.Sprintf("query param 'size' must be between 1 and %d", maxNodeStructureSize))
+		return
+	}
+
+	media, total, err := models.GetNodeMediaPage(g.DB, nodeID, after, size)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"node":  nodeID.Hex(),
+			"error": err.Error(),
+		}).Error("could not select media of node")
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not select media of node")
+		return
+	}
+
+	structure := maps.NodeStructure{
+		After:   r.URL.Query().Get("after"),
+		Size:    size,
+		Total:   total,
+		Entries: make([]maps.NodeStructureEntry, len(media)),
+	}
+	for i, m := range media {
+		structure.Entries[i] = maps.NodeStructureEntry{
+			MediaID:  m.ID.Hex(),
+			Username: m.Creator,
+			Filename: m.FileName,
+			Sha1:     m.Sha1,
+			Size:     m.Size,
+			Groups:   UnParseIDs(m.GroupIDs),
+		}
+	}
+	_http.RespondWithJSON(w, http.StatusOK, structure)
+}
+
+// reportMissingMedia handles the media, whose original has not been found by
+// the reconciliation of the node
+func (g *AppGateway) reportMissingMedia(w http.ResponseWriter, r *http.Request) {
+	nodeID, ok := g.requireNodeClient(w, r)
+	if !ok {
+		return
+	}
+
+	var ids []string
+	ids, status := _http.DecodeStringsRequest(w, r, ids)
+	if status > 0 {
+		return
+	}
+	mediaIDs, err := ParseIDs(ids)
+	if err != nil {
+		_http.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(mediaIDs) == 0 {
+		_http.RespondWithJSON(w, http.StatusOK, "")
+		return
+	}
+
+	removed, err := models.ReportMissingMedia(g.DB, nodeID, mediaIDs)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"node":  nodeID.Hex(),
+			"error": err.Error(),
+		}).Error("could not handle missing media")
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not handle missing media")
+		return
+	}
+	log.WithFields(log.Fields{
+		"node":       nodeID.Hex(),
+		"missing":    len(mediaIDs),
+		"replicated": len(removed),
+	}).Warn("node reported missing media")
+
+	// restore the copies from the other nodes
+	replicate := make([]primitive.ObjectID, len(removed))
+	for i := range removed {
+		g.accountUsage(&removed[i], -1, nodeID)
+		replicate[i] = removed[i].ID
+	}
+	g.enqueueReplication(replicate...)
+	_http.RespondWithJSON(w, http.StatusOK, "")
+}
+
+// requireNodeClient verifies, that the request has been sent by the node of
+// the route
+func (g *AppGateway) requireNodeClient(w http.ResponseWriter, r *http.Request) (primitive.ObjectID, bool) {
+	nodeID := parseID(w, r)
+	if nodeID.IsZero() {
+		return nodeID, false
+	}
+	if w.Header().Get("clientID") != nodeID.Hex() {
+		_http.RespondWithError(w, http.StatusForbidden, "only the node itself may access its structure")
+		return nodeID, false
+	}
+	return nodeID, true
+}
+
+// getPeerEndpoint returns the api endpoint of another node to the node (e.g.
+// the source of a replication)
+func (g *AppGateway) getPeerEndpoint(w http.ResponseWriter, r *http.Request) {
+	if _, ok := g.requireNodeClient(w, r); !ok {
+		return
+	}
+	peerID := parseIDCustomKey(w, r, "peer")
+	if peerID.IsZero() {
+		return
+	}
+	peer := models.Node{ID: peerID}
+	if err := peer.GetNode(g.DB, bson.M{"_id": peer.ID}, models.NodeProjectInternal); err != nil || peer.APIEndpoint == "" {
+		_http.RespondWithError(w, http.StatusNotFound, "Node not found")
+		return
+	}
+	_http.RespondWithJSON(w, http.StatusOK, maps.NodeEndpoint{
+		ID:          peer.ID.Hex(),
+		APIEndpoint: peer.APIEndpoint,
+	})
 }
 
 func (g *AppGateway) syncUserAuthentication(node models.Node) {
@@ -238,7 +427,9 @@ func (g *AppGateway) syncUserAuthentication(node models.Node) {
 		if session.Token != "" {
 			continue
 		}
-		status, msg := handler.NodeAuthentication(session, []models.Node{node}, true, g.HTTPClient)
+		session.User = user
+		session.NodeTokenMap = make(map[primitive.ObjectID]string)
+		status, msg := handler.NodeAuthentication(session, []models.Node{node}, true, g.nodeClient(node.ID))
 		if status > 0 {
 			log.WithFields(log.Fields{
 				"username": session.User,
@@ -247,5 +438,7 @@ func (g *AppGateway) syncUserAuthentication(node models.Node) {
 			}).Error("could not authenticate user")
 			continue
 		}
+		// the session is a copy of the stored one
+		g.Sessions.Put(session)
 	}
 }
@@ -0,0 +1,186 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	_http "github.com/mirisbowring/primboard/helper/http"
+	"github.com/mirisbowring/primboard/models"
+	"github.com/mirisbowring/primboard/models/maps"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// reportIntegrityFailures records the copies, that failed the scrubbing of the
+// node and restores them from other nodes if enabled
+func (g *AppGateway) reportIntegrityFailures(w http.ResponseWriter, r *http.Request) {
+	nodeID, ok := g.requireNodeClient(w, r)
+	if !ok {
+		return
+	}
+
+	var failures []maps.IntegrityFailure
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&failures); err != nil {
+		_http.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	var reports []models.IntegrityReport
+	for _, f := range failures {
+		mediaID, err := primitive.ObjectIDFromHex(f.MediaID)
+		if err != nil {
+			continue
+		}
+		m := models.Media{ID: mediaID}
+		if err := m.GetMedia(g.DB, bson.M{"nodeIDs": nodeID}, models.MediaProjectInternal); err != nil {
+			// media has been deleted or moved in the meantime
+			continue
+		}
+		report := models.IntegrityReport{
+			MediaID:      mediaID,
+			NodeID:       nodeID,
+			Username:     m.Creator,
+			Filename:     m.FileName,
+			Reason:       f.Reason,
+			Expected:     m.Sha1,
+			Actual:       f.Sha1,
+			ExpectedSize: m.Size,
+			Size:         f.Size,
+		}
+		if err := report.Save(g.DB); err != nil {
+			log.WithFields(log.Fields{
+				"node":  nodeID.Hex(),
+				"media": f.MediaID,
+				"error": err.Error(),
+			}).Error("could not save integrity report")
+			continue
+		}
+		log.WithFields(log.Fields{
+			"node":   nodeID.Hex(),
+			"media":  f.MediaID,
+			"reason": f.Reason,
+		}).Warn("node reported corrupted media")
+		reports = append(reports, report)
+	}
+
+	if g.Config.AutoRestore && len(reports) > 0 {
+		go func() {
+			for i := range reports {
+				g.restoreCopy(&reports[i])
+			}
+		}()
+	}
+	_http.RespondWithJSON(w, http.StatusOK, "")
+}
+
+// getIntegrityReports returns the integrity reports of the own media
+func (g *AppGateway) getIntegrityReports(w http.ResponseWriter, r *http.Request) {
+	open, status := _http.ParseQueryBool(w, r, "open", true)
+	if status > 0 {
+		return
+	}
+	reports, err := models.GetIntegrityReports(g.DB, _http.GetUsernameFromHeader(w), primitive.NilObjectID, open)
+	if err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not select integrity reports")
+		return
+	}
+	_http.RespondWithJSON(w, http.StatusOK, reports)
+}
+
+// getMediaIntegrityReports returns the integrity reports of a media
+func (g *AppGateway) getMediaIntegrityReports(w http.ResponseWriter, r *http.Request) {
+	id := parseID(w, r)
+	if id.IsZero() {
+		return
+	}
+	if !g.authorizeMedia(w, id, models.RoleViewer) {
+		return
+	}
+	reports, err := models.GetIntegrityReports(g.DB, "", id, false)
+	if err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not select integrity reports")
+		return
+	}
+	_http.RespondWithJSON(w, http.StatusOK, reports)
+}
+
+// restoreMedia restores all corrupted copies of the media from the healthy
+// copies
+func (g *AppGateway) restoreMedia(w http.ResponseWriter, r *http.Request) {
+	id := parseID(w, r)
+	if id.IsZero() {
+		return
+	}
+	if !g.authorizeMedia(w, id, models.RoleOwner) {
+		return
+	}
+	reports, err := models.GetIntegrityReports(g.DB, "", id, true)
+	if err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not select integrity reports")
+		return
+	}
+	for i := range reports {
+		g.restoreCopy(&reports[i])
+	}
+	_http.RespondWithJSON(w, http.StatusOK, reports)
+}
+
+// restoreCopy instructs the node of the report to copy the media again from
+// another online node. The node verifies the sha1 of the copy.
+func (g *AppGateway) restoreCopy(report *models.IntegrityReport) bool {
+	logfields := log.Fields{
+		"media": report.MediaID.Hex(),
+		"node":  report.NodeID.Hex(),
+	}
+	fail := func(err error) bool {
+		logfields["error"] = err.Error()
+		log.WithFields(logfields).Error("could not restore corrupted copy")
+		if e := report.SetError(g.DB, err.Error()); e != nil {
+			log.WithFields(logfields).Error("could not update integrity report")
+		}
+		return false
+	}
+
+	target, ok := g.getNode(report.NodeID)
+	if !ok || target.Status != models.NodeStatusOnline {
+		return fail(errors.New("node of the corrupted copy is offline"))
+	}
+	m := models.Media{ID: report.MediaID}
+	if err := m.GetMedia(g.DB, bson.M{}, models.MediaProjectInternal); err != nil {
+		return fail(err)
+	}
+
+	req := maps.ReplicationRequest{
+		Username: m.Creator,
+		Filename: m.FileName,
+		Sha1:     m.Sha1,
+		Groups:   UnParseIDs(m.GroupIDs),
+	}
+	lastErr := errors.New("no other online node holds a copy")
+	for _, n := range m.Nodes {
+		if n.ID == report.NodeID {
+			continue
+		}
+		source, ok := g.getNode(n.ID)
+		if !ok || source.Status != models.NodeStatusOnline {
+			continue
+		}
+		req.Source = source.APIEndpoint
+		req.SourceID = source.ID.Hex()
+		if err := g.copyMediaToNode(target, req); err != nil {
+			lastErr = err
+			continue
+		}
+		if err := report.MarkRestored(g.DB, source.ID); err != nil {
+			return fail(err)
+		}
+		logfields["source"] = source.ID.Hex()
+		log.WithFields(logfields).Info("restored corrupted copy")
+		return true
+	}
+	return fail(lastErr)
+}
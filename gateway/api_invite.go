@@ -1,19 +1,77 @@
 package gateway
 
 import (
+	"encoding/json"
 	"net/http"
 
+	"github.com/mirisbowring/primboard/helper"
 	_http "github.com/mirisbowring/primboard/helper/http"
 	"github.com/mirisbowring/primboard/models"
+	log "github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
-// GenerateInvite handles the webrequest for creating a new invite
+// maxInviteUses limits the registrations per invite
+const maxInviteUses = 100
+
+// GenerateInvite handles the webrequest for creating a new invite. A POST
+// request may specify the email, the groups, the max uses and the validity of
+// the invite.
 func (g *AppGateway) GenerateInvite(w http.ResponseWriter, r *http.Request) {
 	// create model by passed username
 	i := models.Invite{}
+	if r.Method == http.MethodPost {
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&i); err != nil {
+			_http.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+			return
+		}
+		defer r.Body.Close()
+	}
+	i.Inviter = _http.GetUsernameFromHeader(w)
+	if i.MaxUses < 0 || i.MaxUses > maxInviteUses {
+		_http.RespondWithError(w, http.StatusBadRequest, "maxUses must be between 1 and 100")
+		return
+	}
+	if i.Validity < 0 {
+		_http.RespondWithError(w, http.StatusBadRequest, "validity must not be negative")
+		return
+	}
+	validity := g.Config.InviteValidity
+	if i.Validity > 0 {
+		validity = i.Validity
+	}
+
+	// the inviter must manage the groups
+	if len(i.GroupIDs) > 0 {
+		i.GroupIDs = helper.UniqueIDs(i.GroupIDs)
+		groups, err := models.GetUserGroupsByIDs(g.DB, i.GroupIDs, models.UserGroupPermission(i.Inviter, models.RoleAdmin))
+		if err != nil {
+			_http.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if len(groups) != len(i.GroupIDs) {
+			_http.RespondWithError(w, http.StatusForbidden, "you can only invite to groups you manage")
+			return
+		}
+	}
+
+	// verify the limit of active invites
+	if g.Config.InviteLimit > 0 {
+		count, err := models.CountActiveInvites(g.DB, i.Inviter)
+		if err != nil {
+			_http.RespondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if count >= int64(g.Config.InviteLimit) {
+			_http.RespondWithError(w, http.StatusTooManyRequests, "too many active invites")
+			return
+		}
+	}
+
 	// try to select model
-	result, err := i.Init(g.DB, g.Config.InviteValidity)
+	result, err := i.Init(g.DB, validity)
 	if err != nil {
 		// another error occured
 		_http.RespondWithError(w, http.StatusInternalServerError, err.Error())
@@ -26,6 +84,46 @@ func (g *AppGateway) GenerateInvite(w http.ResponseWriter, r *http.Request) {
 		_http.RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+
+	log.WithFields(log.Fields{
+		"inviter": i.Inviter,
+		"invite":  i.ID.Hex(),
+		"groups":  i.GroupIDs,
+		"maxUses": i.MaxUses,
+	}).Info("generated invite")
 	// could select user from mongo
 	_http.RespondWithJSON(w, http.StatusOK, i)
 }
+
+// getInvites lists the invites of the user with their redemptions
+func (g *AppGateway) getInvites(w http.ResponseWriter, r *http.Request) {
+	invites, err := models.GetInvitesByInviter(g.DB, _http.GetUsernameFromHeader(w))
+	if err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	_http.RespondWithJSON(w, http.StatusOK, invites)
+}
+
+// revokeInvite revokes an invite of the user
+func (g *AppGateway) revokeInvite(w http.ResponseWriter, r *http.Request) {
+	id := parseID(w, r)
+	if id.IsZero() {
+		return
+	}
+	i := models.Invite{ID: id, Inviter: _http.GetUsernameFromHeader(w)}
+	if err := i.Revoke(g.DB); err != nil {
+		if err == mongo.ErrNoDocuments {
+			_http.RespondWithError(w, http.StatusNotFound, "Invite not found")
+			return
+		}
+		_http.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"inviter": i.Inviter,
+		"invite":  i.ID.Hex(),
+	}).Info("revoked invite")
+	_http.RespondWithJSON(w, http.StatusOK, "revoked invite")
+}
@@ -2,6 +2,7 @@ package gateway
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -13,8 +14,10 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/mirisbowring/primboard/helper"
 	_http "github.com/mirisbowring/primboard/helper/http"
+	"github.com/mirisbowring/primboard/helper/urlsign"
 	"github.com/mirisbowring/primboard/models"
 	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 )
@@ -34,25 +37,37 @@ func (g *AppGateway) AddMedia(w http.ResponseWriter, r *http.Request) {
 		_http.RespondWithError(w, http.StatusInternalServerError, "Could not process tags")
 		return
 	}
+	// only nodes register the media of their uploads
 	nodeID, err := primitive.ObjectIDFromHex(w.Header().Get("clientID"))
 	if err != nil {
 		log.WithFields(log.Fields{
 			"clientID": w.Header().Get("clientID"),
 			"error":    err.Error(),
 		}).Error("could not parse clientID to ObjectID")
-		_http.RespondWithError(w, http.StatusBadRequest, "coud not parse clientID to ObjectID")
+		_http.RespondWithError(w, http.StatusForbidden, "only nodes may add media")
+		return
+	}
+	node := models.Node{ID: nodeID}
+	if err := node.GetNode(g.DB, bson.M{"_id": node.ID}, models.NodeProjectInternal); err != nil {
+		_http.RespondWithError(w, http.StatusForbidden, "only nodes may add media")
+		return
 	}
-	m.NodeIDs = append(m.NodeIDs, nodeID)
+	m.NodeIDs = []primitive.ObjectID{nodeID}
 
 	// url and type are mandatory
 	if m.Creator == "" {
 		_http.RespondWithError(w, http.StatusBadRequest, "Creator cannot be empty")
 		return
 	}
+	// the creator is the user, that has been authenticated by the node
+	if !g.isNodeUser(&node, m.Creator) {
+		_http.RespondWithError(w, http.StatusForbidden, "creator is not allowed to use the node")
+		return
+	}
 	// setting creation timestamp
 	m.TimestampUpload = int64(time.Now().Unix())
-	// set the username
-	// m.Creator = _http.GetUsernameFromHeader(w)
+	// resolve the place name of the location
+	g.resolvePlace(&m)
 	// try to insert model into db
 	log.Warn(m)
 	result, err := m.AddMedia(g.DB)
@@ -60,10 +75,33 @@ func (g *AppGateway) AddMedia(w http.ResponseWriter, r *http.Request) {
 		_http.RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	g.accountUsage(&m, 1, nodeID)
+	// keep the copies of the replication policy
+	if id, ok := result.InsertedID.(primitive.ObjectID); ok {
+		g.enqueueReplication(id)
+	}
 	// creation successful
 	_http.RespondWithJSON(w, http.StatusCreated, result)
 }
 
+// isNodeUser returns whether the user owns the node or is a member of one of
+// its groups
+func (g *AppGateway) isNodeUser(node *models.Node, username string) bool {
+	if node.Creator == username {
+		return true
+	}
+	users, status := node.GetUser(g.DB)
+	if status > 0 {
+		return false
+	}
+	for _, user := range users {
+		if user == username {
+			return true
+		}
+	}
+	return false
+}
+
 // AddCommentByMediaID appends a comment to the specified media
 func (g *AppGateway) AddCommentByMediaID(w http.ResponseWriter, r *http.Request) {
 	var c models.Comment
@@ -84,6 +122,10 @@ func (g *AppGateway) AddCommentByMediaID(w http.ResponseWriter, r *http.Request)
 	if id.IsZero() {
 		return
 	}
+	// verify that the user may comment the media
+	if !g.authorizeMedia(w, id, models.RoleViewer) {
+		return
+	}
 	// create media model by id to select from db
 	m := models.Media{ID: id}
 	// append the new comment
@@ -116,6 +158,10 @@ func (g *AppGateway) AddDescriptionByMediaID(w http.ResponseWriter, r *http.Requ
 	if id.IsZero() {
 		return
 	}
+	// verify that the user may modify the media
+	if !g.authorizeMedia(w, id, models.RoleContributor) {
+		return
+	}
 	// create media model by id to select from db
 	media := models.Media{ID: id}
 	// add the title to the database document
@@ -149,6 +195,10 @@ func (g *AppGateway) AddTagByMediaID(w http.ResponseWriter, r *http.Request) {
 	if id.IsZero() {
 		return
 	}
+	// verify that the user may modify the media
+	if !g.authorizeMedia(w, id, models.RoleContributor) {
+		return
+	}
 	// create media model by id to select from db
 	m := models.Media{ID: id}
 	// append the new tag if not present
@@ -180,6 +230,10 @@ func (g *AppGateway) AddTagsByMediaID(w http.ResponseWriter, r *http.Request) {
 	if id.IsZero() {
 		return
 	}
+	// verify that the user may modify the media
+	if !g.authorizeMedia(w, id, models.RoleContributor) {
+		return
+	}
 	// create media model by id to select from db
 	m := models.Media{ID: id}
 	// append the new tag if not present
@@ -250,15 +304,42 @@ func (g *AppGateway) AddTimestampByMediaID(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	// check if timestamp is valid
-	if m.Timestamp == 0 {
-		_http.RespondWithError(w, http.StatusBadRequest, "Creation date cannot be empty!")
+	// check if timestamp and offset are valid
+	if err := verifyTimestamp(m); err != nil {
+		_http.RespondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	// verify that the creation date is not in the future
-	if time.Unix(m.Timestamp, 0).UTC().After(time.Now().UTC()) {
-		_http.RespondWithError(w, http.StatusBadRequest, "Creation date cannot be the future!")
+	// parse ID from route
+	id := parseID(w, r)
+	if id.IsZero() {
+		return
+	}
+	// verify that the user may modify the media
+	if !g.authorizeMedia(w, id, models.RoleContributor) {
+		return
+	}
+	// add the timestamp and the original utc offset to the database document
+	media := models.Media{ID: id}
+	if err := media.SetTimestamp(g.DB, m.Timestamp, m.TimestampOffset); err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, "Error during document update")
+		return
+	}
+	// success
+	g.GetMediaByID(w, r)
+}
+
+//AddLocationByMediaID sets the geo location of the media
+func (g *AppGateway) AddLocationByMediaID(w http.ResponseWriter, r *http.Request) {
+	var m models.Media
+	m, status := DecodeMediaRequest(w, r, m)
+	if status != 0 {
+		return
+	}
+
+	// check if location is valid
+	if err := verifyLocation(m); err != nil {
+		_http.RespondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
@@ -267,12 +348,13 @@ func (g *AppGateway) AddTimestampByMediaID(w http.ResponseWriter, r *http.Reques
 	if id.IsZero() {
 		return
 	}
-	// create media model by id to select from db
+	// verify that the user may modify the media
+	if !g.authorizeMedia(w, id, models.RoleContributor) {
+		return
+	}
+	// add the location and its place name to the database document
 	media := models.Media{ID: id}
-	// add the timestamp to the database document
-	media.Timestamp = m.Timestamp
-	// append the new tag if not present
-	if err := m.Save(g.DB); err != nil {
+	if err := g.setMediaLocation(&media, m.Location); err != nil {
 		_http.RespondWithError(w, http.StatusInternalServerError, "Error during document update")
 		return
 	}
@@ -280,6 +362,40 @@ func (g *AppGateway) AddTimestampByMediaID(w http.ResponseWriter, r *http.Reques
 	g.GetMediaByID(w, r)
 }
 
+// verifyTimestamp verifies the creation date and the utc offset of the media
+func verifyTimestamp(m models.Media) error {
+	// check if timestamp is valid
+	if m.Timestamp == 0 {
+		return errors.New("Creation date cannot be empty!")
+	}
+	// verify that the creation date is not in the future
+	if time.Unix(m.Timestamp, 0).UTC().After(time.Now().UTC()) {
+		return errors.New("Creation date cannot be the future!")
+	}
+	// verify that the offset is a valid utc offset
+	if m.TimestampOffset != nil && !models.ValidUTCOffset(*m.TimestampOffset) {
+		return errors.New("Offset is not a valid utc offset!")
+	}
+	return nil
+}
+
+// verifyLocation verifies the location of the media
+func verifyLocation(m models.Media) error {
+	if m.Location == nil {
+		return errors.New("Location cannot be empty!")
+	}
+	return m.Location.IsValid()
+}
+
+// setMediaLocation stores the location and its place name (the previous place
+// is removed, if the new location cannot be resolved)
+func (g *AppGateway) setMediaLocation(media *models.Media, location *models.GeoPoint) error {
+	media.Location = location
+	media.Place = nil
+	g.resolvePlace(media)
+	return media.SetLocation(g.DB)
+}
+
 //AddTitleByMediaID adds the title to the media
 func (g *AppGateway) AddTitleByMediaID(w http.ResponseWriter, r *http.Request) {
 	var m models.Media
@@ -300,6 +416,10 @@ func (g *AppGateway) AddTitleByMediaID(w http.ResponseWriter, r *http.Request) {
 	if id.IsZero() {
 		return
 	}
+	// verify that the user may modify the media
+	if !g.authorizeMedia(w, id, models.RoleContributor) {
+		return
+	}
 	// create media model by id to select from db
 	media := models.Media{ID: id}
 	// add the title to the database document
@@ -329,8 +449,9 @@ func (g *AppGateway) DeleteMediaByID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if failed := g.removeMediasFromNode([]models.Media{m}, primitive.NewObjectID()); len(failed) > 0 {
-		_http.RespondWithError(w, http.StatusNotImplemented, "currently, there is no mechanism to handle partially deleted files")
+	// delete the files on all nodes
+	if err := g.removeMediasFromNode([]models.Media{m}, primitive.NilObjectID); err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not schedule deletion on nodes")
 		return
 	}
 
@@ -366,8 +487,8 @@ func (g *AppGateway) deleteMediaByIDFromNode(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	if failed := g.removeMediasFromNode([]models.Media{m}, nodeID); len(failed) > 0 {
-		_http.RespondWithError(w, http.StatusNotImplemented, "currently, there is no mechanism to handle partially deleted files")
+	if err := g.removeMediasFromNode([]models.Media{m}, nodeID); err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not schedule deletion on node")
 		return
 	}
 
@@ -410,6 +531,7 @@ func (g *AppGateway) deleteMediaByIDs(w http.ResponseWriter, r *http.Request) {
 		_http.RespondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	g.auditTargets(r, models.MediaCollection, objectIDs...)
 
 	// parse the medias from Database
 	medias, err := models.GetMediaByIDs(g.DB, objectIDs, g.GetUserPermissionW(w, true))
@@ -418,8 +540,9 @@ func (g *AppGateway) deleteMediaByIDs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if failed := g.removeMediasFromNode(medias, primitive.NewObjectID()); len(failed) > 0 {
-		_http.RespondWithError(w, http.StatusNotImplemented, "currently, there is no mechanism to handle partially deleted files")
+	// delete the files on all nodes
+	if err := g.removeMediasFromNode(medias, primitive.NilObjectID); err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not schedule deletion on nodes")
 		return
 	}
 
@@ -494,12 +617,20 @@ func (g *AppGateway) GetMedia(w http.ResponseWriter, r *http.Request) {
 		query.Size = i
 	}
 
+	// parse optional display timezone
+	loc, status := parseTimezone(w, r)
+	if status > 0 {
+		return
+	}
+
 	// ms, err := GetAllMedia(a.DB)‚s
 	ms, err := models.GetMediaPage(g.DB, query, g.GetUserPermissionW(w, false))
 	if err != nil {
 		_http.RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	models.SetDisplayTimes(ms, loc)
+	g.signMediaURLs(ms, _http.GetUsernameFromHeader(w))
 	_http.RespondWithJSON(w, http.StatusOK, ms)
 }
 
@@ -513,6 +644,12 @@ func (g *AppGateway) GetMediaByID(w http.ResponseWriter, r *http.Request) {
 	// create model by passed id
 	m := models.Media{ID: id}
 
+	// parse optional display timezone
+	loc, status := parseTimezone(w, r)
+	if status > 0 {
+		return
+	}
+
 	// parseNodeTokenMap
 	// nodeMap, status := g.getNodeTokenMap(w)
 	// if status > 0 {
@@ -531,10 +668,117 @@ func (g *AppGateway) GetMediaByID(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	m.SetDisplayTime(loc)
+	g.signMediaURL(&m, _http.GetUsernameFromHeader(w), urlsign.Expiry(time.Now(), g.signedURLTTL()))
 	// could select media from mongo
 	_http.RespondWithJSON(w, http.StatusOK, m)
 }
 
+// geocodeMedia resolves the place names of all own media that have a location
+// but no place yet
+func (g *AppGateway) geocodeMedia(w http.ResponseWriter, r *http.Request) {
+	if g.Gazetteer == nil {
+		_http.RespondWithError(w, http.StatusNotImplemented, "reverse geocoding is not configured")
+		return
+	}
+
+	ms, err := models.GetMediaWithoutPlace(g.DB, g.GetUserPermissionW(w, true))
+	if err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	count := 0
+	for _, m := range ms {
+		g.resolvePlace(&m)
+		if m.Place == nil {
+			continue
+		}
+		media := models.Media{ID: m.ID, Place: m.Place}
+		if err := media.Save(g.DB); err != nil {
+			log.WithFields(log.Fields{
+				"media": m.ID.Hex(),
+				"error": err.Error(),
+			}).Error("could not save place of media")
+			continue
+		}
+		count++
+	}
+
+	_http.RespondWithJSON(w, http.StatusOK, fmt.Sprintf("resolved %d of %d media", count, len(ms)))
+}
+
+// getMediaClusters handles the webrequest for receiving clustered map markers
+// of all media inside of a bounding box for a zoom level
+func (g *AppGateway) getMediaClusters(w http.ResponseWriter, r *http.Request) {
+	box, status := parseBoundingBox(w, r)
+	if status > 0 {
+		return
+	}
+
+	// parse zoom level
+	tmp, status := _http.ParseQueryString(w, r, "zoom", false)
+	if status > 0 {
+		return
+	}
+	zoom, err := strconv.Atoi(tmp)
+	if err != nil {
+		_http.RespondWithError(w, http.StatusBadRequest, "zoom must be specified as integer")
+		return
+	}
+
+	clusters, err := models.GetMediaClusters(g.DB, box, zoom, g.GetUserPermissionW(w, false))
+	if err != nil {
+		_http.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	_http.RespondWithJSON(w, http.StatusOK, clusters)
+}
+
+// getMediaInBox handles the webrequest for receiving all media inside of a
+// bounding box
+func (g *AppGateway) getMediaInBox(w http.ResponseWriter, r *http.Request) {
+	box, status := parseBoundingBox(w, r)
+	if status > 0 {
+		return
+	}
+
+	// check if page size query param is present
+	size := g.Config.DefaultMediaPageSize
+	tmp, _ := _http.ParseQueryString(w, r, "size", true)
+	if i, err := strconv.Atoi(tmp); err == nil && i > 0 {
+		size = i
+	}
+
+	ms, err := models.GetMediaInBox(g.DB, box, g.GetUserPermissionW(w, false), size)
+	if err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	_http.RespondWithJSON(w, http.StatusOK, ms)
+}
+
+// getMediaBySha1s handles the webrequest for receiving the ids of all own media
+// with one of the passed hashes
+func (g *AppGateway) getMediaBySha1s(w http.ResponseWriter, r *http.Request) {
+	var hashes []string
+	hashes, status := DecodeStringsRequest(w, r, hashes)
+	if status > 0 {
+		return
+	}
+	if len(hashes) == 0 {
+		_http.RespondWithError(w, http.StatusBadRequest, "no hashes specified")
+		return
+	}
+
+	media, err := models.GetMediaBySha1s(g.DB, hashes, g.GetUserPermissionW(w, true))
+	if err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	_http.RespondWithJSON(w, http.StatusOK, media)
+}
+
 // GetMediaByIDs handles the webrequest for receiving Media models by ids
 func (g *AppGateway) GetMediaByIDs(w http.ResponseWriter, r *http.Request) {
 	m, status := DecodeMediasRequest(w, r)
@@ -550,6 +794,7 @@ func (g *AppGateway) GetMediaByIDs(w http.ResponseWriter, r *http.Request) {
 		_http.RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	g.signMediaURLs(media, _http.GetUsernameFromHeader(w))
 	_http.RespondWithJSON(w, http.StatusOK, media)
 	return
 }
@@ -577,9 +822,10 @@ func (g *AppGateway) MapEventsToMedia(w http.ResponseWriter, r *http.Request) {
 		_http.RespondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	g.auditTargets(r, models.MediaCollection, mediaIDs...)
 
 	// execute bulk update
-	_, err = models.BulkAddMediaEvent(g.DB, mediaIDs, eventIDs, g.GetUserPermissionW(w, false))
+	_, err = models.BulkAddMediaEvent(g.DB, mediaIDs, eventIDs, g.GetUserPermissionRoleW(w, models.RoleContributor))
 	if err != nil {
 		_http.RespondWithError(w, http.StatusInternalServerError, "Could not bulk update documents!")
 		return
@@ -603,15 +849,13 @@ func (g *AppGateway) MapGroupsToMedia(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// share media on nodes
-	failed := g.shareMediaToGroup(_helper.Medias, _helper.Groups, "add")
-	if len(failed) > 0 {
-		// must be implemented!!!
-		_http.RespondWithError(w, http.StatusNotImplemented, "Currently, there is no machanism to handle partially failed shares")
+	if err := g.shareMediaToGroup(_helper.Medias, _helper.Groups, "add"); err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not schedule shares on nodes")
 		return
 	}
 
 	// execute bulk update
-	_, err := models.BulkAddMediaGroup(g.DB, _helper.MediaIDs, _helper.GroupIDs, g.GetUserPermissionW(w, true))
+	_, err := models.BulkAddMediaGroup(g.DB, _helper.MediaIDs, _helper.GroupIDs, g.GetUserPermissionRoleW(w, models.RoleAdmin))
 	if err != nil {
 		_http.RespondWithError(w, http.StatusInternalServerError, "Could not bulk update documents!")
 		return
@@ -646,8 +890,9 @@ func (g *AppGateway) MapTagsToMedia(w http.ResponseWriter, r *http.Request) {
 		_http.RespondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	g.auditTargets(r, models.MediaCollection, IDs...)
 	// execute bulk update
-	_, err = models.BulkAddTagMedia(g.DB, tmm.Tags, IDs, g.GetUserPermissionW(w, false))
+	_, err = models.BulkAddTagMedia(g.DB, tmm.Tags, IDs, g.GetUserPermissionRoleW(w, models.RoleContributor))
 	if err != nil {
 		_http.RespondWithError(w, http.StatusInternalServerError, "Could not bulk update documents!")
 		return
@@ -681,7 +926,7 @@ func (g *AppGateway) removeGroupFromMedia(w http.ResponseWriter, r *http.Request
 	group := models.UserGroup{ID: gid}
 
 	// select media
-	if err := media.GetMedia(g.DB, g.GetUserPermissionW(w, true), models.MediaProjectInternal); err != nil {
+	if err := media.GetMedia(g.DB, g.GetUserPermissionRoleW(w, models.RoleAdmin), models.MediaProjectInternal); err != nil {
 		log.WithFields(log.Fields{
 			"error": err.Error(),
 		}).Error("could not select media from database")
@@ -690,7 +935,7 @@ func (g *AppGateway) removeGroupFromMedia(w http.ResponseWriter, r *http.Request
 	}
 
 	// select group
-	if err := group.GetUserGroup(g.DB, g.GetUserPermissionW(w, false)); err != nil {
+	if err := group.GetUserGroup(g.DB, models.UserGroupPermission(_http.GetUsernameFromHeader(w), models.RoleViewer)); err != nil {
 		log.WithFields(log.Fields{
 			"error": err.Error(),
 		}).Error("could not select group from database")
@@ -698,8 +943,8 @@ func (g *AppGateway) removeGroupFromMedia(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	if failed := g.shareMediaToGroup([]models.Media{media}, []models.UserGroup{group}, "remove"); len(failed) > 0 {
-		_http.RespondWithError(w, http.StatusNotImplemented, "currently there is no mechanism to handle partially removed shares")
+	if err := g.shareMediaToGroup([]models.Media{media}, []models.UserGroup{group}, "remove"); err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not schedule removal of shares on nodes")
 		return
 	}
 
@@ -728,8 +973,8 @@ func (g *AppGateway) removeGroupsFromMedias(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	if failed := g.shareMediaToGroup(_helper.Medias, _helper.Groups, "remove"); len(failed) > 0 {
-		_http.RespondWithError(w, http.StatusNotImplemented, "currently, there is no mechanism to handle partially removed shares")
+	if err := g.shareMediaToGroup(_helper.Medias, _helper.Groups, "remove"); err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not schedule removal of shares on nodes")
 		return
 	}
 
@@ -741,7 +986,7 @@ func (g *AppGateway) removeGroupsFromMedias(w http.ResponseWriter, r *http.Reque
 	}
 
 	// execute bulk update
-	_, err = models.BulkRemoveMediaGroup(g.DB, _helper.MediaIDs, _helper.GroupIDs, g.GetUserPermissionW(w, true))
+	_, err = models.BulkRemoveMediaGroup(g.DB, _helper.MediaIDs, _helper.GroupIDs, g.GetUserPermissionRoleW(w, models.RoleAdmin))
 	if err != nil {
 		_http.RespondWithError(w, http.StatusInternalServerError, "Could not bulk update documents!")
 		return
@@ -752,6 +997,33 @@ func (g *AppGateway) removeGroupsFromMedias(w http.ResponseWriter, r *http.Reque
 
 }
 
+// shiftMediaTimestamps corrects the capture timestamps of all own media of a
+// camera within a time range
+func (g *AppGateway) shiftMediaTimestamps(w http.ResponseWriter, r *http.Request) {
+	var shift models.MediaTimeShift
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&shift); err != nil {
+		_http.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	// verify the shift before touching the database
+	if err := shift.IsValid(); err != nil {
+		_http.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// only the owner is allowed to correct the timestamps
+	count, err := models.ShiftMediaTimestamps(g.DB, shift, g.GetUserPermissionW(w, true))
+	if err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not shift timestamps")
+		return
+	}
+
+	_http.RespondWithJSON(w, http.StatusOK, fmt.Sprintf("shifted %d documents", count))
+}
+
 // UpdateMediaByHash handles the webrequest for updating the Media with the passed
 // request body
 func (g *AppGateway) UpdateMediaByHash(w http.ResponseWriter, r *http.Request) {
@@ -759,6 +1031,10 @@ func (g *AppGateway) UpdateMediaByHash(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	parts := strings.Split(vars["ipfs_id"], "_")
 	id, _ := primitive.ObjectIDFromHex(parts[1])
+	// verify that the user may modify the media
+	if !g.authorizeMedia(w, id, models.RoleContributor) {
+		return
+	}
 	// store new model in tmp object
 	var um models.Media
 	um, status := DecodeMediaRequest(w, r, um)
@@ -772,10 +1048,7 @@ func (g *AppGateway) UpdateMediaByHash(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 	// trying to update model with requested body
 	m := models.Media{ID: id}
-	err := m.UpdateMedia(g.DB, um)
-	if err != nil {
-		// Error occured during update
-		_http.RespondWithError(w, http.StatusInternalServerError, err.Error())
+	if !g.updateMedia(w, &m, um) {
 		return
 	}
 	// Update successful
@@ -790,6 +1063,10 @@ func (g *AppGateway) UpdateMediaByID(w http.ResponseWriter, r *http.Request) {
 	if id.IsZero() {
 		return
 	}
+	// verify that the user may modify the media
+	if !g.authorizeMedia(w, id, models.RoleContributor) {
+		return
+	}
 	// store new model in tmp object
 	var um models.Media
 	um, status := DecodeMediaRequest(w, r, um)
@@ -803,16 +1080,53 @@ func (g *AppGateway) UpdateMediaByID(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 	// trying to update model with requested body
 	m := models.Media{ID: id}
-	err := m.UpdateMedia(g.DB, um)
-	if err != nil {
-		// Error occured during update
-		_http.RespondWithError(w, http.StatusInternalServerError, err.Error())
+	if !g.updateMedia(w, &m, um) {
 		return
 	}
 	// Update successful
 	_http.RespondWithJSON(w, http.StatusOK, m)
 }
 
+// updateMedia applies the editable fields of the passed media. The creation
+// date and the location are verified and stored like by their own routes.
+// Responds with an error if the update failed.
+func (g *AppGateway) updateMedia(w http.ResponseWriter, m *models.Media, um models.Media) bool {
+	timestamp := um.Timestamp != 0 || um.TimestampOffset != nil
+	if timestamp {
+		if err := verifyTimestamp(um); err != nil {
+			_http.RespondWithError(w, http.StatusBadRequest, err.Error())
+			return false
+		}
+	}
+	if um.Location != nil {
+		if err := verifyLocation(um); err != nil {
+			_http.RespondWithError(w, http.StatusBadRequest, err.Error())
+			return false
+		}
+	}
+
+	if timestamp {
+		if err := m.SetTimestamp(g.DB, um.Timestamp, um.TimestampOffset); err != nil {
+			_http.RespondWithError(w, http.StatusInternalServerError, "Error during document update")
+			return false
+		}
+	}
+	if um.Location != nil {
+		media := models.Media{ID: m.ID}
+		if err := g.setMediaLocation(&media, um.Location); err != nil {
+			_http.RespondWithError(w, http.StatusInternalServerError, "Error during document update")
+			return false
+		}
+	}
+	// selects the updated document as well
+	if err := m.UpdateMedia(g.DB, um); err != nil {
+		// Error occured during update
+		_http.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return false
+	}
+	return true
+}
+
 // UploadMedia handles the webrequest for uploading a file to the api
 func (g *AppGateway) UploadMedia(w http.ResponseWriter, r *http.Request) {
 	username := _http.GetUsernameFromHeader(w)
@@ -877,8 +1191,9 @@ func (g *AppGateway) UploadMedia(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token := g.Nodes[n.ID].Secret
-	if token == "" {
+	online, ok := g.getNode(n.ID)
+	token := online.Secret
+	if !ok || online.Status != models.NodeStatusOnline || token == "" {
 		log.WithFields(log.Fields{
 			"node": n.ID,
 		}).Error("user not authenticated to node - is node running?")
@@ -888,7 +1203,7 @@ func (g *AppGateway) UploadMedia(w http.ResponseWriter, r *http.Request) {
 	n.Secret = token
 
 	// file to specified node
-	m, err = addMediaToNode(filename, m, n, g.HTTPClient)
+	m, err = addMediaToNode(filename, m, n, g.nodeClient(n.ID))
 	if err != nil {
 		_http.RespondWithError(w, http.StatusInternalServerError, "could not push media to node")
 		return
@@ -899,6 +1214,9 @@ func (g *AppGateway) UploadMedia(w http.ResponseWriter, r *http.Request) {
 	// 	return
 	// }
 
+	// resolve the place name of the location
+	g.resolvePlace(&m)
+
 	// try to insert model into db
 	result, err := m.AddMedia(g.DB)
 	if err != nil {
@@ -909,6 +1227,13 @@ func (g *AppGateway) UploadMedia(w http.ResponseWriter, r *http.Request) {
 	// remove temporary file
 	os.Remove(filename)
 
+	g.accountUsage(&m, 1, n.ID)
+
+	// keep the copies of the replication policy
+	if id, ok := result.InsertedID.(primitive.ObjectID); ok {
+		g.enqueueReplication(id)
+	}
+
 	// creation successful
 	_http.RespondWithJSON(w, http.StatusCreated, result)
 }
@@ -6,7 +6,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"mime/multipart"
 	"net/http"
 	"os"
@@ -20,7 +19,6 @@ import (
 	"github.com/mirisbowring/primboard/internal/handler"
 	"github.com/mirisbowring/primboard/models"
 	hModel "github.com/mirisbowring/primboard/models/helper"
-	"github.com/mirisbowring/primboard/models/maps"
 )
 
 // authCookie stores the temporal cookie object
@@ -151,6 +149,12 @@ func addMediaToNode(filePath string, m models.Media, node models.Node, client *h
 		return m, errors.New("could not generate hash for file")
 	}
 
+	// read capture time, location and camera from exif (if available)
+	if exif, err := helper.ReadExif(file); err == nil {
+		m.ApplyExif(exif)
+		m.ApplyExifLocation(exif)
+	}
+
 	// create thumbanil
 	rt := handler.CreateThumbnail(filePath)
 	m.FileNameThumb = handler.ParseFileName(m.Sha1, m.Creator, true, m.Extension)
@@ -229,101 +233,37 @@ func addMediaToNode(filePath string, m models.Media, node models.Node, client *h
 	}
 }
 
-func (g *AppGateway) removeMediasFromNode(medias []models.Media, nodeID primitive.ObjectID) map[string][]string {
-	username := medias[0].Creator
-	nodes := make(map[string]models.Node)
-	requests := make(map[string][]string)
-	failed := make(map[string][]string)
-	// iterate over medias to map them to respective nodes
-	for _, med := range medias {
-		// if file is not on any node - skip
-		if len(med.Nodes) == 0 {
-			continue
-		}
-		// iterate over all nodes for that file
-		for _, node := range med.Nodes {
-			// check if deletion should happen for specific node only
-			if nodeID != primitive.NilObjectID && nodeID != node.ID {
-				continue
-			}
-			id := node.ID.Hex()
-			// check if a key for that node does already exist
-			if val, ok := requests[id]; ok {
-				// add file to node for sharing on node
-				val = append(val, med.FileName)
-				requests[id] = val
-			} else {
-				// add node to node map
-				nodes[id] = *g.Nodes[node.ID]
-				// create new key for node with groups to share with
-				requests[id] = []string{med.FileName}
-			}
-		}
+// removeMediasFromNode records the deletion of the files of the medias on
+// their nodes in the outbox. If nodeID is set, only the files on this node are
+// deleted.
+func (g *AppGateway) removeMediasFromNode(medias []models.Media, nodeID primitive.ObjectID) error {
+	if err := g.recordNodeOperations(medias, models.NodeOperationDelete, nil, nodeID); err != nil {
+		return err
 	}
-
-	// iterate over nodes to send bulk delete
-	for id, node := range nodes {
-		endpoint := fmt.Sprintf("%s/api/v1/files/%s/remove", node.APIEndpoint, username)
-		contentType := "application/json"
-
-		val, _ := requests[id]
-
-		body := new(bytes.Buffer)
-		json.NewEncoder(body).Encode(val)
-
-		// prepare log fields
-		logfields := log.Fields{
-			"node":        id,
-			"endpoint":    endpoint,
-			"contentType": contentType,
-		}
-
-		res, status, msg := _http.SendRequest(g.HTTPClient, "POST", endpoint, node.Secret, body, contentType)
-		if status > 0 {
-			logfields["error"] = msg
-			log.WithFields(logfields).Error("could not send request")
-			continue
-		}
-
-		// append status code to logs
-		logfields["status-code"] = res.StatusCode
-
-		// check response status code
-		switch res.StatusCode {
-		case http.StatusOK:
-			log.WithFields(logfields).Info("deleted file on node successfully")
-			break
-		case http.StatusBadRequest:
-			bytes, err := ioutil.ReadAll(res.Body)
-			if err != nil {
-				log.WithFields(logfields).Error("could not decode response body")
-				break
+	for i := range medias {
+		for _, node := range medias[i].Nodes {
+			if nodeID.IsZero() || nodeID == node.ID {
+				g.accountUsage(&medias[i], -1, node.ID)
 			}
-			logfields["response"] = string(bytes)
-			log.WithFields(logfields).Error("malformed request")
-			break
-		case 902:
-			var err _http.ErrorJSON
-			if e := json.NewDecoder(res.Body).Decode(&err); e != nil {
-				logfields["error"] = e.Error()
-				log.WithFields(logfields).Error("cannot decode response body")
-				break
-			}
-			fail, ok := err.Payload.([]string)
-			if !ok {
-				log.WithFields(logfields).Error("cannot parse error payload to []string")
-				break
-			} else {
-				failed[id] = fail
-			}
-			break
-		default:
-			log.WithFields(logfields).Error("unexpected status code")
 		}
 	}
+	return nil
+}
 
-	return failed
-
+// authorizeMedia verifies that the current user has at least the role for the
+// media (as owner or within a group the media is shared with)
+func (g *AppGateway) authorizeMedia(w http.ResponseWriter, id primitive.ObjectID, role models.GroupRole) bool {
+	m := models.Media{ID: id}
+	if err := m.GetMedia(g.DB, g.GetUserPermissionRoleW(w, role), nil); err != nil {
+		log.WithFields(log.Fields{
+			"media": id.Hex(),
+			"role":  role,
+			"error": err.Error(),
+		}).Debug("media not accessible")
+		_http.RespondWithError(w, http.StatusNotFound, "Media not found")
+		return false
+	}
+	return true
 }
 
 // prepareGroupMedia parses the sharing from body and chooses all related groups
@@ -364,8 +304,8 @@ func (g *AppGateway) prepareGroupMedia(w http.ResponseWriter, r *http.Request) (
 		_helper.GroupIDs = append(_helper.GroupIDs, group.ID)
 	}
 
-	// select all groups from list, the user has access to
-	_helper.Groups, err = models.GetUserGroupsByIDs(g.DB, _helper.GroupIDs, g.GetUserPermissionW(w, false))
+	// select all groups from list, the user can contribute to
+	_helper.Groups, err = models.GetUserGroupsByIDs(g.DB, _helper.GroupIDs, models.UserGroupPermission(_http.GetUsernameFromHeader(w), models.RoleContributor))
 	if err != nil {
 		_http.RespondWithError(w, http.StatusInternalServerError, "could not select matching groups from database")
 		return nil, 4
@@ -377,8 +317,8 @@ func (g *AppGateway) prepareGroupMedia(w http.ResponseWriter, r *http.Request) (
 		return nil, 5
 	}
 
-	// select all medias from list, the user is Owner of
-	_helper.Medias, err = models.GetMediaByIDs(g.DB, _helper.MediaIDs, g.GetUserPermissionW(w, true))
+	// select all medias from list, the user manages the shares of
+	_helper.Medias, err = models.GetMediaByIDs(g.DB, _helper.MediaIDs, g.GetUserPermissionRoleW(w, models.RoleAdmin))
 	if err != nil {
 		_http.RespondWithError(w, http.StatusInternalServerError, "could not select matching medias from database")
 		return nil, 6
@@ -398,6 +338,7 @@ func (g *AppGateway) prepareGroupMedia(w http.ResponseWriter, r *http.Request) (
 	for _, group := range _helper.Groups {
 		_helper.GroupIDs = append(_helper.GroupIDs, group.ID)
 	}
+	g.auditTargets(r, models.MediaCollection, _helper.MediaIDs...)
 
 	return &_helper, 0
 }
@@ -414,14 +355,13 @@ func readSessionCookie(r *http.Response) {
 	log.Fatal("Could not read authentication token!")
 }
 
-// shareMediaToGroup creates a requeast to map all passed media to/from passed
-// groups
+// shareMediaToGroup records the shares of all passed media to/from the passed
+// groups on their nodes in the outbox
 //
 // action must be "remove" || "add" (to add or remove the share for that file)
-func (g *AppGateway) shareMediaToGroup(medias []models.Media, groups []models.UserGroup, action string) map[string][]maps.FilesGroupsMap {
-	username := medias[0].Creator
+// if groups is nil, the groups of the media are used
+func (g *AppGateway) shareMediaToGroup(medias []models.Media, groups []models.UserGroup, action string) error {
 	var groupIDs []string
-
 	// prevent exception
 	if groups != nil {
 		// iterating over all groups
@@ -430,124 +370,14 @@ func (g *AppGateway) shareMediaToGroup(medias []models.Media, groups []models.Us
 		}
 	}
 
-	// requests holds all files / groups that are available on a specific node
-	nodes := make(map[string]models.Node)
-	requests := make(map[string]maps.FilesGroupsMap)
-	failed := make(map[string][]maps.FilesGroupsMap)
-
-	// iterate over all files to share
-	for _, med := range medias {
-		// if file is not on any node - skip
-		if len(med.Nodes) == 0 {
-			continue
-		}
-		if groups == nil {
-			groupIDs = UnParseIDs(med.GroupIDs)
-		}
-		// iterate over all nodes for that file
-		for _, node := range med.Nodes {
-			id := node.ID.Hex()
-			// check if a key for that node does already exist
-			if val, ok := requests[id]; ok {
-				// add file to node for sharing on node
-				val.Filenames = append(val.Filenames, med.FileName)
-				requests[id] = val
-			} else {
-				// add node to node map
-				nodes[id] = *(g.Nodes)[node.ID]
-				// create new key for node with groups to share with
-				requests[id] = maps.FilesGroupsMap{
-					Filenames: []string{med.FileName},
-					Groups:    groupIDs,
-				}
-			}
-		}
-	}
-
-	// iterate over find nodes and post request
-	for id, node := range nodes {
-		endpoint := fmt.Sprintf("%s/api/v1/files/%s/shares", node.APIEndpoint, username)
-		contentType := "application/json"
-
-		val, _ := requests[id]
-
-		body := new(bytes.Buffer)
-		json.NewEncoder(body).Encode(val)
-
-		// prepare log fields
-		logfields := log.Fields{
-			"node":        id,
-			"endpoint":    endpoint,
-			"contentType": contentType,
-			"action":      action,
-		}
-
-		// refresh keycloaktoken in neccessary
-		g.keycloakRefreshToken()
-
-		var res *http.Response
-		var status int
-		var msg string
-		switch action {
-		case "add":
-			res, status, msg = _http.SendRequest(g.HTTPClient, "POST", endpoint, g.KeycloakToken.AccessToken, body, contentType)
-			break
-		case "remove":
-			endpoint = fmt.Sprintf("%s/remove", endpoint)
-			res, status, msg = _http.SendRequest(g.HTTPClient, "POST", endpoint, g.KeycloakToken.AccessToken, body, contentType)
-			break
-		default:
-			log.WithFields(logfields).Error("unknown action specified")
-			return nil
-		}
-
-		if status > 0 {
-			logfields["error"] = msg
-			log.WithFields(logfields).Error("could not send request")
-			continue
-		}
-
-		// apend status code to logs
-		logfields["status-code"] = res.StatusCode
-
-		// check response status code
-		switch res.StatusCode {
-		case http.StatusOK:
-			log.WithFields(logfields).Info("removed share for files successfully")
-			break
-		case http.StatusCreated:
-			log.WithFields(logfields).Info("shared files successfully")
-			break
-		case http.StatusUnauthorized:
-			log.WithFields(logfields).Error("could not authorize to node")
-			break
-		case http.StatusBadRequest:
-			bytes, err := ioutil.ReadAll(res.Body)
-			if err != nil {
-				log.WithFields(logfields).Error("could not decode response body")
-				break
-			}
-			logfields["response"] = string(bytes)
-			log.WithFields(logfields).Error("malformed request")
-			break
-		case 901:
-			var err _http.ErrorJSON
-			json.NewDecoder(res.Body).Decode(&err)
-			fail, ok := err.Payload.([]maps.FilesGroupsMap)
-			if !ok {
-				log.WithFields(logfields).Error("cannot parse payload to FilesGroupsMap")
-				break
-			} else {
-				failed[id] = fail
-			}
-			break
-		default:
-			log.WithFields(logfields).Error("unexpected status code")
-		}
+	switch action {
+	case "add":
+		return g.recordNodeOperations(medias, models.NodeOperationShare, groupIDs, primitive.NilObjectID)
+	case "remove":
+		return g.recordNodeOperations(medias, models.NodeOperationUnshare, groupIDs, primitive.NilObjectID)
+	default:
+		return errors.New("unknown action specified")
 	}
-
-	return failed
-
 }
 
 // walkDir recursively iterates a given folder and adds all files to a slice
@@ -2,12 +2,14 @@ package gateway
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"strings"
 
 	"github.com/gorilla/mux"
 	_http "github.com/mirisbowring/primboard/helper/http"
 	"github.com/mirisbowring/primboard/models"
+	log "github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 )
@@ -43,7 +45,7 @@ func (g *AppGateway) addGroupsToNode(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// select valid groups from database
-	groups, err := models.GetUserGroupsByIDs(g.DB, groupIDs, g.GetUserPermissionW(w, false))
+	groups, err := models.GetUserGroupsByIDs(g.DB, groupIDs, models.UserGroupPermission(_http.GetUsernameFromHeader(w), models.RoleAdmin))
 	if err != nil {
 		_http.RespondWithError(w, http.StatusInternalServerError, "could not select matching groups from database")
 		return
@@ -79,6 +81,8 @@ func (g *AppGateway) AddNode(w http.ResponseWriter, r *http.Request) {
 
 	// settings creator
 	e.Creator = w.Header().Get("user")
+	// certificates are only set by the gateway
+	e.CertSerial, e.CertExpiry = "", 0
 	// check mandatory fields
 	if err := e.VerifyNode(g.DB, g.GetUserPermissionW(w, false)); err != nil {
 		_http.RespondWithError(w, http.StatusBadRequest, err.Error())
@@ -111,12 +115,45 @@ func (g *AppGateway) DeleteNodeByID(w http.ResponseWriter, r *http.Request) {
 		_http.RespondWithError(w, http.StatusForbidden, "you are not allowed to delete this node from the system")
 		return
 	}
+	// refuse while media would be orphaned
+	if running, err := models.HasRunningMigration(g.DB, e.ID); err != nil || running {
+		_http.RespondWithError(w, http.StatusConflict, "the node is being migrated")
+		return
+	}
+	orphaned, err := models.CountOrphanedMedia(g.DB, e.ID)
+	if err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not count the media of the node")
+		return
+	}
+	if orphaned > 0 {
+		_http.RespondWithError(w, http.StatusConflict, fmt.Sprintf("%d media are only stored on this node - migrate them first", orphaned))
+		return
+	}
 	// try to delete model
 	result, err := e.DeleteNode(g.DB)
 	if err != nil {
 		_http.RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	g.removeNode(e.ID)
+	if cc, ok := g.getTunnel(e.ID); ok {
+		g.removeTunnel(e.ID, cc)
+	}
+	// replicate the media of the node from the remaining copies
+	ids, err := models.RemoveNodeFromMedia(g.DB, e.ID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"node":  e.ID.Hex(),
+			"error": err.Error(),
+		}).Error("could not remove node from media")
+	}
+	g.enqueueReplication(ids...)
+	if err := models.DeleteNodeUsage(g.DB, e.ID); err != nil {
+		log.WithFields(log.Fields{
+			"node":  e.ID.Hex(),
+			"error": err.Error(),
+		}).Error("could not remove usage of node")
+	}
 	// deletion successful
 	_http.RespondWithJSON(w, http.StatusOK, result)
 }
@@ -168,6 +205,8 @@ func (g *AppGateway) UpdateNodeByID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer r.Body.Close()
+	// certificates are only set by the gateway
+	ue.CertSerial, ue.CertExpiry = "", 0
 	// verify the correctness of the update
 	if err := ue.VerifyNode(g.DB, g.GetUserPermissionW(w, false)); err != nil {
 		_http.RespondWithError(w, http.StatusBadRequest, err.Error())
@@ -0,0 +1,245 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+
+	_http "github.com/mirisbowring/primboard/helper/http"
+	"github.com/mirisbowring/primboard/models"
+	"github.com/mirisbowring/primboard/models/maps"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// checkQuota reserves the bytes, that the user wants to store on the
+// requesting node. The node releases the reservation after the write.
+func (g *AppGateway) checkQuota(w http.ResponseWriter, r *http.Request) {
+	nodeID, ok := g.requireNodeClient(w, r)
+	if !ok {
+		return
+	}
+
+	var req maps.QuotaRequest
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&req); err != nil {
+		_http.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+	if req.Username == "" || req.Size < 0 || req.Files < 0 {
+		_http.RespondWithError(w, http.StatusBadRequest, "invalid quota request")
+		return
+	}
+	if req.Files == 0 {
+		req.Files = 1
+	}
+
+	node := models.Node{ID: nodeID}
+	if err := node.GetNode(g.DB, bson.M{"_id": node.ID}, models.NodeProjectInternal); err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not select node")
+		return
+	}
+	res, err := g.reserveQuota(&node, req.Username, req.Size, req.Files)
+	if err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not reserve quota")
+		return
+	}
+	if res == nil {
+		log.WithFields(log.Fields{
+			"node":     nodeID.Hex(),
+			"username": req.Username,
+			"size":     req.Size,
+		}).Info("quota exceeded")
+		_http.RespondWithError(w, http.StatusInsufficientStorage, "quota exceeded")
+		return
+	}
+	_http.RespondWithJSON(w, http.StatusOK, res)
+}
+
+// releaseQuota releases a reservation of the requesting node
+func (g *AppGateway) releaseQuota(w http.ResponseWriter, r *http.Request) {
+	nodeID, ok := g.requireNodeClient(w, r)
+	if !ok {
+		return
+	}
+	id := parseIDCustomKey(w, r, "reservation")
+	if id.IsZero() {
+		return
+	}
+	if err := models.ReleaseUsage(g.DB, nodeID, id); err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not release quota")
+		return
+	}
+	_http.RespondWithJSON(w, http.StatusOK, "released quota")
+}
+
+// reserveQuota reserves the bytes and files for the user on the node with
+// respect to the effective quota. Returns nil if the quota would be exceeded.
+func (g *AppGateway) reserveQuota(node *models.Node, username string, size int64, files int64) (*models.Reservation, error) {
+	quota, err := node.EffectiveQuota(g.DB, username)
+	if err != nil {
+		return nil, err
+	}
+	return models.ReserveUsage(g.DB, node.ID, username, quota, size, files)
+}
+
+// releaseReservation removes the reservation (nil is ignored)
+func (g *AppGateway) releaseReservation(nodeID primitive.ObjectID, res *models.Reservation) {
+	if res == nil {
+		return
+	}
+	if err := models.ReleaseUsage(g.DB, nodeID, res.ID); err != nil {
+		log.WithFields(log.Fields{
+			"node":        nodeID.Hex(),
+			"reservation": res.ID.Hex(),
+			"error":       err.Error(),
+		}).Error("could not release quota reservation")
+	}
+}
+
+// setNodeQuota sets the quota of the node for all users except the owner
+// (owner only)
+func (g *AppGateway) setNodeQuota(w http.ResponseWriter, r *http.Request) {
+	id := parseID(w, r)
+	if id.IsZero() {
+		return
+	}
+	q, status := decodeQuota(w, r)
+	if status > 0 {
+		return
+	}
+	node := models.Node{ID: id}
+	if err := node.GetNode(g.DB, g.GetUserPermissionW(w, true), models.NodeProject); err != nil {
+		_http.RespondWithError(w, http.StatusNotFound, "Node not found")
+		return
+	}
+	if err := node.SetQuota(g.DB, q); err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not update quota")
+		return
+	}
+	_http.RespondWithJSON(w, http.StatusOK, node)
+}
+
+// setUserGroupQuota sets the quota of the members on the nodes shared with
+// the group (requires the admin role)
+func (g *AppGateway) setUserGroupQuota(w http.ResponseWriter, r *http.Request) {
+	id := parseID(w, r)
+	if id.IsZero() {
+		return
+	}
+	q, status := decodeQuota(w, r)
+	if status > 0 {
+		return
+	}
+	ug := models.UserGroup{ID: id}
+	if g.GetUserGroupAPI(w, g.DB, &ug) != 0 {
+		return
+	}
+	if !g.requireGroupRole(w, &ug, models.RoleAdmin) {
+		return
+	}
+	if err := ug.SetQuota(g.DB, q); err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not update quota")
+		return
+	}
+	_http.RespondWithJSON(w, http.StatusOK, ug)
+}
+
+// getUsage returns the usage and the quota of the current user on every node
+// the user stores files on
+func (g *AppGateway) getUsage(w http.ResponseWriter, r *http.Request) {
+	username := _http.GetUsernameFromHeader(w)
+	usages, err := models.GetUsages(g.DB, primitive.NilObjectID, username)
+	if err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not select usage")
+		return
+	}
+	for i := range usages {
+		node := models.Node{ID: usages[i].NodeID}
+		if err := node.GetNode(g.DB, bson.M{"_id": node.ID}, models.NodeProjectInternal); err != nil {
+			// node has been removed in the meantime
+			continue
+		}
+		if usages[i].Quota, err = node.EffectiveQuota(g.DB, username); err != nil {
+			_http.RespondWithError(w, http.StatusInternalServerError, "could not resolve quota")
+			return
+		}
+	}
+	_http.RespondWithJSON(w, http.StatusOK, usages)
+}
+
+// getNodeUsage returns the usage and the quota of all users on the node
+// (owner only)
+func (g *AppGateway) getNodeUsage(w http.ResponseWriter, r *http.Request) {
+	id := parseID(w, r)
+	if id.IsZero() {
+		return
+	}
+	node := models.Node{ID: id}
+	if err := node.GetNode(g.DB, g.GetUserPermissionW(w, true), models.NodeProjectInternal); err != nil {
+		_http.RespondWithError(w, http.StatusNotFound, "Node not found")
+		return
+	}
+	usages, err := models.GetUsages(g.DB, node.ID, "")
+	if err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not select usage")
+		return
+	}
+	for i := range usages {
+		if usages[i].Quota, err = node.EffectiveQuota(g.DB, usages[i].Username); err != nil {
+			_http.RespondWithError(w, http.StatusInternalServerError, "could not resolve quota")
+			return
+		}
+	}
+	_http.RespondWithJSON(w, http.StatusOK, usages)
+}
+
+// nodeUsage selects the usage of the user on the node including the
+// effective quota
+//
+// 0 -> ok || 1 -> error (response has been written)
+func (g *AppGateway) nodeUsage(w http.ResponseWriter, node *models.Node, username string) (models.Usage, int) {
+	usage, err := models.GetUsage(g.DB, node.ID, username)
+	if err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not select usage")
+		return usage, 1
+	}
+	if usage.Quota, err = node.EffectiveQuota(g.DB, username); err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not resolve quota")
+		return usage, 1
+	}
+	return usage, 0
+}
+
+// decodeQuota decodes the quota of the request body
+//
+// 0 -> ok || 1 -> error (response has been written)
+func decodeQuota(w http.ResponseWriter, r *http.Request) (*models.Quota, int) {
+	var q models.Quota
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&q); err != nil {
+		_http.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return nil, 1
+	}
+	defer r.Body.Close()
+	if err := q.IsValid(); err != nil {
+		_http.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return nil, 1
+	}
+	return &q, 0
+}
+
+// accountUsage adds (sign 1) or removes (sign -1) the copies of the media on
+// the nodes to the usage of its creator
+func (g *AppGateway) accountUsage(m *models.Media, sign int64, nodeIDs ...primitive.ObjectID) {
+	for _, nodeID := range nodeIDs {
+		if err := m.AccountUsage(g.DB, nodeID, sign); err != nil {
+			log.WithFields(log.Fields{
+				"media": m.ID.Hex(),
+				"node":  nodeID.Hex(),
+				"error": err.Error(),
+			}).Error("could not update usage")
+		}
+	}
+}
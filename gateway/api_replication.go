@@ -0,0 +1,134 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+
+	_http "github.com/mirisbowring/primboard/helper/http"
+	"github.com/mirisbowring/primboard/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// getReplicationPolicies returns the policies of the current user and its
+// groups
+func (g *AppGateway) getReplicationPolicies(w http.ResponseWriter, r *http.Request) {
+	username := _http.GetUsernameFromHeader(w)
+	groups, err := models.GetUserGroups(g.DB, username)
+	if err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not select usergroups")
+		return
+	}
+	ids := make([]primitive.ObjectID, len(groups))
+	for i, ug := range groups {
+		ids[i] = ug.ID
+	}
+	policies, err := models.GetReplicationPolicies(g.DB, username, ids)
+	if err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not select replication policies")
+		return
+	}
+	_http.RespondWithJSON(w, http.StatusOK, policies)
+}
+
+// setReplicationPolicy sets the replica count for the media of the current
+// user
+func (g *AppGateway) setReplicationPolicy(w http.ResponseWriter, r *http.Request) {
+	p, status := decodeReplicationPolicy(w, r)
+	if status > 0 {
+		return
+	}
+	p.Username = _http.GetUsernameFromHeader(w)
+	g.saveReplicationPolicy(w, p)
+}
+
+// deleteReplicationPolicy resets the replica count of the current user to the
+// default
+func (g *AppGateway) deleteReplicationPolicy(w http.ResponseWriter, r *http.Request) {
+	p := models.ReplicationPolicy{Username: _http.GetUsernameFromHeader(w)}
+	if err := p.Delete(g.DB); err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not delete replication policy")
+		return
+	}
+	_http.RespondWithJSON(w, http.StatusOK, "deleted replication policy")
+}
+
+// setUserGroupReplicationPolicy sets the replica count for the media shared
+// with the group (requires the admin role)
+func (g *AppGateway) setUserGroupReplicationPolicy(w http.ResponseWriter, r *http.Request) {
+	ug, status := g.replicationPolicyGroup(w, r)
+	if status > 0 {
+		return
+	}
+	p, status := decodeReplicationPolicy(w, r)
+	if status > 0 {
+		return
+	}
+	p.GroupID = ug.ID
+	g.saveReplicationPolicy(w, p)
+}
+
+// deleteUserGroupReplicationPolicy resets the replica count of the group to
+// the default (requires the admin role)
+func (g *AppGateway) deleteUserGroupReplicationPolicy(w http.ResponseWriter, r *http.Request) {
+	ug, status := g.replicationPolicyGroup(w, r)
+	if status > 0 {
+		return
+	}
+	p := models.ReplicationPolicy{GroupID: ug.ID}
+	if err := p.Delete(g.DB); err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not delete replication policy")
+		return
+	}
+	_http.RespondWithJSON(w, http.StatusOK, "deleted replication policy")
+}
+
+// replicationPolicyGroup selects the group of the route and verifies that the
+// current user is an admin of it
+//
+// 0 -> ok || 1 -> error (response has been written)
+func (g *AppGateway) replicationPolicyGroup(w http.ResponseWriter, r *http.Request) (*models.UserGroup, int) {
+	id := parseID(w, r)
+	if id.IsZero() {
+		return nil, 1
+	}
+	ug := models.UserGroup{ID: id}
+	if g.GetUserGroupAPI(w, g.DB, &ug) != 0 {
+		return nil, 1
+	}
+	if !g.requireGroupRole(w, &ug, models.RoleAdmin) {
+		return nil, 1
+	}
+	return &ug, 0
+}
+
+// decodeReplicationPolicy decodes the policy of the request body
+//
+// 0 -> ok || 1 -> error (response has been written)
+func decodeReplicationPolicy(w http.ResponseWriter, r *http.Request) (models.ReplicationPolicy, int) {
+	var p models.ReplicationPolicy
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&p); err != nil {
+		_http.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return p, 1
+	}
+	defer r.Body.Close()
+	// the target is set by the route
+	p.Username = ""
+	p.GroupID = primitive.NilObjectID
+	return p, 0
+}
+
+// saveReplicationPolicy stores the policy and replicates the media, that
+// misses copies now
+func (g *AppGateway) saveReplicationPolicy(w http.ResponseWriter, p models.ReplicationPolicy) {
+	if err := p.IsValid(); err != nil {
+		_http.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := p.Save(g.DB); err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not save replication policy")
+		return
+	}
+	go g.sweepReplication()
+	_http.RespondWithJSON(w, http.StatusOK, p)
+}
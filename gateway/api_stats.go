@@ -0,0 +1,150 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	_http "github.com/mirisbowring/primboard/helper/http"
+	"github.com/mirisbowring/primboard/models"
+	"github.com/mirisbowring/primboard/models/maps"
+	log "github.com/sirupsen/logrus"
+)
+
+// getNodeStats returns the storage stats of all nodes of the current user and
+// their aggregation
+func (g *AppGateway) getNodeStats(w http.ResponseWriter, r *http.Request) {
+	nodes, err := models.GetAllNodes(g.DB, g.GetUserPermissionW(w, true), "")
+	if err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not select nodes")
+		return
+	}
+
+	dashboard := maps.StatsDashboard{Nodes: make([]maps.NodeStatsReport, len(nodes))}
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		wg.Add(1)
+		go func(i int, node models.Node) {
+			defer wg.Done()
+			dashboard.Nodes[i] = g.nodeStatsReport(node)
+		}(i, node)
+	}
+	wg.Wait()
+
+	dashboard.Total = aggregateNodeStats(dashboard.Nodes)
+	_http.RespondWithJSON(w, http.StatusOK, dashboard)
+}
+
+// getNodeStatsByID returns the storage stats of the node (owner only)
+func (g *AppGateway) getNodeStatsByID(w http.ResponseWriter, r *http.Request) {
+	id := parseID(w, r)
+	if id.IsZero() {
+		return
+	}
+	node := models.Node{ID: id}
+	if err := node.GetNode(g.DB, g.GetUserPermissionW(w, true), models.NodeProject); err != nil {
+		_http.RespondWithError(w, http.StatusNotFound, "Node not found")
+		return
+	}
+	report := g.nodeStatsReport(node)
+	if report.Stats == nil {
+		_http.RespondWithError(w, http.StatusBadGateway, report.Error)
+		return
+	}
+	_http.RespondWithJSON(w, http.StatusOK, report)
+}
+
+// nodeStatsReport requests the stats from the node. Offline nodes are not
+// requested.
+func (g *AppGateway) nodeStatsReport(node models.Node) maps.NodeStatsReport {
+	report := maps.NodeStatsReport{
+		NodeID: node.ID.Hex(),
+		Title:  node.Title,
+		Status: node.Status,
+	}
+	if !g.isNodeOnline(node.ID) {
+		report.Error = "node is offline"
+		return report
+	}
+	stats, err := g.requestNodeStats(node)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"node":  node.ID.Hex(),
+			"error": err.Error(),
+		}).Warn("could not request stats from node")
+		report.Error = err.Error()
+		return report
+	}
+	report.Stats = stats
+	return report
+}
+
+// requestNodeStats requests the stats from the api of the node
+func (g *AppGateway) requestNodeStats(node models.Node) (*maps.NodeStats, error) {
+	// refresh keycloaktoken in neccessary
+	g.refreshServiceToken()
+
+	endpoint := fmt.Sprintf("%s/api/v1/stats", node.APIEndpoint)
+	res, status, msg := _http.SendRequest(g.nodeClient(node.ID), http.MethodGet, endpoint, g.ServiceToken.AccessToken, nil, "")
+	if status > 0 {
+		return nil, fmt.Errorf("could not send request: %s", msg)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+	var stats maps.NodeStats
+	if err := json.NewDecoder(res.Body).Decode(&stats); err != nil {
+		return nil, fmt.Errorf("could not decode stats: %s", err.Error())
+	}
+	return &stats, nil
+}
+
+// aggregateNodeStats sums up the stats of the reachable nodes and merges the
+// users and groups by identifier
+func aggregateNodeStats(reports []maps.NodeStatsReport) maps.NodeStats {
+	var total maps.NodeStats
+	users := make(map[string]*maps.StorageStats)
+	groups := make(map[string]*maps.StorageStats)
+	for _, report := range reports {
+		if report.Stats == nil {
+			continue
+		}
+		total.DiskFree += report.Stats.DiskFree
+		total.DiskTotal += report.Stats.DiskTotal
+		total.Originals.Add(report.Stats.Originals)
+		total.Thumbnails.Add(report.Stats.Thumbnails)
+		mergeStorageStats(users, report.Stats.Users)
+		mergeStorageStats(groups, report.Stats.Groups)
+	}
+	total.Users = sortedStorageStats(users)
+	total.Groups = sortedStorageStats(groups)
+	return total
+}
+
+// mergeStorageStats adds the stats to the entries of the same identifier
+func mergeStorageStats(merged map[string]*maps.StorageStats, stats []maps.StorageStats) {
+	for _, s := range stats {
+		m, ok := merged[s.Identifier]
+		if !ok {
+			m = &maps.StorageStats{Identifier: s.Identifier}
+			merged[s.Identifier] = m
+		}
+		m.Originals.Add(s.Originals)
+		m.Thumbnails.Add(s.Thumbnails)
+	}
+}
+
+// sortedStorageStats returns the stats ordered by the size of the originals
+func sortedStorageStats(merged map[string]*maps.StorageStats) []maps.StorageStats {
+	stats := make([]maps.StorageStats, 0, len(merged))
+	for _, s := range merged {
+		stats = append(stats, *s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Originals.Bytes > stats[j].Originals.Bytes
+	})
+	return stats
+}
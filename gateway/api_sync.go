@@ -0,0 +1,91 @@
+package gateway
+
+import (
+	"net/http"
+
+	_http "github.com/mirisbowring/primboard/helper/http"
+	"github.com/mirisbowring/primboard/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// getNodeOperations returns the outstanding node operations of the own media
+// (optionally filtered by status and media)
+func (g *AppGateway) getNodeOperations(w http.ResponseWriter, r *http.Request) {
+	status, ok := parseSyncStatus(w, r)
+	if !ok {
+		return
+	}
+	mediaID, ok := parseOptionalMediaID(w, r)
+	if !ok {
+		return
+	}
+	ops, err := models.GetNodeOperations(g.DB, _http.GetUsernameFromHeader(w), status, mediaID)
+	if err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not select node operations")
+		return
+	}
+	_http.RespondWithJSON(w, http.StatusOK, ops)
+}
+
+// getMediaNodeOperations returns the outstanding node operations of a media
+func (g *AppGateway) getMediaNodeOperations(w http.ResponseWriter, r *http.Request) {
+	id := parseID(w, r)
+	if id.IsZero() {
+		return
+	}
+	if !g.authorizeMedia(w, id, models.RoleViewer) {
+		return
+	}
+	ops, err := models.GetNodeOperations(g.DB, "", "", id)
+	if err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not select node operations")
+		return
+	}
+	_http.RespondWithJSON(w, http.StatusOK, ops)
+}
+
+// retryNodeOperations schedules the failed node operations of the own media
+// (optionally of a single media) again
+func (g *AppGateway) retryNodeOperations(w http.ResponseWriter, r *http.Request) {
+	mediaID, ok := parseOptionalMediaID(w, r)
+	if !ok {
+		return
+	}
+	count, err := models.RetryFailedNodeOperations(g.DB, _http.GetUsernameFromHeader(w), mediaID)
+	if err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not reschedule node operations")
+		return
+	}
+	g.notifyOutbox()
+	_http.RespondWithJSON(w, http.StatusOK, count)
+}
+
+// parseSyncStatus parses the optional status query param
+func parseSyncStatus(w http.ResponseWriter, r *http.Request) (string, bool) {
+	status, code := _http.ParseQueryString(w, r, "status", true)
+	if code > 0 {
+		return "", false
+	}
+	if status != "" && status != models.SyncStatusPending && status != models.SyncStatusFailed {
+		_http.RespondWithError(w, http.StatusBadRequest, "query param 'status' must be pending or failed")
+		return "", false
+	}
+	return status, true
+}
+
+// parseOptionalMediaID parses the optional media query param
+func parseOptionalMediaID(w http.ResponseWriter, r *http.Request) (primitive.ObjectID, bool) {
+	media, code := _http.ParseQueryString(w, r, "media", true)
+	if code > 0 {
+		return primitive.NilObjectID, false
+	}
+	if media == "" {
+		return primitive.NilObjectID, true
+	}
+	id, err := primitive.ObjectIDFromHex(media)
+	if err != nil {
+		_http.RespondWithError(w, http.StatusBadRequest, "could not parse query param 'media'")
+		return primitive.NilObjectID, false
+	}
+	return id, true
+}
@@ -1,243 +1,262 @@
 package gateway
 
-// import (
-// 	"encoding/json"
-// 	"net/http"
-
-// 	"github.com/gorilla/mux"
-// 	_http "github.com/mirisbowring/primboard/helper/http"
-// 	"github.com/mirisbowring/primboard/models"
-// 	"go.mongodb.org/mongo-driver/mongo"
-// )
-
-// //AddIPFSNodeByUsername adds an ipfs-node setting to the users settings
-// func (g *AppGateway) AddIPFSNodeByUsername(w http.ResponseWriter, r *http.Request) {
-// 	// try to parse node
-// 	var ipfs models.IPFSNode
-// 	ipfs, status := DecodeIPFSNodeRequest(w, r, ipfs)
-// 	if status != 0 {
-// 		return
-// 	}
-
-// 	var u models.User
-// 	// parse request
-// 	vars := mux.Vars(r)
-// 	// create model by passed username
-// 	u = models.User{Username: vars["username"]}
-// 	// try to select model
-// 	if err := u.GetUser(g.DB); err != nil {
-// 		switch err {
-// 		case mongo.ErrNoDocuments:
-// 			// model not found
-// 			_http.RespondWithError(w, http.StatusNotFound, "User not found")
-// 		default:
-// 			// another error occured
-// 			_http.RespondWithError(w, http.StatusInternalServerError, err.Error())
-// 		}
-// 		return
-// 	}
-
-// 	if err := u.AddIPFSNode(ipfs); err != nil {
-// 		// IPFSNode Setting is not valid
-// 		_http.RespondWithError(w, http.StatusBadRequest, err.Error())
-// 	}
-// 	// Save changes
-// 	u.Save(g.DB)
-
-// 	_http.RespondWithJSON(w, http.StatusOK, u)
-
-// }
-
-// // CreateUser handles the webrequest for user creation
-// func (g *AppGateway) CreateUser(w http.ResponseWriter, r *http.Request) {
-// 	var u models.User
-// 	// decode request into model
-// 	decoder := json.NewDecoder(r.Body)
-// 	if err := decoder.Decode(&u); err != nil {
-// 		// an decode error occured
-// 		_http.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
-// 		return
-// 	}
-// 	defer r.Body.Close()
-// 	// username and password are mandatory
-// 	if u.Username == "" || u.Password == "" {
-// 		_http.RespondWithError(w, http.StatusBadRequest, "Username and Password must be set!")
-// 		return
-// 	}
-// 	// verify invite
-// 	i := models.Invite{Token: u.Token}
-// 	if err := i.Invalidate(g.DB); err != nil {
-// 		_http.RespondWithError(w, http.StatusBadRequest, err.Error())
-// 		return
-// 	}
-// 	// hash password
-// 	u.Password = HashPassword(u.Password)
-// 	// try to insert model into db
-// 	result, err := u.CreateUser(g.DB)
-// 	if err != nil {
-// 		// prevent the Token from expiration
-// 		i.Revalidate(g.DB, g.Config.InviteValidity)
-// 		_http.RespondWithError(w, http.StatusInternalServerError, err.Error())
-// 		return
-// 	}
-// 	// creation successful
-// 	_http.RespondWithJSON(w, http.StatusCreated, result)
-// }
-
-// // DeleteUser handles the webrequest for user deletion
-// func (g *AppGateway) DeleteUser(w http.ResponseWriter, r *http.Request) {
-// 	// parse request
-// 	vars := mux.Vars(r)
-// 	// create model by passed username
-// 	u := models.User{Username: vars["username"]}
-// 	u, status := ParseUserSelect(g.DB, w, r, true)
-// 	if status > 0 {
-// 		return
-// 	}
-// 	// try to delete model
-// 	result, err := u.DeleteUser(g.DB)
-// 	if err != nil {
-// 		_http.RespondWithError(w, http.StatusInternalServerError, err.Error())
-// 		return
-// 	}
-// 	// deletion successful
-// 	_http.RespondWithJSON(w, http.StatusOK, result)
-// }
-
-// // GetIPFSNodesByUsername returns all IPFSNodes for the current user
-// func (g *AppGateway) GetIPFSNodesByUsername(w http.ResponseWriter, r *http.Request) {
-// 	// parse request an retrieve user
-// 	u, status := ParseUserSelect(g.DB, w, r, true)
-// 	if status > 0 {
-// 		// cancel request if error occured
-// 		return
-// 	}
-
-// 	_http.RespondWithJSON(w, http.StatusOK, u.Settings.IPFSNodes)
-// }
-
-// // GetSettingsByUsername returns the settings for a given user
-// func (g *AppGateway) GetSettingsByUsername(w http.ResponseWriter, r *http.Request) {
-// 	// parse request an retrieve user
-// 	u, status := ParseUserSelect(g.DB, w, r, true)
-// 	if status > 0 {
-// 		// cancel request if error occured
-// 		return
-// 	}
-
-// 	_http.RespondWithJSON(w, http.StatusOK, u.Settings)
-// }
-
-// // GetUserByUsername handles the webrequest for receiving user model by username
-// func (g *AppGateway) GetUserByUsername(w http.ResponseWriter, r *http.Request) {
-// 	// parse request an retrieve user
-// 	u, status := ParseUserSelect(g.DB, w, r, false)
-// 	if status > 0 {
-// 		// cancel request if error occured
-// 		return
-// 	}
-// 	// could select user from mongo
-// 	_http.RespondWithJSON(w, http.StatusOK, u)
-// }
-
-// // // LoginUser Handles the webrequest for logging the user in
-// // func (g *AppGateway) LoginUser(w http.ResponseWriter, r *http.Request) {
-// // 	var u models.User
-// // 	// decode request into model
-// // 	decoder := json.NewDecoder(r.Body)
-// // 	if err := decoder.Decode(&u); err != nil {
-// // 		// an decode error occured
-// // 		_http.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
-// // 		return
-// // 	}
-// // 	defer r.Body.Close()
-// // 	// validate that username is not empty to prevent high db load
-// // 	if u.Username == "" {
-// // 		_http.RespondWithError(w, http.StatusBadRequest, "Username cannot be empty!")
-// // 		return
-// // 	}
-// // 	// read corresponding user from db
-// // 	var us models.User
-// // 	us.Username = u.Username
-// // 	if err := us.GetUser(g.DB); err != nil {
-// // 		switch err {
-// // 		case mongo.ErrNoDocuments:
-// // 			// model not found
-// // 			_http.RespondWithError(w, http.StatusForbidden, "Login Failed!")
-// // 		default:
-// // 			// any other error occured
-// // 			_http.RespondWithError(w, http.StatusInternalServerError, err.Error())
-// // 		}
-// // 		return
-// // 	}
-
-// // 	// hash passed password and compare
-// // 	if err := MatchesBcrypt(u.Password, us.Password); err != nil {
-// // 		// Passwords do not match
-// // 		_http.RespondWithError(w, http.StatusForbidden, "Login Failed!")
-// // 		return
-// // 	}
-
-// // 	// Create new Session
-// // 	// session := g.NewSession(u, g.DB)
-
-// // 	// select nodes, the user has access to
-// // 	// nodes, err := models.GetAllNodes(g.DB, g.GetUserPermission(w, false), "auth")
-// // 	// if err != nil {
-// // 	// 	_http.RespondWithError(w, http.StatusInternalServerError, "could not retrieve nodes")
-// // 	// 	return
-// // 	// }
-
-// // 	// authenticate user to nodes
-// // 	// if status, msg := handler.NodeAuthentication(session, nodes, true, g.HTTPClient); status > 0 {
-// // 	// 	_http.RespondWithError(w, http.StatusInternalServerError, msg)
-// // 	// 	return
-// // 	// }
-
-// // 	// append session and create cookie
-// // 	// g.Sessions = append(g.Sessions, session)
-// // 	// g.SetSessionCookie(&w, r, session)
-
-// // 	// assuming that the user was logged in
-// // 	_http.RespondWithJSON(w, http.StatusOK, "Login was successful!")
-// // }
-
-// // LogoutUser handles the webrequest for logging the user out
-// func (g *AppGateway) LogoutUser(w http.ResponseWriter, r *http.Request) {
-// 	// session := g.GetSessionByUsername(_http.GetUsernameFromHeader(w))
-// 	// unauthenticating user from nodes
-// 	// if status, msg := handler.NodeAuthentication(session, g.Nodes, false, g.HTTPClient); status > 0 {
-// 	// 	_http.RespondWithError(w, http.StatusInternalServerError, msg)
-// 	// 	return
-// 	// }
-// 	//
-// 	// remove session from session store and delete from response
-// 	// g.CloseSession(&w, r)
-
-// 	_http.RespondWithJSON(w, http.StatusNoContent, "Logout was successfull!")
-// }
-
-// // UpdateUser handles the webrequest for updating the user with the passed request body
-// func (g *AppGateway) UpdateUser(w http.ResponseWriter, r *http.Request) {
-// 	// parse request
-// 	vars := mux.Vars(r)
-// 	// store new model in tmp object
-// 	var uu models.User
-// 	decoder := json.NewDecoder(r.Body)
-// 	if err := decoder.Decode(&uu); err != nil {
-// 		// error occured during encoding
-// 		_http.RespondWithError(w, http.StatusBadRequest, "Invalid Request payload")
-// 		return
-// 	}
-// 	defer r.Body.Close()
-// 	// trying to update model with requested body
-// 	u := models.User{Username: vars["username"]}
-// 	result, err := u.UpdateUser(g.DB, uu)
-// 	if err != nil {
-// 		// Error occured during update
-// 		_http.RespondWithError(w, http.StatusInternalServerError, err.Error())
-// 		return
-// 	}
-// 	// Update successful
-// 	_http.RespondWithJSON(w, http.StatusOK, result)
-// }
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/mirisbowring/primboard/helper"
+	_http "github.com/mirisbowring/primboard/helper/http"
+	"github.com/mirisbowring/primboard/models"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// resetTokenValidity is the time a password reset token can be used
+const resetTokenValidity = 24 * time.Hour
+
+// registerUser creates a local account by consuming an invite token
+func (g *AppGateway) registerUser(w http.ResponseWriter, r *http.Request) {
+	if _, ok := g.localIdentity(w); !ok {
+		return
+	}
+	var u models.User
+	// decode request into model
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&u); err != nil {
+		_http.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if err := u.IsValid(); err != nil {
+		_http.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// redeem invite
+	i := models.Invite{Token: u.Token}
+	if err := i.Redeem(g.DB, u.Username, u.Email); err != nil {
+		if err == mongo.ErrNoDocuments {
+			_http.RespondWithError(w, http.StatusBadRequest, "invite token is invalid")
+			return
+		}
+		_http.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// hash password
+	u.Password = HashPassword(u.Password)
+	if err := u.CreateUser(g.DB); err != nil {
+		// give the redemption back to the invite
+		i.Release(g.DB, u.Username)
+		if err == models.ErrUserExists {
+			_http.RespondWithError(w, http.StatusConflict, err.Error())
+			return
+		}
+		log.WithFields(log.Fields{
+			"username": u.Username,
+			"error":    err.Error(),
+		}).Error("could not create user")
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not create user")
+		return
+	}
+
+	// join the groups of the invite
+	if err := models.AddUserToUserGroups(g.DB, i.GroupIDs, u.Username); err != nil {
+		log.WithFields(log.Fields{
+			"username": u.Username,
+			"groups":   i.GroupIDs,
+			"error":    err.Error(),
+		}).Error("could not add user to the groups of the invite")
+	}
+
+	log.WithFields(log.Fields{
+		"username": u.Username,
+		"inviter":  i.Inviter,
+		"invite":   i.ID.Hex(),
+	}).Info("registered user")
+	// remove credentials from response
+	u.Password = ""
+	u.Token = ""
+	_http.RespondWithJSON(w, http.StatusCreated, u)
+}
+
+// loginUser verifies the credentials of a local user and responds with
+// gateway-signed tokens
+func (g *AppGateway) loginUser(w http.ResponseWriter, r *http.Request) {
+	local, ok := g.localIdentity(w)
+	if !ok {
+		return
+	}
+	var u models.User
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&u); err != nil {
+		_http.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if !g.matchesUserPassword(u.Username, u.Password) {
+		_http.RespondWithError(w, http.StatusUnauthorized, "Login Failed!")
+		return
+	}
+	token, err := local.IssueUserToken(u.Username)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"username": u.Username,
+			"error":    err.Error(),
+		}).Error("could not issue token")
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not issue token")
+		return
+	}
+	_http.RespondWithJSON(w, http.StatusOK, token)
+}
+
+// matchesUserPassword checks the password of a local user
+func (g *AppGateway) matchesUserPassword(username string, password string) bool {
+	// validate that username is not empty to prevent high db load
+	if username == "" || password == "" {
+		return false
+	}
+	us := models.User{Username: username}
+	if err := us.GetUser(g.DB); err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.WithFields(log.Fields{
+				"username": username,
+				"error":    err.Error(),
+			}).Error("could not select user from database")
+		}
+		return false
+	}
+	if err := MatchesBcrypt(password, us.Password); err != nil {
+		log.WithFields(log.Fields{
+			"username": username,
+		}).Warn("login failed")
+		return false
+	}
+	return true
+}
+
+// getProfile returns the profile of the current user
+func (g *AppGateway) getProfile(w http.ResponseWriter, r *http.Request) {
+	u := models.User{Username: _http.GetUsernameFromHeader(w)}
+	if err := u.GetUserProfile(g.DB); err != nil {
+		if err == mongo.ErrNoDocuments {
+			_http.RespondWithError(w, http.StatusNotFound, "no local account found")
+			return
+		}
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not select user")
+		return
+	}
+	_http.RespondWithJSON(w, http.StatusOK, u)
+}
+
+// updateProfile overrides the profile fields of the current user
+func (g *AppGateway) updateProfile(w http.ResponseWriter, r *http.Request) {
+	var profile models.UserProfile
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&profile); err != nil {
+		_http.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	u := models.User{Username: _http.GetUsernameFromHeader(w)}
+	if err := u.UpdateProfile(g.DB, profile); err != nil {
+		if err == mongo.ErrNoDocuments {
+			_http.RespondWithError(w, http.StatusNotFound, "no local account found")
+			return
+		}
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not update profile")
+		return
+	}
+	u.GetUserProfile(g.DB)
+	_http.RespondWithJSON(w, http.StatusOK, u)
+}
+
+// changePassword sets a new password for the current user after verifying the
+// old one
+func (g *AppGateway) changePassword(w http.ResponseWriter, r *http.Request) {
+	var pc models.PasswordChange
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&pc); err != nil {
+		_http.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	username := _http.GetUsernameFromHeader(w)
+	if !g.matchesUserPassword(username, pc.OldPassword) {
+		_http.RespondWithError(w, http.StatusForbidden, "old password does not match")
+		return
+	}
+	if err := models.ValidatePassword(pc.NewPassword); err != nil {
+		_http.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	u := models.User{Username: username}
+	if err := u.UpdatePassword(g.DB, HashPassword(pc.NewPassword)); err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not update password")
+		return
+	}
+	_http.RespondWithJSON(w, http.StatusOK, "password changed")
+}
+
+// createResetToken issues a password reset token for a local user. Only the
+// configured admin client is allowed to request the token.
+func (g *AppGateway) createResetToken(w http.ResponseWriter, r *http.Request) {
+	clientID := w.Header().Get("clientID")
+	if g.Config.AdminClientID == "" || clientID != g.Config.AdminClientID {
+		_http.RespondWithError(w, http.StatusForbidden, "only the admin client can reset passwords")
+		return
+	}
+	username, status := _http.ParsePathString(w, r, "username")
+	if status > 0 {
+		return
+	}
+	u := models.User{Username: username}
+	if err := u.SetResetToken(g.DB, helper.GenerateRandomToken(32), resetTokenValidity); err != nil {
+		if err == mongo.ErrNoDocuments {
+			_http.RespondWithError(w, http.StatusNotFound, "user not found")
+			return
+		}
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not create reset token")
+		return
+	}
+	log.WithFields(log.Fields{
+		"username": username,
+		"clientID": clientID,
+	}).Info("created password reset token")
+	_http.RespondWithJSON(w, http.StatusOK, models.PasswordReset{Token: u.ResetToken})
+}
+
+// resetPassword sets a new password by consuming a reset token
+func (g *AppGateway) resetPassword(w http.ResponseWriter, r *http.Request) {
+	if _, ok := g.localIdentity(w); !ok {
+		return
+	}
+	var pr models.PasswordReset
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&pr); err != nil {
+		_http.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if err := models.ValidatePassword(pr.Password); err != nil {
+		_http.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	u, err := models.GetUserByResetToken(g.DB, pr.Token)
+	if err != nil {
+		_http.RespondWithError(w, http.StatusBadRequest, "reset token is invalid")
+		return
+	}
+	if err := u.UpdatePassword(g.DB, HashPassword(pr.Password)); err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not update password")
+		return
+	}
+	log.WithFields(log.Fields{
+		"username": u.Username,
+	}).Info("password has been reset")
+	_http.RespondWithJSON(w, http.StatusOK, "password changed")
+}
@@ -64,9 +64,8 @@ func (g *AppGateway) AddUserToUserGroupByID(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// verify that user is owner
-	if _http.GetUsernameFromHeader(w) != ug.Creator {
-		_http.RespondWithError(w, http.StatusUnauthorized, "You do not own this group!")
+	// verify that user manages the group
+	if !g.requireGroupRole(w, &ug, models.RoleAdmin) {
 		return
 	}
 
@@ -83,6 +82,7 @@ func (g *AppGateway) AddUserToUserGroupByID(w http.ResponseWriter, r *http.Reque
 		_http.RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	g.refreshSessionGroups(u)
 	// success
 	g.GetUserGroupByID(w, r)
 }
@@ -119,9 +119,8 @@ func (g *AppGateway) AddUsersToUserGroupByID(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	// verify that user is owner
-	if _http.GetUsernameFromHeader(w) != ug.Creator {
-		_http.RespondWithError(w, http.StatusUnauthorized, "You do not own this group!")
+	// verify that user manages the group
+	if !g.requireGroupRole(w, &ug, models.RoleAdmin) {
 		return
 	}
 
@@ -136,6 +135,7 @@ func (g *AppGateway) AddUsersToUserGroupByID(w http.ResponseWriter, r *http.Requ
 		_http.RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	g.refreshSessionGroups(u...)
 	// success
 	g.GetUserGroupByID(w, r)
 }
@@ -149,12 +149,20 @@ func (g *AppGateway) DeleteUserGroupByID(w http.ResponseWriter, r *http.Request)
 	}
 	// create model by passed id
 	ug := models.UserGroup{ID: id}
+	if g.GetUserGroupAPI(w, g.DB, &ug) != 0 {
+		return
+	}
+	// only the owner can delete the group
+	if !g.requireGroupRole(w, &ug, models.RoleOwner) {
+		return
+	}
 	// try to delete model
 	result, err := ug.DeleteUserGroup(g.DB)
 	if err != nil {
 		_http.RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	g.refreshSessionGroups(ug.Users...)
 	// deletion successful
 	_http.RespondWithJSON(w, http.StatusOK, result)
 }
@@ -221,13 +229,24 @@ func (g *AppGateway) RemoveUserFromUserGroupByID(w http.ResponseWriter, r *http.
 		return
 	}
 
+	// members can leave, admins can remove the members they are allowed to
+	// manage
+	if username != _http.GetUsernameFromHeader(w) && !g.requireAssignableRole(w, &ug, ug.Role(username)) {
+		return
+	}
+	if username == ug.Creator {
+		_http.RespondWithError(w, http.StatusBadRequest, "The owner cannot be removed from the group!")
+		return
+	}
+
 	// remove username from slice
-	ug.Users = RemoveString(ug.Users, username)
+	ug.RemoveUser(username)
 
 	if err := ug.Save(g.DB, false); err != nil {
 		_http.RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	g.refreshSessionGroups(username)
 
 	// success
 	g.GetUserGroupByID(w, r)
@@ -254,15 +273,27 @@ func (g *AppGateway) RemoveUsersFromUserGroupByID(w http.ResponseWriter, r *http
 		return
 	}
 
+	// verify that the user is allowed to remove every member
+	for _, user := range u {
+		if user == ug.Creator {
+			_http.RespondWithError(w, http.StatusBadRequest, "The owner cannot be removed from the group!")
+			return
+		}
+		if !g.requireAssignableRole(w, &ug, ug.Role(user)) {
+			return
+		}
+	}
+
 	// remove usernames from slice
 	for _, user := range u {
-		ug.Users = RemoveString(ug.Users, user)
+		ug.RemoveUser(user)
 	}
 
 	if err := ug.Save(g.DB, false); err != nil {
 		_http.RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	g.refreshSessionGroups(u...)
 
 	// success
 	g.GetUserGroupByID(w, r)
@@ -286,20 +317,93 @@ func (g *AppGateway) UpdateUserGroupByID(w http.ResponseWriter, r *http.Request)
 	}
 	defer r.Body.Close()
 
+	// select the current state of the group
+	ug := models.UserGroup{ID: id}
+	if g.GetUserGroupAPI(w, g.DB, &ug) != 0 {
+		return
+	}
+	if !g.requireGroupRole(w, &ug, models.RoleAdmin) {
+		return
+	}
+	// only the passed fields are changed (the owner cannot be changed)
+	uug = ug.Merge(uug)
+
 	// verify the usergroup
 	if err := uug.Verify(g.DB); err != nil {
 		_http.RespondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
+	// admins can only be managed by the owner
+	if ug.Role(_http.GetUsernameFromHeader(w)) != models.RoleOwner {
+		for _, admin := range ug.Admins {
+			if uug.Role(admin) != models.RoleAdmin {
+				_http.RespondWithError(w, http.StatusForbidden, "Only the owner can manage the admins!")
+				return
+			}
+		}
+		if len(uug.Admins) != len(ug.Admins) {
+			_http.RespondWithError(w, http.StatusForbidden, "Only the owner can manage the admins!")
+			return
+		}
+	}
+
 	// trying to update model with requested body
-	ug := models.UserGroup{ID: id}
-	result, err := ug.UpdateUserGroup(g.DB, uug, true)
+	result, err := ug.Update(g.DB, uug)
 	if err != nil {
 		// Error occured during update
 		_http.RespondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	g.refreshSessionGroups(helper.UniqueStrings(append(ug.Users, uug.Users...))...)
 	// Update successful
 	_http.RespondWithJSON(w, http.StatusOK, result)
 }
+
+// setUserGroupRole assigns a role to a member of the usergroup
+func (g *AppGateway) setUserGroupRole(w http.ResponseWriter, r *http.Request) {
+	// parse ID from route
+	id := parseID(w, r)
+	if id.IsZero() {
+		return
+	}
+	username, status := _http.ParsePathString(w, r, "username")
+	if status != 0 {
+		return
+	}
+	role, status := _http.ParsePathString(w, r, "role")
+	if status != 0 {
+		return
+	}
+	if !models.GroupRole(role).IsValid() {
+		_http.RespondWithError(w, http.StatusBadRequest, "role must be one of viewer, contributor or admin")
+		return
+	}
+
+	ug := models.UserGroup{ID: id}
+	if g.GetUserGroupAPI(w, g.DB, &ug) != 0 {
+		return
+	}
+	current := ug.Role(username)
+	if current == "" {
+		_http.RespondWithError(w, http.StatusNotFound, "User is not a member of the usergroup!")
+		return
+	}
+	if current == models.RoleOwner {
+		_http.RespondWithError(w, http.StatusBadRequest, "The role of the owner cannot be changed!")
+		return
+	}
+	// the user must be allowed to manage the current and the new role
+	if !g.requireAssignableRole(w, &ug, current) || !g.requireAssignableRole(w, &ug, models.GroupRole(role)) {
+		return
+	}
+
+	ug.SetRole(username, models.GroupRole(role))
+	if err := ug.Save(g.DB, true); err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	g.refreshSessionGroups(username)
+	// success
+	g.GetUserGroupByID(w, r)
+}
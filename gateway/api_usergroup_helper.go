@@ -12,7 +12,8 @@ import (
 // GetUserGroupAPI handles possible errors during the select and writes Responses
 func (g *AppGateway) GetUserGroupAPI(w http.ResponseWriter, db *mongo.Database, ug *models.UserGroup) int {
 	// try to select user
-	if err := ug.GetUserGroup(db, g.GetUserPermissionW(w, false)); err != nil {
+	permission := models.UserGroupPermission(_http.GetUsernameFromHeader(w), models.RoleViewer)
+	if err := ug.GetUserGroup(db, permission); err != nil {
 		switch err {
 		case mongo.ErrNoDocuments:
 			// model not found
@@ -26,6 +27,25 @@ func (g *AppGateway) GetUserGroupAPI(w http.ResponseWriter, db *mongo.Database,
 	return 0
 }
 
+// requireGroupRole verifies that the current user has at least the role within
+// the group and responds with forbidden otherwise
+func (g *AppGateway) requireGroupRole(w http.ResponseWriter, ug *models.UserGroup, role models.GroupRole) bool {
+	if !ug.Role(_http.GetUsernameFromHeader(w)).Includes(role) {
+		_http.RespondWithError(w, http.StatusForbidden, "You are not allowed to manage this group!")
+		return false
+	}
+	return true
+}
+
+// requireAssignableRole verifies that the current user may manage members with
+// the passed role (the owner manages admins, admins manage the other members)
+func (g *AppGateway) requireAssignableRole(w http.ResponseWriter, ug *models.UserGroup, role models.GroupRole) bool {
+	if role == models.RoleAdmin || role == models.RoleOwner {
+		return g.requireGroupRole(w, ug, models.RoleOwner)
+	}
+	return g.requireGroupRole(w, ug, models.RoleAdmin)
+}
+
 // DecodeUserGroupRequest decodes the api request into the passed object
 // responds with decode error if occurs
 // status 0 => ok || status 1 => error
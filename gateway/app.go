@@ -2,42 +2,54 @@ package gateway
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/mirisbowring/primboard/helper/database"
+	"github.com/mirisbowring/primboard/helper/geo"
 	_http "github.com/mirisbowring/primboard/helper/http"
-	"github.com/mirisbowring/primboard/internal/handler"
+	"github.com/mirisbowring/primboard/internal/identity"
 	iModels "github.com/mirisbowring/primboard/internal/models"
 	"github.com/mirisbowring/primboard/internal/models/infrastructure"
 	"github.com/mirisbowring/primboard/models"
 	log "github.com/sirupsen/logrus"
 
-	"github.com/Nerzal/gocloak/v7"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/http2"
 )
 
 // AppGateway struct to maintain database connection and router
 type AppGateway struct {
-	Router             *mux.Router
-	DB                 *mongo.Database
-	Config             *infrastructure.APIGatewayConfig
-	Ctx                context.Context
-	Nodes              map[primitive.ObjectID]*models.Node // stores all authenticated nodes
-	Sessions           []*iModels.Session
-	HTTPClient         *http.Client
-	KeycloakClient     gocloak.GoCloak
-	KeycloakToken      *gocloak.JWT
-	KeycloakTokenCache map[string]*gocloak.RetrospecTokenResult
+	Router       *mux.Router
+	DB           *mongo.Database
+	Config       *infrastructure.APIGatewayConfig
+	Ctx          context.Context
+	Nodes        map[primitive.ObjectID]*models.Node // stores all authenticated nodes
+	nodesMu      sync.RWMutex
+	tunnels      map[primitive.ObjectID]*http2.ClientConn // open tunnels of the nodes
+	tunnelsMu    sync.RWMutex
+	Sessions     iModels.SessionStore
+	HTTPClient   *http.Client
+	Identity     identity.IdentityProvider
+	ServiceToken *identity.Token
+	Gazetteer    *geo.Gazetteer
+	// replicationQueue holds the ids of the media to replicate
+	replicationQueue chan primitive.ObjectID
+	// outboxSignal triggers the delivery of the node operations
+	outboxSignal chan struct{}
+	// mtls is set if the mutual tls with the nodes is enabled
+	mtls *mtls
 }
 
 // Run starts the application on the passed address with the inherited router
@@ -71,34 +83,42 @@ func (g *AppGateway) Run(addr string) {
 					handlers.AllowCredentials(),
 				)(g.Router)))
 	} else {
+		server := &http.Server{Addr: addr}
+		if g.mtls != nil {
+			// nodes present their certificates, users do not
+			server.TLSConfig = &tls.Config{
+				ClientAuth: tls.VerifyClientCertIfGiven,
+				ClientCAs:  g.mtls.ca.Pool(),
+			}
+		}
+		server.Handler = handlers.CORS(
+			handlers.AllowedHeaders(
+				[]string{
+					"X-Requested-With",
+					"Content-Type",
+					"Authorization",
+				},
+			),
+			handlers.AllowedMethods(
+				[]string{
+					"DELETE",
+					"GET",
+					"POST",
+					"PUT",
+					"HEAD",
+					"OPTIONS",
+				},
+			),
+			handlers.AllowedOrigins(
+				g.Config.AllowedOrigins,
+			),
+			handlers.AllowCredentials(),
+		)(g.Router)
 		log.Error(
-			http.ListenAndServeTLS(
-				addr,
+			server.ListenAndServeTLS(
 				fmt.Sprintf("%s/server.crt", g.Config.Certificates),
 				fmt.Sprintf("%s/server.key", g.Config.Certificates),
-				handlers.CORS(
-					handlers.AllowedHeaders(
-						[]string{
-							"X-Requested-With",
-							"Content-Type",
-							"Authorization",
-						},
-					),
-					handlers.AllowedMethods(
-						[]string{
-							"DELETE",
-							"GET",
-							"POST",
-							"PUT",
-							"HEAD",
-							"OPTIONS",
-						},
-					),
-					handlers.AllowedOrigins(
-						g.Config.AllowedOrigins,
-					),
-					handlers.AllowCredentials(),
-				)(g.Router)))
+			))
 	}
 
 }
@@ -120,57 +140,148 @@ func (g *AppGateway) Connect() {
 // - router initialization
 func (g *AppGateway) Initialize(config infrastructure.APIGatewayConfig) {
 	log.Info("Starting Initialization")
-	g.KeycloakTokenCache = make(map[string]*gocloak.RetrospecTokenResult)
 	g.Nodes = make(map[primitive.ObjectID]*models.Node)
 	g.Config = &config
 	g.Ctx = context.Background()
 	// load ca cert if specified
 	httpClient, tlsConfig := _http.GenerateHTTPClient(g.Config.CaCert, g.Config.TLSInsecure)
 	g.HTTPClient = httpClient
-	g.KeycloakClient = handler.CreateKeycloakClient(tlsConfig, g.Config.Keycloak.URL)
-	g.authenticateToKeycloak(0, 10)
 	g.Connect()
+	g.initializeIdentityProvider(tlsConfig)
+	g.loginServiceAccount(0, 10)
+	g.initializeSessionStore()
+	if err := models.EnsureMediaIndexes(g.DB); err != nil {
+		log.Fatal(err)
+	}
+	if err := models.EnsureUserIndexes(g.DB); err != nil {
+		log.Fatal(err)
+	}
+	if err := models.EnsureAccessTokenIndexes(g.DB); err != nil {
+		log.Fatal(err)
+	}
+	if err := models.EnsureAuditIndexes(g.DB); err != nil {
+		log.Fatal(err)
+	}
+	if err := models.EnsureNodeOperationIndexes(g.DB); err != nil {
+		log.Fatal(err)
+	}
+	if err := models.EnsureIntegrityIndexes(g.DB); err != nil {
+		log.Fatal(err)
+	}
+	if err := models.EnsureUsageIndexes(g.DB); err != nil {
+		log.Fatal(err)
+	}
+	g.initializeMTLS()
+	// migrations are not resumed after a restart (they can be started again)
+	if count, err := models.FailRunningMigrations(g.DB, "interrupted by restart"); err != nil {
+		log.Fatal(err)
+	} else if count > 0 {
+		log.WithFields(log.Fields{
+			"migrations": count,
+		}).Warn("marked interrupted migrations as failed")
+	}
+	go g.monitorNodes(30 * time.Second)
+	g.replicationQueue = make(chan primitive.ObjectID, replicationQueueSize)
+	go g.runReplication(10 * time.Minute)
+	g.outboxSignal = make(chan struct{}, 1)
+	go g.runOutbox(30 * time.Second)
+	g.loadGazetteer()
 	g.initializeRoutes()
 }
 
+// loadGazetteer loads the offline gazetteer if configured. Reverse geocoding
+// is disabled if it could not be loaded.
+func (g *AppGateway) loadGazetteer() {
+	if g.Config.GazetteerPath == "" {
+		log.Info("no gazetteer configured - reverse geocoding disabled")
+		return
+	}
+	gazetteer, err := geo.LoadGazetteer(g.Config.GazetteerPath)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"path":  g.Config.GazetteerPath,
+			"error": err.Error(),
+		}).Error("could not load gazetteer - reverse geocoding disabled")
+		return
+	}
+	if g.Config.GazetteerMaxDistance > 0 {
+		gazetteer.MaxDistance = g.Config.GazetteerMaxDistance
+	}
+	g.Gazetteer = gazetteer
+}
+
+// resolvePlace sets the place of the media from its location if a gazetteer
+// is loaded
+func (g *AppGateway) resolvePlace(m *models.Media) {
+	if g.Gazetteer == nil || m.Location == nil || len(m.Location.Coordinates) != 2 {
+		return
+	}
+	if place, ok := g.Gazetteer.Lookup(m.Location.Coordinates[0], m.Location.Coordinates[1]); ok {
+		m.Place = place
+	}
+}
+
 // Authenticate is a middleware to pre-authenticate routes via the session token
 // if logout is true, no new session token is beeing generated
 func (g *AppGateway) Authenticate(h http.Handler, logout bool) http.Handler {
+	return g.authenticate(h, false)
+}
+
+// AuthenticateIntrospect is a middleware for revocation sensitive routes. The
+// token is additionally introspected at keycloak on every request.
+func (g *AppGateway) AuthenticateIntrospect(h http.Handler) http.Handler {
+	return g.authenticate(h, true)
+}
+
+// authenticate verifies the bearer token and prepares the session of the user
+func (g *AppGateway) authenticate(h http.Handler, introspect bool) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 		bearer := r.Header.Get("Authorization")
 		bearer = strings.Replace(bearer, "Bearer ", "", 1)
-		if g.keycloakTokenActive(bearer) {
-			ctx, cancel := context.WithCancel(g.Ctx)
-			defer cancel()
-			jwt, claims, err := g.KeycloakClient.DecodeAccessToken(ctx, bearer, g.Config.Keycloak.Realm, "")
-			if err == nil && jwt.Valid {
-				if val, ok := (*claims)["clientId"]; ok {
-					w.Header().Set("clientID", val.(string))
-				} else {
-					username := ""
-					if tmp, ok := (*claims)["preferred_username"]; ok {
-						username = tmp.(string)
-					}
-					// generate session
-					s := g.GetSession(bearer)
-					if s == nil {
-						s = g.prepareUsersession(username, bearer)
-						g.Sessions = append(g.Sessions, s)
-					}
-					w.Header().Set("user", username)
-				}
-				h.ServeHTTP(w, r)
-			} else {
-				g.RemoveSessionByToken(bearer)
-				_http.RespondWithError(w, http.StatusUnauthorized, "Your session is invalid")
+		if models.IsAccessToken(bearer) {
+			// personal access tokens are verified against the database
+			username, ok := g.verifyAccessToken(w, r, bearer, introspect)
+			if !ok {
 				return
 			}
-		} else {
+			w.Header().Set("user", username)
+			g.auditIdentify(r, username, true)
+			h.ServeHTTP(w, r)
+			log.WithFields(log.Fields{
+				"method":   r.Method,
+				"uri":      r.RequestURI,
+				"source":   r.RemoteAddr,
+				"duration": time.Since(start),
+			}).Info("handle request")
+			return
+		}
+		id, ok := g.verifyToken(bearer, introspect)
+		if !ok {
 			g.RemoveSessionByToken(bearer)
 			_http.RespondWithError(w, http.StatusUnauthorized, "Your session is invalid")
 			return
 		}
+		if id.ClientID != "" {
+			// nodes must present their certificate if mtls is enabled
+			if nodeID, err := primitive.ObjectIDFromHex(id.ClientID); err == nil && !g.verifyNodeCertificate(r, nodeID) {
+				_http.RespondWithError(w, http.StatusUnauthorized, "node certificate is invalid")
+				return
+			}
+			w.Header().Set("clientID", id.ClientID)
+			g.auditIdentify(r, id.ClientID, false)
+		} else {
+			username := id.Username
+			// generate session or renew its expiry
+			if s := g.GetSession(bearer); s == nil {
+				g.prepareUsersession(username, bearer)
+			} else {
+				g.Sessions.Touch(bearer)
+			}
+			w.Header().Set("user", username)
+			g.auditIdentify(r, username, true)
+		}
+		h.ServeHTTP(w, r)
 		log.WithFields(log.Fields{
 			"method":   r.Method,
 			"uri":      r.RequestURI,
@@ -180,82 +291,98 @@ func (g *AppGateway) Authenticate(h http.Handler, logout bool) http.Handler {
 	})
 }
 
-// logs the client into the keycloak api and retrieves token
-func (g *AppGateway) authenticateToKeycloak(try int, max int) {
+// verifyToken verifies the token offline at the identity provider and returns
+// its identity. If introspect is true, the token is additionally
+// introspected at keycloak to detect revoked tokens.
+func (g *AppGateway) verifyToken(token string, introspect bool) (*identity.Identity, bool) {
+	id, err := g.Identity.Verify(token)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Debug("could not verify token")
+		return nil, false
+	}
+	if introspect && !g.introspectToken(token) {
+		return nil, false
+	}
+	return id, true
+}
+
+// initializeIdentityProvider creates the configured identity provider
+func (g *AppGateway) initializeIdentityProvider(tlsConfig *tls.Config) {
+	provider, err := identity.New(g.Config.Keycloak, g.HTTPClient, tlsConfig, g.DB)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"provider": g.Config.Keycloak.Provider,
+			"error":    err.Error(),
+		}).Fatal("could not initialize identity provider")
+	}
+	g.Identity = provider
+}
+
+// loginServiceAccount logs the application in at the identity provider and
+// retrieves the token of its service account
+func (g *AppGateway) loginServiceAccount(try int, max int) {
 	ctx, cancel := context.WithCancel(g.Ctx)
 	defer cancel()
-	var err error
-	g.KeycloakToken, err = g.KeycloakClient.LoginClient(ctx, g.Config.Keycloak.ClientID, g.Config.Keycloak.Secret, g.Config.Keycloak.Realm)
+	token, err := g.Identity.Login(ctx)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"clientid": g.Config.Keycloak.ClientID,
-			"realm":    g.Config.Keycloak.Realm,
+			"provider": g.Config.Keycloak.Provider,
 			"error":    err.Error(),
-		}).Error("could not authenticate to keycloak api")
-		// retry (possibly, keycloak not up)
+		}).Error("could not authenticate to identity provider")
+		// retry (possibly, the provider is not up)
 		if try < max {
 			time.Sleep(time.Second * 5)
-			g.authenticateToKeycloak(try+1, max)
+			g.loginServiceAccount(try+1, max)
 		}
+		return
 	}
-	g.keycloakTokenActive(g.KeycloakToken.AccessToken)
+	g.ServiceToken = token
 }
 
-func (g *AppGateway) keycloakTokenActive(token string) bool {
-	// check if cached tokens expiry date is in future
-	if val, ok := g.KeycloakTokenCache[token]; ok && int64(*val.Exp) >= time.Now().Unix() {
-		log.Debug("found active token in token cache")
-		return true
-	} else if ok && int64(*val.Exp) < time.Now().Unix() {
-		// cached token expired
-		delete(g.KeycloakTokenCache, token)
-	}
-	// verify token against keycloak
+// introspectToken verifies the token at the identity provider (bypassing the
+// cache)
+func (g *AppGateway) introspectToken(token string) bool {
 	ctx, cancel := context.WithCancel(g.Ctx)
 	defer cancel()
-	rptResult, err := g.KeycloakClient.RetrospectToken(ctx, token, g.Config.Keycloak.ClientID, g.Config.Keycloak.Secret, g.Config.Keycloak.Realm)
+	result, err := g.Identity.Introspect(ctx, token)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"error": err.Error(),
-		}).Error("could not retrospect token")
+		}).Error("could not introspect token")
 		return false
 	}
 
 	// check if token active
-	if !*rptResult.Active {
-		log.Debug("token is not active according to keycloak api")
+	if !result.Active {
+		log.Debug("token is not active according to identity provider")
 		return false
 	}
-
-	// cache token
-	g.KeycloakTokenCache[token] = rptResult
-	return *rptResult.Active
+	return true
 }
 
-// keycloakRefreshToken refreshes the clients access token
-func (g *AppGateway) keycloakRefreshToken() {
-	// no need to refresh if vaid
-	if g.keycloakTokenActive(g.KeycloakToken.AccessToken) {
+// refreshServiceToken refreshes the access token of the service account
+func (g *AppGateway) refreshServiceToken() {
+	// no need to refresh if valid
+	if g.ServiceToken.Valid() {
 		log.Debug("token still valid - skipping refresh")
 		return
 	}
 
-	// verify token against keycloak
-	var err error
 	ctx, cancel := context.WithCancel(g.Ctx)
 	defer cancel()
-	g.KeycloakToken, err = g.KeycloakClient.RefreshToken(ctx, g.KeycloakToken.RefreshToken, g.Config.Keycloak.ClientID, g.Config.Keycloak.Secret, g.Config.Keycloak.Realm)
+	token, err := g.Identity.Refresh(ctx, g.ServiceToken)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"error": err.Error(),
 		}).Error("could not refresh token")
 		// possibly, the refresh token is expired -> try to reauthenticate
-		g.authenticateToKeycloak(0, 1)
+		g.loginServiceAccount(0, 1)
 		return
 	}
-
-	// map token to cache
-	g.keycloakTokenActive(g.KeycloakToken.AccessToken)
+	g.ServiceToken = token
 }
 
 // prepareUsersession selects the user and prepares a local session
@@ -316,10 +443,9 @@ func (g *AppGateway) prepareUsersession(username string, token string) *iModels.
 // GetUserPermission parses the permissionfilter and returns it
 func (g *AppGateway) GetUserPermission(username string, ownerOnly bool) bson.M {
 	if ownerOnly {
-		return database.CreatePermissionFilter(nil, username)
+		return g.GetUserPermissionRole(username, models.RoleOwner)
 	}
-	session := g.GetSessionByUsername(username)
-	return database.CreatePermissionFilter(session.Usergroups, username)
+	return g.GetUserPermissionRole(username, models.RoleViewer)
 }
 
 // GetUserPermissionW parses the permissionfilter and returns it
@@ -329,6 +455,23 @@ func (g *AppGateway) GetUserPermissionW(w http.ResponseWriter, ownerOnly bool) b
 	return g.GetUserPermission(username, ownerOnly)
 }
 
+// GetUserPermissionRole parses the permissionfilter that matches the own
+// documents and the documents of the groups in which the user has at least the
+// passed role
+func (g *AppGateway) GetUserPermissionRole(username string, role models.GroupRole) bson.M {
+	if role == models.RoleOwner {
+		return database.CreatePermissionFilter(nil, username)
+	}
+	session := g.GetSessionByUsername(username)
+	return database.CreatePermissionFilter(session.GroupsWithRole(role), username)
+}
+
+// GetUserPermissionRoleW parses the permissionfilter for the role and reads the
+// username from passed response writer
+func (g *AppGateway) GetUserPermissionRoleW(w http.ResponseWriter, role models.GroupRole) bson.M {
+	return g.GetUserPermissionRole(_http.GetUsernameFromHeader(w), role)
+}
+
 // HashPassword hashes the passed passwort using bcrypt
 func HashPassword(password string) (hashedPassword string) {
 	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
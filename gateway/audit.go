@@ -0,0 +1,356 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mirisbowring/primboard/helper"
+	"github.com/mirisbowring/primboard/models"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// auditAnonymous is the actor of unauthenticated requests
+const auditAnonymous = "anonymous"
+
+// auditContextKey is the context key of the audit record of a request
+type auditContextKey struct{}
+
+// auditRecord collects the actor and the targets of an audited request
+type auditRecord struct {
+	mu         sync.Mutex
+	actor      string
+	collection string
+	username   string
+	targets    []*auditTarget
+}
+
+// auditTarget is a touched document with its state before the request
+type auditTarget struct {
+	collection string
+	id         string
+	filter     bson.M
+	before     bson.M
+}
+
+// auditResponseWriter captures the status code of the response
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader captures the status code
+func (w *auditResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// auditSkipped contains the non-GET routes that do not mutate anything (or
+// only temporary bookkeeping like quota reservations)
+var auditSkipped = map[string]bool{
+	"POST /api/v1/auth/introspect":                                true,
+	"POST /api/v1/export":                                         true,
+	"POST /api/v1/media/bysha1s":                                  true,
+	"POST /api/v2/infrastructure/node/authenticate":               true,
+	"POST /api/v2/infrastructure/node/heartbeat":                  true,
+	"POST /api/v2/infrastructure/node/{id}/quota":                 true,
+	"DELETE /api/v2/infrastructure/node/{id}/quota/{reservation}": true,
+}
+
+// auditForced contains the GET routes that mutate documents
+var auditForced = map[string]bool{
+	"GET /api/v1/events/maptags":                                   true,
+	"GET /api/v1/tunnel/{id}/api/v1/file/{identifier}/{filename}":  true,
+	"HEAD /api/v1/tunnel/{id}/api/v1/file/{identifier}/{filename}": true,
+	"GET /api/v1/user/invite":                                      true,
+	"GET /api/v2/infrastructure/node/register":                     true,
+	"GET /api/v2/infrastructure/node/tunnel":                       true,
+	"GET /api/v2/infrastructure/node/{id}/secret/refresh":          true,
+}
+
+// auditCollections maps route prefixes to the collection of the {id} path
+// variable (more specific prefixes first)
+var auditCollections = []struct {
+	prefix     string
+	collection string
+}{
+	{"/api/v1/user/node", models.NodeCollection},
+	{"/api/v1/user/invite", "invite"},
+	{"/api/v1/user/tokens", models.AccessTokenCollection},
+	{"/api/v2/infrastructure/node", models.NodeCollection},
+	{"/api/v1/usergroup", models.UserGroupCollection},
+	{"/api/v1/media", models.MediaCollection},
+	{"/api/v1/event", "event"},
+	{"/api/v1/tag", models.TagCollection},
+	{"/api/v1/user", models.UserCollection},
+}
+
+// auditOwnerFields are the fields that name the owner of a document
+var auditOwnerFields = []string{"creator", "owner", "inviter"}
+
+// audit is a middleware of the router that records mutating requests with the
+// diffs of the touched documents in the audit log. The actor is set by the
+// authentication (unauthenticated requests are recorded as anonymous).
+func (g *AppGateway) audit(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		template := r.URL.Path
+		if route := mux.CurrentRoute(r); route != nil {
+			if t, err := route.GetPathTemplate(); err == nil {
+				template = t
+			}
+		}
+		readOnly := r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions
+		if readOnly && !auditForced[r.Method+" "+template] || auditSkipped[r.Method+" "+template] {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		// track the document of the route (the user of the own account is
+		// tracked once authenticated)
+		vars := mux.Vars(r)
+		record := &auditRecord{collection: auditCollection(template), username: vars["username"]}
+		if record.collection == models.UserCollection {
+			if record.username != "" {
+				record.track(g, record.collection, record.username, bson.M{"username": record.username})
+			}
+		} else if id, err := primitive.ObjectIDFromHex(vars["id"]); err == nil && record.collection != "" {
+			record.track(g, record.collection, id.Hex(), bson.M{"_id": id})
+		}
+
+		aw := &auditResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(aw, r.WithContext(context.WithValue(r.Context(), auditContextKey{}, record)))
+
+		record.mu.Lock()
+		actor := record.actor
+		record.mu.Unlock()
+		entry := models.AuditEntry{
+			Actor:     auditAnonymous,
+			Method:    r.Method,
+			Action:    template,
+			URI:       r.RequestURI,
+			Source:    r.RemoteAddr,
+			Status:    aw.status,
+			Timestamp: time.Now(),
+		}
+		if actor != "" {
+			entry.Actor = actor
+			entry.Owners = append(entry.Owners, actor)
+		}
+		record.mu.Lock()
+		for _, t := range record.targets {
+			after := models.AuditSnapshot(g.DB, t.collection, t.filter)
+			entry.Targets = append(entry.Targets, models.AuditTarget{
+				Collection: t.collection,
+				ID:         t.id,
+				Changes:    auditDiff(t.before, after),
+			})
+			entry.Owners = append(entry.Owners, auditOwners(t.collection, t.before, after)...)
+		}
+		record.mu.Unlock()
+		entry.Owners = helper.UniqueStrings(entry.Owners)
+
+		if err := entry.Add(g.DB); err != nil {
+			log.WithFields(log.Fields{
+				"actor":  entry.Actor,
+				"action": entry.Action,
+				"error":  err.Error(),
+			}).Error("could not write audit log")
+		}
+	})
+}
+
+// auditIdentify sets the authenticated actor of the audit record of the
+// request. The account of the actor is tracked for the routes of the own user.
+func (g *AppGateway) auditIdentify(r *http.Request, actor string, user bool) {
+	record, ok := r.Context().Value(auditContextKey{}).(*auditRecord)
+	if !ok {
+		return
+	}
+	record.mu.Lock()
+	record.actor = actor
+	record.mu.Unlock()
+	if user && record.collection == models.UserCollection && record.username == "" {
+		record.track(g, record.collection, actor, bson.M{"username": actor})
+	}
+}
+
+// auditTargets adds documents, that are touched by a bulk operation, to the
+// audit record of the request. Must be called before the mutation.
+func (g *AppGateway) auditTargets(r *http.Request, collection string, ids ...primitive.ObjectID) {
+	record, ok := r.Context().Value(auditContextKey{}).(*auditRecord)
+	if !ok {
+		return
+	}
+	for _, id := range ids {
+		record.track(g, collection, id.Hex(), bson.M{"_id": id})
+	}
+}
+
+// track adds the document with its current state to the record
+func (a *auditRecord) track(g *AppGateway, collection string, id string, filter bson.M) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, t := range a.targets {
+		if t.collection == collection && t.id == id {
+			return
+		}
+	}
+	a.targets = append(a.targets, &auditTarget{
+		collection: collection,
+		id:         id,
+		filter:     filter,
+		before:     models.AuditSnapshot(g.DB, collection, filter),
+	})
+}
+
+// auditCollection returns the collection of the {id} variable of the route
+func auditCollection(template string) string {
+	for _, c := range auditCollections {
+		if template == c.prefix || strings.HasPrefix(template, c.prefix+"/") {
+			return c.collection
+		}
+	}
+	return ""
+}
+
+// auditDiff returns the changed fields of a document. Nested documents are
+// compared field by field (dot notation).
+func auditDiff(before bson.M, after bson.M) []models.AuditChange {
+	return auditDiffFields("", before, after)
+}
+
+// auditDiffFields compares the fields of two (nested) documents
+func auditDiffFields(prefix string, before bson.M, after bson.M) []models.AuditChange {
+	var changes []models.AuditChange
+	for field, value := range before {
+		a, ok := after[field]
+		if !ok {
+			changes = append(changes, models.AuditChange{Field: prefix + field, Before: value})
+			continue
+		}
+		changes = append(changes, auditDiffValue(prefix+field, value, a)...)
+	}
+	for field, value := range after {
+		if _, ok := before[field]; !ok {
+			changes = append(changes, models.AuditChange{Field: prefix + field, After: value})
+		}
+	}
+	return changes
+}
+
+// auditDiffValue compares a field. Documents are compared field by field,
+// arrays element by element.
+func auditDiffValue(field string, before interface{}, after interface{}) []models.AuditChange {
+	if reflect.DeepEqual(before, after) {
+		return nil
+	}
+	if b, ok := auditDocument(before); ok {
+		if a, ok := auditDocument(after); ok {
+			return auditDiffFields(field+".", b, a)
+		}
+	}
+	if b, ok := before.(primitive.A); ok {
+		if a, ok := after.(primitive.A); ok {
+			return auditDiffArray(field, b, a)
+		}
+	}
+	return []models.AuditChange{{Field: field, Before: before, After: after}}
+}
+
+// auditDiffArray compares arrays of documents by index. For arrays of values
+// (e.g. the members of a group) the removed and the added values are returned.
+func auditDiffArray(field string, before primitive.A, after primitive.A) []models.AuditChange {
+	if auditContainsDocuments(before) || auditContainsDocuments(after) {
+		var changes []models.AuditChange
+		for i := 0; i < len(before) || i < len(after); i++ {
+			indexed := fmt.Sprintf("%s.%d", field, i)
+			switch {
+			case i >= len(before):
+				changes = append(changes, models.AuditChange{Field: indexed, After: after[i]})
+			case i >= len(after):
+				changes = append(changes, models.AuditChange{Field: indexed, Before: before[i]})
+			default:
+				changes = append(changes, auditDiffValue(indexed, before[i], after[i])...)
+			}
+		}
+		return changes
+	}
+
+	removed := auditMissing(before, after)
+	added := auditMissing(after, before)
+	if len(removed) == 0 && len(added) == 0 {
+		// the order changed only
+		return []models.AuditChange{{Field: field, Before: before, After: after}}
+	}
+	change := models.AuditChange{Field: field}
+	if len(removed) > 0 {
+		change.Before = removed
+	}
+	if len(added) > 0 {
+		change.After = added
+	}
+	return []models.AuditChange{change}
+}
+
+// auditDocument returns the value as document
+func auditDocument(v interface{}) (bson.M, bool) {
+	switch doc := v.(type) {
+	case bson.M:
+		return doc, true
+	case primitive.D:
+		return doc.Map(), true
+	}
+	return nil, false
+}
+
+// auditContainsDocuments returns whether the array contains documents
+func auditContainsDocuments(values primitive.A) bool {
+	for _, v := range values {
+		if _, ok := auditDocument(v); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// auditMissing returns the values of a, that are not contained in b
+func auditMissing(a primitive.A, b primitive.A) primitive.A {
+	var missing primitive.A
+	for _, v := range a {
+		found := false
+		for _, w := range b {
+			if reflect.DeepEqual(v, w) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, v)
+		}
+	}
+	return missing
+}
+
+// auditOwners returns the owners of the document
+func auditOwners(collection string, docs ...bson.M) []string {
+	var owners []string
+	for _, doc := range docs {
+		fields := auditOwnerFields
+		if collection == models.UserCollection {
+			fields = []string{"username"}
+		}
+		for _, field := range fields {
+			if owner, ok := doc[field].(string); ok && owner != "" {
+				owners = append(owners, owner)
+			}
+		}
+	}
+	return owners
+}
@@ -2,10 +2,14 @@ package gateway
 
 import (
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/mirisbowring/primboard/helper"
 	_http "github.com/mirisbowring/primboard/helper/http"
+	"github.com/mirisbowring/primboard/models"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -25,6 +29,55 @@ func parseIDCustomKey(w http.ResponseWriter, r *http.Request, key string) primit
 	return id
 }
 
+// parseTimezone parses the optional "tz" query param into a location. Returns
+// nil if not specified (the original offset of the media should be used then)
+//
+// 0 -> ok || 1 -> unknown timezone (sends respond)
+func parseTimezone(w http.ResponseWriter, r *http.Request) (*time.Location, int) {
+	tz, _ := _http.ParseQueryString(w, r, "tz", true)
+	if tz == "" {
+		return nil, 0
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		_http.RespondWithError(w, http.StatusBadRequest, "unknown timezone specified")
+		return nil, 1
+	}
+	return loc, 0
+}
+
+// parseBoundingBox parses the mandatory "box" query param of the format
+// west,south,east,north into a bounding box
+//
+// 0 -> ok || 1 -> missing or invalid box (sends respond)
+func parseBoundingBox(w http.ResponseWriter, r *http.Request) (models.BoundingBox, int) {
+	var box models.BoundingBox
+	value, status := _http.ParseQueryString(w, r, "box", false)
+	if status > 0 {
+		return box, 1
+	}
+	parts := strings.Split(value, ",")
+	if len(parts) != 4 {
+		_http.RespondWithError(w, http.StatusBadRequest, "box must be of format west,south,east,north")
+		return box, 1
+	}
+	var coords [4]float64
+	for i, part := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			_http.RespondWithError(w, http.StatusBadRequest, "box must consist of numbers")
+			return box, 1
+		}
+		coords[i] = f
+	}
+	box = models.BoundingBox{West: coords[0], South: coords[1], East: coords[2], North: coords[3]}
+	if err := box.IsValid(); err != nil {
+		_http.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return box, 1
+	}
+	return box, 0
+}
+
 // // parseUsername parses the username from the route and returns is
 // // stats 0 -> ok || status 1 -> error
 // func parseUsername(w http.ResponseWriter, r *http.Request) (User, int) {
@@ -0,0 +1,195 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+
+	_http "github.com/mirisbowring/primboard/helper/http"
+	"github.com/mirisbowring/primboard/models"
+	"github.com/mirisbowring/primboard/models/maps"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// migrationProgressInterval is the number of media after which the progress
+// of a migration is stored
+const migrationProgressInterval = 50
+
+// migrateNode moves the media of the node (or of a single user on the node)
+// to another node of the owner
+func (g *AppGateway) migrateNode(w http.ResponseWriter, r *http.Request) {
+	id := parseID(w, r)
+	if id.IsZero() {
+		return
+	}
+
+	var req maps.MigrationRequest
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&req); err != nil {
+		_http.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+	targetID, err := primitive.ObjectIDFromHex(req.Target)
+	if err != nil || targetID == id {
+		_http.RespondWithError(w, http.StatusBadRequest, "invalid target node specified")
+		return
+	}
+
+	// both nodes must be owned by the current user
+	source := models.Node{ID: id}
+	if err := source.GetNode(g.DB, g.GetUserPermissionW(w, true), models.NodeProject); err != nil {
+		_http.RespondWithError(w, http.StatusNotFound, "Node not found")
+		return
+	}
+	target := models.Node{ID: targetID}
+	if err := target.GetNode(g.DB, g.GetUserPermissionW(w, true), models.NodeProject); err != nil {
+		_http.RespondWithError(w, http.StatusNotFound, "target node not found")
+		return
+	}
+	if !g.isNodeOnline(source.ID) || !g.isNodeOnline(target.ID) {
+		_http.RespondWithError(w, http.StatusConflict, "source and target node must be online")
+		return
+	}
+	for _, nodeID := range []primitive.ObjectID{source.ID, target.ID} {
+		running, err := models.HasRunningMigration(g.DB, nodeID)
+		if err != nil {
+			_http.RespondWithError(w, http.StatusInternalServerError, "could not select migrations")
+			return
+		}
+		if running {
+			_http.RespondWithError(w, http.StatusConflict, "a migration of the node is running already")
+			return
+		}
+	}
+
+	mg := models.Migration{
+		SourceID: source.ID,
+		TargetID: target.ID,
+		Username: req.Username,
+		Creator:  _http.GetUsernameFromHeader(w),
+	}
+	if err := mg.Add(g.DB); err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not create migration")
+		return
+	}
+	go g.runMigration(mg)
+	_http.RespondWithJSON(w, http.StatusAccepted, mg)
+}
+
+// getNodeMigrations returns the migrations from or to the node (owner only)
+func (g *AppGateway) getNodeMigrations(w http.ResponseWriter, r *http.Request) {
+	id := parseID(w, r)
+	if id.IsZero() {
+		return
+	}
+	node := models.Node{ID: id}
+	if err := node.GetNode(g.DB, g.GetUserPermissionW(w, true), models.NodeProject); err != nil {
+		_http.RespondWithError(w, http.StatusNotFound, "Node not found")
+		return
+	}
+	migrations, err := models.GetMigrations(g.DB, node.ID)
+	if err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not select migrations")
+		return
+	}
+	_http.RespondWithJSON(w, http.StatusOK, migrations)
+}
+
+// runMigration moves the media one by one and stores the progress
+func (g *AppGateway) runMigration(mg models.Migration) {
+	logfields := log.Fields{
+		"migration": mg.ID.Hex(),
+		"source":    mg.SourceID.Hex(),
+		"target":    mg.TargetID.Hex(),
+		"username":  mg.Username,
+	}
+	defer func() {
+		if mg.Failed > 0 || mg.LastError != "" {
+			mg.Status = models.MigrationStatusFailed
+		} else {
+			mg.Status = models.MigrationStatusCompleted
+		}
+		g.updateMigration(&mg)
+		logfields["moved"] = mg.Moved
+		logfields["failed"] = mg.Failed
+		log.WithFields(logfields).Info("finished migration")
+	}()
+
+	ids, err := models.GetNodeMediaIDs(g.DB, mg.SourceID, mg.Username)
+	if err != nil {
+		mg.LastError = "could not select media of the node"
+		return
+	}
+	mg.Total = len(ids)
+	g.updateMigration(&mg)
+	log.WithFields(logfields).Info("started migration")
+
+	for i, id := range ids {
+		if err := g.migrateMedia(id, mg.SourceID, mg.TargetID); err != nil {
+			mg.Failed++
+			mg.LastError = err.Error()
+			logfields["media"] = id.Hex()
+			logfields["error"] = err.Error()
+			log.WithFields(logfields).Error("could not migrate media")
+			delete(logfields, "media")
+			delete(logfields, "error")
+		} else {
+			mg.Moved++
+		}
+		if (i+1)%migrationProgressInterval == 0 {
+			g.updateMigration(&mg)
+		}
+	}
+}
+
+// migrateMedia copies the media from the source to the target node (the
+// target verifies the sha1 and restores the shares), adds the target to the
+// media and schedules the deletion on the source
+func (g *AppGateway) migrateMedia(id primitive.ObjectID, sourceID primitive.ObjectID, targetID primitive.ObjectID) error {
+	if !g.isNodeOnline(sourceID) || !g.isNodeOnline(targetID) {
+		return errNodeUnavailable
+	}
+	source, _ := g.getNode(sourceID)
+
+	m := models.Media{ID: id}
+	if err := m.GetMedia(g.DB, bson.M{"nodeIDs": sourceID}, models.MediaProjectInternal); err != nil {
+		// media has been deleted or moved in the meantime
+		return nil
+	}
+
+	stored := false
+	for _, n := range m.Nodes {
+		stored = stored || n.ID == targetID
+	}
+	if !stored {
+		req := maps.ReplicationRequest{
+			Source:   source.APIEndpoint,
+			SourceID: source.ID.Hex(),
+			Username: m.Creator,
+			Filename: m.FileName,
+			Sha1:     m.Sha1,
+			Size:     m.Size,
+			Groups:   UnParseIDs(m.GroupIDs),
+		}
+		if err := g.addCopy(&m, targetID, req); err != nil {
+			return err
+		}
+	}
+
+	if err := m.RemoveNodeID(g.DB, sourceID); err != nil {
+		return err
+	}
+	return g.removeMediasFromNode([]models.Media{m}, sourceID)
+}
+
+// updateMigration stores the progress of the migration
+func (g *AppGateway) updateMigration(mg *models.Migration) {
+	if err := mg.Update(g.DB); err != nil {
+		log.WithFields(log.Fields{
+			"migration": mg.ID.Hex(),
+			"error":     err.Error(),
+		}).Error("could not update migration")
+	}
+}
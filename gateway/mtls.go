@@ -0,0 +1,241 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	_http "github.com/mirisbowring/primboard/helper/http"
+	"github.com/mirisbowring/primboard/helper/pki"
+	"github.com/mirisbowring/primboard/models"
+	"github.com/mirisbowring/primboard/models/maps"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// defaultCertValidity is the lifetime of the issued certificates if no
+// validity is configured
+const defaultCertValidity = 90 * 24 * time.Hour
+
+// mtls holds the ca and the certificate of the gateway
+type mtls struct {
+	ca      *pki.CA
+	keypair *pki.Keypair
+	clients *pki.Clients
+}
+
+// initializeMTLS loads (or creates) the ca of the certificates directory and
+// issues the certificate of the gateway
+func (g *AppGateway) initializeMTLS() {
+	if !g.Config.MTLS {
+		return
+	}
+	if g.Config.HTTP {
+		log.Fatal("mtls requires the gateway to serve https")
+	}
+	ca, err := pki.LoadOrCreateCA(g.Config.Certificates)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"certificates": g.Config.Certificates,
+			"error":        err.Error(),
+		}).Fatal("could not load certificate authority")
+	}
+	certPEM, keyPEM, err := ca.Issue(g.Config.Keycloak.ClientID, pki.RoleGateway, g.certValidity())
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Fatal("could not issue gateway certificate")
+	}
+	keypair, err := pki.NewKeypair(certPEM, keyPEM)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Fatal("could not load gateway certificate")
+	}
+	g.mtls = &mtls{
+		ca:      ca,
+		keypair: keypair,
+		clients: pki.NewClients(ca.Pool(), keypair),
+	}
+	go g.runCertificateRotation(time.Hour)
+}
+
+// certValidity returns the configured lifetime of the issued certificates
+func (g *AppGateway) certValidity() time.Duration {
+	if g.Config.CertValidity <= 0 {
+		return defaultCertValidity
+	}
+	return time.Duration(g.Config.CertValidity) * 24 * time.Hour
+}
+
+// runCertificateRotation renews the certificate of the gateway before it
+// expires
+func (g *AppGateway) runCertificateRotation(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !g.mtls.keypair.NeedsRenewal() {
+			continue
+		}
+		certPEM, keyPEM, err := g.mtls.ca.Issue(g.Config.Keycloak.ClientID, pki.RoleGateway, g.certValidity())
+		if err == nil {
+			err = g.mtls.keypair.Set(certPEM, keyPEM)
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Error("could not renew gateway certificate")
+			continue
+		}
+		log.Info("renewed gateway certificate")
+	}
+}
+
+// nodeClient returns the client, that is pinned to the certificate of the
+// node (or the default client without mtls). Tunneled nodes are reached
+// through their tunnel.
+func (g *AppGateway) nodeClient(nodeID primitive.ObjectID) *http.Client {
+	if client, ok := g.tunnelClient(nodeID); ok {
+		return client
+	}
+	if g.mtls == nil {
+		return g.HTTPClient
+	}
+	return g.mtls.clients.Client(pki.RoleNode, nodeID.Hex())
+}
+
+// verifyNodeCertificate verifies that the request presents the current (or
+// the previous) certificate of the node
+func (g *AppGateway) verifyNodeCertificate(r *http.Request, nodeID primitive.ObjectID) bool {
+	if g.mtls == nil {
+		return true
+	}
+	cert, ok := pki.PeerCertificate(r)
+	if !ok || !pki.HasRole(cert, pki.RoleNode) || cert.Subject.CommonName != nodeID.Hex() {
+		return false
+	}
+	node, ok := g.getNode(nodeID)
+	if !ok {
+		node = models.Node{ID: nodeID}
+		if err := node.GetNode(g.DB, bson.M{"_id": node.ID}, models.NodeProjectInternal); err != nil {
+			return false
+		}
+	}
+	return node.AcceptsCertificate(pki.Serial(cert))
+}
+
+// issueNodeCertificate creates a key and a certificate for the node and
+// revokes the previous certificates
+func (g *AppGateway) issueNodeCertificate(node *models.Node) (*models.CertificateBundle, error) {
+	if g.mtls == nil {
+		return nil, errors.New("mtls is not enabled")
+	}
+	certPEM, keyPEM, err := g.mtls.ca.Issue(node.ID.Hex(), pki.RoleNode, g.certValidity())
+	if err != nil {
+		return nil, err
+	}
+	if err := g.storeNodeCertificate(node, certPEM, false); err != nil {
+		return nil, err
+	}
+	return &models.CertificateBundle{
+		Certificate: string(certPEM),
+		Key:         string(keyPEM),
+		CA:          string(g.mtls.ca.PEM),
+	}, nil
+}
+
+// storeNodeCertificate stores the serial of the certificate at the node
+func (g *AppGateway) storeNodeCertificate(node *models.Node, certPEM []byte, keepPrevious bool) error {
+	cert, err := pki.ParseCertificate(certPEM)
+	if err != nil {
+		return err
+	}
+	if err := node.SetCertificate(g.DB, pki.Serial(cert), cert.NotAfter.Unix(), keepPrevious); err != nil {
+		return err
+	}
+	// the authenticated node must accept the new certificate as well
+	if n, ok := g.getNode(node.ID); ok {
+		n.CertSerial, n.PrevCertSerial, n.CertExpiry = node.CertSerial, node.PrevCertSerial, node.CertExpiry
+		g.setNode(&n)
+	}
+	return nil
+}
+
+// getCACertificate returns the pem encoded ca (e.g. to be trusted by the
+// browsers accessing the nodes)
+func (g *AppGateway) getCACertificate(w http.ResponseWriter, r *http.Request) {
+	if g.mtls == nil {
+		_http.RespondWithError(w, http.StatusNotFound, "mtls is not enabled")
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.WriteHeader(http.StatusOK)
+	w.Write(g.mtls.ca.PEM)
+}
+
+// renewNodeCertificate signs the certificate request of the node. The node
+// must present its current certificate.
+func (g *AppGateway) renewNodeCertificate(w http.ResponseWriter, r *http.Request) {
+	nodeID, ok := g.requireNodeClient(w, r)
+	if !ok {
+		return
+	}
+	if g.mtls == nil {
+		_http.RespondWithError(w, http.StatusNotFound, "mtls is not enabled")
+		return
+	}
+
+	var req maps.CertificateRequest
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&req); err != nil {
+		_http.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	node := models.Node{ID: nodeID}
+	if err := node.GetNode(g.DB, bson.M{"_id": node.ID}, models.NodeProjectInternal); err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not select node")
+		return
+	}
+	certPEM, err := g.mtls.ca.SignCSR([]byte(req.CSR), nodeID.Hex(), pki.RoleNode, g.certValidity())
+	if err != nil {
+		_http.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// the current certificate stays valid until the node uses the new one
+	if err := g.storeNodeCertificate(&node, certPEM, true); err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not store certificate")
+		return
+	}
+	log.WithFields(log.Fields{
+		"node":   nodeID.Hex(),
+		"expiry": time.Unix(node.CertExpiry, 0),
+	}).Info("renewed node certificate")
+	_http.RespondWithJSON(w, http.StatusOK, models.CertificateBundle{
+		Certificate: string(certPEM),
+		CA:          string(g.mtls.ca.PEM),
+	})
+}
+
+// reissueNodeCertificate creates a new key and certificate for the node and
+// revokes the previous ones (e.g. if the key has been lost)
+func (g *AppGateway) reissueNodeCertificate(w http.ResponseWriter, r *http.Request) {
+	id := parseID(w, r)
+	if id.IsZero() {
+		return
+	}
+	node := models.Node{ID: id}
+	if err := node.GetNode(g.DB, g.GetUserPermissionW(w, true), models.NodeProjectInternal); err != nil {
+		_http.RespondWithError(w, http.StatusNotFound, "Node not found")
+		return
+	}
+	bundle, err := g.issueNodeCertificate(&node)
+	if err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	_http.RespondWithJSON(w, http.StatusOK, bundle)
+}
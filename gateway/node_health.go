@@ -0,0 +1,112 @@
+package gateway
+
+import (
+	"errors"
+	"time"
+
+	"github.com/mirisbowring/primboard/models"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// defaultNodeTimeout is the time after which a node without heartbeat is
+// considered offline
+const defaultNodeTimeout = 90 * time.Second
+
+// errNodeUnavailable is returned if a node is not authenticated or offline
+var errNodeUnavailable = errors.New("node is not available")
+
+// getNode returns a copy of the authenticated node
+func (g *AppGateway) getNode(id primitive.ObjectID) (models.Node, bool) {
+	g.nodesMu.RLock()
+	defer g.nodesMu.RUnlock()
+	node, ok := g.Nodes[id]
+	if !ok || node == nil {
+		return models.Node{}, false
+	}
+	return *node, true
+}
+
+// isNodeOnline returns whether the node is authenticated and sends heartbeats
+func (g *AppGateway) isNodeOnline(id primitive.ObjectID) bool {
+	node, ok := g.getNode(id)
+	return ok && node.Status == models.NodeStatusOnline
+}
+
+// removeNode removes the node from the authenticated nodes
+func (g *AppGateway) removeNode(id primitive.ObjectID) {
+	g.nodesMu.Lock()
+	defer g.nodesMu.Unlock()
+	delete(g.Nodes, id)
+}
+
+// setNode adds or replaces the authenticated node
+func (g *AppGateway) setNode(node *models.Node) {
+	g.nodesMu.Lock()
+	defer g.nodesMu.Unlock()
+	g.Nodes[node.ID] = node
+}
+
+// monitorNodes marks all nodes without heartbeat within the timeout as
+// offline, removes them from the authenticated nodes and updates the
+// availability of the media
+func (g *AppGateway) monitorNodes(interval time.Duration) {
+	timeout := time.Duration(g.Config.NodeTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultNodeTimeout
+	}
+	// nodes of the previous run have to send a heartbeat first
+	g.checkNodes(timeout, true)
+	for range time.Tick(interval) {
+		g.checkNodes(timeout, false)
+	}
+}
+
+// checkNodes executes a single run of the node monitoring
+func (g *AppGateway) checkNodes(timeout time.Duration, force bool) {
+	since := time.Now().Add(-timeout)
+	changed, err := models.MarkStaleNodesOffline(g.DB, since)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Error("could not mark stale nodes offline")
+		return
+	}
+
+	g.nodesMu.Lock()
+	for id, node := range g.Nodes {
+		if node.LastSeen < since.Unix() {
+			log.WithFields(log.Fields{
+				"node":     id.Hex(),
+				"lastSeen": node.LastSeen,
+			}).Warn("node missed its heartbeats - marking offline")
+			delete(g.Nodes, id)
+		}
+	}
+	g.nodesMu.Unlock()
+
+	if changed > 0 || force {
+		g.refreshMediaAvailability()
+	}
+	// copies on offline nodes have to be replaced
+	if changed > 0 {
+		g.sweepReplication()
+	}
+}
+
+// refreshMediaAvailability flags the media, that is stored on offline nodes
+// only
+func (g *AppGateway) refreshMediaAvailability() {
+	offline, err := models.GetOfflineNodeIDs(g.DB)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Error("could not select offline nodes")
+		return
+	}
+	if err := models.UpdateMediaAvailability(g.DB, offline); err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Error("could not update media availability")
+	}
+}
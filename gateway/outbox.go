@@ -0,0 +1,213 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	_http "github.com/mirisbowring/primboard/helper/http"
+	"github.com/mirisbowring/primboard/models"
+	"github.com/mirisbowring/primboard/models/maps"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// outboxBatchSize limits the operations delivered per run
+const outboxBatchSize = 100
+
+// recordNodeOperations creates one operation per node and owner for the files
+// of the medias and triggers the delivery. If nodeID is set, only the
+// operation for this node is recorded. If groups is nil, the groups of the
+// media are used.
+func (g *AppGateway) recordNodeOperations(medias []models.Media, action string, groups []string, nodeID primitive.ObjectID) error {
+	type key struct {
+		node     primitive.ObjectID
+		username string
+	}
+	ops := make(map[key]*models.NodeOperation)
+	var order []key
+	for _, med := range medias {
+		mediaGroups := groups
+		if groups == nil {
+			mediaGroups = UnParseIDs(med.GroupIDs)
+		}
+		for _, node := range med.Nodes {
+			if !nodeID.IsZero() && nodeID != node.ID {
+				continue
+			}
+			k := key{node: node.ID, username: med.Creator}
+			op, ok := ops[k]
+			if !ok {
+				op = &models.NodeOperation{
+					NodeID:   node.ID,
+					Action:   action,
+					Username: med.Creator,
+					Groups:   mediaGroups,
+				}
+				ops[k] = op
+				order = append(order, k)
+			}
+			op.Filenames = append(op.Filenames, med.FileName)
+			op.MediaIDs = append(op.MediaIDs, med.ID)
+		}
+	}
+
+	records := make([]models.NodeOperation, len(order))
+	for i, k := range order {
+		records[i] = *ops[k]
+	}
+	if err := models.AddNodeOperations(g.DB, records); err != nil {
+		log.WithFields(log.Fields{
+			"action": action,
+			"error":  err.Error(),
+		}).Error("could not record node operations")
+		return err
+	}
+	g.notifyOutbox()
+	return nil
+}
+
+// notifyOutbox triggers the delivery of the pending operations
+func (g *AppGateway) notifyOutbox() {
+	select {
+	case g.outboxSignal <- struct{}{}:
+	default:
+	}
+}
+
+// runOutbox delivers the pending operations, when notified and periodically
+// for the retries
+func (g *AppGateway) runOutbox(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.outboxSignal:
+		case <-ticker.C:
+		}
+		g.deliverOutbox()
+	}
+}
+
+// deliverOutbox delivers all due operations of the online nodes
+func (g *AppGateway) deliverOutbox() {
+	for {
+		ops, err := models.GetDueNodeOperations(g.DB, g.onlineNodeIDs(), outboxBatchSize)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Error("could not select due node operations")
+			return
+		}
+		for i := range ops {
+			// stop on database errors, the same operations would be selected again
+			if err := g.deliverNodeOperation(&ops[i]); err != nil {
+				return
+			}
+		}
+		if len(ops) < outboxBatchSize {
+			return
+		}
+	}
+}
+
+// deliverNodeOperation sends the operation to its node. The operation is
+// acknowledged on success or retried for the failed files. Returns an error
+// if the outbox could not be updated.
+func (g *AppGateway) deliverNodeOperation(op *models.NodeOperation) error {
+	logfields := log.Fields{
+		"operation": op.ID.Hex(),
+		"node":      op.NodeID.Hex(),
+		"action":    op.Action,
+		"attempt":   op.Attempts + 1,
+	}
+
+	failed, err := g.sendNodeOperation(op)
+	if err == nil {
+		if err := op.Acknowledge(g.DB); err != nil {
+			logfields["error"] = err.Error()
+			log.WithFields(logfields).Error("could not acknowledge node operation")
+			return err
+		}
+		log.WithFields(logfields).Debug("delivered node operation")
+		return nil
+	}
+
+	logfields["error"] = err.Error()
+	if e := op.Retry(g.DB, failed, err.Error()); e != nil {
+		logfields["retryError"] = e.Error()
+		log.WithFields(logfields).Error("could not schedule retry of node operation")
+		return e
+	}
+	if op.Status == models.SyncStatusFailed {
+		log.WithFields(logfields).Error("node operation failed permanently")
+		return nil
+	}
+	log.WithFields(logfields).Warn("could not deliver node operation - retrying")
+	return nil
+}
+
+// sendNodeOperation executes the operation on the node. Returns the files,
+// that failed, if the node processed the operation partially.
+func (g *AppGateway) sendNodeOperation(op *models.NodeOperation) ([]string, error) {
+	node, ok := g.getNode(op.NodeID)
+	if !ok {
+		return nil, errNodeUnavailable
+	}
+
+	var endpoint string
+	body := new(bytes.Buffer)
+	switch op.Action {
+	case models.NodeOperationShare:
+		endpoint = fmt.Sprintf("%s/api/v1/files/%s/shares", node.APIEndpoint, op.Username)
+		json.NewEncoder(body).Encode(maps.FilesGroupsMap{Filenames: op.Filenames, Groups: op.Groups})
+	case models.NodeOperationUnshare:
+		endpoint = fmt.Sprintf("%s/api/v1/files/%s/shares/remove", node.APIEndpoint, op.Username)
+		json.NewEncoder(body).Encode(maps.FilesGroupsMap{Filenames: op.Filenames, Groups: op.Groups})
+	case models.NodeOperationDelete:
+		endpoint = fmt.Sprintf("%s/api/v1/files/%s/remove", node.APIEndpoint, op.Username)
+		json.NewEncoder(body).Encode(op.Filenames)
+	default:
+		return nil, fmt.Errorf("unknown action %s", op.Action)
+	}
+
+	// refresh keycloaktoken in neccessary
+	g.refreshServiceToken()
+
+	res, status, msg := _http.SendRequest(g.nodeClient(node.ID), http.MethodPost, endpoint, g.ServiceToken.AccessToken, body, "application/json")
+	if status > 0 {
+		return nil, errors.New(msg)
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+		return nil, nil
+	case 901:
+		// partially failed shares
+		var e struct {
+			Error   string                `json:"error"`
+			Payload []maps.FilesGroupsMap `json:"payload"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&e); err != nil {
+			return nil, errors.New("could not decode response body")
+		}
+		var files []string
+		for _, fail := range e.Payload {
+			files = append(files, fail.Filenames...)
+		}
+		return files, errors.New(e.Error)
+	case 902:
+		// partially failed deletions
+		var files []string
+		if err := json.NewDecoder(res.Body).Decode(&files); err != nil {
+			return nil, errors.New("could not decode response body")
+		}
+		return files, errors.New("could not delete all files")
+	default:
+		return nil, fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+}
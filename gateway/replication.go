@@ -0,0 +1,278 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	_http "github.com/mirisbowring/primboard/helper/http"
+	"github.com/mirisbowring/primboard/models"
+	"github.com/mirisbowring/primboard/models/maps"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// replicationQueueSize limits the pending replications (the sweep picks
+	// up dropped media)
+	replicationQueueSize = 1000
+	// replicationSweepPageSize is the number of media selected at once by the
+	// sweep
+	replicationSweepPageSize = 100
+)
+
+// errQuotaExceeded is returned if a copy would exceed the quota of the creator
+// on the target node
+var errQuotaExceeded = errors.New("quota exceeded on target node")
+
+// runReplication replicates the queued media and sweeps periodically for
+// media with missing copies
+func (g *AppGateway) runReplication(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case id := <-g.replicationQueue:
+			g.replicateMediaByID(id)
+		case <-ticker.C:
+			g.sweepReplication()
+		}
+	}
+}
+
+// enqueueReplication schedules the replication of the media
+func (g *AppGateway) enqueueReplication(ids ...primitive.ObjectID) {
+	for _, id := range ids {
+		select {
+		case g.replicationQueue <- id:
+		default:
+			log.WithFields(log.Fields{
+				"media": id.Hex(),
+			}).Warn("replication queue is full - media is replicated with the next sweep")
+			return
+		}
+	}
+}
+
+// sweepReplication replicates all media, that are stored on less healthy
+// nodes than their policies require. The media is paged by id, so every media
+// is visited once per sweep.
+func (g *AppGateway) sweepReplication() {
+	healthy := g.onlineNodeIDs()
+	var after primitive.ObjectID
+	for {
+		ids, err := models.GetUnderReplicatedMedia(g.DB, healthy, g.defaultReplicas(), after, replicationSweepPageSize)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Error("could not select under-replicated media")
+			return
+		}
+		for _, id := range ids {
+			g.replicateMediaByID(id)
+		}
+		if len(ids) < replicationSweepPageSize {
+			return
+		}
+		after = ids[len(ids)-1]
+	}
+}
+
+// defaultReplicas returns the replica count for media without policy
+func (g *AppGateway) defaultReplicas() int {
+	if g.Config.DefaultReplicas > 0 {
+		return g.Config.DefaultReplicas
+	}
+	return 1
+}
+
+// onlineNodeIDs returns the ids of all online nodes
+func (g *AppGateway) onlineNodeIDs() []primitive.ObjectID {
+	g.nodesMu.RLock()
+	defer g.nodesMu.RUnlock()
+	ids := []primitive.ObjectID{}
+	for id, node := range g.Nodes {
+		if node.Status == models.NodeStatusOnline {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// replicateMediaByID copies the media to further nodes until the replica
+// count of its policies is reached
+func (g *AppGateway) replicateMediaByID(id primitive.ObjectID) {
+	m := models.Media{ID: id}
+	if err := m.GetMedia(g.DB, bson.M{}, models.MediaProjectInternal); err != nil {
+		log.WithFields(log.Fields{
+			"media": id.Hex(),
+			"error": err.Error(),
+		}).Error("could not select media for replication")
+		return
+	}
+	replicas, err := m.ReplicaCount(g.DB, g.defaultReplicas())
+	if err != nil {
+		log.WithFields(log.Fields{
+			"media": id.Hex(),
+			"error": err.Error(),
+		}).Error("could not select replication policies")
+		return
+	}
+	g.replicateMedia(m, replicas)
+}
+
+// replicateMedia copies the media from one of its online nodes to the online
+// nodes of the creator with the most free space. Returns the number of
+// healthy copies.
+func (g *AppGateway) replicateMedia(m models.Media, replicas int) int {
+	logfields := log.Fields{
+		"media":    m.ID.Hex(),
+		"replicas": replicas,
+	}
+
+	var source *models.Node
+	holding := make(map[primitive.ObjectID]bool)
+	healthy := 0
+	for _, n := range m.Nodes {
+		holding[n.ID] = true
+		if node, ok := g.getNode(n.ID); ok && node.Status == models.NodeStatusOnline {
+			healthy++
+			if source == nil {
+				source = &node
+			}
+		}
+	}
+	if healthy >= replicas {
+		return healthy
+	}
+	if source == nil {
+		log.WithFields(logfields).Warn("media has no online node to replicate from")
+		return healthy
+	}
+
+	targets, err := g.replicationTargets(m.Creator, holding)
+	if err != nil {
+		logfields["error"] = err.Error()
+		log.WithFields(logfields).Error("could not select replication targets")
+		return healthy
+	}
+
+	req := maps.ReplicationRequest{
+		Source:   source.APIEndpoint,
+		SourceID: source.ID.Hex(),
+		Username: m.Creator,
+		Filename: m.FileName,
+		Sha1:     m.Sha1,
+		Size:     m.Size,
+		Groups:   UnParseIDs(m.GroupIDs),
+	}
+	for _, target := range targets {
+		if healthy >= replicas {
+			break
+		}
+		if err := g.addCopy(&m, target.ID, req); err != nil {
+			logfields["node"] = target.ID.Hex()
+			logfields["error"] = err.Error()
+			log.WithFields(logfields).Error("could not replicate media to node")
+			continue
+		}
+		healthy++
+	}
+
+	logfields["copies"] = healthy
+	if healthy < replicas {
+		log.WithFields(logfields).Warn("not enough nodes available to reach the replica count")
+	} else {
+		log.WithFields(logfields).Info("replicated media")
+	}
+	return healthy
+}
+
+// replicationTargets returns the online nodes of the user without the media
+// ordered by their free disk space
+func (g *AppGateway) replicationTargets(username string, exclude map[primitive.ObjectID]bool) ([]models.Node, error) {
+	nodes, err := models.GetReplicationTargets(g.DB, username)
+	if err != nil {
+		return nil, err
+	}
+	targets := []models.Node{}
+	for _, n := range nodes {
+		if exclude[n.ID] {
+			continue
+		}
+		if node, ok := g.getNode(n.ID); ok && node.Status == models.NodeStatusOnline {
+			targets = append(targets, node)
+		}
+	}
+	sort.SliceStable(targets, func(i, j int) bool {
+		return diskFree(targets[i]) > diskFree(targets[j])
+	})
+	return targets, nil
+}
+
+// diskFree returns the free space reported by the last heartbeat
+func diskFree(n models.Node) uint64 {
+	if n.Health == nil {
+		return 0
+	}
+	return n.Health.DiskFree
+}
+
+// addCopy copies the media to the target node and adds the node to the media.
+// The size of the copy is reserved from the quota of the creator until the
+// usage has been accounted.
+func (g *AppGateway) addCopy(m *models.Media, targetID primitive.ObjectID, req maps.ReplicationRequest) error {
+	target := models.Node{ID: targetID}
+	if err := target.GetNode(g.DB, bson.M{"_id": target.ID}, models.NodeProjectInternal); err != nil {
+		return err
+	}
+	res, err := g.reserveQuota(&target, m.Creator, m.Size, 1)
+	if err != nil {
+		return err
+	}
+	if res == nil {
+		return errQuotaExceeded
+	}
+	defer g.releaseReservation(target.ID, res)
+
+	if err := g.copyMediaToNode(target, req); err != nil {
+		return err
+	}
+	if err := m.AddNodeID(g.DB, target.ID); err != nil {
+		return err
+	}
+	g.accountUsage(m, 1, target.ID)
+	return nil
+}
+
+// copyMediaToNode instructs the target node to copy the file from the source
+// node (with urls signed by the gateway). The target verifies the sha1 of the
+// copy.
+func (g *AppGateway) copyMediaToNode(target models.Node, req maps.ReplicationRequest) error {
+	if err := g.signReplication(target, &req); err != nil {
+		return err
+	}
+	body := new(bytes.Buffer)
+	json.NewEncoder(body).Encode(req)
+
+	// refresh keycloaktoken in neccessary
+	g.refreshServiceToken()
+
+	endpoint := fmt.Sprintf("%s/api/v1/replicate", target.APIEndpoint)
+	res, status, msg := _http.SendRequest(g.nodeClient(target.ID), http.MethodPost, endpoint, g.ServiceToken.AccessToken, body, "application/json")
+	if status > 0 {
+		return fmt.Errorf("could not send request: %s", msg)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		var e _http.ErrorJSON
+		json.NewDecoder(res.Body).Decode(&e)
+		return fmt.Errorf("unexpected status code %d: %s", res.StatusCode, e.Error)
+	}
+	return nil
+}
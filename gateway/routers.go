@@ -10,9 +10,24 @@ import (
 // initializeRoutes initializes all the available webroutes
 func (g *AppGateway) initializeRoutes() {
 	g.Router = mux.NewRouter().StrictSlash(true)
+	// mutating requests are recorded in the audit log
+	g.Router.Use(g.audit)
 	// index
 	g.Router.HandleFunc("/api/v1/", g.index).Methods("GET")
 	g.Router.HandleFunc("/api/v2/", g.index).Methods("GET")
+	// auth (local identity provider)
+	g.Router.HandleFunc("/.well-known/openid-configuration", g.getOpenIDConfiguration).Methods("GET")
+	g.Router.HandleFunc("/api/v1/auth/ca", g.getCACertificate).Methods("GET")
+	g.Router.HandleFunc("/api/v1/auth/certs", g.getCerts).Methods("GET")
+	g.Router.HandleFunc("/api/v1/auth/introspect", g.introspect).Methods("POST")
+	g.Router.HandleFunc("/api/v1/auth/login", g.loginUser).Methods("POST")
+	g.Router.HandleFunc("/api/v1/auth/register", g.registerUser).Methods("POST")
+	g.Router.HandleFunc("/api/v1/auth/reset", g.resetPassword).Methods("POST")
+	g.Router.HandleFunc("/api/v1/auth/token", g.issueToken).Methods("POST")
+	// tunneled node content (authorized by the node)
+	g.Router.HandleFunc("/api/v1/tunnel/{id}/api/v1/file/{identifier}/{filename}", g.proxyNodeFile).Methods("GET", "HEAD")
+	// audit
+	g.Router.Handle("/api/v1/audit", g.Authenticate(http.HandlerFunc(g.getAuditLog), false)).Methods("GET")
 	// event
 	g.Router.Handle("/api/v1/event", g.Authenticate(http.HandlerFunc(g.AddEvent), false)).Methods("POST")
 	g.Router.Handle("/api/v1/event/{id}", g.Authenticate(http.HandlerFunc(g.DeleteEventByID), false)).Methods("DELETE")
@@ -21,19 +36,29 @@ func (g *AppGateway) initializeRoutes() {
 	g.Router.Handle("/api/v1/events", g.Authenticate(http.HandlerFunc(g.GetEvents), false)).Methods("GET")
 	g.Router.Handle("/api/v1/events/{title}", g.Authenticate(http.HandlerFunc(g.GetEventsByName), false)).Methods("GET")
 	g.Router.Handle("/api/v1/events/maptags", g.Authenticate(http.HandlerFunc(g.MapTagsToEvents), false)).Methods("GET")
+	// export
+	g.Router.Handle("/api/v1/export", g.Authenticate(http.HandlerFunc(g.exportMedia), false)).Methods("POST")
 	// media
 	g.Router.Handle("/api/v1/media", g.Authenticate(http.HandlerFunc(g.GetMedia), false)).Methods("GET")
 	g.Router.Handle("/api/v1/media", g.Authenticate(http.HandlerFunc(g.AddMedia), false)).Methods("POST")
-	g.Router.Handle("/api/v1/media/remove", g.Authenticate(http.HandlerFunc(g.deleteMediaByIDs), false)).Methods("POST")
+	g.Router.Handle("/api/v1/media/remove", g.AuthenticateIntrospect(http.HandlerFunc(g.deleteMediaByIDs))).Methods("POST")
+	g.Router.Handle("/api/v1/media/timeshift", g.Authenticate(http.HandlerFunc(g.shiftMediaTimestamps), false)).Methods("POST")
 	g.Router.Handle("/api/v1/media/upload", g.Authenticate(http.HandlerFunc(g.UploadMedia), false)).Methods("POST")
+	g.Router.Handle("/api/v1/media/geo", g.Authenticate(http.HandlerFunc(g.getMediaInBox), false)).Methods("GET")
+	g.Router.Handle("/api/v1/media/geocode", g.Authenticate(http.HandlerFunc(g.geocodeMedia), false)).Methods("POST")
+	g.Router.Handle("/api/v1/media/geo/clusters", g.Authenticate(http.HandlerFunc(g.getMediaClusters), false)).Methods("GET")
+	g.Router.Handle("/api/v1/media/bysha1s", g.Authenticate(http.HandlerFunc(g.getMediaBySha1s), false)).Methods("POST")
 	g.Router.Handle("/api/v1/media/byids", g.Authenticate(http.HandlerFunc(g.GetMediaByIDs), false)).Methods("GET")
 	g.Router.Handle("/api/v1/media/maptags", g.Authenticate(http.HandlerFunc(g.MapTagsToMedia), false)).Methods("POST")
 	g.Router.Handle("/api/v1/media/mapevents", g.Authenticate(http.HandlerFunc(g.MapEventsToMedia), false)).Methods("POST")
 	g.Router.Handle("/api/v1/media/addgroups", g.Authenticate(http.HandlerFunc(g.MapGroupsToMedia), false)).Methods("POST")
 	g.Router.Handle("/api/v1/media/removegroups", g.Authenticate(http.HandlerFunc(g.removeGroupsFromMedias), false)).Methods("POST")
+	g.Router.Handle("/api/v1/media/{id}/integrity", g.Authenticate(http.HandlerFunc(g.getMediaIntegrityReports), false)).Methods("GET")
+	g.Router.Handle("/api/v1/media/{id}/integrity/restore", g.AuthenticateIntrospect(http.HandlerFunc(g.restoreMedia))).Methods("POST")
+	g.Router.Handle("/api/v1/media/{id}/sync", g.Authenticate(http.HandlerFunc(g.getMediaNodeOperations), false)).Methods("GET")
 	g.Router.Handle("/api/v1/media/{id}/groups/{group}", g.Authenticate(http.HandlerFunc(g.removeGroupFromMedia), false)).Methods("DELETE")
-	g.Router.Handle("/api/v1/media/{id}", g.Authenticate(http.HandlerFunc(g.DeleteMediaByID), false)).Methods("DELETE")
-	g.Router.Handle("/api/v1/media/{id}/{node}", g.Authenticate(http.HandlerFunc(g.deleteMediaByIDFromNode), false)).Methods("DELETE")
+	g.Router.Handle("/api/v1/media/{id}", g.AuthenticateIntrospect(http.HandlerFunc(g.DeleteMediaByID))).Methods("DELETE")
+	g.Router.Handle("/api/v1/media/{id}/{node}", g.AuthenticateIntrospect(http.HandlerFunc(g.deleteMediaByIDFromNode))).Methods("DELETE")
 	g.Router.Handle("/api/v1/media/{id}", g.Authenticate(http.HandlerFunc(g.GetMediaByID), false)).Methods("GET")
 	// a.Router.Handle("/api/v1/media/{id}", a.Authenticate(http.HandlerFunc(a.UpdateMediaByID), false)).Methods("PUT")
 	g.Router.Handle("/api/v1/media/{id}/comment", g.Authenticate(http.HandlerFunc(g.AddCommentByMediaID), false)).Methods("POST")
@@ -41,6 +66,7 @@ func (g *AppGateway) initializeRoutes() {
 	g.Router.Handle("/api/v1/media/{id}/tag", g.Authenticate(http.HandlerFunc(g.AddTagByMediaID), false)).Methods("POST")
 	g.Router.Handle("/api/v1/media/{id}/tags", g.Authenticate(http.HandlerFunc(g.AddTagsByMediaID), false)).Methods("POST")
 	// g.Router.Handle("/api/v1/media/{id}/usergroups", g.Authenticate(http.HandlerFunc(g.AddUserGroupsByMediaID), false)).Methods("POST")
+	g.Router.Handle("/api/v1/media/{id}/location", g.Authenticate(http.HandlerFunc(g.AddLocationByMediaID), false)).Methods("PUT")
 	g.Router.Handle("/api/v1/media/{id}/timestamp", g.Authenticate(http.HandlerFunc(g.AddTimestampByMediaID), false)).Methods("PUT")
 	g.Router.Handle("/api/v1/media/{id}/title", g.Authenticate(http.HandlerFunc(g.AddTitleByMediaID), false)).Methods("PUT")
 	g.Router.Handle("/api/v1/mediaByHash/{ipfs_id}", g.Authenticate(http.HandlerFunc(g.UpdateMediaByHash), false)).Methods("PUT")
@@ -52,38 +78,71 @@ func (g *AppGateway) initializeRoutes() {
 	g.Router.Handle("/api/v1/tags", g.Authenticate(http.HandlerFunc(g.GetTags), false)).Methods("GET")
 	g.Router.Handle("/api/v1/tags/{name}", g.Authenticate(http.HandlerFunc(g.GetTagsByName), false)).Methods("GET")
 	// user
-	// g.Router.HandleFunc("/api/v1/user", g.CreateUser).Methods("POST")
-	g.Router.Handle("/api/v1/user/invite", g.Authenticate(http.HandlerFunc(g.GenerateInvite), false)).Methods("GET")
-	g.Router.Handle("/api/v1/user/node", g.Authenticate(http.HandlerFunc(g.AddNode), false)).Methods("POST")
-	g.Router.Handle("/api/v1/user/node/{id}", g.Authenticate(http.HandlerFunc(g.DeleteNodeByID), false)).Methods("DELETE")
+	g.Router.Handle("/api/v1/user", g.Authenticate(http.HandlerFunc(g.getProfile), false)).Methods("GET")
+	g.Router.Handle("/api/v1/user", g.Authenticate(http.HandlerFunc(g.updateProfile), false)).Methods("PUT")
+	g.Router.Handle("/api/v1/user/invite", g.AuthenticateIntrospect(http.HandlerFunc(g.GenerateInvite))).Methods("GET")
+	g.Router.Handle("/api/v1/user/invite", g.AuthenticateIntrospect(http.HandlerFunc(g.GenerateInvite))).Methods("POST")
+	g.Router.Handle("/api/v1/user/invite/{id}", g.AuthenticateIntrospect(http.HandlerFunc(g.revokeInvite))).Methods("DELETE")
+	g.Router.Handle("/api/v1/user/invites", g.Authenticate(http.HandlerFunc(g.getInvites), false)).Methods("GET")
+	g.Router.Handle("/api/v1/user/node", g.AuthenticateIntrospect(http.HandlerFunc(g.AddNode))).Methods("POST")
+	g.Router.Handle("/api/v1/user/node/{id}", g.AuthenticateIntrospect(http.HandlerFunc(g.DeleteNodeByID))).Methods("DELETE")
 	g.Router.Handle("/api/v1/user/node/{id}", g.Authenticate(http.HandlerFunc(g.GetNodeByID), false)).Methods("GET")
-	g.Router.Handle("/api/v1/user/node/{id}", g.Authenticate(http.HandlerFunc(g.UpdateNodeByID), false)).Methods("PUT")
-	g.Router.Handle("/api/v1/user/node/{id}", g.Authenticate(http.HandlerFunc(g.addGroupsToNode), false)).Methods("POST").Queries("groups", "{groups}")
+	g.Router.Handle("/api/v1/user/node/{id}", g.AuthenticateIntrospect(http.HandlerFunc(g.UpdateNodeByID))).Methods("PUT")
+	g.Router.Handle("/api/v1/user/node/{id}", g.AuthenticateIntrospect(http.HandlerFunc(g.addGroupsToNode))).Methods("POST").Queries("groups", "{groups}")
+	g.Router.Handle("/api/v1/user/node/{id}/stats", g.Authenticate(http.HandlerFunc(g.getNodeStatsByID), false)).Methods("GET")
+	g.Router.Handle("/api/v1/user/node/{id}/certificate", g.AuthenticateIntrospect(http.HandlerFunc(g.reissueNodeCertificate))).Methods("POST")
+	g.Router.Handle("/api/v1/user/node/{id}/migrate", g.AuthenticateIntrospect(http.HandlerFunc(g.migrateNode))).Methods("POST")
+	g.Router.Handle("/api/v1/user/node/{id}/migrations", g.Authenticate(http.HandlerFunc(g.getNodeMigrations), false)).Methods("GET")
+	g.Router.Handle("/api/v1/user/node/{id}/quota", g.AuthenticateIntrospect(http.HandlerFunc(g.setNodeQuota))).Methods("PUT")
+	g.Router.Handle("/api/v1/user/node/{id}/usage", g.Authenticate(http.HandlerFunc(g.getNodeUsage), false)).Methods("GET")
 	g.Router.Handle("/api/v1/user/nodes", g.Authenticate(http.HandlerFunc(g.GetNodes), false)).Methods("GET")
+	g.Router.Handle("/api/v1/user/nodes/stats", g.Authenticate(http.HandlerFunc(g.getNodeStats), false)).Methods("GET")
 	// g.Router.Handle("/api/v1/user/nodes/removegroups", g.Authenticate(http.HandlerFunc(g.MapGroupsToMedia), false)).Methods("POST")
-	// g.Router.Handle("/api/v1/user/{username}", g.Authenticate(http.HandlerFunc(g.DeleteUser), false)).Methods("DELETE")
-	// g.Router.Handle("/api/v1/user/{username}", g.Authenticate(http.HandlerFunc(g.GetUserByUsername), false)).Methods("GET")
-	// g.Router.Handle("/api/v1/user/{username}/settings", g.Authenticate(http.HandlerFunc(g.GetSettingsByUsername), false)).Methods("GET")
-	// // g.Router.HandleFunc("/api/v1/login", g.LoginUser).Methods("POST")
-	// g.Router.Handle("/api/v1/logout", g.Authenticate(http.HandlerFunc(g.LogoutUser), true)).Methods("POST")
-	// g.Router.Handle("/api/v1/user/{username}", g.Authenticate(http.HandlerFunc(g.UpdateUser), false)).Methods("PUT")
+	g.Router.Handle("/api/v1/user/tokens", g.AuthenticateIntrospect(http.HandlerFunc(g.createAccessToken))).Methods("POST")
+	g.Router.Handle("/api/v1/user/tokens", g.Authenticate(http.HandlerFunc(g.getAccessTokens), false)).Methods("GET")
+	g.Router.Handle("/api/v1/user/tokens/{id}", g.AuthenticateIntrospect(http.HandlerFunc(g.revokeAccessToken))).Methods("DELETE")
+	g.Router.Handle("/api/v1/user/password", g.AuthenticateIntrospect(http.HandlerFunc(g.changePassword))).Methods("PUT")
+	g.Router.Handle("/api/v1/user/{username}/reset", g.AuthenticateIntrospect(http.HandlerFunc(g.createResetToken))).Methods("POST")
+	// integrity
+	g.Router.Handle("/api/v1/integrity", g.Authenticate(http.HandlerFunc(g.getIntegrityReports), false)).Methods("GET")
+	// node operations
+	g.Router.Handle("/api/v1/sync", g.Authenticate(http.HandlerFunc(g.getNodeOperations), false)).Methods("GET")
+	g.Router.Handle("/api/v1/sync/retry", g.Authenticate(http.HandlerFunc(g.retryNodeOperations), false)).Methods("POST")
+	// replication
+	g.Router.Handle("/api/v1/replication", g.Authenticate(http.HandlerFunc(g.getReplicationPolicies), false)).Methods("GET")
+	g.Router.Handle("/api/v1/replication", g.Authenticate(http.HandlerFunc(g.setReplicationPolicy), false)).Methods("PUT")
+	g.Router.Handle("/api/v1/replication", g.Authenticate(http.HandlerFunc(g.deleteReplicationPolicy), false)).Methods("DELETE")
+	// usage
+	g.Router.Handle("/api/v1/usage", g.Authenticate(http.HandlerFunc(g.getUsage), false)).Methods("GET")
 	// usergroup
-	g.Router.Handle("/api/v1/usergroup", g.Authenticate(http.HandlerFunc(g.AddUserGroup), false)).Methods("POST")
+	g.Router.Handle("/api/v1/usergroup", g.AuthenticateIntrospect(http.HandlerFunc(g.AddUserGroup))).Methods("POST")
 	g.Router.Handle("/api/v1/usergroups", g.Authenticate(http.HandlerFunc(g.GetUserGroups), false)).Methods("GET")
 	g.Router.Handle("/api/v1/usergroups/{name}", g.Authenticate(http.HandlerFunc(g.GetUserGroupsByName), false)).Methods("GET")
 	g.Router.Handle("/api/v1/usergroup/{id}", g.Authenticate(http.HandlerFunc(g.DeleteUserGroupByID), false)).Methods("DELETE")
 	g.Router.Handle("/api/v1/usergroup/{id}", g.Authenticate(http.HandlerFunc(g.GetUserGroupByID), false)).Methods("GET")
 	g.Router.Handle("/api/v1/usergroup/{id}", g.Authenticate(http.HandlerFunc(g.UpdateUserGroupByID), false)).Methods("PUT")
+	g.Router.Handle("/api/v1/usergroup/{id}/quota", g.Authenticate(http.HandlerFunc(g.setUserGroupQuota), false)).Methods("PUT")
+	g.Router.Handle("/api/v1/usergroup/{id}/replication", g.Authenticate(http.HandlerFunc(g.setUserGroupReplicationPolicy), false)).Methods("PUT")
+	g.Router.Handle("/api/v1/usergroup/{id}/replication", g.Authenticate(http.HandlerFunc(g.deleteUserGroupReplicationPolicy), false)).Methods("DELETE")
 	g.Router.Handle("/api/v1/usergroup/{id}/user/{username}", g.Authenticate(http.HandlerFunc(g.RemoveUserFromUserGroupByID), false)).Methods("DELETE")
 	g.Router.Handle("/api/v1/usergroup/{id}/user/{username}", g.Authenticate(http.HandlerFunc(g.AddUserToUserGroupByID), false)).Methods("POST")
+	g.Router.Handle("/api/v1/usergroup/{id}/user/{username}/role/{role}", g.Authenticate(http.HandlerFunc(g.setUserGroupRole), false)).Methods("PUT")
 	g.Router.Handle("/api/v1/usergroup/{id}/users", g.Authenticate(http.HandlerFunc(g.RemoveUsersFromUserGroupByID), false)).Methods("DELETE")
 	g.Router.Handle("/api/v1/usergroup/{id}/users", g.Authenticate(http.HandlerFunc(g.AddUsersToUserGroupByID), false)).Methods("POST")
 	// infrastructure
 	g.Router.Handle("/api/v2/infrastructure/node/authenticate", g.Authenticate(http.HandlerFunc(g.authenticateNode), false)).Methods("POST")
+	g.Router.Handle("/api/v2/infrastructure/node/tunnel", g.Authenticate(http.HandlerFunc(g.openNodeTunnel), false)).Methods("GET")
+	g.Router.Handle("/api/v2/infrastructure/node/heartbeat", g.Authenticate(http.HandlerFunc(g.nodeHeartbeat), false)).Methods("POST")
 	g.Router.Handle("/api/v2/infrastructure/node/register", g.Authenticate(http.HandlerFunc(g.registerNode), false)).Methods("GET")
 	g.Router.Handle("/api/v2/infrastructure/node/{id}/secret", g.Authenticate(http.HandlerFunc(g.retrieveNodeSecret), false)).Methods("GET")
 	g.Router.Handle("/api/v2/infrastructure/node/{id}/secret/refresh", g.Authenticate(http.HandlerFunc(g.refreshNodeSecret), false)).Methods("GET").Queries("return", "{return}")
-	g.Router.Handle("/api/v2/infrastructure/node/{id}/structure", g.Authenticate(http.HandlerFunc(g.parseNodeStructure), false)).Methods("GET").Queries("page", "{page}", "size", "{size}")
+	g.Router.Handle("/api/v2/infrastructure/node/{id}/certificate", g.Authenticate(http.HandlerFunc(g.renewNodeCertificate), false)).Methods("POST")
+	g.Router.Handle("/api/v2/infrastructure/node/{id}/integrity", g.Authenticate(http.HandlerFunc(g.reportIntegrityFailures), false)).Methods("POST")
+	g.Router.Handle("/api/v2/infrastructure/node/{id}/quota", g.Authenticate(http.HandlerFunc(g.checkQuota), false)).Methods("POST")
+	g.Router.Handle("/api/v2/infrastructure/node/{id}/quota/{reservation}", g.Authenticate(http.HandlerFunc(g.releaseQuota), false)).Methods("DELETE")
+	g.Router.Handle("/api/v2/infrastructure/node/{id}/peer/{peer}", g.Authenticate(http.HandlerFunc(g.getPeerEndpoint), false)).Methods("GET")
+	g.Router.Handle("/api/v2/infrastructure/node/{id}/missing", g.Authenticate(http.HandlerFunc(g.reportMissingMedia), false)).Methods("POST")
+	g.Router.Handle("/api/v2/infrastructure/node/{id}/structure", g.Authenticate(http.HandlerFunc(g.parseNodeStructure), false)).Methods("GET").Queries("size", "{size}")
 }
 
 // Index controller
@@ -2,8 +2,10 @@ package gateway
 
 import (
 	"net/http"
+	"time"
 
 	iModels "github.com/mirisbowring/primboard/internal/models"
+	log "github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 )
@@ -11,17 +13,53 @@ import (
 // NewSession initializes a new Session (if not exists) for the passed user
 // otherwise it updates the token
 func (g *AppGateway) NewSession(user string, db *mongo.Database, token string) *iModels.Session {
-	s := g.GetSessionByUser(user)
-	s.NodeTokenMap = make(map[primitive.ObjectID]string)
-	s.Token = token
-	if s.User == "" {
-		s.User = user
+	s := g.Sessions.GetByUser(user)
+	if s == nil {
+		s = &iModels.Session{User: user}
 		s.InitUserGroups(db, user)
-		g.Sessions = append(g.Sessions, s)
 	}
+	s.NodeTokenMap = make(map[primitive.ObjectID]string)
+	s.Token = token
+	g.Sessions.Put(s)
 	return s
 }
 
+// refreshSessionGroups reselects the usergroups of the sessions of the passed
+// users (e.g. after the membership or a role has changed)
+func (g *AppGateway) refreshSessionGroups(users ...string) {
+	for _, user := range users {
+		s := g.Sessions.GetByUser(user)
+		if s == nil {
+			continue
+		}
+		s.InitUserGroups(g.DB, user)
+		g.Sessions.Put(s)
+	}
+}
+
+// initializeSessionStore creates the configured session store and starts the
+// eviction of expired sessions
+func (g *AppGateway) initializeSessionStore() {
+	ttl := time.Duration(g.Config.SessionTTL) * time.Minute
+	switch g.Config.SessionStore {
+	case "", "memory":
+		g.Sessions = iModels.NewMemorySessionStore(ttl)
+	case "mongo":
+		store, err := iModels.NewMongoSessionStore(g.DB, ttl)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Fatal("could not initialize mongo session store")
+		}
+		g.Sessions = store
+	default:
+		log.WithFields(log.Fields{
+			"store": g.Config.SessionStore,
+		}).Fatal("unknown session store specified")
+	}
+	go iModels.RunEviction(g.Sessions, time.Minute)
+}
+
 // CloseSession deletes the token/session pair from cache and lets the cookie expire
 // func (g *AppGateway) CloseSession(w *http.ResponseWriter, r *http.Request) {
 // 	token := g.ReadSessionCookie(w, r)
@@ -48,27 +86,19 @@ func (g *AppGateway) GetSessionByUser(user string) *iModels.Session {
 
 // GetSessionByUsername returns the session for the passed username if exist
 func (g *AppGateway) GetSessionByUsername(user string) *iModels.Session {
-	// skip iteration if passed argument is invalid
+	// skip lookup if passed argument is invalid
 	if user == "" {
 		return new(iModels.Session)
 	}
-	// iterate over cached sessions
-	for _, v := range g.Sessions {
-		if v.User == user && v.User != "" {
-			return v
-		}
+	if s := g.Sessions.GetByUser(user); s != nil {
+		return s
 	}
 	return new(iModels.Session)
 }
 
 // GetSession returns the session object for the passed token
 func (g *AppGateway) GetSession(token string) *iModels.Session {
-	for _, s := range g.Sessions {
-		if s.Token == token {
-			return s
-		}
-	}
-	return nil
+	return g.Sessions.Get(token)
 }
 
 // SetSessionCookie renews the session attributes and adds the token to the cookie
@@ -98,24 +128,7 @@ func (g *AppGateway) ReadSessionCookie(w *http.ResponseWriter, r *http.Request)
 }
 
 // RemoveSessionByToken finds the session with the given token and removes it
-// from the cached session slice
+// from the session store
 func (g *AppGateway) RemoveSessionByToken(token string) {
-	g.Sessions = removeToken(g.Sessions, token)
-}
-
-// RemoveToken finds the entry with the passed token and deletes it
-func removeToken(ss []*iModels.Session, token string) []*iModels.Session {
-	for index, s := range ss {
-		if s.Token == token {
-			return remove(ss, index)
-		}
-	}
-	return ss
-}
-
-// Remove deletes the item from the slice at the passed index
-func remove(ss []*iModels.Session, index int) []*iModels.Session {
-	ss[index] = ss[len(ss)-1]
-	ss[len(ss)-1] = new(iModels.Session)
-	return ss[:len(ss)-1]
+	g.Sessions.RemoveByToken(token)
 }
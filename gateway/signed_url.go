@@ -0,0 +1,119 @@
+package gateway
+
+import (
+	"errors"
+	"time"
+
+	"github.com/mirisbowring/primboard/helper/urlsign"
+	"github.com/mirisbowring/primboard/internal/handler"
+	"github.com/mirisbowring/primboard/models"
+	"github.com/mirisbowring/primboard/models/maps"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// defaultSignedURLTTL is the lifetime of the signed file urls if no ttl is
+// configured
+const defaultSignedURLTTL = 15 * time.Minute
+
+// signedURLTTL returns the configured lifetime of the signed file urls
+func (g *AppGateway) signedURLTTL() time.Duration {
+	if g.Config.SignedURLTTL <= 0 {
+		return defaultSignedURLTTL
+	}
+	return time.Duration(g.Config.SignedURLTTL) * time.Minute
+}
+
+// signMediaURLs sets the signed urls of the original and the thumbnail of
+// every media. The user must be authorized for the media already.
+func (g *AppGateway) signMediaURLs(media []models.Media, username string) {
+	expires := urlsign.Expiry(time.Now(), g.signedURLTTL())
+	for i := range media {
+		g.signMediaURL(&media[i], username, expires)
+	}
+}
+
+// signMediaURL signs the urls of the media for the first online node, that
+// stores it
+func (g *AppGateway) signMediaURL(m *models.Media, username string, expires int64) {
+	if m.FileName == "" || m.Creator == "" {
+		return
+	}
+	thumb := m.FileNameThumb
+	if thumb == "" {
+		var status int
+		if thumb, status = handler.ParseThumbnailName(m.FileName); status > 0 {
+			return
+		}
+	}
+	node, ok := g.signingNode(m)
+	if !ok {
+		return
+	}
+	key, err := urlsign.DecodeKey(node.SigningKey)
+	if err != nil {
+		return
+	}
+	claims := urlsign.Claims{
+		Identifier: m.Creator,
+		Filename:   m.FileName,
+		Username:   username,
+		Expires:    expires,
+	}
+	endpoint := g.nodeEndpoint(node)
+	m.URL = urlsign.URL(endpoint, key, claims)
+	claims.Filename = thumb
+	claims.Thumb = true
+	m.URLThumb = urlsign.URL(endpoint, key, claims)
+}
+
+// signingNode returns the first online node of the media, that has a signing
+// key
+func (g *AppGateway) signingNode(m *models.Media) (models.Node, bool) {
+	ids := m.NodeIDs
+	if len(ids) == 0 {
+		ids = make([]primitive.ObjectID, len(m.Nodes))
+		for i, n := range m.Nodes {
+			ids[i] = n.ID
+		}
+	}
+	for _, id := range ids {
+		node, ok := g.getNode(id)
+		if ok && node.SigningKey != "" && g.nodeEndpoint(node) != "" && g.isNodeOnline(id) {
+			return node, true
+		}
+	}
+	return models.Node{}, false
+}
+
+// signReplication sets the urls of the file and its thumbnail on the source
+// node, that the target node is allowed to copy. The urls are signed for the
+// target node.
+func (g *AppGateway) signReplication(target models.Node, req *maps.ReplicationRequest) error {
+	sourceID, err := primitive.ObjectIDFromHex(req.SourceID)
+	if err != nil {
+		return err
+	}
+	source, ok := g.getNode(sourceID)
+	if !ok || source.SigningKey == "" {
+		return errors.New("source node has no signing key")
+	}
+	key, err := urlsign.DecodeKey(source.SigningKey)
+	if err != nil {
+		return err
+	}
+	thumb, status := handler.ParseThumbnailName(req.Filename)
+	if status > 0 {
+		return errors.New("could not parse thumbnail name")
+	}
+	claims := urlsign.Claims{
+		Identifier: req.Username,
+		Filename:   req.Filename,
+		Username:   target.ID.Hex(),
+		Expires:    urlsign.Expiry(time.Now(), g.signedURLTTL()),
+	}
+	req.URL = urlsign.URL(source.APIEndpoint, key, claims)
+	claims.Filename = thumb
+	claims.Thumb = true
+	req.URLThumb = urlsign.URL(source.APIEndpoint, key, claims)
+	return nil
+}
@@ -0,0 +1,223 @@
+package gateway
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"time"
+
+	_http "github.com/mirisbowring/primboard/helper/http"
+	"github.com/mirisbowring/primboard/helper/urlsign"
+	"github.com/mirisbowring/primboard/models"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/net/http2"
+)
+
+const (
+	// tunnelHost is the host of the requests sent through a tunnel (the node
+	// does not verify it)
+	tunnelHost = "node"
+	// tunnelPingInterval is the interval the tunnels are checked in
+	tunnelPingInterval = 30 * time.Second
+)
+
+// bufferedConn reads the data, that has been buffered before the connection
+// has been hijacked, first
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// tunnelTransport sends the requests through the tunnel of a node
+type tunnelTransport struct {
+	cc *http2.ClientConn
+}
+
+// RoundTrip implements http.RoundTripper
+func (t tunnelTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	u := *req.URL
+	u.Scheme = "https"
+	u.Host = tunnelHost
+	r := req.WithContext(req.Context())
+	r.URL = &u
+	r.Host = tunnelHost
+	return t.cc.RoundTrip(r)
+}
+
+// getTunnel returns the open tunnel of the node
+func (g *AppGateway) getTunnel(id primitive.ObjectID) (*http2.ClientConn, bool) {
+	g.tunnelsMu.RLock()
+	defer g.tunnelsMu.RUnlock()
+	cc, ok := g.tunnels[id]
+	return cc, ok
+}
+
+// setTunnel stores the tunnel of the node and closes the previous one
+func (g *AppGateway) setTunnel(id primitive.ObjectID, cc *http2.ClientConn) {
+	g.tunnelsMu.Lock()
+	defer g.tunnelsMu.Unlock()
+	if g.tunnels == nil {
+		g.tunnels = make(map[primitive.ObjectID]*http2.ClientConn)
+	}
+	if prev, ok := g.tunnels[id]; ok {
+		prev.Close()
+	}
+	g.tunnels[id] = cc
+}
+
+// removeTunnel removes the tunnel of the node, if it has not been replaced
+func (g *AppGateway) removeTunnel(id primitive.ObjectID, cc *http2.ClientConn) {
+	g.tunnelsMu.Lock()
+	defer g.tunnelsMu.Unlock()
+	if g.tunnels[id] == cc {
+		delete(g.tunnels, id)
+	}
+	cc.Close()
+}
+
+// tunnelClient returns a client, that sends the requests through the tunnel
+// of the node
+func (g *AppGateway) tunnelClient(id primitive.ObjectID) (*http.Client, bool) {
+	cc, ok := g.getTunnel(id)
+	if !ok {
+		return nil, false
+	}
+	return &http.Client{Transport: tunnelTransport{cc: cc}}, true
+}
+
+// nodeEndpoint returns the endpoint the clients reach the node at. Tunneled
+// nodes are proxied by the gateway.
+func (g *AppGateway) nodeEndpoint(node models.Node) string {
+	if _, ok := g.getTunnel(node.ID); ok && g.Config.PublicURL != "" {
+		return fmt.Sprintf("%s/api/v1/tunnel/%s", strings.TrimSuffix(g.Config.PublicURL, "/"), node.ID.Hex())
+	}
+	return node.APIEndpoint
+}
+
+// openNodeTunnel upgrades the request of the node to a tunnel. The gateway
+// sends http/2 requests to the node through the connection.
+func (g *AppGateway) openNodeTunnel(w http.ResponseWriter, r *http.Request) {
+	nodeID, err := primitive.ObjectIDFromHex(w.Header().Get("clientID"))
+	if err != nil {
+		_http.RespondWithError(w, http.StatusForbidden, "only nodes may open a tunnel")
+		return
+	}
+	if _, ok := g.getNode(nodeID); !ok {
+		node := models.Node{ID: nodeID}
+		if err := node.GetNode(g.DB, bson.M{"_id": node.ID}, models.NodeProjectInternal); err != nil {
+			_http.RespondWithError(w, http.StatusForbidden, "only nodes may open a tunnel")
+			return
+		}
+	}
+	if !strings.EqualFold(r.Header.Get("Upgrade"), _http.TunnelProtocol) {
+		_http.RespondWithError(w, http.StatusBadRequest, "unsupported upgrade protocol")
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		_http.RespondWithError(w, http.StatusInternalServerError, "connection cannot be upgraded")
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, "connection cannot be upgraded")
+		return
+	}
+
+	logfields := log.Fields{
+		"node":   nodeID.Hex(),
+		"source": r.RemoteAddr,
+	}
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\n", _http.TunnelProtocol)
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+	cc, err := (&http2.Transport{}).NewClientConn(&bufferedConn{Conn: conn, r: rw.Reader})
+	if err != nil {
+		logfields["error"] = err.Error()
+		log.WithFields(logfields).Error("could not open tunnel")
+		conn.Close()
+		return
+	}
+	g.setTunnel(nodeID, cc)
+	log.WithFields(logfields).Info("opened node tunnel")
+	go g.watchTunnel(nodeID, cc)
+}
+
+// watchTunnel pings the node through the tunnel and removes the tunnel once
+// the node does not answer anymore
+func (g *AppGateway) watchTunnel(id primitive.ObjectID, cc *http2.ClientConn) {
+	ticker := time.NewTicker(tunnelPingInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), tunnelPingInterval/2)
+		err := cc.Ping(ctx)
+		cancel()
+		if err != nil {
+			g.removeTunnel(id, cc)
+			log.WithFields(log.Fields{
+				"node":  id.Hex(),
+				"error": err.Error(),
+			}).Info("closed node tunnel")
+			return
+		}
+	}
+}
+
+// proxyNodeFile streams the file request of a client through the tunnel of
+// the node. Only signed urls are proxied, the node verifies the signature.
+// The credentials of the client are never forwarded, because the node trusts
+// the requests of the tunnel like those of the gateway.
+func (g *AppGateway) proxyNodeFile(w http.ResponseWriter, r *http.Request) {
+	id := parseID(w, r)
+	if id.IsZero() {
+		return
+	}
+	if r.URL.Query().Get(urlsign.ParamSignature) == "" {
+		_http.RespondWithError(w, http.StatusForbidden, "only signed urls may be requested through a tunnel")
+		return
+	}
+	cc, ok := g.getTunnel(id)
+	if !ok {
+		_http.RespondWithError(w, http.StatusBadGateway, "node is not connected")
+		return
+	}
+	prefix := fmt.Sprintf("/api/v1/tunnel/%s", id.Hex())
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Path = strings.TrimPrefix(req.URL.Path, prefix)
+			req.URL.RawPath = ""
+			req.Header.Del("Authorization")
+			req.Header.Del("Cookie")
+		},
+		Transport: tunnelTransport{cc: cc},
+		// the cors headers are set by the gateway
+		ModifyResponse: func(res *http.Response) error {
+			for key := range res.Header {
+				if strings.HasPrefix(key, "Access-Control-") {
+					res.Header.Del(key)
+				}
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.WithFields(log.Fields{
+				"node":  id.Hex(),
+				"error": err.Error(),
+			}).Error("could not proxy request to node")
+			_http.RespondWithError(w, http.StatusBadGateway, "could not reach node")
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
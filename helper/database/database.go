@@ -105,3 +105,16 @@ func ManageField(db *mongo.Database, collection string, filter *bson.M, value *b
 	}
 	return 0
 }
+
+// IsDuplicateKeyError checks whether the error has been caused by a unique
+// index
+func IsDuplicateKeyError(err error) bool {
+	if we, ok := err.(mongo.WriteException); ok {
+		for _, e := range we.WriteErrors {
+			if e.Code == 11000 {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,321 @@
+package helper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// exifDateLayout is the layout used for all exif date fields
+const exifDateLayout = "2006:01:02 15:04:05"
+
+// exif tags that are evaluated
+const (
+	exifTagMake               = 0x010F
+	exifTagModel              = 0x0110
+	exifTagDateTime           = 0x0132
+	exifTagExifIFD            = 0x8769
+	exifTagGPSIFD             = 0x8825
+	exifTagGPSLatitudeRef     = 0x0001
+	exifTagGPSLatitude        = 0x0002
+	exifTagGPSLongitudeRef    = 0x0003
+	exifTagGPSLongitude       = 0x0004
+	exifTagDateTimeOriginal   = 0x9003
+	exifTagOffsetTime         = 0x9010
+	exifTagOffsetTimeOriginal = 0x9011
+)
+
+// Exif holds the subset of exif metadata that is used by primboard
+type Exif struct {
+	Make               string
+	Model              string
+	DateTime           string
+	DateTimeOriginal   string
+	OffsetTime         string
+	OffsetTimeOriginal string
+	Latitude           float64
+	Longitude          float64
+	HasGPS             bool
+}
+
+// exifParser walks the ifds of a tiff structure
+type exifParser struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+// ReadExif parses the exif metadata of a jpeg or tiff file. The reader is
+// rewinded to its start afterwards.
+func ReadExif(rs io.ReadSeeker) (*Exif, error) {
+	defer rs.Seek(0, io.SeekStart)
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	// read the header to identify the file type
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(rs, header); err != nil {
+		return nil, err
+	}
+
+	var tiff []byte
+	var err error
+	switch {
+	case header[0] == 0xFF && header[1] == 0xD8:
+		// jpeg -> exif is stored in the APP1 segment
+		if _, err = rs.Seek(2, io.SeekStart); err != nil {
+			return nil, err
+		}
+		tiff, err = readJPEGExifSegment(rs)
+	case bytes.Equal(header, []byte("II*\x00")) || bytes.Equal(header, []byte("MM\x00*")):
+		// tiff based raw formats -> the file itself is the tiff structure
+		if _, err = rs.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		// the ifds of interest are within the first megabyte
+		tiff, err = readAtMost(rs, 1<<20)
+	default:
+		return nil, errors.New("file type does not support exif")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return parseTIFF(tiff)
+}
+
+// readJPEGExifSegment iterates over the jpeg markers until the exif APP1
+// segment is found and returns the contained tiff structure
+func readJPEGExifSegment(r io.Reader) ([]byte, error) {
+	marker := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(r, marker); err != nil {
+			return nil, err
+		}
+		if marker[0] != 0xFF {
+			return nil, errors.New("invalid jpeg marker")
+		}
+		// start of scan or end of image -> no exif before image data
+		if marker[1] == 0xDA || marker[1] == 0xD9 {
+			return nil, errors.New("no exif segment found")
+		}
+		length := int(binary.BigEndian.Uint16(marker[2:])) - 2
+		if length < 0 {
+			return nil, errors.New("invalid jpeg segment length")
+		}
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return nil, err
+		}
+		if marker[1] == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:], nil
+		}
+	}
+}
+
+// readAtMost reads up to n bytes from the reader
+func readAtMost(r io.Reader, n int64) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if _, err := io.Copy(buf, io.LimitReader(r, n)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// parseTIFF reads the relevant tags from ifd0 and the exif sub ifd
+func parseTIFF(data []byte) (*Exif, error) {
+	if len(data) < 8 {
+		return nil, errors.New("tiff structure too short")
+	}
+	p := exifParser{data: data}
+	switch string(data[:2]) {
+	case "II":
+		p.order = binary.LittleEndian
+	case "MM":
+		p.order = binary.BigEndian
+	default:
+		return nil, errors.New("invalid tiff byte order")
+	}
+
+	var exif Exif
+	ifd0, err := p.readIFD(p.order.Uint32(data[4:8]))
+	if err != nil {
+		return nil, err
+	}
+	exif.Make = p.readString(ifd0[exifTagMake])
+	exif.Model = p.readString(ifd0[exifTagModel])
+	exif.DateTime = p.readString(ifd0[exifTagDateTime])
+
+	// exif sub ifd holds the capture date
+	if entry, ok := ifd0[exifTagExifIFD]; ok {
+		sub, err := p.readIFD(p.order.Uint32(entry[8:12]))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Debug("could not read exif sub ifd")
+		} else {
+			exif.DateTimeOriginal = p.readString(sub[exifTagDateTimeOriginal])
+			exif.OffsetTime = p.readString(sub[exifTagOffsetTime])
+			exif.OffsetTimeOriginal = p.readString(sub[exifTagOffsetTimeOriginal])
+		}
+	}
+
+	// gps sub ifd holds the capture location
+	if entry, ok := ifd0[exifTagGPSIFD]; ok {
+		gps, err := p.readIFD(p.order.Uint32(entry[8:12]))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Debug("could not read gps sub ifd")
+		} else {
+			p.readGPS(gps, &exif)
+		}
+	}
+
+	return &exif, nil
+}
+
+// readGPS converts the degree/minute/second coordinates of the gps ifd into
+// decimal degrees
+func (p *exifParser) readGPS(gps map[uint16][]byte, exif *Exif) {
+	lat, ok := p.readDegrees(gps[exifTagGPSLatitude])
+	if !ok {
+		return
+	}
+	lon, ok := p.readDegrees(gps[exifTagGPSLongitude])
+	if !ok {
+		return
+	}
+	if p.readString(gps[exifTagGPSLatitudeRef]) == "S" {
+		lat = -lat
+	}
+	if p.readString(gps[exifTagGPSLongitudeRef]) == "W" {
+		lon = -lon
+	}
+	if lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return
+	}
+	exif.Latitude = lat
+	exif.Longitude = lon
+	exif.HasGPS = true
+}
+
+// readDegrees reads three unsigned rationals (degrees, minutes, seconds) of an
+// ifd entry and returns them as decimal degrees
+func (p *exifParser) readDegrees(entry []byte) (float64, bool) {
+	// type 5 is unsigned rational
+	if entry == nil || p.order.Uint16(entry[2:]) != 5 || p.order.Uint32(entry[4:]) != 3 {
+		return 0, false
+	}
+	offset := int(p.order.Uint32(entry[8:]))
+	if offset+24 > len(p.data) {
+		return 0, false
+	}
+	var degrees float64
+	for i, div := range []float64{1, 60, 3600} {
+		num := p.order.Uint32(p.data[offset+i*8:])
+		den := p.order.Uint32(p.data[offset+i*8+4:])
+		if den == 0 {
+			if num == 0 {
+				continue
+			}
+			return 0, false
+		}
+		degrees += float64(num) / float64(den) / div
+	}
+	return degrees, true
+}
+
+// readIFD returns all 12 byte entries of the ifd at offset mapped by tag
+func (p *exifParser) readIFD(offset uint32) (map[uint16][]byte, error) {
+	if int(offset)+2 > len(p.data) {
+		return nil, errors.New("ifd offset out of range")
+	}
+	count := int(p.order.Uint16(p.data[offset:]))
+	start := int(offset) + 2
+	if start+count*12 > len(p.data) {
+		return nil, errors.New("ifd exceeds tiff structure")
+	}
+	entries := make(map[uint16][]byte, count)
+	for i := 0; i < count; i++ {
+		entry := p.data[start+i*12 : start+(i+1)*12]
+		entries[p.order.Uint16(entry)] = entry
+	}
+	return entries, nil
+}
+
+// readString reads the ascii value of an ifd entry
+func (p *exifParser) readString(entry []byte) string {
+	// type 2 is ascii
+	if entry == nil || p.order.Uint16(entry[2:]) != 2 {
+		return ""
+	}
+	count := int(p.order.Uint32(entry[4:]))
+	var value []byte
+	if count <= 4 {
+		value = entry[8 : 8+count]
+	} else {
+		offset := int(p.order.Uint32(entry[8:]))
+		if offset+count > len(p.data) {
+			return ""
+		}
+		value = p.data[offset : offset+count]
+	}
+	return strings.TrimSpace(strings.TrimRight(string(value), "\x00"))
+}
+
+// Camera returns the make and model of the capturing device
+func (e *Exif) Camera() string {
+	// most vendors repeat the make in the model
+	if e.Make == "" || strings.HasPrefix(e.Model, e.Make) {
+		return e.Model
+	}
+	return strings.TrimSpace(fmt.Sprintf("%s %s", e.Make, e.Model))
+}
+
+// CaptureTime parses the original capture time of the file. The returned
+// offset is in seconds east of UTC and ok is false if the exif data did not
+// contain any offset.
+func (e *Exif) CaptureTime() (t time.Time, offset int, ok bool, err error) {
+	value := e.DateTimeOriginal
+	if value == "" {
+		value = e.DateTime
+	}
+	if value == "" {
+		return t, 0, false, errors.New("no capture time available")
+	}
+
+	// prefer the offset that belongs to the original capture time
+	offsetValue := e.OffsetTimeOriginal
+	if offsetValue == "" {
+		offsetValue = e.OffsetTime
+	}
+
+	loc := time.UTC
+	if offsetValue != "" {
+		if offset, err = ParseUTCOffset(offsetValue); err != nil {
+			return t, 0, false, err
+		}
+		loc = time.FixedZone("", offset)
+		ok = true
+	}
+
+	t, err = time.ParseInLocation(exifDateLayout, value, loc)
+	return t, offset, ok, err
+}
+
+// ParseUTCOffset parses an offset like "+02:00" into seconds east of UTC
+func ParseUTCOffset(value string) (int, error) {
+	t, err := time.Parse("-07:00", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid utc offset %s", value)
+	}
+	_, offset := t.Zone()
+	return offset, nil
+}
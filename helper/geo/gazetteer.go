@@ -0,0 +1,206 @@
+package geo
+
+import (
+	"bufio"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// earthRadius is the mean radius of the earth in kilometers
+const earthRadius = 6371.0
+
+// kmPerDegree is the distance of one degree latitude in kilometers
+const kmPerDegree = 111.2
+
+// DefaultMaxDistance is the distance in kilometers a place may be away from a
+// coordinate to be resolved
+const DefaultMaxDistance = 50
+
+// files of the geonames dump that are read next to the cities file
+const (
+	admin1File  = "admin1CodesASCII.txt"
+	countryFile = "countryInfo.txt"
+)
+
+// Place holds the resolved names of a location
+type Place struct {
+	City        string `json:"city,omitempty" bson:"city,omitempty"`
+	Region      string `json:"region,omitempty" bson:"region,omitempty"`
+	Country     string `json:"country,omitempty" bson:"country,omitempty"`
+	CountryCode string `json:"countryCode,omitempty" bson:"countryCode,omitempty"`
+}
+
+// city is a single entry of the gazetteer
+type city struct {
+	name    string
+	lat     float64
+	lon     float64
+	country string
+	admin1  string
+}
+
+// cell is the key of a one degree grid cell
+type cell struct {
+	lat int
+	lon int
+}
+
+// Gazetteer resolves coordinates to the nearest known place without calling
+// any external service
+type Gazetteer struct {
+	cells       map[cell][]city
+	regions     map[string]string
+	countries   map[string]string
+	MaxDistance float64
+}
+
+// LoadGazetteer reads a geonames cities dump (e.g. cities1000.txt). The
+// optional admin1CodesASCII.txt and countryInfo.txt of the same directory are
+// used to resolve region and country names.
+func LoadGazetteer(path string) (*Gazetteer, error) {
+	g := &Gazetteer{
+		cells:       make(map[cell][]city),
+		regions:     make(map[string]string),
+		countries:   make(map[string]string),
+		MaxDistance: DefaultMaxDistance,
+	}
+
+	count := 0
+	err := readTSV(path, func(fields []string) {
+		// geonameid, name, asciiname, alternatenames, latitude, longitude,
+		// feature class, feature code, country code, cc2, admin1 code, ...
+		if len(fields) < 11 {
+			return
+		}
+		lat, err := strconv.ParseFloat(fields[4], 64)
+		if err != nil {
+			return
+		}
+		lon, err := strconv.ParseFloat(fields[5], 64)
+		if err != nil {
+			return
+		}
+		c := city{name: fields[1], lat: lat, lon: lon, country: fields[8], admin1: fields[10]}
+		key := cellOf(lat, lon)
+		g.cells[key] = append(g.cells[key], c)
+		count++
+	})
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, errors.New("gazetteer does not contain any place")
+	}
+
+	dir := filepath.Dir(path)
+	// region names are mapped by <country code>.<admin1 code>
+	if err := readTSV(filepath.Join(dir, admin1File), func(fields []string) {
+		if len(fields) >= 2 {
+			g.regions[fields[0]] = fields[1]
+		}
+	}); err != nil {
+		log.WithFields(log.Fields{
+			"file":  admin1File,
+			"error": err.Error(),
+		}).Warn("could not read region names")
+	}
+	if err := readTSV(filepath.Join(dir, countryFile), func(fields []string) {
+		if len(fields) >= 5 {
+			g.countries[fields[0]] = fields[4]
+		}
+	}); err != nil {
+		log.WithFields(log.Fields{
+			"file":  countryFile,
+			"error": err.Error(),
+		}).Warn("could not read country names")
+	}
+
+	log.WithFields(log.Fields{
+		"path":   path,
+		"places": count,
+	}).Info("loaded gazetteer")
+	return g, nil
+}
+
+// readTSV calls fn for every non comment line of a tab separated file
+func readTSV(path string, fn func([]string)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fn(strings.Split(line, "\t"))
+	}
+	return scanner.Err()
+}
+
+// Lookup returns the nearest place of the coordinate. ok is false if there is
+// no place within the maximum distance.
+func (g *Gazetteer) Lookup(lon float64, lat float64) (*Place, bool) {
+	center := cellOf(lat, lon)
+	dLat := int(math.Ceil(g.MaxDistance / kmPerDegree))
+	// longitude degrees get shorter towards the poles
+	maxLat := math.Min(math.Abs(lat)+float64(dLat), 89.9)
+	dLon := int(math.Ceil(g.MaxDistance / (kmPerDegree * math.Cos(maxLat*math.Pi/180))))
+	if dLon > 180 {
+		dLon = 180
+	}
+
+	var nearest *city
+	best := g.MaxDistance
+	for y := center.lat - dLat; y <= center.lat+dLat; y++ {
+		for x := center.lon - dLon; x <= center.lon+dLon; x++ {
+			// wrap around the antimeridian
+			key := cell{lat: y, lon: ((x+180)%360+360)%360 - 180}
+			for i, c := range g.cells[key] {
+				if d := distance(lat, lon, c.lat, c.lon); d <= best {
+					best = d
+					nearest = &g.cells[key][i]
+				}
+			}
+		}
+	}
+	if nearest == nil {
+		return nil, false
+	}
+
+	return &Place{
+		City:        nearest.name,
+		Region:      g.regions[nearest.country+"."+nearest.admin1],
+		Country:     g.countries[nearest.country],
+		CountryCode: nearest.country,
+	}, true
+}
+
+// cellOf returns the grid cell of a coordinate
+func cellOf(lat float64, lon float64) cell {
+	// 180 and -180 describe the same meridian
+	if lon >= 180 {
+		lon -= 360
+	}
+	return cell{lat: int(math.Floor(lat)), lon: int(math.Floor(lon))}
+}
+
+// distance calculates the great circle distance in kilometers (haversine)
+func distance(lat1 float64, lon1 float64, lat2 float64, lon2 float64) float64 {
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
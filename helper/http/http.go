@@ -15,6 +15,10 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// TunnelProtocol is the upgrade protocol of the tunnels, that nodes open to
+// the gateway
+const TunnelProtocol = "primboard-tunnel"
+
 // ErrorJSON is an return object to pass data as error response
 type ErrorJSON struct {
 	Error   string      `json:"error"`
@@ -44,6 +48,20 @@ func GenerateHTTPClient(caCert string, insecure bool) (*http.Client, *tls.Config
 	return &http.Client{}, nil
 }
 
+// GenerateMTLSClient creates a client, that presents the client certificate
+// and only accepts peers, that pass the verification. The hostname is not
+// verified, the peer is pinned by its certificate instead.
+func GenerateMTLSClient(getCert func(*tls.CertificateRequestInfo) (*tls.Certificate, error), verifyPeer func([][]byte, [][]*x509.Certificate) error) *http.Client {
+	config := &tls.Config{
+		InsecureSkipVerify:    true,
+		GetClientCertificate:  getCert,
+		VerifyPeerCertificate: verifyPeer,
+		MinVersion:            tls.VersionTLS12,
+	}
+	tr := &http.Transport{TLSClientConfig: config}
+	return &http.Client{Transport: tr}
+}
+
 // GetUsernameFromHeader returns the "user" header value
 func GetUsernameFromHeader(w http.ResponseWriter) string {
 	return w.Header().Get("user")
@@ -0,0 +1,69 @@
+package jwks
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"time"
+)
+
+// JWK is the json representation of a public rsa signing key
+type JWK struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// KeySet is the json representation of a jwks
+type KeySet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// NewJWK creates the jwk of the public key
+func NewJWK(kid string, key *rsa.PublicKey) JWK {
+	return JWK{
+		Kid: kid,
+		Kty: "RSA",
+		Alg: "RS256",
+		Use: "sig",
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+// Sign creates a RS256 signed jwt of the claims
+func Sign(key *rsa.PrivateKey, kid string, claims Claims) (string, error) {
+	h, err := json.Marshal(header{Alg: "RS256", Kid: kid})
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// NewStaticVerifier creates a verifier for a fixed set of keys (e.g. the keys
+// of the application itself). The keys are never reloaded.
+func NewStaticVerifier(keys map[string]*rsa.PublicKey, issuer string, audience string) *Verifier {
+	return &Verifier{
+		Issuer:   issuer,
+		Audience: audience,
+		keys:     keys,
+		fetched:  time.Now(),
+	}
+}
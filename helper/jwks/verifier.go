@@ -0,0 +1,294 @@
+package jwks
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultRefreshInterval is the interval the key set is reloaded in
+const DefaultRefreshInterval = 15 * time.Minute
+
+// minRefreshInterval limits the reloads triggered by unknown key ids
+const minRefreshInterval = 30 * time.Second
+
+// leeway is the tolerated clock skew for exp and nbf
+const leeway = 30 * time.Second
+
+// Claims are the verified claims of a token
+type Claims map[string]interface{}
+
+// Verifier verifies RS256 signed jwts offline against the cached keys of a
+// jwks endpoint (e.g. the certs endpoint of a keycloak realm)
+type Verifier struct {
+	// URL is the endpoint of the key set
+	URL string
+	// Issuer must match the iss claim
+	Issuer string
+	// Audience must be contained in the aud claim (skipped if empty)
+	Audience string
+
+	client    *http.Client
+	mu        sync.RWMutex
+	keys      map[string]*rsa.PublicKey
+	fetched   time.Time
+	attempted time.Time
+	// refreshing serializes the reloads triggered by unknown key ids
+	refreshing sync.Mutex
+}
+
+// header is the json representation of the jwt header
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// NewVerifier creates a verifier for the key set at url. The keys are loaded
+// lazily with the first verification if they cannot be loaded yet.
+func NewVerifier(client *http.Client, url string, issuer string, audience string) *Verifier {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	v := &Verifier{
+		URL:      url,
+		Issuer:   issuer,
+		Audience: audience,
+		client:   client,
+		keys:     make(map[string]*rsa.PublicKey),
+	}
+	if err := v.Refresh(); err != nil {
+		log.WithFields(log.Fields{
+			"url":   url,
+			"error": err.Error(),
+		}).Warn("could not load jwks")
+	}
+	return v
+}
+
+// Run reloads the key set in the passed interval. Blocks forever and should be
+// started as goroutine.
+func (v *Verifier) Run(interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultRefreshInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := v.Refresh(); err != nil {
+			log.WithFields(log.Fields{
+				"url":   v.URL,
+				"error": err.Error(),
+			}).Error("could not refresh jwks")
+		}
+	}
+}
+
+// Refresh loads the key set and replaces the cached keys. The cached keys are
+// kept if the endpoint cannot be reached.
+func (v *Verifier) Refresh() error {
+	if v.URL == "" {
+		return nil
+	}
+	v.mu.Lock()
+	v.attempted = time.Now()
+	v.mu.Unlock()
+	res, err := v.client.Get(v.URL)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+	var set KeySet
+	if err := json.NewDecoder(res.Body).Decode(&set); err != nil {
+		return err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		key, err := parseRSAKey(k.N, k.E)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"kid":   k.Kid,
+				"error": err.Error(),
+			}).Warn("skipping invalid key of jwks")
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return errors.New("jwks does not contain any rsa signing key")
+	}
+
+	v.mu.Lock()
+	v.keys = keys
+	v.fetched = time.Now()
+	v.mu.Unlock()
+	return nil
+}
+
+// key returns the cached key of the kid. The key set is reloaded once if the
+// kid is unknown (keys have been rotated) and the last reload attempt is not
+// too recent. Concurrent lookups wait for the same reload.
+func (v *Verifier) key(kid string) (*rsa.PublicKey, error) {
+	v.mu.RLock()
+	key, ok := v.keys[kid]
+	v.mu.RUnlock()
+	if ok {
+		return key, nil
+	}
+	if v.URL == "" {
+		return nil, errors.New("unknown key id")
+	}
+
+	v.refreshing.Lock()
+	defer v.refreshing.Unlock()
+	// the keys may have been reloaded while waiting
+	v.mu.RLock()
+	key, ok = v.keys[kid]
+	attempted := v.attempted
+	v.mu.RUnlock()
+	if ok {
+		return key, nil
+	}
+	if time.Since(attempted) < minRefreshInterval {
+		return nil, errors.New("unknown key id")
+	}
+	if err := v.Refresh(); err != nil {
+		return nil, err
+	}
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	if key, ok = v.keys[kid]; !ok {
+		return nil, errors.New("unknown key id")
+	}
+	return key, nil
+}
+
+// Verify validates the signature, the expiry, the issuer and the audience of
+// the token and returns its claims
+func (v *Verifier) Verify(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("token is malformed")
+	}
+
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, errors.New("could not decode token header")
+	}
+	if h.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported signing algorithm '%s'", h.Alg)
+	}
+	key, err := v.key(h.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("could not decode token signature")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, errors.New("invalid token signature")
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errors.New("could not decode token claims")
+	}
+	if err := v.validate(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// validate checks the registered claims
+func (v *Verifier) validate(claims Claims) error {
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("token has no expiry")
+	}
+	if now.Add(-leeway).After(time.Unix(int64(exp), 0)) {
+		return errors.New("token is expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(leeway).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("token is not valid yet")
+	}
+	if v.Issuer != "" && claims.String("iss") != v.Issuer {
+		return errors.New("token has an invalid issuer")
+	}
+	if v.Audience != "" && !claims.hasAudience(v.Audience) {
+		return errors.New("token has an invalid audience")
+	}
+	return nil
+}
+
+// String returns the string value of the claim or an empty string
+func (c Claims) String(key string) string {
+	if val, ok := c[key].(string); ok {
+		return val
+	}
+	return ""
+}
+
+// hasAudience checks whether the aud (string or list) or the azp claim
+// contains the audience
+func (c Claims) hasAudience(audience string) bool {
+	switch aud := c["aud"].(type) {
+	case string:
+		if aud == audience {
+			return true
+		}
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return c.String("azp") == audience
+}
+
+// decodeSegment decodes a base64url encoded json segment of the token
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// parseRSAKey creates a public key from the base64url encoded modulus and
+// exponent
+func parseRSAKey(n string, e string) (*rsa.PublicKey, error) {
+	nb, err := base64.RawURLEncoding.DecodeString(n)
+	if err != nil {
+		return nil, err
+	}
+	eb, err := base64.RawURLEncoding.DecodeString(e)
+	if err != nil {
+		return nil, err
+	}
+	exponent := new(big.Int).SetBytes(eb)
+	if !exponent.IsInt64() || exponent.Int64() < 3 {
+		return nil, errors.New("invalid exponent")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(nb), E: int(exponent.Int64())}, nil
+}
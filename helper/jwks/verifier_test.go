@@ -0,0 +1,227 @@
+package jwks
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testIssuer = "https://auth.example.com/realms/primboard"
+
+// keyServer is a local stand-in for the jwks endpoint of the identity provider
+type keyServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	keys     map[string]*rsa.PrivateKey
+	failing  bool
+	delay    time.Duration
+	requests int32
+}
+
+// newKeyServer starts a jwks endpoint serving the passed keys. The caller
+// has to close it.
+func newKeyServer(keys map[string]*rsa.PrivateKey) *keyServer {
+	s := &keyServer{keys: keys}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&s.requests, 1)
+		s.mu.Lock()
+		failing, delay := s.failing, s.delay
+		var set KeySet
+		for kid, key := range s.keys {
+			set.Keys = append(set.Keys, NewJWK(kid, &key.PublicKey))
+		}
+		s.mu.Unlock()
+		time.Sleep(delay)
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(set)
+	}))
+	return s
+}
+
+// setKeys replaces the served keys (rotation)
+func (s *keyServer) setKeys(keys map[string]*rsa.PrivateKey) {
+	s.mu.Lock()
+	s.keys = keys
+	s.mu.Unlock()
+}
+
+// count returns the number of key set requests
+func (s *keyServer) count() int32 {
+	return atomic.LoadInt32(&s.requests)
+}
+
+// newKey generates a signing key
+func newKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// sign creates a valid token signed by the key
+func sign(t *testing.T, key *rsa.PrivateKey, kid string) string {
+	token, err := Sign(key, kid, Claims{
+		"iss": testIssuer,
+		"sub": "alice",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// expireAttempt pretends the last reload attempt is outside the throttle
+func expireAttempt(v *Verifier) {
+	v.mu.Lock()
+	v.attempted = time.Now().Add(-2 * minRefreshInterval)
+	v.mu.Unlock()
+}
+
+func TestVerifierReloadsUnknownKid(t *testing.T) {
+	key1, key2 := newKey(t), newKey(t)
+	srv := newKeyServer(map[string]*rsa.PrivateKey{"key1": key1})
+	defer srv.Close()
+	v := NewVerifier(srv.Client(), srv.URL, testIssuer, "")
+	if _, err := v.Verify(sign(t, key1, "key1")); err != nil {
+		t.Fatalf("verify with initial key: %v", err)
+	}
+
+	srv.setKeys(map[string]*rsa.PrivateKey{"key1": key1, "key2": key2})
+	expireAttempt(v)
+	claims, err := v.Verify(sign(t, key2, "key2"))
+	if err != nil {
+		t.Fatalf("verify with added key: %v", err)
+	}
+	if claims.String("sub") != "alice" {
+		t.Errorf("sub = %q, want alice", claims.String("sub"))
+	}
+	if n := srv.count(); n != 2 {
+		t.Errorf("key set requests = %d, want 2", n)
+	}
+	// known keys must not trigger further reloads
+	expireAttempt(v)
+	if _, err := v.Verify(sign(t, key1, "key1")); err != nil {
+		t.Fatalf("verify with known key: %v", err)
+	}
+	if n := srv.count(); n != 2 {
+		t.Errorf("key set requests = %d, want 2", n)
+	}
+}
+
+func TestVerifierKeyRotation(t *testing.T) {
+	key1, key2 := newKey(t), newKey(t)
+	srv := newKeyServer(map[string]*rsa.PrivateKey{"key1": key1})
+	defer srv.Close()
+	v := NewVerifier(srv.Client(), srv.URL, testIssuer, "")
+
+	srv.setKeys(map[string]*rsa.PrivateKey{"key2": key2})
+	expireAttempt(v)
+	if _, err := v.Verify(sign(t, key2, "key2")); err != nil {
+		t.Fatalf("verify with rotated key: %v", err)
+	}
+	if _, err := v.Verify(sign(t, key1, "key1")); err == nil {
+		t.Error("verify with retired key succeeded")
+	}
+	// a token claiming the new kid but signed by the retired key
+	if _, err := v.Verify(sign(t, key1, "key2")); err == nil {
+		t.Error("verify with forged kid succeeded")
+	}
+}
+
+func TestVerifierThrottlesReloads(t *testing.T) {
+	key1, key2 := newKey(t), newKey(t)
+	srv := newKeyServer(map[string]*rsa.PrivateKey{"key1": key1})
+	defer srv.Close()
+	v := NewVerifier(srv.Client(), srv.URL, testIssuer, "")
+
+	srv.setKeys(map[string]*rsa.PrivateKey{"key1": key1, "key2": key2})
+	token := sign(t, key2, "key2")
+	for i := 0; i < 3; i++ {
+		if _, err := v.Verify(token); err == nil {
+			t.Fatal("verify within the throttle reloaded the key set")
+		}
+	}
+	if n := srv.count(); n != 1 {
+		t.Errorf("key set requests = %d, want 1", n)
+	}
+
+	// failed attempts are throttled as well
+	srv.mu.Lock()
+	srv.failing = true
+	srv.mu.Unlock()
+	expireAttempt(v)
+	if _, err := v.Verify(token); err == nil {
+		t.Fatal("verify against failing key set succeeded")
+	}
+	if _, err := v.Verify(token); err == nil {
+		t.Fatal("verify against failing key set succeeded")
+	}
+	if n := srv.count(); n != 2 {
+		t.Errorf("key set requests = %d, want 2", n)
+	}
+	// the cached keys survive the failed reload
+	if _, err := v.Verify(sign(t, key1, "key1")); err != nil {
+		t.Fatalf("verify with cached key: %v", err)
+	}
+
+	srv.mu.Lock()
+	srv.failing = false
+	srv.mu.Unlock()
+	expireAttempt(v)
+	if _, err := v.Verify(token); err != nil {
+		t.Fatalf("verify after the throttle: %v", err)
+	}
+	if n := srv.count(); n != 3 {
+		t.Errorf("key set requests = %d, want 3", n)
+	}
+}
+
+func TestVerifierSharesConcurrentReload(t *testing.T) {
+	key1, key2 := newKey(t), newKey(t)
+	srv := newKeyServer(map[string]*rsa.PrivateKey{"key1": key1})
+	defer srv.Close()
+	v := NewVerifier(srv.Client(), srv.URL, testIssuer, "")
+
+	srv.mu.Lock()
+	srv.keys = map[string]*rsa.PrivateKey{"key1": key1, "key2": key2}
+	srv.delay = 50 * time.Millisecond
+	srv.mu.Unlock()
+	expireAttempt(v)
+
+	token := sign(t, key2, "key2")
+	const callers = 16
+	var wg sync.WaitGroup
+	errs := make(chan error, callers)
+	start := make(chan struct{})
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			_, err := v.Verify(token)
+			errs <- err
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("concurrent verify: %v", err)
+		}
+	}
+	if n := srv.count(); n != 2 {
+		t.Errorf("key set requests = %d, want 2", n)
+	}
+}
@@ -68,6 +68,19 @@ func ParseGatewayEnv() infrastructure.Config {
 		}).Error("could not parse env")
 	}
 	tmp.APIGatewayConfig.Domain = os.Getenv("DOMAIN")
+	tmp.APIGatewayConfig.PublicURL = os.Getenv("PUBLIC_URL")
+	tmp.APIGatewayConfig.AdminClientID = os.Getenv("ADMIN_CLIENT_ID")
+	tmp.APIGatewayConfig.GazetteerPath = os.Getenv("GAZETTEER_PATH")
+	if os.Getenv("GAZETTEER_MAX_DISTANCE") != "" {
+		tmp.APIGatewayConfig.GazetteerMaxDistance, err = strconv.ParseFloat(os.Getenv("GAZETTEER_MAX_DISTANCE"), 64)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"env":   "GAZETTEER_MAX_DISTANCE",
+				"value": os.Getenv("GAZETTEER_MAX_DISTANCE"),
+				"error": err.Error(),
+			}).Error("could not parse env")
+		}
+	}
 	tmp.APIGatewayConfig.HTTP, err = strconv.ParseBool(os.Getenv("HTTP"))
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -84,11 +97,106 @@ func ParseGatewayEnv() infrastructure.Config {
 			"error": err.Error(),
 		}).Error("could not parse env")
 	}
+	if os.Getenv("INVITE_LIMIT") != "" {
+		tmp.APIGatewayConfig.InviteLimit, err = strconv.Atoi(os.Getenv("INVITE_LIMIT"))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"env":   "INVITE_LIMIT",
+				"value": os.Getenv("INVITE_LIMIT"),
+				"error": err.Error(),
+			}).Error("could not parse env")
+		}
+	}
+	if os.Getenv("NODE_TIMEOUT") != "" {
+		tmp.APIGatewayConfig.NodeTimeout, err = strconv.Atoi(os.Getenv("NODE_TIMEOUT"))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"env":   "NODE_TIMEOUT",
+				"value": os.Getenv("NODE_TIMEOUT"),
+				"error": err.Error(),
+			}).Error("could not parse env")
+		}
+	}
+	if os.Getenv("DEFAULT_REPLICAS") != "" {
+		tmp.APIGatewayConfig.DefaultReplicas, err = strconv.Atoi(os.Getenv("DEFAULT_REPLICAS"))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"env":   "DEFAULT_REPLICAS",
+				"value": os.Getenv("DEFAULT_REPLICAS"),
+				"error": err.Error(),
+			}).Error("could not parse env")
+		}
+	}
+	if os.Getenv("AUTO_RESTORE") != "" {
+		tmp.APIGatewayConfig.AutoRestore, err = strconv.ParseBool(os.Getenv("AUTO_RESTORE"))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"env":   "AUTO_RESTORE",
+				"value": os.Getenv("AUTO_RESTORE"),
+				"error": err.Error(),
+			}).Error("could not parse env")
+		}
+	}
+	if os.Getenv("MTLS") != "" {
+		tmp.APIGatewayConfig.MTLS, err = strconv.ParseBool(os.Getenv("MTLS"))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"env":   "MTLS",
+				"value": os.Getenv("MTLS"),
+				"error": err.Error(),
+			}).Error("could not parse env")
+		}
+	}
+	if os.Getenv("CERT_VALIDITY") != "" {
+		tmp.APIGatewayConfig.CertValidity, err = strconv.Atoi(os.Getenv("CERT_VALIDITY"))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"env":   "CERT_VALIDITY",
+				"value": os.Getenv("CERT_VALIDITY"),
+				"error": err.Error(),
+			}).Error("could not parse env")
+		}
+	}
 	tmp.APIGatewayConfig.Keycloak = &infrastructure.KeycloakConfig{}
+	tmp.APIGatewayConfig.Keycloak.Provider = os.Getenv("IDENTITY_PROVIDER")
 	tmp.APIGatewayConfig.Keycloak.URL = os.Getenv("KEYCLOAK_URL")
 	tmp.APIGatewayConfig.Keycloak.Realm = os.Getenv("KEYCLOAK_REALM")
 	tmp.APIGatewayConfig.Keycloak.ClientID = os.Getenv("KEYCLOAK_CLIENT_ID")
 	tmp.APIGatewayConfig.Keycloak.Secret = os.Getenv("KEYCLOAK_SECRET")
+	tmp.APIGatewayConfig.Keycloak.JWKSURL = os.Getenv("KEYCLOAK_JWKS_URL")
+	tmp.APIGatewayConfig.Keycloak.Issuer = os.Getenv("KEYCLOAK_ISSUER")
+	tmp.APIGatewayConfig.Keycloak.Audience = os.Getenv("KEYCLOAK_AUDIENCE")
+	tmp.APIGatewayConfig.Keycloak.SigningKey = os.Getenv("SIGNING_KEY")
+	if os.Getenv("REFRESH_LIFETIME") != "" {
+		tmp.APIGatewayConfig.Keycloak.RefreshLifetime, err = strconv.Atoi(os.Getenv("REFRESH_LIFETIME"))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"env":   "REFRESH_LIFETIME",
+				"value": os.Getenv("REFRESH_LIFETIME"),
+				"error": err.Error(),
+			}).Error("could not parse env")
+		}
+	}
+	if os.Getenv("TOKEN_LIFETIME") != "" {
+		tmp.APIGatewayConfig.Keycloak.TokenLifetime, err = strconv.Atoi(os.Getenv("TOKEN_LIFETIME"))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"env":   "TOKEN_LIFETIME",
+				"value": os.Getenv("TOKEN_LIFETIME"),
+				"error": err.Error(),
+			}).Error("could not parse env")
+		}
+	}
+	if os.Getenv("KEYCLOAK_JWKS_REFRESH") != "" {
+		tmp.APIGatewayConfig.Keycloak.JWKSRefresh, err = strconv.Atoi(os.Getenv("KEYCLOAK_JWKS_REFRESH"))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"env":   "KEYCLOAK_JWKS_REFRESH",
+				"value": os.Getenv("KEYCLOAK_JWKS_REFRESH"),
+				"error": err.Error(),
+			}).Error("could not parse env")
+		}
+	}
 	tmp.APIGatewayConfig.MongoURL = os.Getenv("MONGO_URL")
 	tmp.APIGatewayConfig.Port, err = strconv.Atoi(os.Getenv("PORT"))
 	if err != nil {
@@ -106,6 +214,27 @@ func ParseGatewayEnv() infrastructure.Config {
 			"error": err.Error(),
 		}).Error("could not parse env")
 	}
+	tmp.APIGatewayConfig.SessionStore = os.Getenv("SESSION_STORE")
+	if os.Getenv("SESSION_TTL") != "" {
+		tmp.APIGatewayConfig.SessionTTL, err = strconv.Atoi(os.Getenv("SESSION_TTL"))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"env":   "SESSION_TTL",
+				"value": os.Getenv("SESSION_TTL"),
+				"error": err.Error(),
+			}).Error("could not parse env")
+		}
+	}
+	if os.Getenv("SIGNED_URL_TTL") != "" {
+		tmp.APIGatewayConfig.SignedURLTTL, err = strconv.Atoi(os.Getenv("SIGNED_URL_TTL"))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"env":   "SIGNED_URL_TTL",
+				"value": os.Getenv("SIGNED_URL_TTL"),
+				"error": err.Error(),
+			}).Error("could not parse env")
+		}
+	}
 	tmp.APIGatewayConfig.TagPreviewLimit, err = strconv.Atoi(os.Getenv("TAG_PREVIEW_LIMIT"))
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -138,10 +267,24 @@ func ParseNodeEnv() infrastructure.Config {
 	tmp.NodeConfig.TargetPath = os.Getenv("TARGETPATH")
 	tmp.NodeConfig.GatewayURL = os.Getenv("GATEWAY_URL")
 	tmp.NodeConfig.Keycloak = &infrastructure.KeycloakConfig{}
+	tmp.NodeConfig.Keycloak.Provider = os.Getenv("IDENTITY_PROVIDER")
 	tmp.NodeConfig.Keycloak.URL = os.Getenv("KEYCLOAK_URL")
 	tmp.NodeConfig.Keycloak.Realm = os.Getenv("KEYCLOAK_REALM")
 	tmp.NodeConfig.Keycloak.ClientID = os.Getenv("KEYCLOAK_CLIENT_ID")
 	tmp.NodeConfig.Keycloak.Secret = os.Getenv("KEYCLOAK_SECRET")
+	tmp.NodeConfig.Keycloak.JWKSURL = os.Getenv("KEYCLOAK_JWKS_URL")
+	tmp.NodeConfig.Keycloak.Issuer = os.Getenv("KEYCLOAK_ISSUER")
+	tmp.NodeConfig.Keycloak.Audience = os.Getenv("KEYCLOAK_AUDIENCE")
+	if os.Getenv("KEYCLOAK_JWKS_REFRESH") != "" {
+		tmp.NodeConfig.Keycloak.JWKSRefresh, err = strconv.Atoi(os.Getenv("KEYCLOAK_JWKS_REFRESH"))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"env":   "KEYCLOAK_JWKS_REFRESH",
+				"value": os.Getenv("KEYCLOAK_JWKS_REFRESH"),
+				"error": err.Error(),
+			}).Error("could not parse env")
+		}
+	}
 	tmp.NodeConfig.NodeAuth = &infrastructure.NodeAuth{}
 	tmp.NodeConfig.NodeAuth.ID = os.Getenv("NODE_AUTH_ID")
 	tmp.NodeConfig.NodeAuth.Secret = os.Getenv("NODE_AUTH_SECRET")
@@ -153,6 +296,86 @@ func ParseNodeEnv() infrastructure.Config {
 			"error": err.Error(),
 		}).Error("could not parse env")
 	}
+	if os.Getenv("SESSION_TTL") != "" {
+		tmp.NodeConfig.SessionTTL, err = strconv.Atoi(os.Getenv("SESSION_TTL"))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"env":   "SESSION_TTL",
+				"value": os.Getenv("SESSION_TTL"),
+				"error": err.Error(),
+			}).Error("could not parse env")
+		}
+	}
+	if os.Getenv("HEARTBEAT_INTERVAL") != "" {
+		tmp.NodeConfig.HeartbeatInterval, err = strconv.Atoi(os.Getenv("HEARTBEAT_INTERVAL"))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"env":   "HEARTBEAT_INTERVAL",
+				"value": os.Getenv("HEARTBEAT_INTERVAL"),
+				"error": err.Error(),
+			}).Error("could not parse env")
+		}
+	}
+	if os.Getenv("RECONCILE_INTERVAL") != "" {
+		tmp.NodeConfig.ReconcileInterval, err = strconv.Atoi(os.Getenv("RECONCILE_INTERVAL"))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"env":   "RECONCILE_INTERVAL",
+				"value": os.Getenv("RECONCILE_INTERVAL"),
+				"error": err.Error(),
+			}).Error("could not parse env")
+		}
+	}
+	if os.Getenv("SCRUB_INTERVAL") != "" {
+		tmp.NodeConfig.ScrubInterval, err = strconv.Atoi(os.Getenv("SCRUB_INTERVAL"))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"env":   "SCRUB_INTERVAL",
+				"value": os.Getenv("SCRUB_INTERVAL"),
+				"error": err.Error(),
+			}).Error("could not parse env")
+		}
+	}
+	if os.Getenv("SCRUB_RATE") != "" {
+		tmp.NodeConfig.ScrubRate, err = strconv.Atoi(os.Getenv("SCRUB_RATE"))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"env":   "SCRUB_RATE",
+				"value": os.Getenv("SCRUB_RATE"),
+				"error": err.Error(),
+			}).Error("could not parse env")
+		}
+	}
+	if os.Getenv("MTLS") != "" {
+		tmp.NodeConfig.MTLS, err = strconv.ParseBool(os.Getenv("MTLS"))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"env":   "MTLS",
+				"value": os.Getenv("MTLS"),
+				"error": err.Error(),
+			}).Error("could not parse env")
+		}
+	}
+	if os.Getenv("TLS") != "" {
+		tmp.NodeConfig.TLS, err = strconv.ParseBool(os.Getenv("TLS"))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"env":   "TLS",
+				"value": os.Getenv("TLS"),
+				"error": err.Error(),
+			}).Error("could not parse env")
+		}
+	}
+	if os.Getenv("TUNNEL") != "" {
+		tmp.NodeConfig.Tunnel, err = strconv.ParseBool(os.Getenv("TUNNEL"))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"env":   "TUNNEL",
+				"value": os.Getenv("TUNNEL"),
+				"error": err.Error(),
+			}).Error("could not parse env")
+		}
+	}
 	tmp.NodeConfig.TLSInsecure, err = strconv.ParseBool(os.Getenv("TLS_INSECURE"))
 	if err != nil {
 		log.WithFields(log.Fields{
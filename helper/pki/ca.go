@@ -0,0 +1,233 @@
+package pki
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// RoleGateway is the organizational unit of the gateway certificate
+	RoleGateway = "gateway"
+	// RoleNode is the organizational unit of the node certificates
+	RoleNode = "node"
+
+	// caValidity is the lifetime of a created ca
+	caValidity = 10 * 365 * 24 * time.Hour
+)
+
+// CA issues the certificates of the gateway and its nodes
+type CA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	// PEM is the pem encoded certificate of the ca
+	PEM []byte
+}
+
+// LoadOrCreateCA reads ca.crt and ca.key from the directory. A new ca is
+// created, if the files do not exist.
+func LoadOrCreateCA(dir string) (*CA, error) {
+	certFile := filepath.Join(dir, "ca.crt")
+	keyFile := filepath.Join(dir, "ca.key")
+
+	certPEM, err := ioutil.ReadFile(certFile)
+	if os.IsNotExist(err) {
+		return createCA(certFile, keyFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := ParseCertificate(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parseKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &CA{cert: cert, key: key, PEM: certPEM}, nil
+}
+
+// createCA creates a self signed ca and writes it to the files
+func createCA(certFile string, keyFile string) (*CA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "primboard ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := EncodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+		return nil, err
+	}
+	log.WithFields(log.Fields{
+		"file": certFile,
+	}).Info("created certificate authority")
+	return &CA{cert: cert, key: key, PEM: certPEM}, nil
+}
+
+// Pool returns a pool, that only contains the ca
+func (ca *CA) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// Issue creates a key and a certificate for the identity
+func (ca *CA) Issue(identity string, role string, validity time.Duration) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM, err := ca.sign(&key.PublicKey, identity, role, validity)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := EncodeKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certPEM, keyPEM, nil
+}
+
+// SignCSR issues a certificate for the key of the request. The common name of
+// the request must match the identity.
+func (ca *CA) SignCSR(csrPEM []byte, identity string, role string, validity time.Duration) ([]byte, error) {
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, errors.New("could not decode certificate request")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, err
+	}
+	if csr.Subject.CommonName != identity {
+		return nil, errors.New("certificate request does not match the identity")
+	}
+	return ca.sign(csr.PublicKey, identity, role, validity)
+}
+
+// sign issues a certificate for the public key, that is valid for client and
+// server authentication
+func (ca *CA) sign(pub interface{}, identity string, role string, validity time.Duration) ([]byte, error) {
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:         identity,
+			OrganizationalUnit: []string{role},
+		},
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().Add(validity),
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, pub, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+// GenerateCSR creates a key and a certificate request for the identity
+func GenerateCSR(identity string) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.CertificateRequest{Subject: pkix.Name{CommonName: identity}}
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := EncodeKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), keyPEM, nil
+}
+
+// ParseCertificate decodes the first certificate of the pem
+func ParseCertificate(certPEM []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("could not decode certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// Serial returns the serial number of the certificate as hex
+func Serial(cert *x509.Certificate) string {
+	return cert.SerialNumber.Text(16)
+}
+
+// EncodeKey encodes the private key as pem
+func EncodeKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+// parseKey decodes the pem encoded private key
+func parseKey(keyPEM []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("could not decode private key")
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+// newSerial generates a random serial number
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
@@ -0,0 +1,195 @@
+package pki
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	_http "github.com/mirisbowring/primboard/helper/http"
+)
+
+// Keypair holds the current certificate of the application. The certificate
+// is swapped on rotation without restarting the servers and clients.
+type Keypair struct {
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// NewKeypair parses the pem encoded certificate and key
+func NewKeypair(certPEM []byte, keyPEM []byte) (*Keypair, error) {
+	k := &Keypair{}
+	if err := k.Set(certPEM, keyPEM); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// LoadKeypair reads the certificate and the key from the files
+func LoadKeypair(certFile string, keyFile string) (*Keypair, error) {
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return NewKeypair(certPEM, keyPEM)
+}
+
+// Set replaces the current certificate
+func (k *Keypair) Set(certPEM []byte, keyPEM []byte) error {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return err
+	}
+	k.mu.Lock()
+	k.cert = &cert
+	k.mu.Unlock()
+	return nil
+}
+
+// Leaf returns the current certificate
+func (k *Keypair) Leaf() *x509.Certificate {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.cert.Leaf
+}
+
+// NeedsRenewal returns whether less than a third of the lifetime of the
+// current certificate is left
+func (k *Keypair) NeedsRenewal() bool {
+	leaf := k.Leaf()
+	lifetime := leaf.NotAfter.Sub(leaf.NotBefore)
+	return time.Until(leaf.NotAfter) < lifetime/3
+}
+
+// GetCertificate presents the current certificate as server
+func (k *Keypair) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.cert, nil
+}
+
+// GetClientCertificate presents the current certificate as client
+func (k *Keypair) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.cert, nil
+}
+
+// ServerTLSConfig creates the config of a server, that presents the current
+// certificate and verifies the client certificates against the pool, if
+// given (users do not present certificates)
+func ServerTLSConfig(pool *x509.CertPool, keypair *Keypair) *tls.Config {
+	return &tls.Config{
+		GetCertificate: keypair.GetCertificate,
+		ClientAuth:     tls.VerifyClientCertIfGiven,
+		ClientCAs:      pool,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// PeerCertificate returns the verified client certificate of the request
+func PeerCertificate(r *http.Request) (*x509.Certificate, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, false
+	}
+	return r.TLS.VerifiedChains[0][0], true
+}
+
+// HasRole returns whether the certificate has been issued for the role
+func HasRole(cert *x509.Certificate, role string) bool {
+	for _, ou := range cert.Subject.OrganizationalUnit {
+		if ou == role {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyPeer returns a function, that verifies the peer certificate against
+// the pool and pins the role and identity (common name) of the peer. An empty
+// identity accepts any identity of the role.
+func VerifyPeer(pool *x509.CertPool, role string, identity string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("peer did not present a certificate")
+		}
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			certs[i] = cert
+		}
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		opts := x509.VerifyOptions{
+			Roots:         pool,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		if _, err := certs[0].Verify(opts); err != nil {
+			return err
+		}
+		if !HasRole(certs[0], role) {
+			return errors.New("peer certificate has not been issued for the role " + role)
+		}
+		if identity != "" && certs[0].Subject.CommonName != identity {
+			return errors.New("peer certificate has not been issued for " + identity)
+		}
+		return nil
+	}
+}
+
+// Clients caches the http clients, that are pinned to a peer
+type Clients struct {
+	pool    *x509.CertPool
+	keypair *Keypair
+	mu      sync.Mutex
+	clients map[string]*http.Client
+}
+
+// NewClients creates the cache of the pinned clients
+func NewClients(pool *x509.CertPool, keypair *Keypair) *Clients {
+	return &Clients{
+		pool:    pool,
+		keypair: keypair,
+		clients: make(map[string]*http.Client),
+	}
+}
+
+// Client returns the client, that presents the current certificate and only
+// accepts the passed peer
+func (c *Clients) Client(role string, identity string) *http.Client {
+	key := role + "/" + identity
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	client, ok := c.clients[key]
+	if !ok {
+		client = _http.GenerateMTLSClient(c.keypair.GetClientCertificate, VerifyPeer(c.pool, role, identity))
+		c.clients[key] = client
+	}
+	return client
+}
+
+// WriteFile replaces the file atomically
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,106 @@
+package urlsign
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	// ParamUser is the query parameter of the user the url has been signed for
+	ParamUser = "user"
+	// ParamExpires is the query parameter of the unix expiry
+	ParamExpires = "expires"
+	// ParamSignature is the query parameter of the signature
+	ParamSignature = "signature"
+)
+
+var (
+	// ErrExpired is returned if the url is expired
+	ErrExpired = errors.New("signed url is expired")
+	// ErrInvalidSignature is returned if the signature does not match
+	ErrInvalidSignature = errors.New("signature is invalid")
+)
+
+// Claims describe the file (and rendition) a signed url grants access to
+type Claims struct {
+	Identifier string
+	Filename   string
+	Group      bool
+	Thumb      bool
+	Username   string
+	Expires    int64
+}
+
+// payload is the canonical representation of the claims, that is signed
+func (c Claims) payload() string {
+	return fmt.Sprintf("%s\n%s\n%t\n%t\n%s\n%d", c.Identifier, c.Filename, c.Group, c.Thumb, c.Username, c.Expires)
+}
+
+// GenerateKey creates a random base64 encoded signing key
+func GenerateKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// DecodeKey decodes the base64 encoded signing key
+func DecodeKey(key string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("signing key is empty")
+	}
+	return b, nil
+}
+
+// Sign creates the signature of the claims
+func Sign(key []byte, c Claims) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(c.payload()))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature and the expiry of the claims
+func Verify(key []byte, c Claims, signature string, now time.Time) error {
+	expected := Sign(key, c)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return ErrInvalidSignature
+	}
+	if now.Unix() > c.Expires {
+		return ErrExpired
+	}
+	return nil
+}
+
+// Expiry returns the expiry of an url signed now. The expiry is aligned to a
+// multiple of the ttl (and at least one ttl ahead), so the url does not change
+// within that window and can be cached by the browsers and cdns.
+func Expiry(now time.Time, ttl time.Duration) int64 {
+	window := int64(ttl / time.Second)
+	if window <= 0 {
+		window = 1
+	}
+	return (now.Unix()/window + 2) * window
+}
+
+// URL builds the signed file url of the node
+func URL(endpoint string, key []byte, c Claims) string {
+	query := url.Values{}
+	query.Set("thumb", strconv.FormatBool(c.Thumb))
+	query.Set("group", strconv.FormatBool(c.Group))
+	query.Set(ParamUser, c.Username)
+	query.Set(ParamExpires, strconv.FormatInt(c.Expires, 10))
+	query.Set(ParamSignature, Sign(key, c))
+	return fmt.Sprintf("%s/api/v1/file/%s/%s?%s", endpoint, url.PathEscape(c.Identifier), url.PathEscape(c.Filename), query.Encode())
+}
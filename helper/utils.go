@@ -155,6 +155,19 @@ func UniqueStrings(slice []string) []string {
 	return list
 }
 
+// UniqueIDs removes all duplicates from an id slice and returns the result
+func UniqueIDs(slice []primitive.ObjectID) []primitive.ObjectID {
+	keys := make(map[primitive.ObjectID]bool)
+	list := []primitive.ObjectID{}
+	for _, entry := range slice {
+		if _, value := keys[entry]; !value {
+			keys[entry] = true
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
 // RemoveID removes a given value from a given slice
 func RemoveID(s []primitive.ObjectID, r primitive.ObjectID) []primitive.ObjectID {
 	for i, v := range s {
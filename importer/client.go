@@ -0,0 +1,206 @@
+package importer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Nerzal/gocloak/v7"
+	_http "github.com/mirisbowring/primboard/helper/http"
+	"github.com/mirisbowring/primboard/models"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// tokenLeeway is the time before expiry a token gets refreshed
+const tokenLeeway = 30 * time.Second
+
+// client talks to the keycloak, the gateway and the node on behalf of the
+// importing user
+type client struct {
+	config   *Config
+	http     *http.Client
+	keycloak gocloak.GoCloak
+	token    *gocloak.JWT
+	expires  time.Time
+}
+
+// newClient creates the client and logs the user in
+func newClient(config *Config) (*client, error) {
+	httpClient, tlsConfig := _http.GenerateHTTPClient(config.CaCert, config.TLSInsecure)
+	keycloak := gocloak.NewClient(config.Keycloak.URL)
+	if tlsConfig != nil {
+		keycloak.RestyClient().SetTLSClientConfig(tlsConfig)
+	}
+	c := &client{config: config, http: httpClient, keycloak: keycloak}
+	if err := c.login(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// login retrieves a new token with the credentials of the user
+func (c *client) login() error {
+	kc := c.config.Keycloak
+	token, err := c.keycloak.Login(context.Background(), kc.ClientID, kc.Secret, kc.Realm, c.config.Username, c.config.Password)
+	if err != nil {
+		return err
+	}
+	c.setToken(token)
+	return nil
+}
+
+// setToken stores the token and calculates its expiry
+func (c *client) setToken(token *gocloak.JWT) {
+	c.token = token
+	c.expires = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+}
+
+// accessToken returns a valid access token. The token is refreshed (or the
+// user logged in again) if it is about to expire.
+func (c *client) accessToken() (string, error) {
+	if time.Now().Add(tokenLeeway).Before(c.expires) {
+		return c.token.AccessToken, nil
+	}
+	kc := c.config.Keycloak
+	token, err := c.keycloak.RefreshToken(context.Background(), c.token.RefreshToken, kc.ClientID, kc.Secret, kc.Realm)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Debug("could not refresh token - logging in again")
+		if err := c.login(); err != nil {
+			return "", err
+		}
+		return c.token.AccessToken, nil
+	}
+	c.setToken(token)
+	return c.token.AccessToken, nil
+}
+
+// sendJSON sends the payload to the gateway and decodes the response into
+// result (if not nil)
+func (c *client) sendJSON(method string, api string, payload interface{}, expected int, result interface{}) error {
+	token, err := c.accessToken()
+	if err != nil {
+		return err
+	}
+	body := new(bytes.Buffer)
+	if err := json.NewEncoder(body).Encode(payload); err != nil {
+		return err
+	}
+
+	endpoint := c.config.GatewayURL + api
+	res, status, msg := _http.SendRequest(c.http, method, endpoint, token, body, "application/json")
+	if status > 0 {
+		return errors.New(msg)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != expected {
+		return fmt.Errorf("unexpected status code %d from %s", res.StatusCode, endpoint)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(result)
+}
+
+// existingMedia returns the ids of all own media with one of the hashes
+// mapped by hash
+func (c *client) existingMedia(hashes []string) (map[string]primitive.ObjectID, error) {
+	var media []models.Media
+	if err := c.sendJSON(http.MethodPost, "/api/v1/media/bysha1s", hashes, http.StatusOK, &media); err != nil {
+		return nil, err
+	}
+	existing := make(map[string]primitive.ObjectID, len(media))
+	for _, m := range media {
+		existing[m.Sha1] = m.ID
+	}
+	return existing, nil
+}
+
+// createEvent creates an event for the album and returns its id
+func (c *client) createEvent(a *album) (primitive.ObjectID, error) {
+	event := models.Event{
+		Title:          a.Title,
+		Description:    a.Description,
+		TimestampStart: a.Timestamp,
+	}
+	var result struct {
+		InsertedID primitive.ObjectID
+	}
+	if err := c.sendJSON(http.MethodPost, "/api/v1/event", event, http.StatusCreated, &result); err != nil {
+		return primitive.NilObjectID, err
+	}
+	return result.InsertedID, nil
+}
+
+// mapEvent adds the event to all passed media
+func (c *client) mapEvent(eventID primitive.ObjectID, mediaIDs []string) error {
+	mem := models.MediaEventMap{
+		Events:   []models.Event{{ID: eventID}},
+		MediaIDs: mediaIDs,
+	}
+	return c.sendJSON(http.MethodPost, "/api/v1/media/mapevents", mem, http.StatusOK, nil)
+}
+
+// upload streams the file with its meta to the node (same flow as the web
+// upload). The multipart body is written through a pipe to avoid buffering
+// large videos.
+func (c *client) upload(path string, m models.Media) error {
+	token, err := c.accessToken()
+	if err != nil {
+		return err
+	}
+	meta, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(writeUpload(writer, path, meta))
+	}()
+
+	endpoint := c.config.NodeURL + "/api/v1/file"
+	res, status, msg := _http.SendRequest(c.http, http.MethodPost, endpoint, token, pr, writer.FormDataContentType())
+	if status > 0 {
+		pr.Close()
+		return errors.New(msg)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d from node", res.StatusCode)
+	}
+	return nil
+}
+
+// writeUpload writes the meta and the file into the multipart writer
+func writeUpload(writer *multipart.Writer, path string, meta []byte) error {
+	if err := writer.WriteField("filemeta", string(meta)); err != nil {
+		return err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	part, err := writer.CreateFormFile("uploadfile", filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(part, file); err != nil {
+		return err
+	}
+	return writer.Close()
+}
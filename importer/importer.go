@@ -0,0 +1,351 @@
+package importer
+
+import (
+	"errors"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mirisbowring/primboard/helper"
+	"github.com/mirisbowring/primboard/internal/models/infrastructure"
+	"github.com/mirisbowring/primboard/models"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// supportedTypes maps all importable file extensions to the media type
+var supportedTypes = map[string]string{
+	"bmp":  "image",
+	"gif":  "image",
+	"heic": "image",
+	"heif": "image",
+	"jpeg": "image",
+	"jpg":  "image",
+	"png":  "image",
+	"tif":  "image",
+	"tiff": "image",
+	"webp": "image",
+	"3gp":  "video",
+	"avi":  "video",
+	"m4v":  "video",
+	"mkv":  "video",
+	"mov":  "video",
+	"mp4":  "video",
+	"webm": "video",
+}
+
+// Config holds all settings of an import
+type Config struct {
+	Dir          string
+	StateFile    string
+	GatewayURL   string
+	NodeURL      string
+	Username     string
+	Password     string
+	CaCert       string
+	TLSInsecure  bool
+	BatchSize    int
+	FolderEvents bool
+	Keycloak     infrastructure.KeycloakConfig
+}
+
+// Importer uploads a directory (e.g. a google takeout export) into primboard
+type Importer struct {
+	config *Config
+	client *client
+	state  *state
+	albums map[string]*album
+}
+
+// file is a single file of the import with its resolved metadata
+type file struct {
+	path  string
+	sha1  string
+	media models.Media
+	album *album
+}
+
+// Stats summarizes an import run
+type Stats struct {
+	Uploaded int
+	Skipped  int
+	Failed   int
+}
+
+// IsValid verifies that all mandatory settings are present
+func (c *Config) IsValid() error {
+	switch "" {
+	case c.Dir:
+		return errors.New("directory must be specified")
+	case c.StateFile:
+		return errors.New("state file must be specified")
+	case c.GatewayURL:
+		return errors.New("gateway url must be specified")
+	case c.NodeURL:
+		return errors.New("node url must be specified")
+	case c.Username:
+		return errors.New("username must be specified")
+	case c.Keycloak.URL:
+		return errors.New("keycloak url must be specified")
+	}
+	if c.BatchSize < 1 {
+		return errors.New("batch size must be positive")
+	}
+	return nil
+}
+
+// New creates an importer, logs the user in and loads the state of previous
+// runs
+func New(config Config) (*Importer, error) {
+	if err := config.IsValid(); err != nil {
+		return nil, err
+	}
+	c, err := newClient(&config)
+	if err != nil {
+		return nil, err
+	}
+	s, err := loadState(config.StateFile)
+	if err != nil {
+		return nil, err
+	}
+	return &Importer{
+		config: &config,
+		client: c,
+		state:  s,
+		albums: make(map[string]*album),
+	}, nil
+}
+
+// Run walks the directory and imports all supported files that have not been
+// processed in a previous run
+func (i *Importer) Run() (Stats, error) {
+	var stats Stats
+	defer i.state.close()
+
+	var paths []string
+	err := filepath.Walk(i.config.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || i.state.done[path] {
+			return nil
+		}
+		if _, ok := supportedTypes[extension(path)]; ok {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+	log.WithFields(log.Fields{
+		"files": len(paths),
+		"done":  len(i.state.done),
+	}).Info("starting import")
+
+	for start := 0; start < len(paths); start += i.config.BatchSize {
+		end := start + i.config.BatchSize
+		if end > len(paths) {
+			end = len(paths)
+		}
+		batch := i.importBatch(paths[start:end])
+		stats.Uploaded += batch.Uploaded
+		stats.Skipped += batch.Skipped
+		stats.Failed += batch.Failed
+		log.WithFields(log.Fields{
+			"progress": end,
+			"total":    len(paths),
+			"uploaded": stats.Uploaded,
+			"skipped":  stats.Skipped,
+			"failed":   stats.Failed,
+		}).Info("imported batch")
+	}
+	return stats, nil
+}
+
+// importBatch uploads all files of the batch that are not present yet and
+// maps them to the events of their albums
+func (i *Importer) importBatch(paths []string) Stats {
+	var stats Stats
+
+	// hash and prepare all files
+	var files []*file
+	var hashes []string
+	for _, path := range paths {
+		f, err := i.prepare(path)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"path":  path,
+				"error": err.Error(),
+			}).Error("could not prepare file")
+			stats.Failed++
+			continue
+		}
+		files = append(files, f)
+		hashes = append(hashes, f.sha1)
+	}
+	if len(files) == 0 {
+		return stats
+	}
+
+	existing, err := i.client.existingMedia(hashes)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Error("could not check for existing media")
+		stats.Failed += len(files)
+		return stats
+	}
+
+	// upload every hash only once (takeout stores files of albums twice)
+	uploaded := make(map[string]bool)
+	for _, f := range files {
+		if _, ok := existing[f.sha1]; ok || uploaded[f.sha1] {
+			stats.Skipped++
+			continue
+		}
+		if err := i.client.upload(f.path, f.media); err != nil {
+			log.WithFields(log.Fields{
+				"path":  f.path,
+				"error": err.Error(),
+			}).Error("could not upload file")
+			stats.Failed++
+			continue
+		}
+		uploaded[f.sha1] = true
+		stats.Uploaded++
+	}
+
+	// resolve the ids of the uploaded media
+	if len(uploaded) > 0 {
+		if existing, err = i.client.existingMedia(hashes); err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Error("could not resolve uploaded media")
+			return stats
+		}
+	}
+
+	// map the media to the events of their albums
+	mapping := make(map[string][]string)
+	failedAlbums := make(map[string]bool)
+	for _, f := range files {
+		id, ok := existing[f.sha1]
+		if !ok || f.album == nil {
+			continue
+		}
+		mapping[f.album.Title] = append(mapping[f.album.Title], id.Hex())
+	}
+	for title, mediaIDs := range mapping {
+		if err := i.mapAlbum(title, mediaIDs); err != nil {
+			log.WithFields(log.Fields{
+				"album": title,
+				"error": err.Error(),
+			}).Error("could not map media to album event")
+			failedAlbums[title] = true
+		}
+	}
+
+	// remember all completed files
+	for _, f := range files {
+		if _, ok := existing[f.sha1]; !ok || (f.album != nil && failedAlbums[f.album.Title]) {
+			continue
+		}
+		if err := i.state.record(stateEntry{Path: f.path, Done: true}); err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Error("could not write state")
+		}
+	}
+	return stats
+}
+
+// prepare hashes the file (cached in the state) and maps the takeout sidecar
+// and the album into the media
+func (i *Importer) prepare(path string) (*file, error) {
+	f := &file{path: path, sha1: i.state.hashes[path]}
+	if f.sha1 == "" {
+		reader, err := helper.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		f.sha1 = helper.GenerateSHA1(reader)
+		reader.Close()
+		if f.sha1 == "" {
+			return nil, errors.New("could not calculate checksum")
+		}
+		if err := i.state.record(stateEntry{Path: path, Sha1: f.sha1}); err != nil {
+			return nil, err
+		}
+	}
+
+	ext := extension(path)
+	f.media = models.Media{
+		Sha1:        f.sha1,
+		Extension:   ext,
+		Type:        supportedTypes[ext],
+		ContentType: mime.TypeByExtension("." + ext),
+	}
+
+	if sidecar := readSidecar(path); sidecar != nil {
+		// google uses the filename as default title
+		if sidecar.Title != filepath.Base(path) {
+			f.media.Title = sidecar.Title
+		}
+		f.media.Description = sidecar.Description
+		f.media.Timestamp = sidecar.PhotoTakenTime.unix()
+		if f.media.Timestamp == 0 {
+			f.media.Timestamp = sidecar.CreationTime.unix()
+		}
+		geo := sidecar.GeoData
+		if !geo.isSet() {
+			geo = sidecar.GeoDataExif
+		}
+		if geo.isSet() {
+			f.media.Location = models.NewGeoPoint(geo.Longitude, geo.Latitude)
+		}
+	}
+
+	dir := filepath.Dir(path)
+	a, ok := i.albums[dir]
+	if !ok {
+		a = readAlbum(dir, i.config.Dir, i.config.FolderEvents)
+		i.albums[dir] = a
+	}
+	f.album = a
+	return f, nil
+}
+
+// mapAlbum adds the event of the album to the media. The event is created
+// once and remembered in the state.
+func (i *Importer) mapAlbum(title string, mediaIDs []string) error {
+	hex, ok := i.state.events[title]
+	if !ok {
+		var a *album
+		for _, candidate := range i.albums {
+			if candidate != nil && candidate.Title == title {
+				a = candidate
+				break
+			}
+		}
+		id, err := i.client.createEvent(a)
+		if err != nil {
+			return err
+		}
+		hex = id.Hex()
+		if err := i.state.record(stateEntry{Album: title, Event: hex}); err != nil {
+			return err
+		}
+	}
+	id, err := primitive.ObjectIDFromHex(hex)
+	if err != nil {
+		return err
+	}
+	return i.client.mapEvent(id, mediaIDs)
+}
+
+// extension returns the lowercase extension of the path without dot
+func extension(path string) string {
+	return strings.ToLower(strings.TrimPrefix(filepath.Ext(path), "."))
+}
@@ -0,0 +1,96 @@
+package importer
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// stateEntry is a single line of the state file. Either the hash of a path,
+// the completion of a path or the event of an album is recorded.
+type stateEntry struct {
+	Path  string `json:"path,omitempty"`
+	Sha1  string `json:"sha1,omitempty"`
+	Done  bool   `json:"done,omitempty"`
+	Album string `json:"album,omitempty"`
+	Event string `json:"event,omitempty"`
+}
+
+// state is an append only log of the import progress that allows to resume an
+// interrupted import
+type state struct {
+	file   *os.File
+	hashes map[string]string
+	done   map[string]bool
+	events map[string]string
+}
+
+// loadState reads the passed state file (if it exists) and opens it for
+// appending
+func loadState(path string) (*state, error) {
+	s := &state{
+		hashes: make(map[string]string),
+		done:   make(map[string]bool),
+		events: make(map[string]string),
+	}
+
+	if file, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var entry stateEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				// the last line could be incomplete after a crash
+				log.WithFields(log.Fields{
+					"line": scanner.Text(),
+				}).Warn("skipping invalid state entry")
+				continue
+			}
+			s.apply(entry)
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s.file = file
+	return s, nil
+}
+
+// apply adds the entry to the in memory state
+func (s *state) apply(entry stateEntry) {
+	switch {
+	case entry.Album != "":
+		s.events[entry.Album] = entry.Event
+	case entry.Done:
+		s.done[entry.Path] = true
+	case entry.Sha1 != "":
+		s.hashes[entry.Path] = entry.Sha1
+	}
+}
+
+// record appends the entry to the state file and applies it
+func (s *state) record(entry stateEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err = s.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	s.apply(entry)
+	return nil
+}
+
+// close closes the state file
+func (s *state) close() error {
+	return s.file.Close()
+}
@@ -0,0 +1,142 @@
+package importer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// takeoutMaxName is the length google truncates sidecar names to (without the
+// .json extension)
+const takeoutMaxName = 46
+
+// takeoutAlbumMeta is the name of the album metadata within an album folder
+const takeoutAlbumMeta = "metadata.json"
+
+// takeoutYearFolder matches the generic year folders of google photos, that
+// do not represent an album
+var takeoutYearFolder = regexp.MustCompile(`^Photos from \d{4}$`)
+
+// takeoutDuplicate matches the counter google appends to duplicate names
+var takeoutDuplicate = regexp.MustCompile(`^(.*)(\(\d+\))$`)
+
+// takeoutSidecar is the json sidecar google takeout stores next to every file
+type takeoutSidecar struct {
+	Title          string      `json:"title"`
+	Description    string      `json:"description"`
+	PhotoTakenTime takeoutTime `json:"photoTakenTime"`
+	CreationTime   takeoutTime `json:"creationTime"`
+	GeoData        takeoutGeo  `json:"geoData"`
+	GeoDataExif    takeoutGeo  `json:"geoDataExif"`
+}
+
+// takeoutAlbum is the metadata.json of an album folder. Older exports nest
+// the information in albumData.
+type takeoutAlbum struct {
+	Title       string        `json:"title"`
+	Description string        `json:"description"`
+	Date        takeoutTime   `json:"date"`
+	AlbumData   *takeoutAlbum `json:"albumData"`
+}
+
+type takeoutTime struct {
+	Timestamp string `json:"timestamp"`
+}
+
+type takeoutGeo struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// album describes the event a folder is mapped to
+type album struct {
+	Title       string
+	Description string
+	Timestamp   int64
+}
+
+// unix returns the timestamp in seconds or 0 if not set
+func (t takeoutTime) unix() int64 {
+	i, _ := strconv.ParseInt(t.Timestamp, 10, 64)
+	return i
+}
+
+// isSet returns whether the coordinates have been set (google uses 0/0 for
+// unknown locations)
+func (g takeoutGeo) isSet() bool {
+	return g.Latitude != 0 || g.Longitude != 0
+}
+
+// readSidecar looks for the takeout sidecar of the file. Returns nil if there
+// is none.
+func readSidecar(path string) *takeoutSidecar {
+	for _, candidate := range sidecarCandidates(path) {
+		data, err := ioutil.ReadFile(candidate)
+		if err != nil {
+			continue
+		}
+		var sidecar takeoutSidecar
+		if err := json.Unmarshal(data, &sidecar); err != nil {
+			continue
+		}
+		return &sidecar
+	}
+	return nil
+}
+
+// sidecarCandidates returns all names google uses for the sidecar of a file
+// e.g. IMG_1.jpg.json, IMG_1.json, IMG_1.jpg(1).json for IMG_1(1).jpg and
+// names truncated to 46 characters
+func sidecarCandidates(path string) []string {
+	dir, name := filepath.Split(path)
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+
+	names := []string{name, base}
+	if m := takeoutDuplicate.FindStringSubmatch(base); m != nil {
+		names = append(names, m[1]+ext+m[2])
+	}
+	if len(name) > takeoutMaxName {
+		names = append(names, name[:takeoutMaxName])
+	}
+	// edited copies share the sidecar of the original
+	if strings.HasSuffix(base, "-edited") {
+		names = append(names, strings.TrimSuffix(base, "-edited")+ext)
+	}
+
+	candidates := make([]string, len(names))
+	for i, n := range names {
+		candidates[i] = filepath.Join(dir, n+".json")
+	}
+	return candidates
+}
+
+// readAlbum returns the album of a folder. Takeout albums are described by
+// their metadata.json. Other folders are mapped by their name if folderEvents
+// is enabled.
+func readAlbum(dir string, root string, folderEvents bool) *album {
+	if data, err := ioutil.ReadFile(filepath.Join(dir, takeoutAlbumMeta)); err == nil {
+		var meta takeoutAlbum
+		if err := json.Unmarshal(data, &meta); err == nil {
+			if meta.AlbumData != nil {
+				meta = *meta.AlbumData
+			}
+			if meta.Title != "" {
+				return &album{Title: meta.Title, Description: meta.Description, Timestamp: meta.Date.unix()}
+			}
+		}
+	}
+
+	name := filepath.Base(dir)
+	if !folderEvents || filepath.Clean(dir) == filepath.Clean(root) || takeoutYearFolder.MatchString(name) {
+		return nil
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return nil
+	}
+	return &album{Title: name}
+}
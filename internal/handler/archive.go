@@ -0,0 +1,158 @@
+package handler
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mirisbowring/primboard/models/maps"
+	log "github.com/sirupsen/logrus"
+)
+
+// supported archive formats
+const (
+	ArchiveFormatZip = "zip"
+	ArchiveFormatTar = "tar"
+)
+
+// ArchiveWriter streams files into an archive without buffering them
+type ArchiveWriter interface {
+	Add(name string, size int64, modTime time.Time, r io.Reader) error
+	Close() error
+}
+
+type zipArchive struct {
+	w *zip.Writer
+}
+
+type tarArchive struct {
+	w *tar.Writer
+}
+
+// NewArchiveWriter creates an archive writer of the passed format (defaults to
+// zip) on top of w
+func NewArchiveWriter(format string, w io.Writer) (ArchiveWriter, error) {
+	switch format {
+	case "", ArchiveFormatZip:
+		return &zipArchive{w: zip.NewWriter(w)}, nil
+	case ArchiveFormatTar:
+		return &tarArchive{w: tar.NewWriter(w)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported archive format %s", format)
+	}
+}
+
+// ArchiveContentType returns the mime type of the archive format
+func ArchiveContentType(format string) string {
+	if format == ArchiveFormatTar {
+		return "application/x-tar"
+	}
+	return "application/zip"
+}
+
+// ArchiveExtension returns the file extension of the archive format
+func ArchiveExtension(format string) string {
+	if format == ArchiveFormatTar {
+		return ArchiveFormatTar
+	}
+	return ArchiveFormatZip
+}
+
+// Add writes a file into the zip archive. Media files are already compressed,
+// so they are only stored.
+func (a *zipArchive) Add(name string, size int64, modTime time.Time, r io.Reader) error {
+	header := &zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store,
+		Modified: modTime,
+	}
+	fw, err := a.w.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, r)
+	return err
+}
+
+// Close finishes the zip archive
+func (a *zipArchive) Close() error {
+	return a.w.Close()
+}
+
+// Add writes a file into the tar archive. The size must match the content of
+// the reader.
+func (a *tarArchive) Add(name string, size int64, modTime time.Time, r io.Reader) error {
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  modTime,
+	}
+	if err := a.w.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := io.CopyN(a.w, r, size)
+	return err
+}
+
+// Close finishes the tar archive
+func (a *tarArchive) Close() error {
+	return a.w.Close()
+}
+
+// ValidateArchiveFile verifies that the file does not escape the data path of
+// the user
+func ValidateArchiveFile(file maps.ArchiveFile) error {
+	for _, value := range []string{file.Username, file.Filename} {
+		if value == "" || value == "." || value == ".." || strings.ContainsAny(value, `/\`) {
+			return errors.New("invalid username or filename")
+		}
+	}
+	if file.Name != "" && (filepath.IsAbs(file.Name) || strings.Contains(file.Name, "..")) {
+		return errors.New("invalid name within archive")
+	}
+	return nil
+}
+
+// ArchiveFiles adds the original files of the users to the archive. Returns
+// the files that could not be added.
+func ArchiveFiles(basePath string, aw ArchiveWriter, files []maps.ArchiveFile) []maps.ArchiveFile {
+	var failed []maps.ArchiveFile
+	for _, file := range files {
+		path := filepath.Join(basePath, "user", file.Username, "own", file.Filename)
+		name := file.Name
+		if name == "" {
+			name = file.Filename
+		}
+		if err := addFileToArchive(aw, path, name); err != nil {
+			log.WithFields(log.Fields{
+				"path":  path,
+				"error": err.Error(),
+			}).Error("could not add file to archive")
+			failed = append(failed, file)
+		}
+	}
+	return failed
+}
+
+// addFileToArchive streams a single file from the filesystem into the archive
+func addFileToArchive(aw ArchiveWriter, path string, name string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return aw.Add(name, info.Size(), info.ModTime(), file)
+}
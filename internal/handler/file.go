@@ -1,7 +1,6 @@
 package handler
 
 import (
-	"bufio"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -219,9 +218,8 @@ func DeleteShares(basePath string, username string, _maps maps.FilesGroupsMap, w
 
 	for _, group := range _maps.Groups {
 		gpath := filepath.Join(groupPath, group)
-		// check if group does exist on this node
+		// nothing is shared with the group on this node
 		if !helper.PathExists(gpath) {
-			failed = append(failed, maps.FilesGroupsMap{Groups: []string{group}})
 			continue
 		}
 		for _, file := range _maps.Filenames {
@@ -315,63 +313,6 @@ func GetDirectories(path string) ([]string, []string) {
 	return dirs, files
 }
 
-// LinkUser creates a symlink for the user folder from basepath to token link
-// in targetpath
-//
-// 0 -> ok || 1 -> could not create symlink
-func LinkUser(basePath string, targetPath string, username string, token string) int {
-	// verify that locations path does exist
-	if err := os.MkdirAll("/etc/nginx/locations/", os.ModePerm); err != nil {
-		log.WithFields(log.Fields{
-			"username": username,
-			"token":    token,
-			"error":    err.Error(),
-		}).Error("could not create locations directory")
-		return 1
-	}
-
-	for _, loc := range []string{"group", "user"} {
-		file, err := os.Create(fmt.Sprintf("/etc/nginx/locations/%s_%s.location", token, loc))
-		if err != nil {
-			log.WithFields(log.Fields{
-				"username": username,
-				"token":    token,
-				"error":    err.Error(),
-			}).Error("could not create locations file")
-			return 1
-		}
-		writer := bufio.NewWriter(file)
-		switch loc {
-		case "user":
-			_, err = writer.WriteString(fmt.Sprintf("location /node-data/%s/own {\nalias /data/user/%s/own;\n}", token, username))
-			if err != nil {
-				log.WithFields(log.Fields{
-					"type":     loc,
-					"username": username,
-					"token":    token,
-					"error":    err.Error(),
-				}).Error("could not write to locations file")
-				return 1
-			}
-			break
-		case "group":
-			_, err = writer.WriteString(fmt.Sprintf("location /node-data/%s/groups {\nalias /data/group;\n}", token))
-			if err != nil {
-				log.WithFields(log.Fields{
-					"type":  loc,
-					"token": token,
-					"error": err.Error(),
-				}).Error("could not write to locations file")
-				return 1
-			}
-			break
-		}
-
-		writer.Flush()
-	}
-	return 0
-}
-
 // ParseFileName parses the filename from hash, username and extension (thumb toggle)
 func ParseFileName(hash string, username string, thumbnail bool, extension string) string {
 	switch "" {
@@ -492,19 +433,3 @@ func ShareFiles(basePath string, username string, _maps maps.FilesGroupsMap) []m
 
 	return failed
 }
-
-// UnlinkUser removes the symlink for the token from targetPath
-//
-// 0 -> ok || 1 -> could not delete symlink
-func UnlinkUser(targetPath string, token string) (int, string) {
-	if err := os.Remove(fmt.Sprintf("/etc/nginx/locations/%s.location", token)); err != nil {
-		msg := "could not delete symlink"
-		log.WithFields(log.Fields{
-			"token":      token,
-			"targetpath": targetPath,
-			"error":      err.Error(),
-		}).Error(msg)
-		return 1, msg
-	}
-	return 0, ""
-}
@@ -1,12 +1,10 @@
 package handler
 
 import (
-	"crypto/tls"
 	"fmt"
 	"net/http"
 	"strings"
 
-	"github.com/Nerzal/gocloak/v7"
 	"github.com/mirisbowring/primboard/helper"
 	_http "github.com/mirisbowring/primboard/helper/http"
 	iModels "github.com/mirisbowring/primboard/internal/models"
@@ -14,17 +12,6 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-// CreateKeycloakClient parses a tls.Config (if passed) and authenticates to
-// the passed keycloak api
-func CreateKeycloakClient(config *tls.Config, keycloakURL string) gocloak.GoCloak {
-	log.Info("authenticating to keycloak")
-	client := gocloak.NewClient(keycloakURL)
-	if config != nil {
-		client.RestyClient().SetTLSClientConfig(config)
-	}
-	return client
-}
-
 // NodeAuthentication can be called by the server to authenticate or
 // unauthenticate a user from a node.
 func NodeAuthentication(session *iModels.Session, nodes []models.Node, authenticate bool, client *http.Client) (int, string) {
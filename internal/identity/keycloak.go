@@ -0,0 +1,148 @@
+package identity
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/Nerzal/gocloak/v7"
+	"github.com/mirisbowring/primboard/helper/jwks"
+	"github.com/mirisbowring/primboard/internal/models/infrastructure"
+	log "github.com/sirupsen/logrus"
+)
+
+// Keycloak is the IdentityProvider of a keycloak realm
+type Keycloak struct {
+	config   *infrastructure.KeycloakConfig
+	client   gocloak.GoCloak
+	verifier *jwks.Verifier
+}
+
+// NewKeycloak creates the keycloak client and the verifier for the tokens of
+// the realm
+func NewKeycloak(config *infrastructure.KeycloakConfig, client *http.Client, tlsConfig *tls.Config) *Keycloak {
+	log.Info("creating keycloak client")
+	kc := gocloak.NewClient(config.URL)
+	if tlsConfig != nil {
+		kc.RestyClient().SetTLSClientConfig(tlsConfig)
+	}
+	url := config.JWKSURL
+	if url == "" {
+		url = config.RealmURL() + "/protocol/openid-connect/certs"
+	}
+	issuer := config.Issuer
+	if issuer == "" {
+		issuer = config.RealmURL()
+	}
+	verifier := jwks.NewVerifier(client, url, issuer, config.Audience)
+	go verifier.Run(time.Duration(config.JWKSRefresh) * time.Minute)
+	return &Keycloak{config: config, client: kc, verifier: verifier}
+}
+
+// Verify validates the token against the cached keys of the realm
+func (k *Keycloak) Verify(token string) (*Identity, error) {
+	claims, err := k.verifier.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+	return accessIdentity(claims)
+}
+
+// Introspect retrospects the token at keycloak
+func (k *Keycloak) Introspect(ctx context.Context, token string) (*Introspection, error) {
+	res, err := k.client.RetrospectToken(ctx, token, k.config.ClientID, k.config.Secret, k.config.Realm)
+	if err != nil {
+		return nil, err
+	}
+	i := &Introspection{Active: res.Active != nil && *res.Active}
+	if res.Exp != nil {
+		i.Expiry = time.Unix(int64(*res.Exp), 0)
+	}
+	return i, nil
+}
+
+// Login logs the client in with its credentials
+func (k *Keycloak) Login(ctx context.Context) (*Token, error) {
+	jwt, err := k.client.LoginClient(ctx, k.config.ClientID, k.config.Secret, k.config.Realm)
+	if err != nil {
+		return nil, err
+	}
+	return newToken(jwt), nil
+}
+
+// Refresh renews the token with its refresh token
+func (k *Keycloak) Refresh(ctx context.Context, token *Token) (*Token, error) {
+	jwt, err := k.client.RefreshToken(ctx, token.RefreshToken, k.config.ClientID, k.config.Secret, k.config.Realm)
+	if err != nil {
+		return nil, err
+	}
+	return newToken(jwt), nil
+}
+
+// RegisterNode creates a confidential keycloak client for the node
+func (k *Keycloak) RegisterNode(ctx context.Context, nodeID string) (*Credentials, error) {
+	token, err := k.Login(ctx)
+	if err != nil {
+		return nil, err
+	}
+	client := gocloak.Client{
+		ClientID:                  gocloak.StringP(nodeID),
+		ClientAuthenticatorType:   gocloak.StringP("client-secret"),
+		Enabled:                   gocloak.BoolP(true),
+		FrontChannelLogout:        gocloak.BoolP(false),
+		Protocol:                  gocloak.StringP("openid-connect"),
+		StandardFlowEnabled:       gocloak.BoolP(true),
+		ImplicitFlowEnabled:       gocloak.BoolP(false),
+		DirectAccessGrantsEnabled: gocloak.BoolP(true),
+		ServiceAccountsEnabled:    gocloak.BoolP(true),
+		PublicClient:              gocloak.BoolP(false),
+		BearerOnly:                gocloak.BoolP(false),
+		Attributes: &(map[string]string{
+			"backchannel.logout.session.required":      "false",
+			"backchannel.logout.revoke.offline.tokens": "false",
+			"access.token.signed.response.alg":         "RS256",
+			"id.token.signed.response.alg":             "RS256",
+		}),
+	}
+	id, err := k.client.CreateClient(ctx, token.AccessToken, k.config.Realm, client)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := k.client.RegenerateClientSecret(ctx, token.AccessToken, k.config.Realm, id)
+	if err != nil {
+		return nil, err
+	}
+	if secret.Value == nil {
+		return nil, errors.New("keycloak did not return a secret")
+	}
+	return &Credentials{ID: id, ClientID: nodeID, Secret: *secret.Value}, nil
+}
+
+// RotateNodeSecret regenerates the secret of the keycloak client
+func (k *Keycloak) RotateNodeSecret(ctx context.Context, credentialsID string) (string, error) {
+	token, err := k.Login(ctx)
+	if err != nil {
+		return "", err
+	}
+	secret, err := k.client.RegenerateClientSecret(ctx, token.AccessToken, k.config.Realm, credentialsID)
+	if err != nil {
+		return "", err
+	}
+	if secret.Value == nil {
+		return "", errors.New("keycloak did not return a secret")
+	}
+	return *secret.Value, nil
+}
+
+// newToken converts the gocloak jwt
+func newToken(jwt *gocloak.JWT) *Token {
+	return &Token{
+		AccessToken:  jwt.AccessToken,
+		RefreshToken: jwt.RefreshToken,
+		TokenType:    jwt.TokenType,
+		ExpiresIn:    jwt.ExpiresIn,
+		Expiry:       time.Now().Add(time.Duration(jwt.ExpiresIn) * time.Second),
+	}
+}
@@ -0,0 +1,322 @@
+package identity
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/mirisbowring/primboard/helper"
+	"github.com/mirisbowring/primboard/helper/database"
+	"github.com/mirisbowring/primboard/helper/jwks"
+	"github.com/mirisbowring/primboard/internal/models/infrastructure"
+	"github.com/mirisbowring/primboard/models"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// clientCollection stores the credentials of the local clients
+var clientCollection = "client"
+
+// DefaultTokenLifetime is the lifetime of tokens issued by the local provider
+const DefaultTokenLifetime = 15 * time.Minute
+
+// DefaultRefreshLifetime is the lifetime of refresh tokens of local users
+const DefaultRefreshLifetime = 24 * time.Hour
+
+// tokenTypeRefresh marks refresh tokens (same claim as keycloak)
+const tokenTypeRefresh = "Refresh"
+
+// ErrInvalidClient is returned if the client credentials do not match
+var ErrInvalidClient = errors.New("invalid client credentials")
+
+// Local is the built-in IdentityProvider for small self-hosted setups. The
+// gateway signs the tokens itself and acts as openid provider for its nodes.
+type Local struct {
+	config   *infrastructure.KeycloakConfig
+	db       *mongo.Database
+	key      *rsa.PrivateKey
+	kid      string
+	lifetime time.Duration
+	refresh  time.Duration
+	verifier *jwks.Verifier
+}
+
+// client is the bson representation of local client credentials
+type client struct {
+	ID      string `bson:"_id"`
+	Secret  string `bson:"secret"`
+	Created int64  `bson:"created"`
+}
+
+// NewLocal loads the signing key (or generates an ephemeral one) and creates
+// the local provider. The configured url is the public url of the gateway and
+// is used as issuer.
+func NewLocal(config *infrastructure.KeycloakConfig, db *mongo.Database) (*Local, error) {
+	key, err := loadSigningKey(config.SigningKey)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(der)
+	kid := hex.EncodeToString(sum[:8])
+
+	lifetime := time.Duration(config.TokenLifetime) * time.Minute
+	if lifetime <= 0 {
+		lifetime = DefaultTokenLifetime
+	}
+	refresh := time.Duration(config.RefreshLifetime) * time.Minute
+	if refresh <= 0 {
+		refresh = DefaultRefreshLifetime
+	}
+	l := &Local{
+		config:   config,
+		db:       db,
+		key:      key,
+		kid:      kid,
+		lifetime: lifetime,
+		refresh:  refresh,
+	}
+	l.verifier = jwks.NewStaticVerifier(map[string]*rsa.PublicKey{kid: &key.PublicKey}, l.Issuer(), config.Audience)
+	return l, nil
+}
+
+// loadSigningKey reads a pem encoded rsa key (pkcs1 or pkcs8). An ephemeral
+// key is generated if no path is configured.
+func loadSigningKey(path string) (*rsa.PrivateKey, error) {
+	if path == "" {
+		log.Warn("no signing key configured - generating an ephemeral key (tokens are invalid after restart)")
+		return rsa.GenerateKey(rand.Reader, 2048)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("signing key is not pem encoded")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("signing key is not an rsa key")
+	}
+	return key, nil
+}
+
+// Issuer returns the issuer of the local tokens
+func (l *Local) Issuer() string {
+	if l.config.Issuer != "" {
+		return l.config.Issuer
+	}
+	return strings.TrimSuffix(l.config.URL, "/")
+}
+
+// KeySet returns the public signing key as jwks
+func (l *Local) KeySet() jwks.KeySet {
+	return jwks.KeySet{Keys: []jwks.JWK{jwks.NewJWK(l.kid, &l.key.PublicKey)}}
+}
+
+// Metadata returns the openid provider metadata of the gateway
+func (l *Local) Metadata() Metadata {
+	issuer := l.Issuer()
+	return Metadata{
+		Issuer:                issuer,
+		JWKSURI:               issuer + "/api/v1/auth/certs",
+		TokenEndpoint:         issuer + "/api/v1/auth/token",
+		IntrospectionEndpoint: issuer + "/api/v1/auth/introspect",
+	}
+}
+
+// Issue signs an access token for the subject with the passed additional
+// claims
+func (l *Local) Issue(subject string, claims jwks.Claims) (*Token, error) {
+	signed, expiry, err := l.sign(subject, claims, l.lifetime)
+	if err != nil {
+		return nil, err
+	}
+	return &Token{
+		AccessToken: signed,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(l.lifetime.Seconds()),
+		Expiry:      expiry,
+	}, nil
+}
+
+// sign creates a signed jwt for the subject that expires after lifetime
+func (l *Local) sign(subject string, claims jwks.Claims, lifetime time.Duration) (string, time.Time, error) {
+	now := time.Now()
+	expiry := now.Add(lifetime)
+	c := jwks.Claims{
+		"iss": l.Issuer(),
+		"sub": subject,
+		"iat": now.Unix(),
+		"exp": expiry.Unix(),
+		"jti": helper.GenerateRandomToken(16),
+	}
+	if l.config.Audience != "" {
+		c["aud"] = l.config.Audience
+	}
+	for k, v := range claims {
+		c[k] = v
+	}
+	signed, err := jwks.Sign(l.key, l.kid, c)
+	return signed, expiry, err
+}
+
+// IssueClientToken signs a service account token for the client
+func (l *Local) IssueClientToken(clientID string) (*Token, error) {
+	return l.Issue(clientID, jwks.Claims{"clientId": clientID, "azp": clientID})
+}
+
+// IssueUserToken signs an access and a refresh token for a local user
+func (l *Local) IssueUserToken(username string) (*Token, error) {
+	token, err := l.Issue(username, jwks.Claims{"preferred_username": username})
+	if err != nil {
+		return nil, err
+	}
+	token.RefreshToken, _, err = l.sign(username, jwks.Claims{"typ": tokenTypeRefresh}, l.refresh)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// RefreshUserToken issues new tokens for the user of a valid refresh token
+func (l *Local) RefreshUserToken(refreshToken string) (*Token, error) {
+	claims, err := l.verifier.Verify(refreshToken)
+	if err != nil {
+		return nil, err
+	}
+	if claims.String("typ") != tokenTypeRefresh {
+		return nil, errors.New("token is not a refresh token")
+	}
+	username := claims.String("sub")
+	if !l.userActive(username, claims) {
+		return nil, errors.New("user is not active anymore")
+	}
+	return l.IssueUserToken(username)
+}
+
+// Verify validates the token against the signing key
+func (l *Local) Verify(token string) (*Identity, error) {
+	claims, err := l.verifier.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+	return accessIdentity(claims)
+}
+
+// Introspect verifies the token and checks that the client still exists
+func (l *Local) Introspect(ctx context.Context, token string) (*Introspection, error) {
+	id, err := l.Verify(token)
+	if err != nil {
+		return &Introspection{Active: false}, nil
+	}
+	i := &Introspection{Active: true}
+	if exp, ok := id.Claims["exp"].(float64); ok {
+		i.Expiry = time.Unix(int64(exp), 0)
+	}
+	switch {
+	case id.Username != "":
+		i.Active = l.userActive(id.Username, id.Claims)
+	case id.ClientID != "" && id.ClientID != l.config.ClientID:
+		i.Active = l.clientExists(id.ClientID)
+	}
+	return i, nil
+}
+
+// Login issues a token for the gateway itself
+func (l *Local) Login(ctx context.Context) (*Token, error) {
+	return l.IssueClientToken(l.config.ClientID)
+}
+
+// Refresh issues a new token for the gateway itself
+func (l *Local) Refresh(ctx context.Context, token *Token) (*Token, error) {
+	return l.Login(ctx)
+}
+
+// RegisterNode creates local client credentials for the node
+func (l *Local) RegisterNode(ctx context.Context, nodeID string) (*Credentials, error) {
+	secret, err := l.saveClient(nodeID)
+	if err != nil {
+		return nil, err
+	}
+	return &Credentials{ID: nodeID, ClientID: nodeID, Secret: secret}, nil
+}
+
+// RotateNodeSecret replaces the secret of the local client
+func (l *Local) RotateNodeSecret(ctx context.Context, credentialsID string) (string, error) {
+	return l.saveClient(credentialsID)
+}
+
+// AuthenticateClient verifies the credentials of a local client
+func (l *Local) AuthenticateClient(clientID string, secret string) error {
+	if clientID == "" || secret == "" {
+		return ErrInvalidClient
+	}
+	conn := database.GetColCtx(clientCollection, l.db, 30)
+	defer conn.Cancel()
+	var c client
+	if err := conn.Col.FindOne(conn.Ctx, bson.M{"_id": clientID}).Decode(&c); err != nil {
+		return ErrInvalidClient
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(c.Secret), []byte(secret)); err != nil {
+		return ErrInvalidClient
+	}
+	return nil
+}
+
+// saveClient generates a new secret and stores its hash for the client
+func (l *Local) saveClient(clientID string) (string, error) {
+	secret := helper.GenerateRandomToken(32)
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	c := client{ID: clientID, Secret: string(hash), Created: time.Now().Unix()}
+	conn := database.GetColCtx(clientCollection, l.db, 30)
+	defer conn.Cancel()
+	if _, err := conn.Col.ReplaceOne(conn.Ctx, bson.M{"_id": clientID}, c, options.Replace().SetUpsert(true)); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// userActive checks that the user exists and has not changed the password
+// since the token has been issued
+func (l *Local) userActive(username string, claims jwks.Claims) bool {
+	u := models.User{Username: username}
+	if err := u.GetUser(l.db); err != nil {
+		return false
+	}
+	iat, _ := claims["iat"].(float64)
+	return u.PasswordChanged <= int64(iat)
+}
+
+// clientExists checks whether the client has not been deleted
+func (l *Local) clientExists(clientID string) bool {
+	conn := database.GetColCtx(clientCollection, l.db, 30)
+	defer conn.Cancel()
+	count, err := conn.Col.CountDocuments(conn.Ctx, bson.M{"_id": clientID})
+	return err == nil && count > 0
+}
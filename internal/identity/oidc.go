@@ -0,0 +1,149 @@
+package identity
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mirisbowring/primboard/helper/jwks"
+	"github.com/mirisbowring/primboard/internal/models/infrastructure"
+)
+
+// discoveryPath is the path of the openid provider metadata
+const discoveryPath = "/.well-known/openid-configuration"
+
+// OIDC is a generic IdentityProvider for openid connect providers. Nodes have
+// to be registered manually (with the node id as client id) because there is
+// no standard api to manage clients.
+type OIDC struct {
+	config   *infrastructure.KeycloakConfig
+	client   *http.Client
+	metadata Metadata
+	verifier *jwks.Verifier
+}
+
+// Metadata is the subset of the openid provider metadata used by primboard
+type Metadata struct {
+	Issuer                string `json:"issuer"`
+	JWKSURI               string `json:"jwks_uri"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	IntrospectionEndpoint string `json:"introspection_endpoint,omitempty"`
+}
+
+// NewOIDC loads the metadata of the provider at the configured url and
+// creates the verifier for its tokens
+func NewOIDC(config *infrastructure.KeycloakConfig, client *http.Client) (*OIDC, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Get(strings.TrimSuffix(config.URL, "/") + discoveryPath)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d from discovery endpoint", res.StatusCode)
+	}
+	var metadata Metadata
+	if err := json.NewDecoder(res.Body).Decode(&metadata); err != nil {
+		return nil, err
+	}
+
+	if config.JWKSURL != "" {
+		metadata.JWKSURI = config.JWKSURL
+	}
+	issuer := config.Issuer
+	if issuer == "" {
+		issuer = metadata.Issuer
+	}
+	verifier := jwks.NewVerifier(client, metadata.JWKSURI, issuer, config.Audience)
+	go verifier.Run(time.Duration(config.JWKSRefresh) * time.Minute)
+	return &OIDC{config: config, client: client, metadata: metadata, verifier: verifier}, nil
+}
+
+// Verify validates the token against the cached keys of the provider
+func (o *OIDC) Verify(token string) (*Identity, error) {
+	claims, err := o.verifier.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+	return accessIdentity(claims)
+}
+
+// Introspect calls the introspection endpoint of the provider (RFC 7662)
+func (o *OIDC) Introspect(ctx context.Context, token string) (*Introspection, error) {
+	if o.metadata.IntrospectionEndpoint == "" {
+		return nil, ErrNotSupported
+	}
+	var result struct {
+		Active bool  `json:"active"`
+		Exp    int64 `json:"exp"`
+	}
+	form := url.Values{"token": {token}}
+	if err := o.post(ctx, o.metadata.IntrospectionEndpoint, form, &result); err != nil {
+		return nil, err
+	}
+	return &Introspection{Active: result.Active, Expiry: time.Unix(result.Exp, 0)}, nil
+}
+
+// Login requests a token with the client credentials grant
+func (o *OIDC) Login(ctx context.Context) (*Token, error) {
+	return o.token(ctx, url.Values{"grant_type": {"client_credentials"}})
+}
+
+// Refresh renews the token with its refresh token. Tokens of the client
+// credentials grant usually come without refresh token - the client logs in
+// again in that case.
+func (o *OIDC) Refresh(ctx context.Context, token *Token) (*Token, error) {
+	if token == nil || token.RefreshToken == "" {
+		return o.Login(ctx)
+	}
+	return o.token(ctx, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {token.RefreshToken},
+	})
+}
+
+// RegisterNode is not supported by generic providers
+func (o *OIDC) RegisterNode(ctx context.Context, nodeID string) (*Credentials, error) {
+	return nil, ErrNotSupported
+}
+
+// RotateNodeSecret is not supported by generic providers
+func (o *OIDC) RotateNodeSecret(ctx context.Context, credentialsID string) (string, error) {
+	return "", ErrNotSupported
+}
+
+// token requests a token from the token endpoint
+func (o *OIDC) token(ctx context.Context, form url.Values) (*Token, error) {
+	var token Token
+	if err := o.post(ctx, o.metadata.TokenEndpoint, form, &token); err != nil {
+		return nil, err
+	}
+	token.Expiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return &token, nil
+}
+
+// post sends the form with the client credentials (basic auth) to the
+// endpoint and decodes the json response into result
+func (o *OIDC) post(ctx context.Context, endpoint string, form url.Values, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(o.config.ClientID), url.QueryEscape(o.config.Secret))
+	res, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d from %s", res.StatusCode, endpoint)
+	}
+	return json.NewDecoder(res.Body).Decode(result)
+}
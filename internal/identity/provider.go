@@ -0,0 +1,148 @@
+package identity
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mirisbowring/primboard/helper/jwks"
+	"github.com/mirisbowring/primboard/internal/models/infrastructure"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// supported providers
+const (
+	ProviderKeycloak = "keycloak"
+	ProviderOIDC     = "oidc"
+	ProviderLocal    = "local"
+)
+
+// ErrNotSupported is returned if the provider does not support an operation
+var ErrNotSupported = errors.New("operation is not supported by the identity provider")
+
+// IdentityProvider validates the tokens of users and services, logs the
+// application in as service account and issues the credentials of nodes
+type IdentityProvider interface {
+	// Verify validates the signature and the claims of an access token offline
+	Verify(token string) (*Identity, error)
+	// Introspect asks the provider whether the token is still active (detects
+	// revoked tokens)
+	Introspect(ctx context.Context, token string) (*Introspection, error)
+	// Login retrieves a token for the service account of the application
+	Login(ctx context.Context) (*Token, error)
+	// Refresh renews the token of the service account
+	Refresh(ctx context.Context, token *Token) (*Token, error)
+	// RegisterNode issues credentials for the node (the client id equals the
+	// node id)
+	RegisterNode(ctx context.Context, nodeID string) (*Credentials, error)
+	// RotateNodeSecret issues a new secret for the credentials of a node
+	RotateNodeSecret(ctx context.Context, credentialsID string) (string, error)
+}
+
+// Identity is the verified subject of an access token
+type Identity struct {
+	Subject  string
+	Username string
+	// ClientID is only set for service accounts
+	ClientID string
+	Claims   jwks.Claims
+}
+
+// Introspection is the result of a token introspection
+type Introspection struct {
+	Active bool
+	Expiry time.Time
+}
+
+// Token is an access token of a service account
+type Token struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	TokenType    string    `json:"token_type"`
+	ExpiresIn    int       `json:"expires_in"`
+	Expiry       time.Time `json:"-"`
+}
+
+// Credentials are the client credentials issued for a node
+type Credentials struct {
+	// ID is the id of the credentials at the provider
+	ID       string
+	ClientID string
+	Secret   string
+}
+
+// Valid checks whether the token is set and not about to expire
+func (t *Token) Valid() bool {
+	return t != nil && t.AccessToken != "" && time.Now().Add(30*time.Second).Before(t.Expiry)
+}
+
+// serviceAccountPrefix is the prefix of the usernames of keycloak service
+// accounts
+const serviceAccountPrefix = "service-account-"
+
+// newIdentity maps the claims of a verified token
+func newIdentity(claims jwks.Claims) *Identity {
+	return &Identity{
+		Subject:  claims.String("sub"),
+		Username: claims.String("preferred_username"),
+		ClientID: serviceClientID(claims),
+		Claims:   claims,
+	}
+}
+
+// serviceClientID returns the client of a client credentials token. Keycloak
+// marks service accounts with clientId (issued to the client itself), RFC 9068
+// tokens have no user subject (the subject is the client). User tokens do not
+// have a client id.
+func serviceClientID(claims jwks.Claims) string {
+	subject := claims.String("sub")
+	username := claims.String("preferred_username")
+	azp := claims.String("azp")
+	if clientID := claims.String("clientId"); clientID != "" && clientID == azp {
+		if username == "" || strings.EqualFold(username, serviceAccountPrefix+clientID) {
+			return clientID
+		}
+	}
+	if username != "" {
+		return ""
+	}
+	if clientID := claims.String("client_id"); clientID != "" && clientID == subject {
+		return clientID
+	}
+	if azp != "" && azp == subject {
+		return azp
+	}
+	return ""
+}
+
+// accessIdentity maps the claims of a verified token and rejects refresh
+// tokens that are passed as access tokens
+func accessIdentity(claims jwks.Claims) (*Identity, error) {
+	if claims.String("typ") == "Refresh" {
+		return nil, errors.New("refresh tokens cannot be used as access tokens")
+	}
+	return newIdentity(claims), nil
+}
+
+// New creates the configured identity provider. The database is only used by
+// the local provider of the gateway.
+func New(config *infrastructure.KeycloakConfig, client *http.Client, tlsConfig *tls.Config, db *mongo.Database) (IdentityProvider, error) {
+	switch config.Provider {
+	case "", ProviderKeycloak:
+		return NewKeycloak(config, client, tlsConfig), nil
+	case ProviderOIDC:
+		return NewOIDC(config, client)
+	case ProviderLocal:
+		// nodes use the gateway as oidc provider
+		if db == nil {
+			return NewOIDC(config, client)
+		}
+		return NewLocal(config, db)
+	default:
+		return nil, fmt.Errorf("unknown identity provider '%s'", config.Provider)
+	}
+}
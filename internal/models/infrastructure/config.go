@@ -1,5 +1,7 @@
 package infrastructure
 
+import "strings"
+
 // Config holds all possible configurations about the framework
 type Config struct {
 	APIGatewayConfig APIGatewayConfig `json:"api_gateway"`
@@ -9,6 +11,7 @@ type Config struct {
 // APIGatewayConfig struct that stores every api related settings
 type APIGatewayConfig struct {
 	Domain               string          `json:"domain"`
+	PublicURL            string          `json:"public_url"`
 	Port                 int             `json:"port"`
 	MongoURL             string          `json:"mongo_url"`
 	DBName               string          `json:"database_name"`
@@ -25,17 +28,52 @@ type APIGatewayConfig struct {
 	TagPreviewLimit      int             `json:"tag_preview_limit"`
 	TLSInsecure          bool            `json:"tls_insecure"`
 	SessionRotation      bool            `json:"session_rotation"`
+	SessionStore         string          `json:"session_store"`
+	SessionTTL           int             `json:"session_ttl"`
+	SignedURLTTL         int             `json:"signed_url_ttl"`
 	DefaultMediaPageSize int             `json:"default_media_page_size"`
 	InviteValidity       int             `json:"invite_validity"`
+	InviteLimit          int             `json:"invite_limit"`
+	NodeTimeout          int             `json:"node_timeout"`
+	DefaultReplicas      int             `json:"default_replicas"`
+	AutoRestore          bool            `json:"auto_restore"`
+	MTLS                 bool            `json:"mtls"`
+	CertValidity         int             `json:"cert_validity"`
+	AdminClientID        string          `json:"admin_client_id"`
+	GazetteerPath        string          `json:"gazetteer_path"`
+	GazetteerMaxDistance float64         `json:"gazetteer_max_distance"`
 	Keycloak             *KeycloakConfig `json:"keycloak_config"`
 }
 
-// KeycloakConfig stores the information for the client to connect to a keycloak
+// KeycloakConfig stores the information for the client to connect to the
+// identity provider (keycloak, a generic oidc provider or the built-in local
+// provider)
 type KeycloakConfig struct {
+	// Provider is one of keycloak (default), oidc or local
+	Provider string `json:"provider"`
 	URL      string `json:"url"`
 	Realm    string `json:"realm"`
 	ClientID string `json:"client_id"`
 	Secret   string `json:"secret"`
+	// JWKSURL overrides the certs endpoint of the realm
+	JWKSURL string `json:"jwks_url"`
+	// Issuer overrides the expected issuer (defaults to the realm url)
+	Issuer string `json:"issuer"`
+	// Audience is verified against the aud claim if set
+	Audience string `json:"audience"`
+	// JWKSRefresh is the refresh interval of the jwks in minutes
+	JWKSRefresh int `json:"jwks_refresh"`
+	// SigningKey is the pem encoded rsa key of the local provider
+	SigningKey string `json:"signing_key"`
+	// TokenLifetime is the lifetime of local tokens in minutes
+	TokenLifetime int `json:"token_lifetime"`
+	// RefreshLifetime is the lifetime of local refresh tokens in minutes
+	RefreshLifetime int `json:"refresh_lifetime"`
+}
+
+// RealmURL returns the url of the realm (equals the issuer of its tokens)
+func (k *KeycloakConfig) RealmURL() string {
+	return strings.TrimSuffix(k.URL, "/") + "/auth/realms/" + k.Realm
 }
 
 // NodeConfig struct that stores every api related settings
@@ -50,6 +88,24 @@ type NodeConfig struct {
 	Port           int             `json:"port"`
 	TLSInsecure    bool            `json:"tls_insecure"`
 	NodeAuth       *NodeAuth       `json:"node_auth"`
+	SessionTTL     int             `json:"session_ttl"`
+	// HeartbeatInterval is the interval of the heartbeats in seconds
+	HeartbeatInterval int `json:"heartbeat_interval"`
+	// ReconcileInterval is the interval of the reconciliation in hours
+	ReconcileInterval int `json:"reconcile_interval"`
+	// ScrubInterval is the interval of the integrity scrubbing in hours
+	ScrubInterval int `json:"scrub_interval"`
+	// ScrubRate limits the read rate of the scrubbing in MB/s
+	ScrubRate int `json:"scrub_rate"`
+	// MTLS enables the mutual tls with the gateway and the other nodes (the
+	// certificates directory must contain node.crt, node.key and ca.crt)
+	MTLS bool `json:"mtls"`
+	// TLS serves https with server.crt and server.key of the certificates
+	// directory (without a reverse proxy)
+	TLS bool `json:"tls"`
+	// Tunnel opens a tunnel to the gateway, that proxies the requests of the
+	// clients (if the node is not publicly reachable)
+	Tunnel bool `json:"tunnel"`
 }
 
 // NodeAuth represents the id / secret map for the current node deployment
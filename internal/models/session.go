@@ -12,11 +12,15 @@ import (
 // Session stores the user data, the token, the expiration of the session and
 // the usergroups of the current user
 type Session struct {
-	User         string
-	Token        string
-	Expire       time.Time
-	Usergroups   []primitive.ObjectID
-	NodeTokenMap map[primitive.ObjectID]string
+	User       string
+	Token      string
+	Expire     time.Time
+	Usergroups []primitive.ObjectID
+	// ContributorGroups and AdminGroups are the usergroups in which the user
+	// has at least the contributor or admin role
+	ContributorGroups []primitive.ObjectID
+	AdminGroups       []primitive.ObjectID
+	NodeTokenMap      map[primitive.ObjectID]string
 }
 
 // InitUserGroups preselects usergroups for the user (for performance reasons)
@@ -26,9 +30,34 @@ func (s *Session) InitUserGroups(db *mongo.Database, user string) {
 		log.Println("Could not select usergroups for " + user)
 		return
 	}
+	s.Usergroups = nil
+	s.ContributorGroups = nil
+	s.AdminGroups = nil
 	// map IDs to session
 	for _, group := range groups {
+		role := group.Role(user)
 		s.Usergroups = append(s.Usergroups, group.ID)
+		if role.Includes(models.RoleContributor) {
+			s.ContributorGroups = append(s.ContributorGroups, group.ID)
+		}
+		if role.Includes(models.RoleAdmin) {
+			s.AdminGroups = append(s.AdminGroups, group.ID)
+		}
+	}
+}
+
+// GroupsWithRole returns the usergroups in which the user has at least the
+// passed role (the owner role is not granted by any group)
+func (s *Session) GroupsWithRole(role models.GroupRole) []primitive.ObjectID {
+	switch role {
+	case models.RoleViewer:
+		return s.Usergroups
+	case models.RoleContributor:
+		return s.ContributorGroups
+	case models.RoleAdmin:
+		return s.AdminGroups
+	default:
+		return nil
 	}
 }
 
@@ -50,23 +79,23 @@ func (s *Session) IsValid() bool {
 // 	return s.Token
 // }
 
-// RemoveEmptySessions removes nil objects from session slice
-func RemoveEmptySessions(sessions []*Session) []*Session {
-	if sessions == nil {
-		return sessions
+// Copy returns a deep copy of the session
+func (s *Session) Copy() *Session {
+	c := *s
+	if s.Usergroups != nil {
+		c.Usergroups = append([]primitive.ObjectID(nil), s.Usergroups...)
 	}
-	for i := 0; i < len(sessions); {
-		if sessions[i] != nil {
-			i++
-			continue
-		}
-
-		if i < len(sessions)-1 {
-			copy(sessions[i:], sessions[i+1:])
+	if s.ContributorGroups != nil {
+		c.ContributorGroups = append([]primitive.ObjectID(nil), s.ContributorGroups...)
+	}
+	if s.AdminGroups != nil {
+		c.AdminGroups = append([]primitive.ObjectID(nil), s.AdminGroups...)
+	}
+	if s.NodeTokenMap != nil {
+		c.NodeTokenMap = make(map[primitive.ObjectID]string, len(s.NodeTokenMap))
+		for k, v := range s.NodeTokenMap {
+			c.NodeTokenMap[k] = v
 		}
-
-		sessions[len(sessions)-1] = nil
-		sessions = sessions[:len(sessions)-1]
 	}
-	return sessions
+	return &c
 }
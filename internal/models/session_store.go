@@ -0,0 +1,43 @@
+package models
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultSessionTTL is the lifetime of a session without activity
+const DefaultSessionTTL = time.Hour
+
+// SessionStore keeps the sessions of authenticated users. Implementations must
+// be safe for concurrent use. Returned sessions are copies - changes have to
+// be written back with Put.
+type SessionStore interface {
+	// Get returns the valid session of the token or nil
+	Get(token string) *Session
+	// GetByUser returns the valid session of the user or nil
+	GetByUser(user string) *Session
+	// Put inserts or replaces the session of the user and renews its expiry
+	Put(s *Session) error
+	// Touch renews the expiry of the valid session of the token (activity)
+	Touch(token string)
+	// RemoveByToken deletes the session of the token
+	RemoveByToken(token string)
+	// Evict deletes all expired sessions and returns the number of deleted
+	// sessions
+	Evict() int
+}
+
+// RunEviction evicts expired sessions of the store in the passed interval.
+// Blocks forever and should be started as goroutine.
+func RunEviction(store SessionStore, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if count := store.Evict(); count > 0 {
+			log.WithFields(log.Fields{
+				"count": count,
+			}).Debug("evicted expired sessions")
+		}
+	}
+}
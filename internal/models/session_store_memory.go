@@ -0,0 +1,119 @@
+package models
+
+import (
+	"sync"
+	"time"
+)
+
+// MemorySessionStore is a mutex protected in-memory SessionStore
+type MemorySessionStore struct {
+	mu       sync.RWMutex
+	sessions map[string]*Session // mapped by user
+	tokens   map[string]string   // maps token to user
+	ttl      time.Duration
+	// OnEvict is called for every expired session that is evicted
+	OnEvict func(s Session)
+}
+
+// NewMemorySessionStore creates an empty store whose sessions expire after ttl
+func NewMemorySessionStore(ttl time.Duration) *MemorySessionStore {
+	if ttl <= 0 {
+		ttl = DefaultSessionTTL
+	}
+	return &MemorySessionStore{
+		sessions: make(map[string]*Session),
+		tokens:   make(map[string]string),
+		ttl:      ttl,
+	}
+}
+
+// Get returns a copy of the valid session of the token or nil
+func (m *MemorySessionStore) Get(token string) *Session {
+	if token == "" {
+		return nil
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	user, ok := m.tokens[token]
+	if !ok {
+		return nil
+	}
+	return m.valid(user)
+}
+
+// GetByUser returns a copy of the valid session of the user or nil
+func (m *MemorySessionStore) GetByUser(user string) *Session {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.valid(user)
+}
+
+// valid returns a copy of the session if it is not expired (lock must be held)
+func (m *MemorySessionStore) valid(user string) *Session {
+	s, ok := m.sessions[user]
+	if !ok || !s.IsValid() {
+		return nil
+	}
+	return s.Copy()
+}
+
+// Put stores a copy of the session and renews its expiry
+func (m *MemorySessionStore) Put(s *Session) error {
+	s.Expire = time.Now().Add(m.ttl)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if old, ok := m.sessions[s.User]; ok {
+		delete(m.tokens, old.Token)
+	}
+	m.sessions[s.User] = s.Copy()
+	// sessions without token are only found by their user
+	if s.Token != "" {
+		m.tokens[s.Token] = s.User
+	}
+	return nil
+}
+
+// Touch renews the expiry of the valid session of the token
+func (m *MemorySessionStore) Touch(token string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.tokens[token]
+	if !ok {
+		return
+	}
+	if s, ok := m.sessions[user]; ok && s.IsValid() {
+		s.Expire = time.Now().Add(m.ttl)
+	}
+}
+
+// RemoveByToken deletes the session of the token
+func (m *MemorySessionStore) RemoveByToken(token string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if user, ok := m.tokens[token]; ok {
+		delete(m.sessions, user)
+		delete(m.tokens, token)
+	}
+}
+
+// Evict deletes all expired sessions
+func (m *MemorySessionStore) Evict() int {
+	var evicted []Session
+	m.mu.Lock()
+	for user, s := range m.sessions {
+		if s.IsValid() {
+			continue
+		}
+		delete(m.sessions, user)
+		delete(m.tokens, s.Token)
+		evicted = append(evicted, *s)
+	}
+	m.mu.Unlock()
+	// callbacks must not be executed while holding the lock
+	if m.OnEvict != nil {
+		for _, s := range evicted {
+			m.OnEvict(s)
+		}
+	}
+	return len(evicted)
+}
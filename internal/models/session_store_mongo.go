@@ -0,0 +1,186 @@
+package models
+
+import (
+	"time"
+
+	"github.com/mirisbowring/primboard/helper/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// sessionCollection is the name of the mongo collection
+var sessionCollection = "session"
+
+// sessionTouchInterval limits the writes of the session expiry on activity
+const sessionTouchInterval = time.Minute
+
+// MongoSessionStore is a SessionStore that persists the sessions in mongodb,
+// so that multiple gateway replicas share their sessions
+type MongoSessionStore struct {
+	db  *mongo.Database
+	ttl time.Duration
+}
+
+// mongoSession is the bson representation of a session (bson maps must be
+// keyed by strings)
+type mongoSession struct {
+	User       string               `bson:"_id"`
+	Token      string               `bson:"token"`
+	Expire     time.Time            `bson:"expire"`
+	Usergroups []primitive.ObjectID `bson:"usergroups,omitempty"`
+	// groups with contributor and admin role
+	ContributorGroups []primitive.ObjectID `bson:"contributorGroups,omitempty"`
+	AdminGroups       []primitive.ObjectID `bson:"adminGroups,omitempty"`
+	NodeTokens        map[string]string    `bson:"nodeTokens,omitempty"`
+}
+
+// NewMongoSessionStore creates the store and its indexes. Expired sessions are
+// additionally removed by a ttl index.
+func NewMongoSessionStore(db *mongo.Database, ttl time.Duration) (*MongoSessionStore, error) {
+	if ttl <= 0 {
+		ttl = DefaultSessionTTL
+	}
+	conn := database.GetColCtx(sessionCollection, db, 30)
+	defer conn.Cancel()
+	indexes := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "token", Value: 1}},
+			Options: options.Index().SetName("token"),
+		},
+		{
+			Keys:    bson.D{{Key: "expire", Value: 1}},
+			Options: options.Index().SetName("expire_ttl").SetExpireAfterSeconds(0),
+		},
+	}
+	if _, err := conn.Col.Indexes().CreateMany(conn.Ctx, indexes); err != nil {
+		return nil, err
+	}
+	return &MongoSessionStore{db: db, ttl: ttl}, nil
+}
+
+// Get returns the valid session of the token or nil
+func (m *MongoSessionStore) Get(token string) *Session {
+	if token == "" {
+		return nil
+	}
+	return m.find(bson.M{"token": token})
+}
+
+// GetByUser returns the valid session of the user or nil
+func (m *MongoSessionStore) GetByUser(user string) *Session {
+	return m.find(bson.M{"_id": user})
+}
+
+// find selects a single not expired session
+func (m *MongoSessionStore) find(filter bson.M) *Session {
+	filter["expire"] = bson.M{"$gt": time.Now()}
+	conn := database.GetColCtx(sessionCollection, m.db, 30)
+	defer conn.Cancel()
+	var ms mongoSession
+	if err := conn.Col.FindOne(conn.Ctx, filter).Decode(&ms); err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Error("could not select session")
+		}
+		return nil
+	}
+
+	s := &Session{
+		User:              ms.User,
+		Token:             ms.Token,
+		Expire:            ms.Expire,
+		Usergroups:        ms.Usergroups,
+		ContributorGroups: ms.ContributorGroups,
+		AdminGroups:       ms.AdminGroups,
+		NodeTokenMap:      make(map[primitive.ObjectID]string),
+	}
+	for id, token := range ms.NodeTokens {
+		if oid, err := primitive.ObjectIDFromHex(id); err == nil {
+			s.NodeTokenMap[oid] = token
+		}
+	}
+	return s
+}
+
+// Put inserts or replaces the session of the user and renews its expiry
+func (m *MongoSessionStore) Put(s *Session) error {
+	s.Expire = time.Now().Add(m.ttl)
+	ms := mongoSession{
+		User:              s.User,
+		Token:             s.Token,
+		Expire:            s.Expire,
+		Usergroups:        s.Usergroups,
+		ContributorGroups: s.ContributorGroups,
+		AdminGroups:       s.AdminGroups,
+		NodeTokens:        make(map[string]string),
+	}
+	for id, token := range s.NodeTokenMap {
+		ms.NodeTokens[id.Hex()] = token
+	}
+
+	conn := database.GetColCtx(sessionCollection, m.db, 30)
+	defer conn.Cancel()
+	_, err := conn.Col.ReplaceOne(conn.Ctx, bson.M{"_id": s.User}, ms, options.Replace().SetUpsert(true))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"user":  s.User,
+			"error": err.Error(),
+		}).Error("could not save session")
+	}
+	return err
+}
+
+// Touch renews the expiry of the valid session of the token. The session is
+// only written, if its expiry has not been renewed within the last minute.
+func (m *MongoSessionStore) Touch(token string) {
+	if token == "" {
+		return
+	}
+	interval := sessionTouchInterval
+	if interval > m.ttl/2 {
+		interval = m.ttl / 2
+	}
+	now := time.Now()
+	filter := bson.M{
+		"token":  token,
+		"expire": bson.M{"$gt": now, "$lt": now.Add(m.ttl - interval)},
+	}
+	conn := database.GetColCtx(sessionCollection, m.db, 30)
+	defer conn.Cancel()
+	if _, err := conn.Col.UpdateOne(conn.Ctx, filter, bson.M{"$set": bson.M{"expire": now.Add(m.ttl)}}); err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Error("could not renew session")
+	}
+}
+
+// RemoveByToken deletes the session of the token
+func (m *MongoSessionStore) RemoveByToken(token string) {
+	conn := database.GetColCtx(sessionCollection, m.db, 30)
+	defer conn.Cancel()
+	if _, err := conn.Col.DeleteOne(conn.Ctx, bson.M{"token": token}); err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Error("could not remove session")
+	}
+}
+
+// Evict deletes all expired sessions (the ttl index of mongodb only runs once
+// a minute)
+func (m *MongoSessionStore) Evict() int {
+	conn := database.GetColCtx(sessionCollection, m.db, 30)
+	defer conn.Cancel()
+	res, err := conn.Col.DeleteMany(conn.Ctx, bson.M{"expire": bson.M{"$lte": time.Now()}})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Error("could not evict sessions")
+		return 0
+	}
+	return int(res.DeletedCount)
+}
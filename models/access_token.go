@@ -0,0 +1,225 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/mirisbowring/primboard/helper/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// AccessToken is a personal access token of a user for scripts. Only the hash
+// of the token is stored.
+type AccessToken struct {
+	ID    primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	Owner string             `json:"owner,omitempty" bson:"owner"`
+	Name  string             `json:"name" bson:"name"`
+	// Prefix are the first characters of the token to recognize it
+	Prefix   string   `json:"prefix,omitempty" bson:"prefix"`
+	Hash     string   `json:"-" bson:"hash"`
+	Scopes   []string `json:"scopes" bson:"scopes"`
+	Created  int64    `json:"created,omitempty" bson:"created"`
+	Expires  int64    `json:"expires,omitempty" bson:"expires,omitempty"`
+	LastUsed int64    `json:"lastUsed,omitempty" bson:"lastUsed,omitempty"`
+	Revoked  bool     `json:"revoked,omitempty" bson:"revoked,omitempty"`
+	// Token is the plain token (only returned on creation)
+	Token string `json:"token,omitempty" bson:"-"`
+	// ExpiresIn is the requested lifetime in days (0 -> no expiry)
+	ExpiresIn int `json:"expiresIn,omitempty" bson:"-"`
+}
+
+const (
+	// ScopeMediaRead allows to read media, events and tags
+	ScopeMediaRead = "media:read"
+	// ScopeMediaUpload allows to upload media
+	ScopeMediaUpload = "media:upload"
+	// ScopeTagsManage allows to create tags and tag media
+	ScopeTagsManage = "tags:manage"
+)
+
+// AccessTokenPrefix marks personal access tokens (to distinguish them from
+// jwts)
+const AccessTokenPrefix = "pbt_"
+
+// accessTokenLastUsedInterval throttles the last used updates
+const accessTokenLastUsedInterval = 60
+
+// AccessTokenCollection is the name of the mongo collection
+var AccessTokenCollection = "accesstoken"
+
+// scopes contains all valid scopes
+var scopes = []string{ScopeMediaRead, ScopeMediaUpload, ScopeTagsManage}
+
+// EnsureAccessTokenIndexes creates the indexes of the access token collection
+func EnsureAccessTokenIndexes(db *mongo.Database) error {
+	conn := database.GetColCtx(AccessTokenCollection, db, 30)
+	defer conn.Cancel()
+	indexes := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "hash", Value: 1}},
+			Options: options.Index().SetName("hash_unique").SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "owner", Value: 1}},
+			Options: options.Index().SetName("owner"),
+		},
+	}
+	if _, err := conn.Col.Indexes().CreateMany(conn.Ctx, indexes); err != nil {
+		log.WithFields(log.Fields{
+			"collection": AccessTokenCollection,
+			"error":      err.Error(),
+		}).Error("could not create indexes")
+		return err
+	}
+	return nil
+}
+
+// HashAccessToken returns the hash of the token that is stored in the
+// database (the token is random, so a fast hash is sufficient)
+func HashAccessToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// IsAccessToken returns whether the bearer is a personal access token
+func IsAccessToken(bearer string) bool {
+	return strings.HasPrefix(bearer, AccessTokenPrefix)
+}
+
+// IsValid verifies the name and the scopes of the token request
+func (t *AccessToken) IsValid() error {
+	if strings.TrimSpace(t.Name) == "" {
+		return errors.New("the name is not set")
+	}
+	if len(t.Scopes) == 0 {
+		return errors.New("at least one scope must be specified")
+	}
+	for _, scope := range t.Scopes {
+		found := false
+		for _, s := range scopes {
+			if s == scope {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.New("unknown scope " + scope)
+		}
+	}
+	if t.ExpiresIn < 0 {
+		return errors.New("expiresIn must not be negative")
+	}
+	return nil
+}
+
+// HasScope returns whether the token grants the scope
+func (t *AccessToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Create generates the token and saves its hash into the database. The plain
+// token is set to the model.
+func (t *AccessToken) Create(db *mongo.Database) error {
+	random, err := generateRandomStringURLSafe(32)
+	if err != nil {
+		return err
+	}
+	t.ID = primitive.NewObjectID()
+	t.Token = AccessTokenPrefix + strings.TrimRight(random, "=")
+	t.Prefix = t.Token[:len(AccessTokenPrefix)+6]
+	t.Hash = HashAccessToken(t.Token)
+	t.Created = time.Now().Unix()
+	if t.ExpiresIn > 0 {
+		t.Expires = time.Now().Add(time.Duration(t.ExpiresIn) * 24 * time.Hour).Unix()
+	}
+	t.LastUsed = 0
+	t.Revoked = false
+
+	conn := database.GetColCtx(AccessTokenCollection, db, 30)
+	defer conn.Cancel()
+	_, err = conn.Col.InsertOne(conn.Ctx, t)
+	return err
+}
+
+// GetActiveAccessToken selects the not revoked and not expired token by its
+// plain value and tracks the usage
+func GetActiveAccessToken(db *mongo.Database, token string) (*AccessToken, error) {
+	now := time.Now().Unix()
+	filter := bson.M{
+		"hash":    HashAccessToken(token),
+		"revoked": bson.M{"$ne": true},
+		"$or": []bson.M{
+			{"expires": bson.M{"$exists": false}},
+			{"expires": bson.M{"$gt": now}},
+		},
+	}
+	conn := database.GetColCtx(AccessTokenCollection, db, 30)
+	defer conn.Cancel()
+	var t AccessToken
+	if err := conn.Col.FindOne(conn.Ctx, filter).Decode(&t); err != nil {
+		return nil, err
+	}
+	// track usage (throttled to limit the writes)
+	if t.LastUsed < now-accessTokenLastUsedInterval {
+		t.LastUsed = now
+		if _, err := conn.Col.UpdateOne(conn.Ctx, bson.M{"_id": t.ID}, bson.M{"$set": bson.M{"lastUsed": now}}); err != nil {
+			log.WithFields(log.Fields{
+				"token": t.ID.Hex(),
+				"error": err.Error(),
+			}).Warn("could not track usage of access token")
+		}
+	}
+	return &t, nil
+}
+
+// GetAccessTokens selects all tokens of the owner (newest first)
+func GetAccessTokens(db *mongo.Database, owner string) ([]AccessToken, error) {
+	conn := database.GetColCtx(AccessTokenCollection, db, 30)
+	defer conn.Cancel()
+	opts := options.Find().SetSort(bson.M{"created": -1})
+	cursor, err := conn.Col.Find(conn.Ctx, bson.M{"owner": owner}, opts)
+	if err != nil {
+		return nil, err
+	}
+	tokens := []AccessToken{}
+	if err := cursor.All(conn.Ctx, &tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// CountAccessTokens counts the not revoked tokens of the owner
+func CountAccessTokens(db *mongo.Database, owner string) (int64, error) {
+	conn := database.GetColCtx(AccessTokenCollection, db, 30)
+	defer conn.Cancel()
+	return conn.Col.CountDocuments(conn.Ctx, bson.M{"owner": owner, "revoked": bson.M{"$ne": true}})
+}
+
+// Revoke revokes the token of the owner
+func (t *AccessToken) Revoke(db *mongo.Database) error {
+	filter := bson.M{"_id": t.ID, "owner": t.Owner}
+	update := bson.M{"$set": bson.M{"revoked": true}}
+	conn := database.GetColCtx(AccessTokenCollection, db, 30)
+	defer conn.Cancel()
+	res, err := conn.Col.UpdateOne(conn.Ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
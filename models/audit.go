@@ -0,0 +1,183 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/mirisbowring/primboard/helper/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// AuditEntry records a mutating request and its effect on the touched
+// documents
+type AuditEntry struct {
+	ID     primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	Actor  string             `json:"actor" bson:"actor"`
+	Method string             `json:"method" bson:"method"`
+	// Action is the route template of the request
+	Action  string        `json:"action" bson:"action"`
+	URI     string        `json:"uri" bson:"uri"`
+	Source  string        `json:"source" bson:"source"`
+	Status  int           `json:"status" bson:"status"`
+	Targets []AuditTarget `json:"targets,omitempty" bson:"targets,omitempty"`
+	// Owners are the owners of the touched documents (allowed to read the entry)
+	Owners    []string  `json:"owners,omitempty" bson:"owners,omitempty"`
+	Timestamp time.Time `json:"timestamp" bson:"timestamp"`
+}
+
+// AuditTarget is a document touched by an audited request
+type AuditTarget struct {
+	Collection string        `json:"collection" bson:"collection"`
+	ID         string        `json:"id" bson:"id"`
+	Changes    []AuditChange `json:"changes,omitempty" bson:"changes,omitempty"`
+}
+
+// AuditChange is the diff of a single field of a target
+type AuditChange struct {
+	Field  string      `json:"field" bson:"field"`
+	Before interface{} `json:"before,omitempty" bson:"before,omitempty"`
+	After  interface{} `json:"after,omitempty" bson:"after,omitempty"`
+}
+
+// AuditQuery holds the filter options for the audit api
+type AuditQuery struct {
+	Actor  string
+	Action string
+	Target string
+	From   time.Time
+	Until  time.Time
+	Before primitive.ObjectID
+	Size   int
+}
+
+// AuditCollection is the name of the mongo collection
+var AuditCollection = "audit"
+
+// auditSecretFields are never written into the audit log
+var auditSecretFields = bson.M{
+	"password":        0,
+	"secret":          0,
+	"hash":            0,
+	"token":           0,
+	"resetToken":      0,
+	"resetUntil":      0,
+	"passwordChanged": 0,
+	"nodeTokens":      0,
+	"redemptions":     0,
+	"signingKey":      0,
+	"prevCertSerial":  0,
+}
+
+// EnsureAuditIndexes creates the indexes of the audit collection
+func EnsureAuditIndexes(db *mongo.Database) error {
+	conn := database.GetColCtx(AuditCollection, db, 30)
+	defer conn.Cancel()
+	indexes := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "owners", Value: 1}, {Key: "_id", Value: -1}},
+			Options: options.Index().SetName("owners"),
+		},
+		{
+			Keys:    bson.D{{Key: "actor", Value: 1}, {Key: "_id", Value: -1}},
+			Options: options.Index().SetName("actor"),
+		},
+		{
+			Keys:    bson.D{{Key: "targets.id", Value: 1}},
+			Options: options.Index().SetName("targets"),
+		},
+	}
+	if _, err := conn.Col.Indexes().CreateMany(conn.Ctx, indexes); err != nil {
+		log.WithFields(log.Fields{
+			"collection": AuditCollection,
+			"error":      err.Error(),
+		}).Error("could not create indexes")
+		return err
+	}
+	return nil
+}
+
+// AuditSnapshot selects the document without secrets for the audit log.
+// Returns nil if the document does not exist.
+func AuditSnapshot(db *mongo.Database, collection string, filter bson.M) bson.M {
+	conn := database.GetColCtx(collection, db, 30)
+	defer conn.Cancel()
+	var doc bson.M
+	opts := options.FindOne().SetProjection(auditSecretFields)
+	if err := conn.Col.FindOne(conn.Ctx, filter, opts).Decode(&doc); err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.WithFields(log.Fields{
+				"collection": collection,
+				"error":      err.Error(),
+			}).Error("could not select audit snapshot")
+		}
+		return nil
+	}
+	return doc
+}
+
+// Add saves the entry into the database
+func (a *AuditEntry) Add(db *mongo.Database) error {
+	conn := database.GetColCtx(AuditCollection, db, 30)
+	defer conn.Cancel()
+	a.ID = primitive.NewObjectID()
+	_, err := conn.Col.InsertOne(conn.Ctx, a)
+	return err
+}
+
+// IsValid validates the query and sets the default size
+func (q *AuditQuery) IsValid(defaultSize int) error {
+	if !q.From.IsZero() && !q.Until.IsZero() && q.Until.Before(q.From) {
+		return errors.New("query param 'until' must not be before 'from'")
+	}
+	if q.Size <= 0 {
+		q.Size = defaultSize
+	}
+	if q.Size > 1000 {
+		return errors.New("query param 'size' must not be greater than 1000")
+	}
+	return nil
+}
+
+// GetAuditEntries selects a page (newest first) of the entries the user is
+// allowed to read (as actor or owner of the touched documents)
+func GetAuditEntries(db *mongo.Database, user string, q AuditQuery) ([]AuditEntry, error) {
+	filters := []bson.M{
+		{"$or": []bson.M{{"owners": user}, {"actor": user}}},
+	}
+	if q.Actor != "" {
+		filters = append(filters, bson.M{"actor": q.Actor})
+	}
+	if q.Action != "" {
+		filters = append(filters, bson.M{"action": q.Action})
+	}
+	if q.Target != "" {
+		filters = append(filters, bson.M{"targets.id": q.Target})
+	}
+	if !q.From.IsZero() {
+		filters = append(filters, bson.M{"timestamp": bson.M{"$gte": q.From}})
+	}
+	if !q.Until.IsZero() {
+		filters = append(filters, bson.M{"timestamp": bson.M{"$lte": q.Until}})
+	}
+	if !q.Before.IsZero() {
+		filters = append(filters, bson.M{"_id": bson.M{"$lt": q.Before}})
+	}
+
+	conn := database.GetColCtx(AuditCollection, db, 30)
+	defer conn.Cancel()
+	opts := options.Find().SetSort(bson.M{"_id": -1}).SetLimit(int64(q.Size))
+	cursor, err := conn.Col.Find(conn.Ctx, bson.M{"$and": filters}, opts)
+	if err != nil {
+		return nil, err
+	}
+	entries := []AuditEntry{}
+	if err := cursor.All(conn.Ctx, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
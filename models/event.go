@@ -226,7 +226,21 @@ func GetEventsByKeyword(db *mongo.Database, permission bson.M, keyword string, l
 
 }
 
-// UpdateEvent updates the record with the passed one
+// editable returns a copy of the event, that contains the fields a
+// contributor may modify only
+func (e Event) editable() Event {
+	return Event{
+		Title:          e.Title,
+		Description:    e.Description,
+		Comments:       e.Comments,
+		TimestampStart: e.TimestampStart,
+		TimestampEnd:   e.TimestampEnd,
+		URL:            e.URL,
+		URLThumb:       e.URLThumb,
+	}
+}
+
+// UpdateEvent updates the record with the editable fields of the passed one
 func (e *Event) UpdateEvent(db *mongo.Database, ue Event, permission bson.M) (*mongo.UpdateResult, error) {
 	// check if user is allowed to select this node
 	if err := e.GetEvent(db, permission); err != nil {
@@ -234,7 +248,7 @@ func (e *Event) UpdateEvent(db *mongo.Database, ue Event, permission bson.M) (*m
 	}
 	conn := database.GetColCtx(eventColName, db, 30)
 	filter := bson.M{"_id": e.ID}
-	update := bson.M{"$set": ue}
+	update := bson.M{"$set": ue.editable()}
 	result, err := conn.Col.UpdateOne(conn.Ctx, filter, update)
 	defer conn.Cancel()
 	return result, err
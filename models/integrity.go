@@ -0,0 +1,147 @@
+package models
+
+import (
+	"time"
+
+	"github.com/mirisbowring/primboard/helper/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// IntegrityReport records a copy of a media, that failed the scrubbing of its
+// node
+type IntegrityReport struct {
+	ID       primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	MediaID  primitive.ObjectID `json:"mediaID" bson:"mediaID"`
+	NodeID   primitive.ObjectID `json:"nodeID" bson:"nodeID"`
+	Username string             `json:"username" bson:"username"`
+	Filename string             `json:"filename" bson:"filename"`
+	// Reason is one of checksum, truncated or unreadable
+	Reason       string             `json:"reason" bson:"reason"`
+	Expected     string             `json:"expected" bson:"expected"`
+	Actual       string             `json:"actual,omitempty" bson:"actual,omitempty"`
+	ExpectedSize int64              `json:"expectedSize,omitempty" bson:"expectedSize,omitempty"`
+	Size         int64              `json:"size" bson:"size"`
+	Detected     int64              `json:"detected" bson:"detected"`
+	Restored     int64              `json:"restored,omitempty" bson:"restored,omitempty"`
+	RestoredFrom primitive.ObjectID `json:"restoredFrom,omitempty" bson:"restoredFrom,omitempty"`
+	LastError    string             `json:"lastError,omitempty" bson:"lastError,omitempty"`
+}
+
+const (
+	// IntegrityChecksum is reported if the sha1 does not match
+	IntegrityChecksum = "checksum"
+	// IntegrityTruncated is reported if the file is smaller than recorded
+	IntegrityTruncated = "truncated"
+	// IntegrityUnreadable is reported if the file could not be read
+	IntegrityUnreadable = "unreadable"
+)
+
+// IntegrityReportCollection is the name of the mongo collection
+var IntegrityReportCollection = "integrityreport"
+
+// EnsureIntegrityIndexes creates the indexes of the integrity collection
+func EnsureIntegrityIndexes(db *mongo.Database) error {
+	conn := database.GetColCtx(IntegrityReportCollection, db, 30)
+	defer conn.Cancel()
+	indexes := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "mediaID", Value: 1}, {Key: "nodeID", Value: 1}},
+			Options: options.Index().SetName("media_node"),
+		},
+		{
+			Keys:    bson.D{{Key: "username", Value: 1}, {Key: "_id", Value: -1}},
+			Options: options.Index().SetName("username"),
+		},
+	}
+	if _, err := conn.Col.Indexes().CreateMany(conn.Ctx, indexes); err != nil {
+		log.WithFields(log.Fields{
+			"collection": IntegrityReportCollection,
+			"error":      err.Error(),
+		}).Error("could not create indexes")
+		return err
+	}
+	return nil
+}
+
+// Save records the report. An open report of the same copy is updated.
+func (ir *IntegrityReport) Save(db *mongo.Database) error {
+	ir.Detected = time.Now().Unix()
+	filter := bson.M{
+		"mediaID":  ir.MediaID,
+		"nodeID":   ir.NodeID,
+		"restored": bson.M{"$exists": false},
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"username":     ir.Username,
+			"filename":     ir.Filename,
+			"reason":       ir.Reason,
+			"expected":     ir.Expected,
+			"actual":       ir.Actual,
+			"expectedSize": ir.ExpectedSize,
+			"size":         ir.Size,
+			"detected":     ir.Detected,
+		},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	conn := database.GetColCtx(IntegrityReportCollection, db, 30)
+	defer conn.Cancel()
+	return conn.Col.FindOneAndUpdate(conn.Ctx, filter, update, opts).Decode(ir)
+}
+
+// MarkRestored closes the report after the copy has been restored from the
+// passed node
+func (ir *IntegrityReport) MarkRestored(db *mongo.Database, source primitive.ObjectID) error {
+	ir.Restored = time.Now().Unix()
+	ir.RestoredFrom = source
+	ir.LastError = ""
+	update := bson.M{
+		"$set":   bson.M{"restored": ir.Restored, "restoredFrom": source},
+		"$unset": bson.M{"lastError": ""},
+	}
+	conn := database.GetColCtx(IntegrityReportCollection, db, 30)
+	defer conn.Cancel()
+	_, err := conn.Col.UpdateOne(conn.Ctx, bson.M{"_id": ir.ID}, update)
+	return err
+}
+
+// SetError stores the reason of a failed restore
+func (ir *IntegrityReport) SetError(db *mongo.Database, cause string) error {
+	ir.LastError = cause
+	conn := database.GetColCtx(IntegrityReportCollection, db, 30)
+	defer conn.Cancel()
+	_, err := conn.Col.UpdateOne(conn.Ctx, bson.M{"_id": ir.ID}, bson.M{"$set": bson.M{"lastError": cause}})
+	return err
+}
+
+// GetIntegrityReports selects the reports (newest first). The user and the
+// media are optional filters. If open is true, restored reports are skipped.
+func GetIntegrityReports(db *mongo.Database, username string, mediaID primitive.ObjectID, open bool) ([]IntegrityReport, error) {
+	filter := bson.M{}
+	if username != "" {
+		filter["username"] = username
+	}
+	if !mediaID.IsZero() {
+		filter["mediaID"] = mediaID
+	}
+	if open {
+		filter["restored"] = bson.M{"$exists": false}
+	}
+	opts := options.Find().SetSort(bson.M{"_id": -1}).SetLimit(1000)
+	conn := database.GetColCtx(IntegrityReportCollection, db, 30)
+	defer conn.Cancel()
+	cursor, err := conn.Col.Find(conn.Ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	reports := []IntegrityReport{}
+	if err := cursor.All(conn.Ctx, &reports); err != nil {
+		return nil, err
+	}
+	return reports, nil
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"errors"
+	"strings"
 	"time"
 
 	"github.com/mirisbowring/primboard/helper/database"
@@ -15,10 +16,27 @@ import (
 
 // Invite represents the database entry for the tokens
 type Invite struct {
-	ID    primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
-	Token string             `json:"token,omitempty" bson:"token,omitempty"`
-	Until int64              `json:"until,omitempty" bson:"until,omitempty"`
-	Used  bool               `json:"used,omitempty" bson:"used,omitempty"`
+	ID      primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	Token   string             `json:"token,omitempty" bson:"token,omitempty"`
+	Inviter string             `json:"inviter,omitempty" bson:"inviter,omitempty"`
+	// Email restricts the invite to the registration with this address
+	Email string `json:"email,omitempty" bson:"email,omitempty"`
+	// GroupIDs are the usergroups the invitee joins on registration
+	GroupIDs    []primitive.ObjectID `json:"groupIDs,omitempty" bson:"groupIDs,omitempty"`
+	MaxUses     int                  `json:"maxUses,omitempty" bson:"maxUses,omitempty"`
+	Uses        int                  `json:"uses" bson:"uses"`
+	Created     int64                `json:"created,omitempty" bson:"created,omitempty"`
+	Until       int64                `json:"until,omitempty" bson:"until,omitempty"`
+	Revoked     bool                 `json:"revoked,omitempty" bson:"revoked,omitempty"`
+	Redemptions []InviteRedemption   `json:"redemptions,omitempty" bson:"redemptions,omitempty"`
+	// Validity is the requested validity in days
+	Validity int `json:"validity,omitempty" bson:"-"`
+}
+
+// InviteRedemption records a registration with an invite
+type InviteRedemption struct {
+	Username string `json:"username" bson:"username"`
+	Redeemed int64  `json:"redeemed" bson:"redeemed"`
 }
 
 var inviteColName = "invite"
@@ -26,23 +44,29 @@ var inviteColName = "invite"
 // Init inits a token and saves it into database.
 // Default validity is 3 days
 func (i *Invite) Init(db *mongo.Database, validity int) (*mongo.InsertOneResult, error) {
-	if err := i.generateToken(); err != nil {
-		return nil, err
+	for {
+		if err := i.generateToken(); err != nil {
+			return nil, err
+		}
+		// try to find token.
+		tmp := Invite{Token: i.Token}
+		err := tmp.FindToken(db)
+		if err == mongo.ErrNoDocuments {
+			// token is unique -> continue
+			break
+		} else if err != nil {
+			return nil, err
+		}
 	}
-	token := i.Token
-	// try to find token.
-	err := i.FindToken(db)
-	if err == nil {
-		// if no error occured -> token was found -> generate new
-		i.Init(db, validity)
-	} else if err != mongo.ErrNoDocuments {
-		// if no ErrNoDocuments error occured -> return
-		return nil, err
+	if i.MaxUses < 1 {
+		i.MaxUses = 1
 	}
-	// Token could not be found -> continue
-	i.Token = token //prevent, that token becomes resetted after noDocErr
+	i.Email = strings.ToLower(i.Email)
+	i.Uses = 0
+	i.Revoked = false
+	i.Redemptions = nil
+	i.Created = time.Now().Unix()
 	i.Until = time.Now().Add(time.Hour * time.Duration(validity*24)).Unix()
-	i.Used = false
 
 	conn := database.GetColCtx(inviteColName, db, 30)
 	result, err := conn.Col.InsertOne(conn.Ctx, i)
@@ -50,39 +74,87 @@ func (i *Invite) Init(db *mongo.Database, validity int) (*mongo.InsertOneResult,
 	return result, err
 }
 
-// Invalidate verifies that the token is in the database and is valid.
-// If the token is valid, it sets it's used state to used.
-func (i *Invite) Invalidate(db *mongo.Database) error {
-	// find token
-	if err := i.FindToken(db); err != nil {
-		return err
+// Redeem verifies that the token is in the database and is valid for the
+// passed email. If the token is valid, the usage is recorded for the user.
+// The token is consumed atomically, so that it cannot be used more often than
+// allowed by parallel requests.
+func (i *Invite) Redeem(db *mongo.Database, username string, email string) error {
+	now := time.Now().Unix()
+	filter := bson.M{
+		"token":   i.Token,
+		"revoked": bson.M{"$ne": true},
+		// used is set by single-use invites of earlier versions
+		"used":  bson.M{"$ne": true},
+		"until": bson.M{"$gte": now},
+		"$expr": bson.M{"$lt": bson.A{
+			bson.M{"$ifNull": bson.A{"$uses", 0}},
+			bson.M{"$ifNull": bson.A{"$maxUses", 1}},
+		}},
+		"$or": []bson.M{
+			{"email": bson.M{"$exists": false}},
+			{"email": strings.ToLower(email)},
+		},
 	}
-	// verify
-	if i.Used {
-		// token has been used already
-		return errors.New("token has been used already")
-	} else if i.Until < time.Now().Unix() {
-		// token has been expired
-		return errors.New("token has been expired")
+	update := bson.M{
+		"$inc":  bson.M{"uses": 1},
+		"$push": bson.M{"redemptions": InviteRedemption{Username: username, Redeemed: now}},
 	}
-	// invalidate
-	i.Used = true
-	filter := bson.M{"token": i.Token}
-	update := bson.M{"$set": i}
 	// options to return the updated document
 	after := options.After
-	upsert := true
 	options := options.FindOneAndUpdateOptions{
 		ReturnDocument: &after,
-		Upsert:         &upsert,
 	}
 	// execute update
 	conn := database.GetColCtx(inviteColName, db, 30)
 	err := conn.Col.FindOneAndUpdate(conn.Ctx, filter, update, &options).Decode(&i)
 	defer conn.Cancel()
+	if err != mongo.ErrNoDocuments {
+		return err
+	}
+	// find out why the token could not be redeemed
+	if err := i.FindToken(db); err != nil {
+		return err
+	}
+	switch {
+	case i.Revoked:
+		return errors.New("token has been revoked")
+	case i.Until < now:
+		return errors.New("token has been expired")
+	case i.Email != "" && i.Email != strings.ToLower(email):
+		return errors.New("token has been issued for another email")
+	default:
+		return errors.New("token has been used already")
+	}
+}
+
+// Release reverts the redemption of the user (e.g. if the registration
+// failed)
+func (i *Invite) Release(db *mongo.Database, username string) error {
+	filter := bson.M{"token": i.Token, "redemptions.username": username}
+	update := bson.M{
+		"$inc":  bson.M{"uses": -1},
+		"$pull": bson.M{"redemptions": bson.M{"username": username}},
+	}
+	conn := database.GetColCtx(inviteColName, db, 30)
+	defer conn.Cancel()
+	_, err := conn.Col.UpdateOne(conn.Ctx, filter, update)
+	return err
+}
+
+// Revoke revokes the invite of the inviter, so that it cannot be redeemed
+// anymore
+func (i *Invite) Revoke(db *mongo.Database) error {
+	filter := bson.M{"_id": i.ID, "inviter": i.Inviter}
+	update := bson.M{"$set": bson.M{"revoked": true}}
+	conn := database.GetColCtx(inviteColName, db, 30)
+	defer conn.Cancel()
+	res, err := conn.Col.UpdateOne(conn.Ctx, filter, update)
 	if err != nil {
 		return err
 	}
+	if res.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
 	return nil
 }
 
@@ -104,36 +176,34 @@ func (i *Invite) FindID(db *mongo.Database) error {
 	return err
 }
 
-// Revalidate sets the given token usage to false and adjusts the until date if
-// needed
-func (i *Invite) Revalidate(db *mongo.Database, validity int) error {
-	// find token
-	if err := i.FindToken(db); err != nil {
-		return err
+// GetInvitesByInviter selects all invites of the inviter (newest first)
+func GetInvitesByInviter(db *mongo.Database, inviter string) ([]Invite, error) {
+	conn := database.GetColCtx(inviteColName, db, 30)
+	defer conn.Cancel()
+	opts := options.Find().SetSort(bson.M{"created": -1})
+	cursor, err := conn.Col.Find(conn.Ctx, bson.M{"inviter": inviter}, opts)
+	if err != nil {
+		return nil, err
 	}
-	i.Used = false
-	// adjust date if expired
-	if i.Until < time.Now().Unix() {
-		i.Until = time.Now().Add(time.Hour * time.Duration(validity*24)).Unix()
+	invites := []Invite{}
+	if err := cursor.All(conn.Ctx, &invites); err != nil {
+		return nil, err
 	}
+	return invites, nil
+}
 
-	filter := bson.M{"token": i.Token}
-	update := bson.M{"$set": i}
-	// set update options
-	after := options.After
-	upsert := true
-	options := options.FindOneAndUpdateOptions{
-		ReturnDocument: &after,
-		Upsert:         &upsert,
+// CountActiveInvites counts the invites of the inviter that can still be
+// redeemed
+func CountActiveInvites(db *mongo.Database, inviter string) (int64, error) {
+	filter := bson.M{
+		"inviter": inviter,
+		"revoked": bson.M{"$ne": true},
+		"until":   bson.M{"$gte": time.Now().Unix()},
+		"$expr":   bson.M{"$lt": bson.A{"$uses", "$maxUses"}},
 	}
-	// execute update
 	conn := database.GetColCtx(inviteColName, db, 30)
-	err := conn.Col.FindOneAndUpdate(conn.Ctx, filter, update, &options).Decode(&i)
 	defer conn.Cancel()
-	if err != nil {
-		return err
-	}
-	return nil
+	return conn.Col.CountDocuments(conn.Ctx, filter)
 }
 
 // GenerateToken creates a crypto/rand based unique token
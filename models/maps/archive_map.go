@@ -0,0 +1,14 @@
+package maps
+
+// ArchiveFile maps a file of a user to its name within an archive
+type ArchiveFile struct {
+	Username string `json:"username"`
+	Filename string `json:"filename"`
+	Name     string `json:"name,omitempty"`
+}
+
+// ArchiveRequest lists all files that should be streamed as archive
+type ArchiveRequest struct {
+	Format string        `json:"format,omitempty"`
+	Files  []ArchiveFile `json:"files"`
+}
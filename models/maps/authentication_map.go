@@ -0,0 +1,10 @@
+package maps
+
+// NodeAuthentication is returned to the node after it authenticated to the
+// gateway
+type NodeAuthentication struct {
+	// SigningKey is the base64 encoded key of the signed file urls
+	SigningKey string `json:"signingKey"`
+	// GatewayClientID is the client id of the service account of the gateway
+	GatewayClientID string `json:"gatewayClientID"`
+}
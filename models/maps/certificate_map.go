@@ -0,0 +1,6 @@
+package maps
+
+// CertificateRequest contains the pem encoded certificate request of a node
+type CertificateRequest struct {
+	CSR string `json:"csr"`
+}
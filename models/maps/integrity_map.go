@@ -0,0 +1,10 @@
+package maps
+
+// IntegrityFailure is a file, whose content does not match the recorded sha1
+type IntegrityFailure struct {
+	MediaID string `json:"mediaID"`
+	// Reason is one of checksum, truncated or unreadable
+	Reason string `json:"reason"`
+	Sha1   string `json:"sha1,omitempty"`
+	Size   int64  `json:"size"`
+}
@@ -0,0 +1,20 @@
+package maps
+
+// NodeStructure is a page of the manifest of all files, that should be stored
+// on a node. The pages are ordered by media id and start after the passed id.
+type NodeStructure struct {
+	After   string               `json:"after,omitempty"`
+	Size    int                  `json:"size"`
+	Total   int64                `json:"total"`
+	Entries []NodeStructureEntry `json:"entries"`
+}
+
+// NodeStructureEntry is a file of a media and the groups it is shared with
+type NodeStructureEntry struct {
+	MediaID  string   `json:"mediaID"`
+	Username string   `json:"username"`
+	Filename string   `json:"filename"`
+	Sha1     string   `json:"sha1"`
+	Size     int64    `json:"size,omitempty"`
+	Groups   []string `json:"groups,omitempty"`
+}
@@ -0,0 +1,9 @@
+package maps
+
+// QuotaRequest asks the gateway whether a user may store additional bytes on
+// a node
+type QuotaRequest struct {
+	Username string `json:"username"`
+	Size     int64  `json:"size"`
+	Files    int64  `json:"files"`
+}
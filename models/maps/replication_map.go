@@ -0,0 +1,36 @@
+package maps
+
+// ReplicationRequest instructs a node to copy a file of a user from another
+// node
+type ReplicationRequest struct {
+	// Source is the api endpoint of the node, that holds the file
+	Source string `json:"source"`
+	// SourceID is the id of the source node. The target resolves the endpoint
+	// of the source at the gateway.
+	SourceID string `json:"sourceID,omitempty"`
+	Username string `json:"username"`
+	Filename string `json:"filename"`
+	// Sha1 is verified after the copy
+	Sha1 string `json:"sha1"`
+	// Size is checked against the quota of the user on the target
+	Size int64 `json:"size,omitempty"`
+	// Groups the file is shared with
+	Groups []string `json:"groups,omitempty"`
+	// URL and URLThumb are the signed urls of the file and its thumbnail on
+	// the source node
+	URL      string `json:"url,omitempty"`
+	URLThumb string `json:"urlThumb,omitempty"`
+}
+
+// MigrationRequest moves the media of a node to the target node
+type MigrationRequest struct {
+	Target string `json:"target"`
+	// Username limits the migration to the media of the user
+	Username string `json:"username,omitempty"`
+}
+
+// NodeEndpoint is the endpoint of a node returned to another node
+type NodeEndpoint struct {
+	ID          string `json:"id"`
+	APIEndpoint string `json:"APIEndpoint"`
+}
@@ -0,0 +1,51 @@
+package maps
+
+// NodeStats is the storage usage of a node
+type NodeStats struct {
+	DiskFree  uint64 `json:"diskFree"`
+	DiskTotal uint64 `json:"diskTotal"`
+	// Originals and Thumbnails sum up the files of all users
+	Originals  FileStats      `json:"originals"`
+	Thumbnails FileStats      `json:"thumbnails"`
+	Users      []StorageStats `json:"users,omitempty"`
+	// Groups contain hard links of the user files and do not occupy
+	// additional space
+	Groups []StorageStats `json:"groups,omitempty"`
+}
+
+// StorageStats is the storage usage of a user or group directory
+type StorageStats struct {
+	Identifier string    `json:"identifier"`
+	Originals  FileStats `json:"originals"`
+	Thumbnails FileStats `json:"thumbnails"`
+}
+
+// FileStats sums up the size and count of files
+type FileStats struct {
+	Bytes int64 `json:"bytes"`
+	Files int64 `json:"files"`
+}
+
+// Add adds the passed stats
+func (f *FileStats) Add(o FileStats) {
+	f.Bytes += o.Bytes
+	f.Files += o.Files
+}
+
+// NodeStatsReport contains the stats of a single node for the dashboard
+type NodeStatsReport struct {
+	NodeID string     `json:"nodeID"`
+	Title  string     `json:"title"`
+	Status string     `json:"status,omitempty"`
+	Stats  *NodeStats `json:"stats,omitempty"`
+	// Error is set, if the stats could not be requested from the node
+	Error string `json:"error,omitempty"`
+}
+
+// StatsDashboard aggregates the stats of the nodes of an owner
+type StatsDashboard struct {
+	Nodes []NodeStatsReport `json:"nodes"`
+	// Total sums up the stats of all reachable nodes (users and groups are
+	// merged by identifier)
+	Total NodeStats `json:"total"`
+}
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/mirisbowring/primboard/helper/database"
+	"github.com/mirisbowring/primboard/helper/geo"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -28,14 +29,26 @@ type Media struct {
 	Events          []primitive.ObjectID `json:"events,omitempty" bson:"events,omitempty"`
 	GroupIDs        []primitive.ObjectID `json:"groupIDs,omitempty" bson:"groupIDs,omitempty"`
 	Timestamp       int64                `json:"timestamp,omitempty" bson:"timestamp,omitempty"`
+	TimestampOffset *int                 `json:"timestampOffset,omitempty" bson:"timestampOffset,omitempty"`
+	TimestampLocal  string               `json:"timestampLocal,omitempty" bson:"-"`
 	TimestampUpload int64                `json:"timestampUpload,omitempty" bson:"timestampUpload,omitempty"`
+	Camera          string               `json:"camera,omitempty" bson:"camera,omitempty"`
+	Location        *GeoPoint            `json:"location,omitempty" bson:"location,omitempty"`
+	Place           *geo.Place           `json:"place,omitempty" bson:"place,omitempty"`
 	URL             string               `json:"url,omitempty" bson:"url,omitempty"`
 	URLThumb        string               `json:"urlThumb,omitempty" bson:"urlThumb,omitempty"`
 	Type            string               `json:"type,omitempty" bson:"type,omitempty"`
 	Extension       string               `json:"extension,omitempty" bson:"extension,omitempty"`
+	Size            int64                `json:"size,omitempty" bson:"size,omitempty"`
 	ContentType     string               `json:"contentType,omitempty" bson:"contentType,omitempty"`
 	Tags            []string             `json:"tags,omitempty" bson:"tags,omitempty"`
 	NodeIDs         []primitive.ObjectID `json:"nodeIDs,omitempty" bson:"nodeIDs,omitempty"`
+	// Unavailable is set if all nodes of the media are offline
+	Unavailable bool `json:"unavailable,omitempty" bson:"unavailable,omitempty"`
+	// SyncStatus is set while node operations of the media are pending or failed
+	SyncStatus string `json:"syncStatus,omitempty" bson:"syncStatus,omitempty"`
+	// Missing is set if the original of the media is missing on its only node
+	Missing bool `json:"missing,omitempty" bson:"missing,omitempty"`
 	// Users           []string             `json:"users,omitempty"`
 	Groups []UserGroup `json:"groups,omitempty"`
 	Nodes  []Node      `json:"nodes,omitempty"`
@@ -65,13 +78,21 @@ var MediaProject = bson.M{
 	"creator":         1,
 	"events":          1,
 	"timestamp":       1,
+	"timestampOffset": 1,
 	"timestampUpload": 1,
+	"camera":          1,
+	"location":        1,
+	"place":           1,
 	"url":             1,
 	"urlThumb":        1,
 	"type":            1,
 	"extension":       1,
+	"size":            1,
 	"contentType":     1,
 	"tags":            1,
+	"unavailable":     1,
+	"syncStatus":      1,
+	"missing":         1,
 	// "users":           1,
 	"groups": UserGroupProject,
 	"nodes":  NodeProject,
@@ -90,13 +111,21 @@ var MediaProjectInternal = bson.M{
 	"events":          1,
 	"groupIDs":        1,
 	"timestamp":       1,
+	"timestampOffset": 1,
 	"timestampUpload": 1,
+	"camera":          1,
+	"location":        1,
+	"place":           1,
 	"url":             1,
 	"urlThumb":        1,
 	"type":            1,
 	"extension":       1,
+	"size":            1,
 	"contentType":     1,
 	"tags":            1,
+	"unavailable":     1,
+	"syncStatus":      1,
+	"missing":         1,
 	"nodes":           NodeProject,
 }
 
@@ -112,7 +141,13 @@ var MediaListProject = bson.M{
 	"urlThumb":      1,
 	"type":          1,
 	"extension":     1,
+	"size":          1,
 	"contentType":   1,
+	"location":      1,
+	"place":         1,
+	"unavailable":   1,
+	"syncStatus":    1,
+	"missing":       1,
 	"nodes":         NodeProject,
 	"groups":        UserGroupProject,
 }
@@ -198,6 +233,229 @@ func (m *Media) AddUserGroups(db *mongo.Database, ugIDs []primitive.ObjectID) er
 	return nil
 }
 
+// UpdateMediaAvailability flags the media, whose nodes are all offline, as
+// unavailable and removes the flag from all other media
+func UpdateMediaAvailability(db *mongo.Database, offline []primitive.ObjectID) error {
+	// all nodes of the media are in the offline list
+	unavailable := bson.M{
+		"nodeIDs.0": bson.M{"$exists": true},
+		"nodeIDs":   bson.M{"$not": bson.M{"$elemMatch": bson.M{"$nin": offline}}},
+	}
+	conn := database.GetColCtx(MediaCollection, db, 30)
+	defer conn.Cancel()
+	if _, err := conn.Col.UpdateMany(conn.Ctx, unavailable, bson.M{"$set": bson.M{"unavailable": true}}); err != nil {
+		return err
+	}
+	available := bson.M{
+		"unavailable": true,
+		"nodeIDs":     bson.M{"$elemMatch": bson.M{"$nin": offline}},
+	}
+	_, err := conn.Col.UpdateMany(conn.Ctx, available, bson.M{"$unset": bson.M{"unavailable": ""}})
+	return err
+}
+
+// AddNodeID adds the node to the media after a copy has been stored on it
+func (m *Media) AddNodeID(db *mongo.Database, nodeID primitive.ObjectID) error {
+	update := bson.M{
+		"$addToSet": bson.M{"nodeIDs": nodeID},
+		"$unset":    bson.M{"unavailable": "", "missing": ""},
+	}
+	conn := database.GetColCtx(MediaCollection, db, 30)
+	defer conn.Cancel()
+	_, err := conn.Col.UpdateOne(conn.Ctx, bson.M{"_id": m.ID}, update)
+	return err
+}
+
+// RemoveNodeID removes the node from the media
+func (m *Media) RemoveNodeID(db *mongo.Database, nodeID primitive.ObjectID) error {
+	conn := database.GetColCtx(MediaCollection, db, 30)
+	defer conn.Cancel()
+	_, err := conn.Col.UpdateOne(conn.Ctx, bson.M{"_id": m.ID}, bson.M{"$pull": bson.M{"nodeIDs": nodeID}})
+	return err
+}
+
+// GetNodeMediaIDs selects the ids of the media stored on the node (optionally
+// only of the passed user)
+func GetNodeMediaIDs(db *mongo.Database, nodeID primitive.ObjectID, username string) ([]primitive.ObjectID, error) {
+	filter := bson.M{"nodeIDs": nodeID}
+	if username != "" {
+		filter["creator"] = username
+	}
+	conn := database.GetColCtx(MediaCollection, db, 30)
+	defer conn.Cancel()
+	opts := options.Find().SetProjection(bson.M{"_id": 1}).SetSort(bson.M{"_id": 1})
+	cursor, err := conn.Col.Find(conn.Ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var media []Media
+	if err := cursor.All(conn.Ctx, &media); err != nil {
+		return nil, err
+	}
+	ids := make([]primitive.ObjectID, len(media))
+	for i, m := range media {
+		ids[i] = m.ID
+	}
+	return ids, nil
+}
+
+// CountOrphanedMedia counts the media, that are only stored on the node
+func CountOrphanedMedia(db *mongo.Database, nodeID primitive.ObjectID) (int64, error) {
+	filter := bson.M{"$and": []bson.M{{"nodeIDs": nodeID}, {"nodeIDs": bson.M{"$size": 1}}}}
+	conn := database.GetColCtx(MediaCollection, db, 30)
+	defer conn.Cancel()
+	return conn.Col.CountDocuments(conn.Ctx, filter)
+}
+
+// RemoveNodeFromMedia removes the node from all media and returns the ids of
+// the affected media
+func RemoveNodeFromMedia(db *mongo.Database, nodeID primitive.ObjectID) ([]primitive.ObjectID, error) {
+	conn := database.GetColCtx(MediaCollection, db, 30)
+	defer conn.Cancel()
+	filter := bson.M{"nodeIDs": nodeID}
+	opts := options.Find().SetProjection(bson.M{"_id": 1})
+	cursor, err := conn.Col.Find(conn.Ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var media []Media
+	if err := cursor.All(conn.Ctx, &media); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Col.UpdateMany(conn.Ctx, filter, bson.M{"$pull": bson.M{"nodeIDs": nodeID}}); err != nil {
+		return nil, err
+	}
+	ids := make([]primitive.ObjectID, len(media))
+	for i, m := range media {
+		ids[i] = m.ID
+	}
+	return ids, nil
+}
+
+// GetNodeMediaPage selects a page of the media stored on the node, that
+// follows the passed id (ordered by id), and the total count. A zero id
+// selects the first page.
+func GetNodeMediaPage(db *mongo.Database, nodeID primitive.ObjectID, after primitive.ObjectID, size int) ([]Media, int64, error) {
+	filter := bson.M{"nodeIDs": nodeID}
+	conn := database.GetColCtx(MediaCollection, db, 30)
+	defer conn.Cancel()
+	total, err := conn.Col.CountDocuments(conn.Ctx, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !after.IsZero() {
+		filter = bson.M{"nodeIDs": nodeID, "_id": bson.M{"$gt": after}}
+	}
+	opts := options.Find().
+		SetProjection(bson.M{"_id": 1, "creator": 1, "filename": 1, "sha1": 1, "size": 1, "groupIDs": 1}).
+		SetSort(bson.M{"_id": 1}).
+		SetLimit(int64(size))
+	cursor, err := conn.Col.Find(conn.Ctx, filter, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	media := []Media{}
+	if err := cursor.All(conn.Ctx, &media); err != nil {
+		return nil, 0, err
+	}
+	return media, total, nil
+}
+
+// ReportMissingMedia handles the media, whose original is missing on the
+// node. The node is removed from the media with further copies (to be
+// replicated again), the others are flagged as missing. Returns the media,
+// the node has been removed from.
+func ReportMissingMedia(db *mongo.Database, nodeID primitive.ObjectID, ids []primitive.ObjectID) ([]Media, error) {
+	conn := database.GetColCtx(MediaCollection, db, 30)
+	defer conn.Cancel()
+	filter := bson.M{"_id": bson.M{"$in": ids}, "nodeIDs": nodeID}
+
+	// the only copy is lost
+	only := bson.M{"$and": []bson.M{filter, {"nodeIDs": bson.M{"$size": 1}}}}
+	if _, err := conn.Col.UpdateMany(conn.Ctx, only, bson.M{"$set": bson.M{"missing": true}}); err != nil {
+		return nil, err
+	}
+
+	copies := bson.M{"$and": []bson.M{filter, {"nodeIDs.1": bson.M{"$exists": true}}}}
+	project := bson.M{"_id": 1, "creator": 1, "type": 1, "size": 1}
+	cursor, err := conn.Col.Find(conn.Ctx, copies, options.Find().SetProjection(project))
+	if err != nil {
+		return nil, err
+	}
+	var media []Media
+	if err := cursor.All(conn.Ctx, &media); err != nil {
+		return nil, err
+	}
+	if len(media) == 0 {
+		return nil, nil
+	}
+	replicate := make([]primitive.ObjectID, len(media))
+	for i, m := range media {
+		replicate[i] = m.ID
+	}
+	_, err = conn.Col.UpdateMany(conn.Ctx, bson.M{"_id": bson.M{"$in": replicate}}, bson.M{"$pull": bson.M{"nodeIDs": nodeID}})
+	return media, err
+}
+
+// GetUnderReplicatedMedia selects the ids of the media following the passed
+// id (ordered by id), that are stored on less of the healthy nodes than their
+// policies require (but at least on one of them). The replica count of a media
+// is the highest count of the policies of its creator and groups (at least
+// the passed default).
+func GetUnderReplicatedMedia(db *mongo.Database, healthy []primitive.ObjectID, def int, after primitive.ObjectID, limit int64) ([]primitive.ObjectID, error) {
+	copies := bson.M{"$size": bson.M{"$setIntersection": bson.A{
+		bson.M{"$ifNull": bson.A{"$nodeIDs", bson.A{}}},
+		healthy,
+	}}}
+	highest := def
+	if MaxReplicas > highest {
+		highest = MaxReplicas
+	}
+	pipeline := []bson.M{
+		{"$match": bson.M{"nodeIDs": bson.M{"$in": healthy}, "_id": bson.M{"$gt": after}}},
+		{"$sort": bson.M{"_id": 1}},
+		{"$project": bson.M{"creator": 1, "groupIDs": 1, "copies": copies}},
+		// no policy requires more copies
+		{"$match": bson.M{"copies": bson.M{"$lt": highest}}},
+		{"$lookup": bson.M{
+			"from": ReplicationPolicyCollection,
+			"let": bson.M{
+				"creator": "$creator",
+				"groups":  bson.M{"$ifNull": bson.A{"$groupIDs", bson.A{}}},
+			},
+			"pipeline": []bson.M{
+				{"$match": bson.M{"$expr": bson.M{"$or": bson.A{
+					bson.M{"$eq": bson.A{"$username", "$$creator"}},
+					bson.M{"$in": bson.A{"$groupID", "$$groups"}},
+				}}}},
+				{"$project": bson.M{"replicas": 1}},
+			},
+			"as": "policies",
+		}},
+		{"$match": bson.M{"$expr": bson.M{"$lt": bson.A{
+			"$copies",
+			bson.M{"$max": bson.A{def, bson.M{"$max": "$policies.replicas"}}},
+		}}}},
+		{"$limit": limit},
+		{"$project": bson.M{"_id": 1}},
+	}
+	conn := database.GetColCtx(MediaCollection, db, 30)
+	defer conn.Cancel()
+	cursor, err := conn.Col.Aggregate(conn.Ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var media []Media
+	if err := cursor.All(conn.Ctx, &media); err != nil {
+		return nil, err
+	}
+	ids := make([]primitive.ObjectID, len(media))
+	for i, m := range media {
+		ids[i] = m.ID
+	}
+	return ids, nil
+}
+
 // BulkAddTagMedia bulk operates an add Tags to  many media ids
 func BulkAddTagMedia(db *mongo.Database, tags []string, ids []primitive.ObjectID, permission bson.M) (*mongo.BulkWriteResult, error) {
 	if permission == nil {
@@ -602,12 +860,31 @@ func (m *Media) ManageGroupIDs(db *mongo.Database, operator string) int {
 	return status
 }
 
-// UpdateMedia updates the record with the passed one
+// editable returns a copy of the media, that contains the fields a
+// contributor may modify only (creator, groups, nodes, the file, the creation
+// date and the location are managed by their own routes)
+func (m Media) editable() Media {
+	return Media{
+		Title:       m.Title,
+		Description: m.Description,
+		Comments:    m.Comments,
+		Camera:      m.Camera,
+		Tags:        m.Tags,
+	}
+}
+
+// UpdateMedia updates the record with the editable fields of the passed one
 // Does NOT call the checkComments Method
 func (m *Media) UpdateMedia(db *mongo.Database, um Media) error {
 	conn := database.GetColCtx(MediaCollection, db, 30)
 	filter := bson.M{"_id": m.ID}
-	update := bson.M{"$set": um}
+	e := um.editable()
+	if e.Title == "" && e.Description == "" && len(e.Comments) == 0 && e.Camera == "" && len(e.Tags) == 0 {
+		// nothing to update (an empty $set is rejected)
+		defer conn.Cancel()
+		return conn.Col.FindOne(conn.Ctx, filter).Decode(&m)
+	}
+	update := bson.M{"$set": e}
 	// options to return the update document
 	after := options.After
 	upsert := true
@@ -661,9 +938,16 @@ func buildTagFilter(tagFilter string) bson.M {
 	if len(tags) == 0 {
 		return bson.M{}
 	}
-	// iterate over passed tags and append regex pattern
+	// iterate over passed tags and append regex pattern (a term matches either
+	// a tag or the resolved place of the media)
 	for _, tag := range tags {
-		filters = append(filters, bson.M{"tags": bson.M{"$regex": tag, "$options": "i"}})
+		regex := bson.M{"$regex": tag, "$options": "i"}
+		filters = append(filters, bson.M{"$or": []bson.M{
+			{"tags": regex},
+			{"place.city": regex},
+			{"place.region": regex},
+			{"place.country": regex},
+		}})
 	}
 
 	if len(filters) > 1 {
@@ -677,3 +961,29 @@ func buildTagFilter(tagFilter string) bson.M {
 		return bson.M{}
 	}
 }
+
+// GetMediaBySha1s selects the id and hash of all media with one of the passed
+// hashes that match the permission filter
+func GetMediaBySha1s(db *mongo.Database, hashes []string, permission bson.M) ([]Media, error) {
+	if permission == nil {
+		return nil, errors.New("no permissions specified")
+	}
+	filter := bson.M{"$and": []bson.M{
+		{"sha1": bson.M{"$in": hashes}},
+		permission}}
+	opts := options.Find().SetProjection(bson.M{"_id": 1, "sha1": 1})
+
+	conn := database.GetColCtx(MediaCollection, db, 30)
+	defer conn.Cancel()
+
+	var media []Media
+	cursor, err := conn.Col.Find(conn.Ctx, filter, opts)
+	if err != nil {
+		log.Error(err.Error())
+		return media, err
+	}
+	defer cursor.Close(conn.Ctx)
+
+	cursor.All(conn.Ctx, &media)
+	return media, nil
+}
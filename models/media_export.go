@@ -0,0 +1,95 @@
+package models
+
+import (
+	"errors"
+
+	"github.com/mirisbowring/primboard/helper/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ExportRequest specifies which media should be exported. If All is set, the
+// whole library of the user is exported.
+type ExportRequest struct {
+	MediaIDs []string `json:"mediaIDs,omitempty"`
+	EventIDs []string `json:"eventIDs,omitempty"`
+	All      bool     `json:"all,omitempty"`
+	Format   string   `json:"format,omitempty"`
+}
+
+// MediaExport is the json sidecar that is added to every export
+type MediaExport struct {
+	Timestamp int64    `json:"timestamp"`
+	Media     []Media  `json:"media"`
+	Events    []Event  `json:"events,omitempty"`
+	Missing   []string `json:"missing,omitempty"`
+}
+
+// IsValid verifies that anything has been selected for the export
+func (e *ExportRequest) IsValid() error {
+	if !e.All && len(e.MediaIDs) == 0 && len(e.EventIDs) == 0 {
+		return errors.New("nothing specified to export")
+	}
+	return nil
+}
+
+// GetMediaForExport selects all media by ids or events (or all if both are
+// empty) that match the permission filter
+func GetMediaForExport(db *mongo.Database, mediaIDs []primitive.ObjectID, eventIDs []primitive.ObjectID, permission bson.M) ([]Media, error) {
+	if permission == nil {
+		return nil, errors.New("no permissions specified")
+	}
+
+	selection := []bson.M{}
+	if len(mediaIDs) > 0 {
+		selection = append(selection, bson.M{"_id": bson.M{"$in": mediaIDs}})
+	}
+	if len(eventIDs) > 0 {
+		selection = append(selection, bson.M{"events": bson.M{"$in": eventIDs}})
+	}
+	filters := []bson.M{permission}
+	if len(selection) > 0 {
+		filters = append(filters, bson.M{"$or": selection})
+	}
+
+	pipeline := []bson.M{
+		{"$match": bson.M{"$and": filters}},
+		{"$sort": bson.M{"_id": 1}},
+		{"$lookup": bson.M{
+			"from":         "node",
+			"localField":   "nodeIDs",
+			"foreignField": "_id",
+			"as":           "nodes",
+		}},
+		{"$project": MediaProjectInternal},
+	}
+
+	opts := options.Aggregate()
+	conn := database.GetColCtx(MediaCollection, db, 30)
+	defer conn.Cancel()
+	cursor, err := conn.Col.Aggregate(conn.Ctx, pipeline, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(conn.Ctx)
+
+	var media []Media
+	if err = cursor.All(conn.Ctx, &media); err != nil {
+		return nil, err
+	}
+	return media, nil
+}
+
+// ExportCopy returns a copy of the media without any infrastructure details to
+// be stored in the sidecar of an export
+func (m Media) ExportCopy() Media {
+	m.GroupIDs = nil
+	m.Groups = nil
+	m.NodeIDs = nil
+	m.Nodes = nil
+	m.URL = ""
+	m.URLThumb = ""
+	return m
+}
@@ -0,0 +1,299 @@
+package models
+
+import (
+	"errors"
+	"math"
+
+	"github.com/mirisbowring/primboard/helper"
+	"github.com/mirisbowring/primboard/helper/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// GeoPoint is a GeoJSON point. Coordinates are stored as [longitude, latitude]
+type GeoPoint struct {
+	Type        string    `json:"type" bson:"type"`
+	Coordinates []float64 `json:"coordinates" bson:"coordinates"`
+}
+
+// BoundingBox describes the visible area of a map in degrees
+type BoundingBox struct {
+	West  float64 `json:"west"`
+	South float64 `json:"south"`
+	East  float64 `json:"east"`
+	North float64 `json:"north"`
+}
+
+// MediaCluster is a server side aggregated marker of multiple media
+type MediaCluster struct {
+	Location GeoPoint           `json:"location" bson:"location"`
+	Count    int                `json:"count" bson:"count"`
+	MediaID  primitive.ObjectID `json:"mediaID,omitempty" bson:"mediaID,omitempty"`
+	URLThumb string             `json:"urlThumb,omitempty" bson:"urlThumb,omitempty"`
+}
+
+// maxZoom is the deepest zoom level clusters are calculated for
+const maxZoom = 22
+
+// clusterCellsPerTile is the number of cluster cells per map tile and axis
+const clusterCellsPerTile = 4
+
+// NewGeoPoint creates a GeoJSON point from longitude and latitude
+func NewGeoPoint(lon float64, lat float64) *GeoPoint {
+	return &GeoPoint{Type: "Point", Coordinates: []float64{lon, lat}}
+}
+
+// IsValid verifies that the point is a GeoJSON point within valid ranges
+func (p *GeoPoint) IsValid() error {
+	if p.Type != "Point" {
+		return errors.New("location must be of type 'Point'")
+	}
+	if len(p.Coordinates) != 2 {
+		return errors.New("location must consist of longitude and latitude")
+	}
+	if lon := p.Coordinates[0]; lon < -180 || lon > 180 {
+		return errors.New("longitude is out of range")
+	}
+	if lat := p.Coordinates[1]; lat < -90 || lat > 90 {
+		return errors.New("latitude is out of range")
+	}
+	return nil
+}
+
+// IsValid verifies the ranges of the bounding box. A west value greater than
+// the east value describes a box crossing the antimeridian.
+func (b *BoundingBox) IsValid() error {
+	if b.West < -180 || b.West > 180 || b.East < -180 || b.East > 180 {
+		return errors.New("longitude is out of range")
+	}
+	if b.South < -90 || b.North > 90 {
+		return errors.New("latitude is out of range")
+	}
+	if b.South >= b.North {
+		return errors.New("'south' must be below 'north'")
+	}
+	if b.West == b.East {
+		return errors.New("'west' and 'east' must not be equal")
+	}
+	return nil
+}
+
+// filter creates a $geoWithin filter on the location field. Boxes crossing the
+// antimeridian are split and every part is divided into polygons of at most 90
+// degrees width, so that mongodb never chooses the complementary polygon.
+func (b *BoundingBox) filter() bson.M {
+	var ranges [][2]float64
+	if b.West < b.East {
+		ranges = append(ranges, [2]float64{b.West, b.East})
+	} else {
+		ranges = append(ranges, [2]float64{b.West, 180}, [2]float64{-180, b.East})
+	}
+
+	var filters []bson.M
+	for _, r := range ranges {
+		for west := r[0]; west < r[1]; west += 90 {
+			east := math.Min(west+90, r[1])
+			polygon := [][][]float64{{
+				{west, b.South},
+				{east, b.South},
+				{east, b.North},
+				{west, b.North},
+				{west, b.South},
+			}}
+			filters = append(filters, bson.M{"location": bson.M{"$geoWithin": bson.M{
+				"$geometry": bson.M{"type": "Polygon", "coordinates": polygon},
+			}}})
+		}
+	}
+	if len(filters) == 1 {
+		return filters[0]
+	}
+	return bson.M{"$or": filters}
+}
+
+// ApplyExifLocation sets the location from the exif gps data if no location
+// has been set yet
+func (m *Media) ApplyExifLocation(exif *helper.Exif) {
+	if exif == nil || !exif.HasGPS || m.Location != nil {
+		return
+	}
+	m.Location = NewGeoPoint(exif.Longitude, exif.Latitude)
+}
+
+// SetLocation stores the location and the place of the media. The place is
+// removed, if it has not been resolved for the new location.
+func (m *Media) SetLocation(db *mongo.Database) error {
+	set := bson.M{"location": m.Location}
+	update := bson.M{"$set": set}
+	if m.Place != nil {
+		set["place"] = m.Place
+	} else {
+		update["$unset"] = bson.M{"place": ""}
+	}
+	conn := database.GetColCtx(MediaCollection, db, 30)
+	defer conn.Cancel()
+	res, err := conn.Col.UpdateOne(conn.Ctx, bson.M{"_id": m.ID}, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// EnsureMediaIndexes creates the indexes of the media collection
+func EnsureMediaIndexes(db *mongo.Database) error {
+	conn := database.GetColCtx(MediaCollection, db, 30)
+	defer conn.Cancel()
+	index := mongo.IndexModel{
+		Keys:    bson.D{{Key: "location", Value: "2dsphere"}},
+		Options: options.Index().SetName("location_2dsphere"),
+	}
+	if _, err := conn.Col.Indexes().CreateOne(conn.Ctx, index); err != nil {
+		log.WithFields(log.Fields{
+			"collection": MediaCollection,
+			"error":      err.Error(),
+		}).Error("could not create geospatial index")
+		return err
+	}
+	return nil
+}
+
+// GetMediaInBox selects all media with a location inside of the bounding box
+// that match the permission filter
+func GetMediaInBox(db *mongo.Database, box BoundingBox, permission bson.M, limit int) ([]Media, error) {
+	if permission == nil {
+		return nil, errors.New("no permissions specified")
+	}
+	if err := box.IsValid(); err != nil {
+		return nil, err
+	}
+
+	pipeline := []bson.M{
+		{"$match": bson.M{"$and": []bson.M{box.filter(), permission}}},
+		{"$sort": bson.M{"_id": -1}},
+	}
+	if limit > 0 {
+		pipeline = append(pipeline, bson.M{"$limit": limit})
+	}
+	pipeline = append(pipeline,
+		bson.M{"$lookup": bson.M{
+			"from":         "usergroup",
+			"localField":   "groupIDs",
+			"foreignField": "_id",
+			"as":           "groups",
+		}},
+		bson.M{"$lookup": bson.M{
+			"from":         "node",
+			"localField":   "nodeIDs",
+			"foreignField": "_id",
+			"as":           "nodes",
+		}},
+		bson.M{"$project": MediaListProject},
+	)
+
+	conn := database.GetColCtx(MediaCollection, db, 30)
+	defer conn.Cancel()
+	cursor, err := conn.Col.Aggregate(conn.Ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var ms []Media
+	if err = cursor.All(conn.Ctx, &ms); err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
+
+// GetMediaClusters groups all media inside of the bounding box into a grid
+// whose cell size depends on the zoom level and returns one marker per cell
+func GetMediaClusters(db *mongo.Database, box BoundingBox, zoom int, permission bson.M) ([]MediaCluster, error) {
+	if permission == nil {
+		return nil, errors.New("no permissions specified")
+	}
+	if err := box.IsValid(); err != nil {
+		return nil, err
+	}
+	if zoom < 0 || zoom > maxZoom {
+		return nil, errors.New("zoom is out of range")
+	}
+
+	// width of a cell in degrees (a tile covers 360 / 2^zoom degrees)
+	cell := 360 / math.Pow(2, float64(zoom)) / clusterCellsPerTile
+	lon := bson.M{"$arrayElemAt": []interface{}{"$location.coordinates", 0}}
+	lat := bson.M{"$arrayElemAt": []interface{}{"$location.coordinates", 1}}
+
+	pipeline := []bson.M{
+		{"$match": bson.M{"$and": []bson.M{box.filter(), permission}}},
+		{"$sort": bson.M{"_id": -1}},
+		{"$project": bson.M{
+			"urlThumb": 1,
+			"lon":      lon,
+			"lat":      lat,
+		}},
+		{"$group": bson.M{
+			"_id": bson.M{
+				"x": bson.M{"$floor": bson.M{"$divide": []interface{}{bson.M{"$add": []interface{}{"$lon", 180}}, cell}}},
+				"y": bson.M{"$floor": bson.M{"$divide": []interface{}{bson.M{"$add": []interface{}{"$lat", 90}}, cell}}},
+			},
+			"count":    bson.M{"$sum": 1},
+			"lon":      bson.M{"$avg": "$lon"},
+			"lat":      bson.M{"$avg": "$lat"},
+			"mediaID":  bson.M{"$first": "$_id"},
+			"urlThumb": bson.M{"$first": "$urlThumb"},
+		}},
+		{"$project": bson.M{
+			"_id":      0,
+			"count":    1,
+			"mediaID":  1,
+			"urlThumb": 1,
+			"location": bson.M{
+				"type":        bson.M{"$literal": "Point"},
+				"coordinates": []interface{}{"$lon", "$lat"},
+			},
+		}},
+	}
+
+	conn := database.GetColCtx(MediaCollection, db, 30)
+	defer conn.Cancel()
+	cursor, err := conn.Col.Aggregate(conn.Ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var clusters []MediaCluster
+	if err = cursor.All(conn.Ctx, &clusters); err != nil {
+		return nil, err
+	}
+	return clusters, nil
+}
+
+// GetMediaWithoutPlace selects all media that have a location but no resolved
+// place yet
+func GetMediaWithoutPlace(db *mongo.Database, permission bson.M) ([]Media, error) {
+	if permission == nil {
+		return nil, errors.New("no permissions specified")
+	}
+	filter := bson.M{"$and": []bson.M{
+		{"location": bson.M{"$exists": true}},
+		{"place": bson.M{"$exists": false}},
+		permission,
+	}}
+	opts := options.Find().SetProjection(bson.M{"_id": 1, "location": 1})
+
+	conn := database.GetColCtx(MediaCollection, db, 30)
+	defer conn.Cancel()
+	cursor, err := conn.Col.Find(conn.Ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var ms []Media
+	if err = cursor.All(conn.Ctx, &ms); err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
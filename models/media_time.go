@@ -0,0 +1,172 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/mirisbowring/primboard/helper"
+	"github.com/mirisbowring/primboard/helper/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MediaTimeShift describes a bulk correction of capture timestamps (e.g. for a
+// camera that was left on home time during a trip)
+type MediaTimeShift struct {
+	Camera string `json:"camera,omitempty"`
+	From   int64  `json:"from,omitempty"`
+	Until  int64  `json:"until,omitempty"`
+	Shift  int64  `json:"shift,omitempty"`
+	Offset *int   `json:"offset,omitempty"`
+}
+
+// maxUTCOffset is the largest offset in seconds a timezone can have
+const maxUTCOffset = 14 * 60 * 60
+
+// ValidUTCOffset returns whether the offset in seconds is a valid utc offset
+func ValidUTCOffset(offset int) bool {
+	return offset <= maxUTCOffset && offset >= -maxUTCOffset
+}
+
+// IsValid verifies that the shift can be applied
+func (s *MediaTimeShift) IsValid() error {
+	if s.Camera == "" {
+		return errors.New("camera must be specified")
+	}
+	if s.From == 0 || s.Until == 0 {
+		return errors.New("range must be specified")
+	}
+	if s.From > s.Until {
+		return errors.New("'from' must not be after 'until'")
+	}
+	if s.Shift == 0 && s.Offset == nil {
+		return errors.New("neither shift nor offset specified")
+	}
+	if s.Offset != nil && !ValidUTCOffset(*s.Offset) {
+		return errors.New("offset is out of range")
+	}
+	return nil
+}
+
+// ApplyExif sets the camera and capture time of the media from the passed exif
+// data. Timestamps that have already been set are not overridden. The offset
+// is left unset, if the exif data does not contain one (the capture time is
+// the local time of the camera then).
+func (m *Media) ApplyExif(exif *helper.Exif) {
+	if exif == nil {
+		return
+	}
+	if m.Camera == "" {
+		m.Camera = exif.Camera()
+	}
+	if m.Timestamp != 0 {
+		return
+	}
+	t, offset, ok, err := exif.CaptureTime()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Debug("could not parse capture time from exif")
+		return
+	}
+	m.Timestamp = t.Unix()
+	if ok {
+		m.TimestampOffset = &offset
+	}
+}
+
+// SetTimestamp stores the capture timestamp and its original utc offset. The
+// offset is removed, if it is unknown (nil).
+func (m *Media) SetTimestamp(db *mongo.Database, timestamp int64, offset *int) error {
+	conn := database.GetColCtx(MediaCollection, db, 30)
+	defer conn.Cancel()
+	set := bson.M{"timestamp": timestamp}
+	update := bson.M{"$set": set}
+	if offset != nil {
+		set["timestampOffset"] = *offset
+	} else {
+		update["$unset"] = bson.M{"timestampOffset": ""}
+	}
+	res, err := conn.Col.UpdateOne(conn.Ctx, bson.M{"_id": m.ID}, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	m.Timestamp = timestamp
+	m.TimestampOffset = offset
+	return nil
+}
+
+// LocalTime returns the capture time in the passed location. If loc is nil, the
+// original offset of the capture is used (utc if unknown, which is the local
+// time of the camera).
+func (m *Media) LocalTime(loc *time.Location) time.Time {
+	if loc == nil {
+		loc = time.UTC
+		if m.TimestampOffset != nil {
+			loc = time.FixedZone("", *m.TimestampOffset)
+		}
+	}
+	return time.Unix(m.Timestamp, 0).In(loc)
+}
+
+// SetDisplayTime fills the display only TimestampLocal field
+func (m *Media) SetDisplayTime(loc *time.Location) {
+	if m.Timestamp == 0 {
+		return
+	}
+	m.TimestampLocal = m.LocalTime(loc).Format(time.RFC3339)
+}
+
+// SetDisplayTimes fills the display only TimestampLocal field of all media
+func SetDisplayTimes(media []Media, loc *time.Location) {
+	for i := range media {
+		media[i].SetDisplayTime(loc)
+	}
+}
+
+// ShiftMediaTimestamps moves the capture timestamps of all media of a camera
+// within the specified range and optionally sets the original utc offset
+func ShiftMediaTimestamps(db *mongo.Database, shift MediaTimeShift, permission bson.M) (int64, error) {
+	if permission == nil {
+		return 0, errors.New("no permissions specified")
+	}
+	if err := shift.IsValid(); err != nil {
+		return 0, err
+	}
+
+	filter := bson.M{"$and": []bson.M{
+		{"camera": shift.Camera},
+		{"timestamp": bson.M{"$gte": shift.From, "$lte": shift.Until}},
+		permission,
+	}}
+	update := bson.M{}
+	if shift.Shift != 0 {
+		update["$inc"] = bson.M{"timestamp": shift.Shift}
+	}
+	if shift.Offset != nil {
+		update["$set"] = bson.M{"timestampOffset": *shift.Offset}
+	}
+
+	conn := database.GetColCtx(MediaCollection, db, 30)
+	defer conn.Cancel()
+	res, err := conn.Col.UpdateMany(conn.Ctx, filter, update)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"camera": shift.Camera,
+			"error":  err.Error(),
+		}).Error("could not shift media timestamps")
+		return 0, err
+	}
+
+	log.WithFields(log.Fields{
+		"camera": shift.Camera,
+		"shift":  shift.Shift,
+		"count":  res.ModifiedCount,
+	}).Info("shifted media timestamps")
+	return res.ModifiedCount, nil
+}
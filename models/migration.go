@@ -0,0 +1,118 @@
+package models
+
+import (
+	"time"
+
+	"github.com/mirisbowring/primboard/helper/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Migration moves the media of a node (or of a single user on the node) to
+// another node
+type Migration struct {
+	ID       primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	SourceID primitive.ObjectID `json:"sourceID" bson:"sourceID"`
+	TargetID primitive.ObjectID `json:"targetID" bson:"targetID"`
+	// Username limits the migration to the media of the user
+	Username  string `json:"username,omitempty" bson:"username,omitempty"`
+	Creator   string `json:"creator" bson:"creator"`
+	Status    string `json:"status" bson:"status"`
+	Total     int    `json:"total" bson:"total"`
+	Moved     int    `json:"moved" bson:"moved"`
+	Failed    int    `json:"failed" bson:"failed"`
+	LastError string `json:"lastError,omitempty" bson:"lastError,omitempty"`
+	Created   int64  `json:"created" bson:"created"`
+	Updated   int64  `json:"updated,omitempty" bson:"updated,omitempty"`
+}
+
+const (
+	// MigrationStatusRunning is set while the media are moved
+	MigrationStatusRunning = "running"
+	// MigrationStatusCompleted is set if all media have been moved
+	MigrationStatusCompleted = "completed"
+	// MigrationStatusFailed is set if any media could not be moved
+	MigrationStatusFailed = "failed"
+)
+
+// MigrationCollection is the name of the mongo collection
+var MigrationCollection = "migration"
+
+// Add inserts the migration as running
+func (mg *Migration) Add(db *mongo.Database) error {
+	mg.ID = primitive.NilObjectID
+	mg.Status = MigrationStatusRunning
+	mg.Created = time.Now().Unix()
+	conn := database.GetColCtx(MigrationCollection, db, 30)
+	defer conn.Cancel()
+	result, err := conn.Col.InsertOne(conn.Ctx, mg)
+	if err != nil {
+		return err
+	}
+	mg.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// Update stores the progress of the migration
+func (mg *Migration) Update(db *mongo.Database) error {
+	mg.Updated = time.Now().Unix()
+	update := bson.M{"$set": bson.M{
+		"status":    mg.Status,
+		"total":     mg.Total,
+		"moved":     mg.Moved,
+		"failed":    mg.Failed,
+		"lastError": mg.LastError,
+		"updated":   mg.Updated,
+	}}
+	conn := database.GetColCtx(MigrationCollection, db, 30)
+	defer conn.Cancel()
+	_, err := conn.Col.UpdateOne(conn.Ctx, bson.M{"_id": mg.ID}, update)
+	return err
+}
+
+// GetMigrations selects the migrations from or to the node (newest first)
+func GetMigrations(db *mongo.Database, nodeID primitive.ObjectID) ([]Migration, error) {
+	filter := bson.M{"$or": []bson.M{{"sourceID": nodeID}, {"targetID": nodeID}}}
+	conn := database.GetColCtx(MigrationCollection, db, 30)
+	defer conn.Cancel()
+	cursor, err := conn.Col.Find(conn.Ctx, filter, options.Find().SetSort(bson.M{"_id": -1}))
+	if err != nil {
+		return nil, err
+	}
+	migrations := []Migration{}
+	if err := cursor.All(conn.Ctx, &migrations); err != nil {
+		return nil, err
+	}
+	return migrations, nil
+}
+
+// HasRunningMigration returns whether media are moved from or to the node
+func HasRunningMigration(db *mongo.Database, nodeID primitive.ObjectID) (bool, error) {
+	filter := bson.M{
+		"status": MigrationStatusRunning,
+		"$or":    []bson.M{{"sourceID": nodeID}, {"targetID": nodeID}},
+	}
+	conn := database.GetColCtx(MigrationCollection, db, 30)
+	defer conn.Cancel()
+	count, err := conn.Col.CountDocuments(conn.Ctx, filter)
+	return count > 0, err
+}
+
+// FailRunningMigrations marks the running migrations as failed (e.g. after a
+// restart) and returns the number of changed migrations
+func FailRunningMigrations(db *mongo.Database, reason string) (int64, error) {
+	update := bson.M{"$set": bson.M{
+		"status":    MigrationStatusFailed,
+		"lastError": reason,
+		"updated":   time.Now().Unix(),
+	}}
+	conn := database.GetColCtx(MigrationCollection, db, 30)
+	defer conn.Cancel()
+	result, err := conn.Col.UpdateMany(conn.Ctx, bson.M{"status": MigrationStatusRunning}, update)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
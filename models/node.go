@@ -2,9 +2,11 @@ package models
 
 import (
 	"errors"
+	"time"
 
 	"github.com/mirisbowring/primboard/helper"
 	"github.com/mirisbowring/primboard/helper/database"
+	"github.com/mirisbowring/primboard/helper/urlsign"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -24,12 +26,48 @@ type Node struct {
 	Secret       string               `json:"secret,omitempty" bson:"secret,omitempty"`
 	APIEndpoint  string               `json:"APIEndpoint,omitempty" bson:"APIEndpoint,omitempty"`
 	DataEndpoint string               `json:"dataEndpoint,omitempty" bson:"dataEndpoint,omitempty"`
+	Status       string               `json:"status,omitempty" bson:"status,omitempty"`
+	LastSeen     int64                `json:"lastSeen,omitempty" bson:"lastSeen,omitempty"`
+	Health       *NodeHealth          `json:"health,omitempty" bson:"health,omitempty"`
+	// Quota applies to every user except the creator (nil -> unlimited)
+	Quota *Quota `json:"quota,omitempty" bson:"quota,omitempty"`
+	// CertSerial is the serial of the current mtls certificate, the previous
+	// certificate stays valid after a rotation until it expires
+	CertSerial     string `json:"certSerial,omitempty" bson:"certSerial,omitempty"`
+	PrevCertSerial string `json:"-" bson:"prevCertSerial,omitempty"`
+	CertExpiry     int64  `json:"certExpiry,omitempty" bson:"certExpiry,omitempty"`
+	// SigningKey signs the file urls of the node (never returned to users)
+	SigningKey string `json:"-" bson:"signingKey,omitempty"`
+	// Bundle is only returned, when the gateway issued the key of the node
+	Bundle *CertificateBundle `json:"bundle,omitempty" bson:"-"`
 	// UserSession  string               `json:"userSession,omitempty" bson:"-"`
 	Groups    []UserGroup `json:"groups,omitempty" bson:"-"`
 	Users     []string    `json:"users,omitempty" bson:"-"`
 	Usernames []string    `json:"usernames,omitempty" bson:"-"`
 }
 
+// CertificateBundle contains the pem encoded mtls credentials of a node
+type CertificateBundle struct {
+	Certificate string `json:"certificate"`
+	Key         string `json:"key,omitempty"`
+	CA          string `json:"ca"`
+}
+
+// NodeHealth is reported by the node with every heartbeat
+type NodeHealth struct {
+	Version    string `json:"version,omitempty" bson:"version,omitempty"`
+	DiskFree   uint64 `json:"diskFree" bson:"diskFree"`
+	DiskTotal  uint64 `json:"diskTotal" bson:"diskTotal"`
+	QueueDepth int    `json:"queueDepth" bson:"queueDepth"`
+}
+
+const (
+	// NodeStatusOnline is set on every heartbeat
+	NodeStatusOnline = "online"
+	// NodeStatusOffline is set if the heartbeats are missing
+	NodeStatusOffline = "offline"
+)
+
 // NodeProject is a bson representation of the ipfs-node setting object
 var NodeProject = bson.M{
 	"_id":          1,
@@ -39,19 +77,32 @@ var NodeProject = bson.M{
 	"groups":       UserGroupProject,
 	"APIEndpoint":  1,
 	"dataEndpoint": 1,
+	"status":       1,
+	"lastSeen":     1,
+	"health":       1,
+	"quota":        1,
+	"certSerial":   1,
+	"certExpiry":   1,
 }
 
 // NodeProjectInternal is a bson representation of the ipfs-node setting object
 var NodeProjectInternal = bson.M{
-	"_id":          1,
-	"title":        1,
-	"creator":      1,
-	"keycloakID":   1,
-	"groupIDs":     1,
-	"type":         1,
-	"APIEndpoint":  1,
-	"dataEndpoint": 1,
-	"users":        1,
+	"_id":            1,
+	"title":          1,
+	"creator":        1,
+	"keycloakID":     1,
+	"groupIDs":       1,
+	"type":           1,
+	"APIEndpoint":    1,
+	"dataEndpoint":   1,
+	"users":          1,
+	"status":         1,
+	"lastSeen":       1,
+	"quota":          1,
+	"certSerial":     1,
+	"prevCertSerial": 1,
+	"certExpiry":     1,
+	"signingKey":     1,
 }
 
 // NodeProjectSecret is bson representation of the node to retrieve the secret
@@ -425,3 +476,142 @@ func (n *Node) VerifyNode(db *mongo.Database, permission bson.M) error {
 	}
 	return nil
 }
+
+// UpdateHealth stores the reported health, marks the node as online and
+// returns whether the node was offline before
+func (n *Node) UpdateHealth(db *mongo.Database, health NodeHealth) (bool, error) {
+	n.Health = &health
+	n.LastSeen = time.Now().Unix()
+	filter := bson.M{"_id": n.ID}
+	update := bson.M{"$set": bson.M{
+		"health":   n.Health,
+		"lastSeen": n.LastSeen,
+		"status":   NodeStatusOnline,
+	}}
+	conn := database.GetColCtx(NodeCollection, db, 30)
+	defer conn.Cancel()
+	var before Node
+	opts := options.FindOneAndUpdate().SetProjection(bson.M{"status": 1})
+	if err := conn.Col.FindOneAndUpdate(conn.Ctx, filter, update, opts).Decode(&before); err != nil {
+		return false, err
+	}
+	n.Status = NodeStatusOnline
+	return before.Status != NodeStatusOnline, nil
+}
+
+// MarkStaleNodesOffline sets the status of all nodes, that were not seen since
+// the passed time, to offline and returns the number of changed nodes
+func MarkStaleNodesOffline(db *mongo.Database, since time.Time) (int64, error) {
+	filter := bson.M{
+		"status": bson.M{"$ne": NodeStatusOffline},
+		"$or": []bson.M{
+			{"lastSeen": bson.M{"$exists": false}},
+			{"lastSeen": bson.M{"$lt": since.Unix()}},
+		},
+	}
+	update := bson.M{"$set": bson.M{"status": NodeStatusOffline}}
+	conn := database.GetColCtx(NodeCollection, db, 30)
+	defer conn.Cancel()
+	res, err := conn.Col.UpdateMany(conn.Ctx, filter, update)
+	if err != nil {
+		return 0, err
+	}
+	return res.ModifiedCount, nil
+}
+
+// GetOfflineNodeIDs returns the ids of all nodes that are not online
+func GetOfflineNodeIDs(db *mongo.Database) ([]primitive.ObjectID, error) {
+	conn := database.GetColCtx(NodeCollection, db, 30)
+	defer conn.Cancel()
+	filter := bson.M{"status": bson.M{"$ne": NodeStatusOnline}}
+	opts := options.Find().SetProjection(bson.M{"_id": 1})
+	cursor, err := conn.Col.Find(conn.Ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var nodes []Node
+	if err := cursor.All(conn.Ctx, &nodes); err != nil {
+		return nil, err
+	}
+	ids := []primitive.ObjectID{}
+	for _, n := range nodes {
+		ids = append(ids, n.ID)
+	}
+	return ids, nil
+}
+
+// GetReplicationTargets selects the nodes, the user may store media on (own
+// nodes and the nodes of the groups of the user)
+func GetReplicationTargets(db *mongo.Database, username string) ([]Node, error) {
+	groups, err := GetUserGroups(db, username)
+	if err != nil {
+		return nil, err
+	}
+	groupIDs := make([]primitive.ObjectID, len(groups))
+	for i, g := range groups {
+		groupIDs[i] = g.ID
+	}
+	conn := database.GetColCtx(NodeCollection, db, 30)
+	defer conn.Cancel()
+	opts := options.Find().SetProjection(NodeProjectInternal)
+	cursor, err := conn.Col.Find(conn.Ctx, database.CreatePermissionFilter(groupIDs, username), opts)
+	if err != nil {
+		return nil, err
+	}
+	nodes := []Node{}
+	if err := cursor.All(conn.Ctx, &nodes); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// SetCertificate stores the serial of the issued certificate. If keepPrevious
+// is set, the current certificate stays valid (rotation), otherwise it is
+// revoked.
+func (n *Node) SetCertificate(db *mongo.Database, serial string, expiry int64, keepPrevious bool) error {
+	set := bson.M{"certSerial": serial, "certExpiry": expiry}
+	update := bson.M{"$set": set}
+	if keepPrevious && n.CertSerial != "" {
+		set["prevCertSerial"] = n.CertSerial
+	} else {
+		update["$unset"] = bson.M{"prevCertSerial": ""}
+	}
+	conn := database.GetColCtx(NodeCollection, db, 30)
+	defer conn.Cancel()
+	if _, err := conn.Col.UpdateOne(conn.Ctx, bson.M{"_id": n.ID}, update); err != nil {
+		return err
+	}
+	if keepPrevious {
+		n.PrevCertSerial = n.CertSerial
+	} else {
+		n.PrevCertSerial = ""
+	}
+	n.CertSerial = serial
+	n.CertExpiry = expiry
+	return nil
+}
+
+// AcceptsCertificate returns whether the serial belongs to the current or
+// the previous certificate of the node
+func (n *Node) AcceptsCertificate(serial string) bool {
+	return serial != "" && (serial == n.CertSerial || serial == n.PrevCertSerial)
+}
+
+// EnsureSigningKey creates the signing key of the file urls if the node does
+// not have one yet
+func (n *Node) EnsureSigningKey(db *mongo.Database) error {
+	if n.SigningKey != "" {
+		return nil
+	}
+	key, err := urlsign.GenerateKey()
+	if err != nil {
+		return err
+	}
+	conn := database.GetColCtx(NodeCollection, db, 30)
+	defer conn.Cancel()
+	if _, err := conn.Col.UpdateOne(conn.Ctx, bson.M{"_id": n.ID}, bson.M{"$set": bson.M{"signingKey": key}}); err != nil {
+		return err
+	}
+	n.SigningKey = key
+	return nil
+}
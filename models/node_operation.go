@@ -0,0 +1,323 @@
+package models
+
+import (
+	"math"
+	"time"
+
+	"github.com/mirisbowring/primboard/helper/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// NodeOperation is a pending change of the files on a node (outbox entry). It
+// is delivered until the node acknowledges it.
+type NodeOperation struct {
+	ID     primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	NodeID primitive.ObjectID `json:"nodeID" bson:"nodeID"`
+	Action string             `json:"action" bson:"action"`
+	// Username is the owner of the files
+	Username  string               `json:"username" bson:"username"`
+	Filenames []string             `json:"filenames" bson:"filenames"`
+	Groups    []string             `json:"groups,omitempty" bson:"groups,omitempty"`
+	MediaIDs  []primitive.ObjectID `json:"mediaIDs,omitempty" bson:"mediaIDs,omitempty"`
+	Status    string               `json:"status" bson:"status"`
+	Attempts  int                  `json:"attempts" bson:"attempts"`
+	// NextAttempt is the earliest time of the next delivery
+	NextAttempt int64  `json:"nextAttempt,omitempty" bson:"nextAttempt"`
+	LastError   string `json:"lastError,omitempty" bson:"lastError,omitempty"`
+	Created     int64  `json:"created" bson:"created"`
+	Updated     int64  `json:"updated" bson:"updated"`
+}
+
+const (
+	// NodeOperationShare links files into group directories
+	NodeOperationShare = "share"
+	// NodeOperationUnshare removes files from group directories
+	NodeOperationUnshare = "unshare"
+	// NodeOperationDelete removes files and their shares
+	NodeOperationDelete = "delete"
+)
+
+const (
+	// SyncStatusPending marks operations (and media) waiting for delivery
+	SyncStatusPending = "pending"
+	// SyncStatusFailed marks operations (and media) that exceeded the attempts
+	SyncStatusFailed = "failed"
+)
+
+const (
+	// nodeOperationMaxAttempts before an operation is marked as failed
+	nodeOperationMaxAttempts = 10
+	// nodeOperationBackoff is the delay after the first failed attempt (doubled
+	// with every further attempt)
+	nodeOperationBackoff = 10 * time.Second
+	// nodeOperationMaxBackoff limits the delay between two attempts
+	nodeOperationMaxBackoff = time.Hour
+)
+
+// NodeOperationCollection is the name of the mongo collection
+var NodeOperationCollection = "nodeoperation"
+
+// EnsureNodeOperationIndexes creates the indexes of the outbox collection
+func EnsureNodeOperationIndexes(db *mongo.Database) error {
+	conn := database.GetColCtx(NodeOperationCollection, db, 30)
+	defer conn.Cancel()
+	indexes := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "status", Value: 1}, {Key: "nextAttempt", Value: 1}},
+			Options: options.Index().SetName("due"),
+		},
+		{
+			Keys:    bson.D{{Key: "status", Value: 1}, {Key: "nodeID", Value: 1}, {Key: "_id", Value: 1}},
+			Options: options.Index().SetName("queue"),
+		},
+		{
+			Keys:    bson.D{{Key: "mediaIDs", Value: 1}},
+			Options: options.Index().SetName("media"),
+		},
+		{
+			Keys:    bson.D{{Key: "username", Value: 1}},
+			Options: options.Index().SetName("username"),
+		},
+	}
+	if _, err := conn.Col.Indexes().CreateMany(conn.Ctx, indexes); err != nil {
+		log.WithFields(log.Fields{
+			"collection": NodeOperationCollection,
+			"error":      err.Error(),
+		}).Error("could not create indexes")
+		return err
+	}
+	return nil
+}
+
+// AddNodeOperations records the operations as pending and marks their media
+func AddNodeOperations(db *mongo.Database, ops []NodeOperation) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	now := time.Now().Unix()
+	docs := make([]interface{}, len(ops))
+	var mediaIDs []primitive.ObjectID
+	for i := range ops {
+		ops[i].ID = primitive.NewObjectID()
+		ops[i].Status = SyncStatusPending
+		ops[i].Attempts = 0
+		ops[i].NextAttempt = now
+		ops[i].Created = now
+		ops[i].Updated = now
+		docs[i] = ops[i]
+		mediaIDs = append(mediaIDs, ops[i].MediaIDs...)
+	}
+	conn := database.GetColCtx(NodeOperationCollection, db, 30)
+	defer conn.Cancel()
+	if _, err := conn.Col.InsertMany(conn.Ctx, docs); err != nil {
+		return err
+	}
+	return UpdateMediaSyncStatus(db, mediaIDs)
+}
+
+// GetDueNodeOperations selects the pending operations of the passed nodes,
+// that are due for delivery (oldest first). The operations of a user are
+// delivered to a node in the order they have been recorded, so only the
+// oldest outstanding operation of every node and user is selected. A failed
+// operation blocks the later operations until it is retried.
+func GetDueNodeOperations(db *mongo.Database, nodeIDs []primitive.ObjectID, limit int64) ([]NodeOperation, error) {
+	pipeline := []bson.M{
+		{"$match": bson.M{
+			"status": bson.M{"$in": bson.A{SyncStatusPending, SyncStatusFailed}},
+			"nodeID": bson.M{"$in": nodeIDs},
+		}},
+		{"$sort": bson.M{"_id": 1}},
+		{"$group": bson.M{
+			"_id": bson.M{"nodeID": "$nodeID", "username": "$username"},
+			"op":  bson.M{"$first": "$$ROOT"},
+		}},
+		{"$replaceRoot": bson.M{"newRoot": "$op"}},
+		{"$match": bson.M{"status": SyncStatusPending, "nextAttempt": bson.M{"$lte": time.Now().Unix()}}},
+		{"$sort": bson.M{"_id": 1}},
+		{"$limit": limit},
+	}
+	conn := database.GetColCtx(NodeOperationCollection, db, 30)
+	defer conn.Cancel()
+	cursor, err := conn.Col.Aggregate(conn.Ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	ops := []NodeOperation{}
+	if err := cursor.All(conn.Ctx, &ops); err != nil {
+		return nil, err
+	}
+	return ops, nil
+}
+
+// GetNodeOperations selects the operations (newest first). The user, the
+// status and the media are optional filters.
+func GetNodeOperations(db *mongo.Database, username string, status string, mediaID primitive.ObjectID) ([]NodeOperation, error) {
+	filter := bson.M{}
+	if username != "" {
+		filter["username"] = username
+	}
+	if status != "" {
+		filter["status"] = status
+	}
+	if !mediaID.IsZero() {
+		filter["mediaIDs"] = mediaID
+	}
+	opts := options.Find().SetSort(bson.M{"_id": -1}).SetLimit(1000)
+	conn := database.GetColCtx(NodeOperationCollection, db, 30)
+	defer conn.Cancel()
+	cursor, err := conn.Col.Find(conn.Ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	ops := []NodeOperation{}
+	if err := cursor.All(conn.Ctx, &ops); err != nil {
+		return nil, err
+	}
+	return ops, nil
+}
+
+// Acknowledge removes the delivered operation from the outbox
+func (op *NodeOperation) Acknowledge(db *mongo.Database) error {
+	conn := database.GetColCtx(NodeOperationCollection, db, 30)
+	defer conn.Cancel()
+	if _, err := conn.Col.DeleteOne(conn.Ctx, bson.M{"_id": op.ID}); err != nil {
+		return err
+	}
+	return UpdateMediaSyncStatus(db, op.MediaIDs)
+}
+
+// Retry schedules the next delivery with exponential backoff for the remaining
+// files. The operation is marked as failed after the max attempts.
+func (op *NodeOperation) Retry(db *mongo.Database, filenames []string, cause string) error {
+	op.Attempts++
+	if len(filenames) > 0 {
+		op.Filenames = filenames
+	}
+	backoff := time.Duration(float64(nodeOperationBackoff) * math.Pow(2, float64(op.Attempts-1)))
+	if backoff > nodeOperationMaxBackoff {
+		backoff = nodeOperationMaxBackoff
+	}
+	op.NextAttempt = time.Now().Add(backoff).Unix()
+	op.LastError = cause
+	op.Updated = time.Now().Unix()
+	if op.Attempts >= nodeOperationMaxAttempts {
+		op.Status = SyncStatusFailed
+	}
+	update := bson.M{"$set": bson.M{
+		"filenames":   op.Filenames,
+		"attempts":    op.Attempts,
+		"nextAttempt": op.NextAttempt,
+		"lastError":   op.LastError,
+		"status":      op.Status,
+		"updated":     op.Updated,
+	}}
+	conn := database.GetColCtx(NodeOperationCollection, db, 30)
+	defer conn.Cancel()
+	if _, err := conn.Col.UpdateOne(conn.Ctx, bson.M{"_id": op.ID}, update); err != nil {
+		return err
+	}
+	if op.Status == SyncStatusFailed {
+		return UpdateMediaSyncStatus(db, op.MediaIDs)
+	}
+	return nil
+}
+
+// RetryFailedNodeOperations resets the failed operations of the user to
+// pending. The media is optional.
+func RetryFailedNodeOperations(db *mongo.Database, username string, mediaID primitive.ObjectID) (int64, error) {
+	filter := bson.M{"username": username, "status": SyncStatusFailed}
+	if !mediaID.IsZero() {
+		filter["mediaIDs"] = mediaID
+	}
+	conn := database.GetColCtx(NodeOperationCollection, db, 30)
+	defer conn.Cancel()
+	var ops []NodeOperation
+	cursor, err := conn.Col.Find(conn.Ctx, filter, options.Find().SetProjection(bson.M{"mediaIDs": 1}))
+	if err != nil {
+		return 0, err
+	}
+	if err := cursor.All(conn.Ctx, &ops); err != nil {
+		return 0, err
+	}
+	now := time.Now().Unix()
+	update := bson.M{"$set": bson.M{
+		"status":      SyncStatusPending,
+		"attempts":    0,
+		"nextAttempt": now,
+		"updated":     now,
+	}}
+	res, err := conn.Col.UpdateMany(conn.Ctx, filter, update)
+	if err != nil {
+		return 0, err
+	}
+	var mediaIDs []primitive.ObjectID
+	for _, op := range ops {
+		mediaIDs = append(mediaIDs, op.MediaIDs...)
+	}
+	return res.ModifiedCount, UpdateMediaSyncStatus(db, mediaIDs)
+}
+
+// UpdateMediaSyncStatus sets the sync status of the media according to their
+// outstanding operations (failed before pending, unset if none)
+func UpdateMediaSyncStatus(db *mongo.Database, ids []primitive.ObjectID) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	pipeline := []bson.M{
+		{"$match": bson.M{"mediaIDs": bson.M{"$in": ids}}},
+		{"$unwind": "$mediaIDs"},
+		{"$match": bson.M{"mediaIDs": bson.M{"$in": ids}}},
+		{"$group": bson.M{"_id": "$mediaIDs", "statuses": bson.M{"$addToSet": "$status"}}},
+	}
+	conn := database.GetColCtx(NodeOperationCollection, db, 30)
+	defer conn.Cancel()
+	cursor, err := conn.Col.Aggregate(conn.Ctx, pipeline)
+	if err != nil {
+		return err
+	}
+	var results []struct {
+		ID       primitive.ObjectID `bson:"_id"`
+		Statuses []string           `bson:"statuses"`
+	}
+	if err := cursor.All(conn.Ctx, &results); err != nil {
+		return err
+	}
+
+	statuses := make(map[string][]primitive.ObjectID)
+	outstanding := make(map[primitive.ObjectID]bool)
+	for _, r := range results {
+		status := SyncStatusPending
+		for _, s := range r.Statuses {
+			if s == SyncStatusFailed {
+				status = SyncStatusFailed
+			}
+		}
+		statuses[status] = append(statuses[status], r.ID)
+		outstanding[r.ID] = true
+	}
+	var synced []primitive.ObjectID
+	for _, id := range ids {
+		if !outstanding[id] {
+			synced = append(synced, id)
+		}
+	}
+
+	media := database.GetColCtx(MediaCollection, db, 30)
+	defer media.Cancel()
+	for status, mediaIDs := range statuses {
+		if _, err := media.Col.UpdateMany(media.Ctx, bson.M{"_id": bson.M{"$in": mediaIDs}}, bson.M{"$set": bson.M{"syncStatus": status}}); err != nil {
+			return err
+		}
+	}
+	if len(synced) > 0 {
+		if _, err := media.Col.UpdateMany(media.Ctx, bson.M{"_id": bson.M{"$in": synced}}, bson.M{"$unset": bson.M{"syncStatus": ""}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
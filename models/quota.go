@@ -0,0 +1,318 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/mirisbowring/primboard/helper/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Quota limits the storage of a user on a node (0 -> unlimited)
+type Quota struct {
+	Bytes int64 `json:"bytes" bson:"bytes"`
+	Files int64 `json:"files" bson:"files"`
+}
+
+// Usage is the storage used by a user on a node. It is maintained
+// incrementally whenever a copy of a media is added or removed.
+type Usage struct {
+	ID       primitive.ObjectID    `json:"id,omitempty" bson:"_id,omitempty"`
+	NodeID   primitive.ObjectID    `json:"nodeID" bson:"nodeID"`
+	Username string                `json:"username" bson:"username"`
+	Bytes    int64                 `json:"bytes" bson:"bytes"`
+	Files    int64                 `json:"files" bson:"files"`
+	Types    map[string]UsageCount `json:"types,omitempty" bson:"types,omitempty"`
+	Updated  int64                 `json:"updated,omitempty" bson:"updated,omitempty"`
+	// Reservations block the quota for files, that are currently written
+	Reservations []Reservation `json:"reservations,omitempty" bson:"reservations,omitempty"`
+	// Quota is the effective quota of the user on the node (nil -> unlimited)
+	Quota *Quota `json:"quota,omitempty" bson:"-"`
+}
+
+// UsageCount is the usage of a single media type
+type UsageCount struct {
+	Bytes int64 `json:"bytes" bson:"bytes"`
+	Files int64 `json:"files" bson:"files"`
+}
+
+// Reservation blocks the quota of a user on a node for a file, that is
+// currently written. It is released after the write or expires.
+type Reservation struct {
+	ID      primitive.ObjectID `json:"id" bson:"id"`
+	Bytes   int64              `json:"bytes" bson:"bytes"`
+	Files   int64              `json:"files" bson:"files"`
+	Expires int64              `json:"expires" bson:"expires"`
+}
+
+// reservationTTL is the time a reservation is kept, if it is not released
+// (e.g. the node crashed while writing)
+const reservationTTL = time.Hour
+
+// UsageCollection is the name of the mongo collection
+var UsageCollection = "usage"
+
+// IsValid verifies that the limits are not negative
+func (q *Quota) IsValid() error {
+	if q.Bytes < 0 || q.Files < 0 {
+		return errors.New("quota must not be negative")
+	}
+	return nil
+}
+
+// narrowLimit returns the stricter limit (0 -> unlimited)
+func narrowLimit(a int64, b int64) int64 {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// widenLimit returns the more generous limit (0 -> unlimited)
+func widenLimit(a int64, b int64) int64 {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	if b > a {
+		return b
+	}
+	return a
+}
+
+// EffectiveQuota returns the quota of the user on the node (nil ->
+// unlimited). The creator of the node is not limited. The quota of the node
+// applies to every user and is narrowed by the most generous quota of the
+// groups, the node is shared with.
+func (n *Node) EffectiveQuota(db *mongo.Database, username string) (*Quota, error) {
+	if username == n.Creator {
+		return nil, nil
+	}
+	var groupQuota *Quota
+	if len(n.GroupIDs) > 0 {
+		groups, err := GetUserGroupsByIDs(db, n.GroupIDs, UserGroupPermission(username, RoleViewer))
+		if err != nil {
+			return nil, err
+		}
+		for i, ug := range groups {
+			q := Quota{}
+			if ug.Quota != nil {
+				q = *ug.Quota
+			}
+			if i == 0 {
+				groupQuota = &q
+				continue
+			}
+			groupQuota.Bytes = widenLimit(groupQuota.Bytes, q.Bytes)
+			groupQuota.Files = widenLimit(groupQuota.Files, q.Files)
+		}
+	}
+
+	quota := Quota{}
+	if n.Quota != nil {
+		quota = *n.Quota
+	}
+	if groupQuota != nil {
+		quota.Bytes = narrowLimit(quota.Bytes, groupQuota.Bytes)
+		quota.Files = narrowLimit(quota.Files, groupQuota.Files)
+	}
+	if quota.Bytes == 0 && quota.Files == 0 {
+		return nil, nil
+	}
+	return &quota, nil
+}
+
+// quotaUpdate sets the quota or removes it if unlimited
+func quotaUpdate(q *Quota) bson.M {
+	if q == nil || (q.Bytes == 0 && q.Files == 0) {
+		return bson.M{"$unset": bson.M{"quota": ""}}
+	}
+	return bson.M{"$set": bson.M{"quota": q}}
+}
+
+// SetQuota updates the quota of the node !!! CHECK PERMISSIONS FIRST !!!
+func (n *Node) SetQuota(db *mongo.Database, q *Quota) error {
+	conn := database.GetColCtx(NodeCollection, db, 30)
+	defer conn.Cancel()
+	if _, err := conn.Col.UpdateOne(conn.Ctx, bson.M{"_id": n.ID}, quotaUpdate(q)); err != nil {
+		return err
+	}
+	n.Quota = q
+	return nil
+}
+
+// SetQuota updates the quota of the usergroup !!! CHECK PERMISSIONS FIRST !!!
+func (ug *UserGroup) SetQuota(db *mongo.Database, q *Quota) error {
+	conn := database.GetColCtx(UserGroupCollection, db, 30)
+	defer conn.Cancel()
+	if _, err := conn.Col.UpdateOne(conn.Ctx, bson.M{"_id": ug.ID}, quotaUpdate(q)); err != nil {
+		return err
+	}
+	ug.Quota = q
+	return nil
+}
+
+// EnsureUsageIndexes creates the indexes of the usage collection
+func EnsureUsageIndexes(db *mongo.Database) error {
+	conn := database.GetColCtx(UsageCollection, db, 30)
+	defer conn.Cancel()
+	indexes := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "nodeID", Value: 1}, {Key: "username", Value: 1}},
+			Options: options.Index().SetName("node_username_unique").SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "username", Value: 1}},
+			Options: options.Index().SetName("username"),
+		},
+	}
+	if _, err := conn.Col.Indexes().CreateMany(conn.Ctx, indexes); err != nil {
+		log.WithFields(log.Fields{
+			"collection": UsageCollection,
+			"error":      err.Error(),
+		}).Error("could not create indexes")
+		return err
+	}
+	return nil
+}
+
+// usageType returns the key of the media type within the usage document
+func (m *Media) usageType() string {
+	t := strings.NewReplacer(".", "_", "$", "_").Replace(m.Type)
+	if t == "" {
+		return "other"
+	}
+	return t
+}
+
+// AccountUsage adds (sign 1) or removes (sign -1) the copy of the media on
+// the node to the usage of its creator
+func (m *Media) AccountUsage(db *mongo.Database, nodeID primitive.ObjectID, sign int64) error {
+	t := m.usageType()
+	update := bson.M{
+		"$inc": bson.M{
+			"bytes":                 sign * m.Size,
+			"files":                 sign,
+			"types." + t + ".bytes": sign * m.Size,
+			"types." + t + ".files": sign,
+		},
+		"$set": bson.M{"updated": time.Now().Unix()},
+	}
+	filter := bson.M{"nodeID": nodeID, "username": m.Creator}
+	conn := database.GetColCtx(UsageCollection, db, 30)
+	defer conn.Cancel()
+	_, err := conn.Col.UpdateOne(conn.Ctx, filter, update, options.Update().SetUpsert(true))
+	return err
+}
+
+// ReserveUsage reserves the passed bytes and files of the user on the node.
+// The quota is checked and the reservation is added atomically, so that
+// concurrent writes cannot exceed the quota together. Expired reservations
+// are dropped. Returns nil if the quota would be exceeded.
+func ReserveUsage(db *mongo.Database, nodeID primitive.ObjectID, username string, q *Quota, bytes int64, files int64) (*Reservation, error) {
+	filter := bson.M{"nodeID": nodeID, "username": username}
+	conn := database.GetColCtx(UsageCollection, db, 30)
+	defer conn.Cancel()
+	// the usage must exist to be updated conditionally
+	create := bson.M{"$setOnInsert": bson.M{"bytes": 0, "files": 0}}
+	if _, err := conn.Col.UpdateOne(conn.Ctx, filter, create, options.Update().SetUpsert(true)); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	res := Reservation{
+		ID:      primitive.NewObjectID(),
+		Bytes:   bytes,
+		Files:   files,
+		Expires: now + int64(reservationTTL.Seconds()),
+	}
+	active := bson.M{"$filter": bson.M{
+		"input": bson.M{"$ifNull": bson.A{"$reservations", bson.A{}}},
+		"as":    "r",
+		"cond":  bson.M{"$gt": bson.A{"$$r.expires", now}},
+	}}
+	var limits bson.A
+	if q != nil && q.Bytes > 0 {
+		limits = append(limits, bson.M{"$lte": bson.A{
+			bson.M{"$add": bson.A{"$bytes", bson.M{"$sum": bson.M{"$map": bson.M{"input": active, "as": "r", "in": "$$r.bytes"}}}, bytes}},
+			q.Bytes,
+		}})
+	}
+	if q != nil && q.Files > 0 {
+		limits = append(limits, bson.M{"$lte": bson.A{
+			bson.M{"$add": bson.A{"$files", bson.M{"$sum": bson.M{"$map": bson.M{"input": active, "as": "r", "in": "$$r.files"}}}, files}},
+			q.Files,
+		}})
+	}
+	if len(limits) > 0 {
+		filter["$expr"] = bson.M{"$and": limits}
+	}
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{"reservations": bson.M{"$concatArrays": bson.A{active, bson.A{res}}}}}},
+	}
+	result, err := conn.Col.UpdateOne(conn.Ctx, filter, update)
+	if err != nil {
+		return nil, err
+	}
+	if result.MatchedCount == 0 {
+		return nil, nil
+	}
+	return &res, nil
+}
+
+// ReleaseUsage removes the reservation of the node
+func ReleaseUsage(db *mongo.Database, nodeID primitive.ObjectID, id primitive.ObjectID) error {
+	filter := bson.M{"nodeID": nodeID, "reservations.id": id}
+	update := bson.M{"$pull": bson.M{"reservations": bson.M{"id": id}}}
+	conn := database.GetColCtx(UsageCollection, db, 30)
+	defer conn.Cancel()
+	_, err := conn.Col.UpdateOne(conn.Ctx, filter, update)
+	return err
+}
+
+// GetUsage selects the usage of the user on the node (empty if none)
+func GetUsage(db *mongo.Database, nodeID primitive.ObjectID, username string) (Usage, error) {
+	u := Usage{NodeID: nodeID, Username: username}
+	conn := database.GetColCtx(UsageCollection, db, 30)
+	defer conn.Cancel()
+	err := conn.Col.FindOne(conn.Ctx, bson.M{"nodeID": nodeID, "username": username}).Decode(&u)
+	if err == mongo.ErrNoDocuments {
+		return u, nil
+	}
+	return u, err
+}
+
+// GetUsages selects the usages of the user or of the node
+func GetUsages(db *mongo.Database, nodeID primitive.ObjectID, username string) ([]Usage, error) {
+	filter := bson.M{}
+	if !nodeID.IsZero() {
+		filter["nodeID"] = nodeID
+	}
+	if username != "" {
+		filter["username"] = username
+	}
+	conn := database.GetColCtx(UsageCollection, db, 30)
+	defer conn.Cancel()
+	cursor, err := conn.Col.Find(conn.Ctx, filter, options.Find().SetSort(bson.M{"bytes": -1}))
+	if err != nil {
+		return nil, err
+	}
+	usages := []Usage{}
+	if err := cursor.All(conn.Ctx, &usages); err != nil {
+		return nil, err
+	}
+	return usages, nil
+}
+
+// DeleteNodeUsage removes the usages of the node
+func DeleteNodeUsage(db *mongo.Database, nodeID primitive.ObjectID) error {
+	conn := database.GetColCtx(UsageCollection, db, 30)
+	defer conn.Cancel()
+	_, err := conn.Col.DeleteMany(conn.Ctx, bson.M{"nodeID": nodeID})
+	return err
+}
@@ -0,0 +1,106 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/mirisbowring/primboard/helper/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ReplicationPolicy defines how many copies of the media of a user or a group
+// should be kept on different nodes
+type ReplicationPolicy struct {
+	ID primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	// Username is set for the policy of a user
+	Username string `json:"username,omitempty" bson:"username,omitempty"`
+	// GroupID is set for the policy of a group
+	GroupID  primitive.ObjectID `json:"groupID,omitempty" bson:"groupID,omitempty"`
+	Replicas int                `json:"replicas" bson:"replicas"`
+	Updated  int64              `json:"updated,omitempty" bson:"updated"`
+}
+
+// MaxReplicas limits the replica count of a policy
+const MaxReplicas = 5
+
+// ReplicationPolicyCollection is the name of the mongo collection
+var ReplicationPolicyCollection = "replicationpolicy"
+
+// IsValid verifies, that the policy targets either a user or a group and the
+// replica count is within the limits
+func (p *ReplicationPolicy) IsValid() error {
+	if (p.Username == "") == p.GroupID.IsZero() {
+		return errors.New("the policy must target either a user or a group")
+	}
+	if p.Replicas < 1 || p.Replicas > MaxReplicas {
+		return errors.New("replicas must be between 1 and 5")
+	}
+	return nil
+}
+
+// filter returns the filter that matches the target of the policy
+func (p *ReplicationPolicy) filter() bson.M {
+	if p.Username != "" {
+		return bson.M{"username": p.Username}
+	}
+	return bson.M{"groupID": p.GroupID}
+}
+
+// Save creates or replaces the policy of the user or group
+func (p *ReplicationPolicy) Save(db *mongo.Database) error {
+	if err := p.IsValid(); err != nil {
+		return err
+	}
+	p.Updated = time.Now().Unix()
+	update := bson.M{"$set": bson.M{"replicas": p.Replicas, "updated": p.Updated}}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	conn := database.GetColCtx(ReplicationPolicyCollection, db, 30)
+	defer conn.Cancel()
+	return conn.Col.FindOneAndUpdate(conn.Ctx, p.filter(), update, opts).Decode(p)
+}
+
+// Delete removes the policy of the user or group
+func (p *ReplicationPolicy) Delete(db *mongo.Database) error {
+	conn := database.GetColCtx(ReplicationPolicyCollection, db, 30)
+	defer conn.Cancel()
+	_, err := conn.Col.DeleteOne(conn.Ctx, p.filter())
+	return err
+}
+
+// GetReplicationPolicies selects the policies of the user and the groups
+func GetReplicationPolicies(db *mongo.Database, username string, groupIDs []primitive.ObjectID) ([]ReplicationPolicy, error) {
+	filters := []bson.M{{"username": username}}
+	if len(groupIDs) > 0 {
+		filters = append(filters, bson.M{"groupID": bson.M{"$in": groupIDs}})
+	}
+	conn := database.GetColCtx(ReplicationPolicyCollection, db, 30)
+	defer conn.Cancel()
+	cursor, err := conn.Col.Find(conn.Ctx, bson.M{"$or": filters})
+	if err != nil {
+		return nil, err
+	}
+	policies := []ReplicationPolicy{}
+	if err := cursor.All(conn.Ctx, &policies); err != nil {
+		return nil, err
+	}
+	return policies, nil
+}
+
+// ReplicaCount returns the number of copies, that should be kept for the
+// media (the highest count of the policies of its creator and groups)
+func (m *Media) ReplicaCount(db *mongo.Database, def int) (int, error) {
+	policies, err := GetReplicationPolicies(db, m.Creator, m.GroupIDs)
+	if err != nil {
+		return def, err
+	}
+	replicas := def
+	for _, p := range policies {
+		if p.Replicas > replicas {
+			replicas = p.Replicas
+		}
+	}
+	return replicas, nil
+}
@@ -1,124 +1,219 @@
 package models
 
-// import (
-// 	"github.com/mirisbowring/primboard/helper/database"
-// 	"go.mongodb.org/mongo-driver/bson"
-// 	"go.mongodb.org/mongo-driver/mongo"
-// 	"go.mongodb.org/mongo-driver/mongo/options"
-// )
-
-// // User contains all information about the user
-// type User struct {
-// 	Username  string    `json:"username" bson:"username"`
-// 	FirstName string    `json:"firstName,omitempty" bson:"firstName,omitempty"`
-// 	LastName  string    `json:"lastName,omitempty" bson:"lastName,omitempty"`
-// 	Password  string    `json:"password,omitempty" bson:"password,omitempty"`
-// 	URLImage  string    `json:"urlImage,omitempty" bson:"urlImage,omitempty"`
-// 	Token     string    `json:"token,omitempty"`
-// 	Settings  *Settings `json:"settings,omitempty" bson:"settings,omitempty"`
-// }
-
-// //UserProject is a bson representation of the user object
-// var UserProject = bson.M{
-// 	"username":  1,
-// 	"firstName": 1,
-// 	"lastName":  1,
-// 	"urlImage":  1,
-// }
-
-// var UserSettingsProject = bson.M{
-// 	"settings": SettingsProject,
-// }
-
-// // name of the mongo collection
-// var UserCollection = "user"
-
-// // CreateUser creates the user model in the mongodb
-// func (u *User) CreateUser(db *mongo.Database) (*mongo.InsertOneResult, error) {
-// 	conn := database.GetColCtx(UserCollection, db, 30)
-// 	result, err := conn.Col.InsertOne(conn.Ctx, u)
-// 	defer conn.Cancel()
-// 	return result, err
-// }
-
-// // DeleteUser deletes the model from the mongodb
-// func (u *User) DeleteUser(db *mongo.Database) (*mongo.DeleteResult, error) {
-// 	conn := database.GetColCtx(UserCollection, db, 30)
-// 	filter := bson.M{"username": u.Username}
-// 	result, err := conn.Col.DeleteOne(conn.Ctx, filter)
-// 	defer conn.Cancel()
-// 	return result, err
-// }
-
-// // Exists checks if the user can be selected from the database
-// // Assumes false if any error occurs
-// func (u *User) Exists(db *mongo.Database) bool {
-// 	if err := u.GetUser(db); err != nil {
-// 		return false
-// 	}
-// 	if u.Username == "" {
-// 		return false
-// 	}
-// 	return true
-// }
-
-// //GetUser returns the specified entry from the mongodb
-// func (u *User) GetUser(db *mongo.Database) error {
-// 	conn := database.GetColCtx(UserCollection, db, 30)
-// 	filter := bson.M{"username": u.Username}
-// 	err := conn.Col.FindOne(conn.Ctx, filter).Decode(&u)
-// 	defer conn.Cancel()
-// 	return err
-// }
-
-// // GetUsers returns a sclice of the specified users from the database
-// func GetUsers(db *mongo.Database, u []User) ([]User, error) {
-// 	conn := database.GetColCtx(UserCollection, db, 30)
-// 	var usernames []string
-// 	// read all usernames
-// 	for _, user := range u {
-// 		usernames = append(usernames, user.Username)
-// 	}
-// 	filter := bson.M{"username": bson.M{"$in": usernames}}
-
-// 	cursor, err := conn.Col.Find(conn.Ctx, filter)
-// 	if err != nil {
-// 		defer conn.Cancel()
-// 		return []User{}, err
-// 	}
-// 	cursor.All(conn.Ctx, &u)
-// 	defer conn.Cancel()
-// 	return u, nil
-// }
-
-// // Save writes changes, made to the instance itself, to the database and
-// // overrides the instance with the return value from the database
-// func (u *User) Save(db *mongo.Database) error {
-// 	filter := bson.M{"username": u.Username}
-// 	update := bson.M{"$set": u}
-// 	// options to return the update document
-// 	after := options.After
-// 	upsert := true
-// 	options := options.FindOneAndUpdateOptions{
-// 		ReturnDocument: &after,
-// 		Upsert:         &upsert,
-// 	}
-// 	// Execute query
-// 	conn := database.GetColCtx(UserCollection, db, 30)
-// 	err := conn.Col.FindOneAndUpdate(conn.Ctx, filter, update, &options).Decode(&u)
-// 	defer conn.Cancel()
-// 	if err != nil {
-// 		return err
-// 	}
-// 	return nil
-// }
-
-// // UpdateUser updates the record with the passed one
-// func (u *User) UpdateUser(db *mongo.Database, uu User) (*mongo.UpdateResult, error) {
-// 	conn := database.GetColCtx(UserCollection, db, 30)
-// 	filter := bson.M{"username": u.Username}
-// 	update := bson.M{"$set": uu}
-// 	result, err := conn.Col.UpdateOne(conn.Ctx, filter, update)
-// 	defer conn.Cancel()
-// 	return result, err
-// }
+import (
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/mirisbowring/primboard/helper/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// User contains all information about a local account
+type User struct {
+	Username  string `json:"username" bson:"username"`
+	FirstName string `json:"firstName,omitempty" bson:"firstName,omitempty"`
+	LastName  string `json:"lastName,omitempty" bson:"lastName,omitempty"`
+	Email     string `json:"email,omitempty" bson:"email,omitempty"`
+	Password  string `json:"password,omitempty" bson:"password,omitempty"`
+	URLImage  string `json:"urlImage,omitempty" bson:"urlImage,omitempty"`
+	// Token is the invite token consumed by the registration
+	Token           string    `json:"token,omitempty" bson:"-"`
+	Created         int64     `json:"created,omitempty" bson:"created,omitempty"`
+	PasswordChanged int64     `json:"-" bson:"passwordChanged,omitempty"`
+	ResetToken      string    `json:"-" bson:"resetToken,omitempty"`
+	ResetUntil      int64     `json:"-" bson:"resetUntil,omitempty"`
+	Settings        *Settings `json:"settings,omitempty" bson:"settings,omitempty"`
+}
+
+// UserProfile contains the fields a user is allowed to change
+type UserProfile struct {
+	FirstName string `json:"firstName" bson:"firstName"`
+	LastName  string `json:"lastName" bson:"lastName"`
+	Email     string `json:"email" bson:"email"`
+	URLImage  string `json:"urlImage" bson:"urlImage"`
+}
+
+// PasswordChange is the request to change the own password
+type PasswordChange struct {
+	OldPassword string `json:"oldPassword"`
+	NewPassword string `json:"newPassword"`
+}
+
+// PasswordReset is the request to set a new password with a reset token
+type PasswordReset struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// UserProject is a bson representation of the user object
+var UserProject = bson.M{
+	"username":  1,
+	"firstName": 1,
+	"lastName":  1,
+	"email":     1,
+	"urlImage":  1,
+	"created":   1,
+}
+
+// UserCollection is the name of the mongo collection
+var UserCollection = "user"
+
+// usernamePattern restricts usernames to characters that are safe within paths
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{2,63}$`)
+
+// ErrUserExists is returned if the username has been taken already
+var ErrUserExists = errors.New("username is already taken")
+
+// EnsureUserIndexes creates the indexes of the user collection
+func EnsureUserIndexes(db *mongo.Database) error {
+	conn := database.GetColCtx(UserCollection, db, 30)
+	defer conn.Cancel()
+	indexes := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "username", Value: 1}},
+			Options: options.Index().SetName("username_unique").SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "resetToken", Value: 1}},
+			Options: options.Index().SetName("resetToken").SetSparse(true),
+		},
+	}
+	if _, err := conn.Col.Indexes().CreateMany(conn.Ctx, indexes); err != nil {
+		log.WithFields(log.Fields{
+			"collection": UserCollection,
+			"error":      err.Error(),
+		}).Error("could not create indexes")
+		return err
+	}
+	return nil
+}
+
+// ValidatePassword verifies the length of a password (bcrypt only considers
+// the first 72 bytes)
+func ValidatePassword(password string) error {
+	if len(password) < 8 {
+		return errors.New("password must contain at least 8 characters")
+	}
+	if len(password) > 72 {
+		return errors.New("password must not contain more than 72 bytes")
+	}
+	return nil
+}
+
+// IsValid verifies the username and the password of a registration
+func (u *User) IsValid() error {
+	if !usernamePattern.MatchString(u.Username) {
+		return errors.New("username must consist of 3 to 64 letters, digits, '.', '_' or '-'")
+	}
+	return ValidatePassword(u.Password)
+}
+
+// CreateUser creates the user model in the mongodb
+func (u *User) CreateUser(db *mongo.Database) error {
+	u.Created = time.Now().Unix()
+	u.PasswordChanged = u.Created
+	conn := database.GetColCtx(UserCollection, db, 30)
+	defer conn.Cancel()
+	if _, err := conn.Col.InsertOne(conn.Ctx, u); err != nil {
+		if database.IsDuplicateKeyError(err) {
+			return ErrUserExists
+		}
+		return err
+	}
+	return nil
+}
+
+// GetUser returns the specified entry from the mongodb
+func (u *User) GetUser(db *mongo.Database) error {
+	conn := database.GetColCtx(UserCollection, db, 30)
+	defer conn.Cancel()
+	filter := bson.M{"username": u.Username}
+	return conn.Col.FindOne(conn.Ctx, filter).Decode(&u)
+}
+
+// GetUserProfile selects the user without credentials
+func (u *User) GetUserProfile(db *mongo.Database) error {
+	conn := database.GetColCtx(UserCollection, db, 30)
+	defer conn.Cancel()
+	filter := bson.M{"username": u.Username}
+	opts := options.FindOne().SetProjection(UserProject)
+	return conn.Col.FindOne(conn.Ctx, filter, opts).Decode(&u)
+}
+
+// UpdateProfile overrides the profile fields of the user
+func (u *User) UpdateProfile(db *mongo.Database, profile UserProfile) error {
+	conn := database.GetColCtx(UserCollection, db, 30)
+	defer conn.Cancel()
+	filter := bson.M{"username": u.Username}
+	res, err := conn.Col.UpdateOne(conn.Ctx, filter, bson.M{"$set": profile})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// UpdatePassword sets the hashed password and removes pending reset tokens.
+// Tokens issued before the change become invalid.
+func (u *User) UpdatePassword(db *mongo.Database, hash string) error {
+	u.PasswordChanged = time.Now().Unix()
+	conn := database.GetColCtx(UserCollection, db, 30)
+	defer conn.Cancel()
+	filter := bson.M{"username": u.Username}
+	update := bson.M{
+		"$set":   bson.M{"password": hash, "passwordChanged": u.PasswordChanged},
+		"$unset": bson.M{"resetToken": "", "resetUntil": ""},
+	}
+	res, err := conn.Col.UpdateOne(conn.Ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// SetResetToken stores the hash of a reset token for the user that is valid
+// for the passed duration
+func (u *User) SetResetToken(db *mongo.Database, token string, validity time.Duration) error {
+	u.ResetToken = token
+	u.ResetUntil = time.Now().Add(validity).Unix()
+	conn := database.GetColCtx(UserCollection, db, 30)
+	defer conn.Cancel()
+	filter := bson.M{"username": u.Username}
+	update := bson.M{"$set": bson.M{"resetToken": HashAccessToken(token), "resetUntil": u.ResetUntil}}
+	res, err := conn.Col.UpdateOne(conn.Ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// GetUserByResetToken selects the user with the not expired reset token
+func GetUserByResetToken(db *mongo.Database, token string) (*User, error) {
+	if token == "" {
+		return nil, errors.New("reset token must be specified")
+	}
+	conn := database.GetColCtx(UserCollection, db, 30)
+	defer conn.Cancel()
+	filter := bson.M{
+		"resetToken": HashAccessToken(token),
+		"resetUntil": bson.M{"$gte": time.Now().Unix()},
+	}
+	var u User
+	if err := conn.Col.FindOne(conn.Ctx, filter).Decode(&u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
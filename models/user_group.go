@@ -11,20 +11,74 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-// UserGroup holts the users and the information about the group
+// UserGroup holts the users and the information about the group. All members
+// are listed in users, members without another role are viewers.
 type UserGroup struct {
-	ID      primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
-	Title   string             `json:"title,omitempty" bson:"title,omitempty"`
-	Creator string             `json:"creator,omitempty" bson:"creator,omitempty"`
-	Users   []string           `json:"users,omitempty" bson:"users,omitempty"`
+	ID           primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	Title        string             `json:"title,omitempty" bson:"title,omitempty"`
+	Creator      string             `json:"creator,omitempty" bson:"creator,omitempty"`
+	Users        []string           `json:"users,omitempty" bson:"users,omitempty"`
+	Admins       []string           `json:"admins,omitempty" bson:"admins,omitempty"`
+	Contributors []string           `json:"contributors,omitempty" bson:"contributors,omitempty"`
+	// Quota limits the members on the nodes shared with the group
+	Quota *Quota `json:"quota,omitempty" bson:"quota,omitempty"`
+}
+
+// GroupRole is the role of a member within a usergroup
+type GroupRole string
+
+const (
+	// RoleViewer can see the content shared with the group
+	RoleViewer GroupRole = "viewer"
+	// RoleContributor can additionally add media, tags and events
+	RoleContributor GroupRole = "contributor"
+	// RoleAdmin can additionally manage the membership and the shares
+	RoleAdmin GroupRole = "admin"
+	// RoleOwner is the creator of the group (or the content)
+	RoleOwner GroupRole = "owner"
+)
+
+var roleLevels = map[GroupRole]int{
+	RoleViewer:      1,
+	RoleContributor: 2,
+	RoleAdmin:       3,
+	RoleOwner:       4,
+}
+
+// Includes returns whether the role grants at least the passed role
+func (r GroupRole) Includes(role GroupRole) bool {
+	return roleLevels[r] > 0 && roleLevels[r] >= roleLevels[role]
+}
+
+// IsValid returns whether the role can be assigned to a member
+func (r GroupRole) IsValid() bool {
+	return r == RoleViewer || r == RoleContributor || r == RoleAdmin
 }
 
 //UserGroupProject is a bson representation of a user group
 var UserGroupProject = bson.M{
-	"_id":     1,
-	"title":   1,
-	"creator": 1,
-	"users":   1,
+	"_id":          1,
+	"title":        1,
+	"creator":      1,
+	"users":        1,
+	"admins":       1,
+	"contributors": 1,
+	"quota":        1,
+}
+
+// UserGroupPermission creates a filter for usergroups in which the user has
+// at least the passed role
+func UserGroupPermission(user string, role GroupRole) bson.M {
+	filters := []bson.M{{"creator": user}}
+	switch role {
+	case RoleViewer:
+		filters = append(filters, bson.M{"users": user})
+	case RoleContributor:
+		filters = append(filters, bson.M{"admins": user}, bson.M{"contributors": user})
+	case RoleAdmin:
+		filters = append(filters, bson.M{"admins": user})
+	}
+	return bson.M{"$or": filters}
 }
 
 // UserGroupCollection is the name of the mongo collection
@@ -123,6 +177,19 @@ func GetUserGroupsByIDs(db *mongo.Database, ids []primitive.ObjectID, permission
 	return groups, nil
 }
 
+// AddUserToUserGroups adds the user to all passed usergroups
+func AddUserToUserGroups(db *mongo.Database, ids []primitive.ObjectID, user string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	filter := bson.M{"_id": bson.M{"$in": ids}}
+	update := bson.M{"$addToSet": bson.M{"users": user}}
+	conn := database.GetColCtx(UserGroupCollection, db, 30)
+	defer conn.Cancel()
+	_, err := conn.Col.UpdateMany(conn.Ctx, filter, update)
+	return err
+}
+
 // GetUserGroupsByKeyword returns the topmost groups that are starting with the keyword
 func GetUserGroupsByKeyword(db *mongo.Database, keyword string, limit int) ([]UserGroup, error) {
 	conn := database.GetColCtx(UserGroupCollection, db, 30)
@@ -154,7 +221,14 @@ func (ug *UserGroup) Save(db *mongo.Database, skipVerify bool) error {
 		}
 	}
 	filter := bson.M{"_id": ug.ID}
-	update := bson.M{"$set": ug}
+	// members and roles are set explicitly, so that emptied lists are saved
+	update := bson.M{"$set": bson.M{
+		"title":        ug.Title,
+		"creator":      ug.Creator,
+		"users":        nonNil(ug.Users),
+		"admins":       nonNil(ug.Admins),
+		"contributors": nonNil(ug.Contributors),
+	}}
 	// options to return the update document
 	after := options.After
 	upsert := true
@@ -172,24 +246,124 @@ func (ug *UserGroup) Save(db *mongo.Database, skipVerify bool) error {
 	return nil
 }
 
-// UpdateUserGroup updates the record with the passed one
-func (ug *UserGroup) UpdateUserGroup(db *mongo.Database, uug UserGroup, skipVerify bool) (*mongo.UpdateResult, error) {
-	if !skipVerify {
-		// verify that the fields are valid
-		if err := uug.Verify(db); err != nil {
-			return nil, err
-		}
+// Merge applies the title and the member lists of the passed group, that
+// have been set, to a copy of the group (lists passed as empty are set)
+func (ug *UserGroup) Merge(uug UserGroup) UserGroup {
+	merged := *ug
+	if uug.Title != "" {
+		merged.Title = uug.Title
 	}
-	// ID should not be changes
-	if ug.ID != uug.ID {
-		uug.ID = ug.ID
+	if uug.Users != nil {
+		merged.Users = append([]string{}, uug.Users...)
+	}
+	if uug.Admins != nil {
+		merged.Admins = append([]string{}, uug.Admins...)
+	}
+	if uug.Contributors != nil {
+		merged.Contributors = append([]string{}, uug.Contributors...)
+	}
+	return merged
+}
+
+// Update sets the title and the member lists of the passed group, that differ
+// from the current state of the group
+func (ug *UserGroup) Update(db *mongo.Database, uug UserGroup) (*mongo.UpdateResult, error) {
+	set := bson.M{}
+	if uug.Title != ug.Title {
+		set["title"] = uug.Title
+	}
+	if !equalStrings(uug.Users, ug.Users) {
+		set["users"] = nonNil(uug.Users)
+	}
+	if !equalStrings(uug.Admins, ug.Admins) {
+		set["admins"] = nonNil(uug.Admins)
+	}
+	if !equalStrings(uug.Contributors, ug.Contributors) {
+		set["contributors"] = nonNil(uug.Contributors)
+	}
+	if len(set) == 0 {
+		return &mongo.UpdateResult{MatchedCount: 1}, nil
 	}
-	filter := bson.M{"_id": ug.ID}
-	update := bson.M{"$set": uug}
 	conn := database.GetColCtx(UserGroupCollection, db, 30)
-	result, err := conn.Col.UpdateOne(conn.Ctx, filter, update)
 	defer conn.Cancel()
-	return result, err
+	return conn.Col.UpdateOne(conn.Ctx, bson.M{"_id": ug.ID}, bson.M{"$set": set})
+}
+
+// Role returns the role of the user within the group (empty if the user is
+// not a member)
+func (ug *UserGroup) Role(user string) GroupRole {
+	if user == "" {
+		return ""
+	}
+	if user == ug.Creator {
+		return RoleOwner
+	}
+	if _, found := helper.FindInSlice(ug.Users, user); !found {
+		return ""
+	}
+	if _, found := helper.FindInSlice(ug.Admins, user); found {
+		return RoleAdmin
+	}
+	if _, found := helper.FindInSlice(ug.Contributors, user); found {
+		return RoleContributor
+	}
+	return RoleViewer
+}
+
+// SetRole assigns the role to the user and adds the user to the group if
+// necessary
+func (ug *UserGroup) SetRole(user string, role GroupRole) {
+	ug.Admins = removeString(ug.Admins, user)
+	ug.Contributors = removeString(ug.Contributors, user)
+	switch role {
+	case RoleAdmin:
+		ug.Admins = append(ug.Admins, user)
+	case RoleContributor:
+		ug.Contributors = append(ug.Contributors, user)
+	}
+	if _, found := helper.FindInSlice(ug.Users, user); !found {
+		ug.Users = append(ug.Users, user)
+	}
+}
+
+// RemoveUser removes the user and its role from the group
+func (ug *UserGroup) RemoveUser(user string) {
+	ug.Users = removeString(ug.Users, user)
+	ug.Admins = removeString(ug.Admins, user)
+	ug.Contributors = removeString(ug.Contributors, user)
+}
+
+// removeString removes all occurences of the value from the slice
+func removeString(s []string, r string) []string {
+	list := []string{}
+	for _, v := range s {
+		if v != r {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// equalStrings returns whether both slices contain the same values in the
+// same order
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// nonNil returns an empty slice instead of nil
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
 }
 
 // Verify tries to verify the usergroup object
@@ -211,6 +385,23 @@ func (ug *UserGroup) Verify(db *mongo.Database) error {
 	if len(ug.Users) > 1 {
 		ug.Users = helper.UniqueStrings(ug.Users)
 	}
+	// roles can only be assigned to members (the creator is the owner anyway)
+	admins := []string{}
+	for _, user := range helper.UniqueStrings(ug.Admins) {
+		if _, found := helper.FindInSlice(ug.Users, user); found && user != ug.Creator {
+			admins = append(admins, user)
+		}
+	}
+	ug.Admins = admins
+	contributors := []string{}
+	for _, user := range helper.UniqueStrings(ug.Contributors) {
+		_, isMember := helper.FindInSlice(ug.Users, user)
+		_, isAdmin := helper.FindInSlice(ug.Admins, user)
+		if isMember && !isAdmin && user != ug.Creator {
+			contributors = append(contributors, user)
+		}
+	}
+	ug.Contributors = contributors
 
 	return nil
 }
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"path/filepath"
 
 	"github.com/mirisbowring/primboard/helper"
 	_http "github.com/mirisbowring/primboard/helper/http"
@@ -47,10 +48,19 @@ func (n *AppNode) addFile(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
+	reservation, status := n.reserveQuota(w, username, handlerOrigin.Size)
+	if status > 0 {
+		return
+	}
+	defer n.releaseQuota(reservation)
+
 	// create original
 	if status := handler.CreateFileFromMultipart(n.Config.BasePath, file, handlerOrigin, username, "original", w); status > 0 {
 		return
 	}
+	if _, status := writtenSize(w, filepath.Join(n.Config.BasePath, "user", username, "own", handlerOrigin.Filename), reservation); status > 0 {
+		return
+	}
 	// create thumbnail
 	if status := handler.CreateFileFromMultipart(n.Config.BasePath, fileThumb, handlerThumb, username, "thumb", w); status > 0 {
 		return
@@ -60,6 +70,58 @@ func (n *AppNode) addFile(w http.ResponseWriter, r *http.Request) {
 	_http.RespondWithJSON(w, http.StatusCreated, "upload was successfull")
 }
 
+// archiveFiles streams the requested files of the users as zip or tar archive
+// without creating temporary files. Only the gateway may request an archive
+// (it authorizes the files of the archive).
+func (n *AppNode) archiveFiles(w http.ResponseWriter, r *http.Request) {
+	if !n.isGatewayClient(w) {
+		_http.RespondWithError(w, http.StatusForbidden, "only the gateway may request an archive")
+		return
+	}
+
+	var req maps.ArchiveRequest
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&req); err != nil {
+		_http.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if len(req.Files) == 0 {
+		_http.RespondWithError(w, http.StatusBadRequest, "no files specified")
+		return
+	}
+	for _, file := range req.Files {
+		if err := handler.ValidateArchiveFile(file); err != nil {
+			_http.RespondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	aw, err := handler.NewArchiveWriter(req.Format, w)
+	if err != nil {
+		_http.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// the status cannot be changed after the first file has been written
+	w.Header().Set("Content-Type", handler.ArchiveContentType(req.Format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"archive.%s\"", handler.ArchiveExtension(req.Format)))
+	w.WriteHeader(http.StatusOK)
+
+	failed := handler.ArchiveFiles(n.Config.BasePath, aw, req.Files)
+	if err := aw.Close(); err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Error("could not finish archive")
+		return
+	}
+	log.WithFields(log.Fields{
+		"files":  len(req.Files),
+		"failed": len(failed),
+	}).Info("streamed archive")
+}
+
 // deleteFile deletes a specific file from filesystem
 func (n *AppNode) deleteFile(w http.ResponseWriter, r *http.Request) {
 	// parse filename from url
@@ -141,7 +203,7 @@ func (n *AppNode) deleteShareForGroup(w http.ResponseWriter, r *http.Request) {
 
 	// delete file for group
 	if failed := handler.DeleteShares(n.Config.BasePath, username, maps, w); len(failed) > 0 {
-		_http.RespondWithJSON(w, 901, _http.ErrorJSON{Error: "could not remove share for all files", Payload: maps})
+		_http.RespondWithJSON(w, 901, _http.ErrorJSON{Error: "could not remove share for all files", Payload: failed})
 		return
 	}
 	// if status = handler.DeleteFile(n.Config.BasePath, username, group, filename, w); status > 0 {
@@ -168,7 +230,7 @@ func (n *AppNode) deleteShares(w http.ResponseWriter, r *http.Request) {
 
 	// delete the specified shares
 	if failed := handler.DeleteShares(n.Config.BasePath, username, maps, w); len(failed) > 0 {
-		_http.RespondWithJSON(w, 901, _http.ErrorJSON{Error: "could not remove share for all files", Payload: maps})
+		_http.RespondWithJSON(w, 901, _http.ErrorJSON{Error: "could not remove share for all files", Payload: failed})
 		return
 	}
 
@@ -201,14 +263,22 @@ func (n *AppNode) getFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !validPathElement(ident) || !validPathElement(file) {
+		_http.RespondWithError(w, http.StatusBadRequest, "invalid identifier or filename")
+		return
+	}
+	if !n.authorizeFile(w, r, ident, group) {
+		_http.RespondWithError(w, http.StatusForbidden, "you are not allowed to access this file")
+		return
+	}
+
 	var path string
 	if group {
 		path = n.getDataPath(ident, pathTypeGroup, thumb)
 	} else {
 		path = n.getDataPath(ident, pathTypeUser, thumb)
 	}
-	path = fmt.Sprintf("%s/%s", path, file)
-	http.ServeFile(w, r, path)
+	n.serveFile(w, r, filepath.Join(path, file))
 }
 
 func (n *AppNode) shareFiles(w http.ResponseWriter, r *http.Request) {
@@ -255,6 +325,13 @@ func (n *AppNode) uploadFile(w http.ResponseWriter, r *http.Request) {
 	// set the username
 	m.Creator = username
 
+	reservation, status := n.reserveQuota(w, username, fileHeader.Size)
+	if status > 0 {
+		return
+	}
+	// released after the gateway accounted the usage of the media
+	defer n.releaseQuota(reservation)
+
 	// verify dir existance
 	path := n.getDataPath(m.Creator, pathTypeUser, false)
 	pathThumb := n.getDataPath(m.Creator, pathTypeUser, true)
@@ -281,6 +358,10 @@ func (n *AppNode) uploadFile(w http.ResponseWriter, r *http.Request) {
 		_http.RespondWithError(w, http.StatusInternalServerError, "could create file")
 		return
 	}
+	// account the bytes, that have actually been written
+	if m.Size, status = writtenSize(w, filepath, reservation); status > 0 {
+		return
+	}
 
 	// create new stream
 	file, err = os.Open(filepath)
@@ -299,6 +380,12 @@ func (n *AppNode) uploadFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// read capture time, location and camera from exif (if available)
+	if exif, err := helper.ReadExif(file); err == nil {
+		m.ApplyExif(exif)
+		m.ApplyExifLocation(exif)
+	}
+
 	// parse filenames
 	m.FileNameThumb = handler.ParseFileName(m.Sha1, m.Creator, true, m.Extension)
 	m.FileName = handler.ParseFileName(m.Sha1, m.Creator, false, m.Extension)
@@ -341,10 +428,10 @@ func (n *AppNode) uploadFile(w http.ResponseWriter, r *http.Request) {
 	body := bytes.NewReader(data)
 
 	// refresh keycloaktoken in neccessary
-	n.keycloakRefreshToken()
+	n.refreshServiceToken()
 
 	// post media to gateway
-	resp, status, msg := _http.SendRequest(n.HTTPClient, http.MethodPost, n.Config.GatewayURL+"/api/v1/media", n.KeycloakToken.AccessToken, body, "application/json")
+	resp, status, msg := _http.SendRequest(n.gatewayClient(), http.MethodPost, n.Config.GatewayURL+"/api/v1/media", n.ServiceToken.AccessToken, body, "application/json")
 	if status > 0 {
 		_http.RespondWithError(w, http.StatusInternalServerError, msg)
 		return
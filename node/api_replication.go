@@ -0,0 +1,190 @@
+package node
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mirisbowring/primboard/helper"
+	_http "github.com/mirisbowring/primboard/helper/http"
+	"github.com/mirisbowring/primboard/internal/handler"
+	"github.com/mirisbowring/primboard/models/maps"
+	log "github.com/sirupsen/logrus"
+)
+
+// errChecksumMismatch is returned if the copied file does not match the sha1
+var errChecksumMismatch = errors.New("checksum of the copied file does not match")
+
+// replicateFile copies the file and its thumbnail of a user from the source
+// node. The original is verified against the passed sha1. Only the gateway
+// may request a replication.
+func (n *AppNode) replicateFile(w http.ResponseWriter, r *http.Request) {
+	if !n.isGatewayClient(w) {
+		_http.RespondWithError(w, http.StatusForbidden, "only the gateway may request a replication")
+		return
+	}
+
+	var req maps.ReplicationRequest
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&req); err != nil {
+		_http.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if err := handler.ValidateArchiveFile(maps.ArchiveFile{Username: req.Username, Filename: req.Filename}); err != nil {
+		_http.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.SourceID == "" || req.Sha1 == "" || req.URL == "" || req.URLThumb == "" {
+		_http.RespondWithError(w, http.StatusBadRequest, "source id, sha1 and signed urls must be specified")
+		return
+	}
+	// the service token is only sent to known nodes
+	source, err := n.resolvePeer(req.SourceID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"source": req.SourceID,
+			"error":  err.Error(),
+		}).Error("could not resolve source node")
+		_http.RespondWithError(w, http.StatusBadRequest, "unknown source node")
+		return
+	}
+	if req.Source != "" && req.Source != source {
+		_http.RespondWithError(w, http.StatusBadRequest, "source does not match the endpoint of the source node")
+		return
+	}
+	req.Source = source
+	// the signed urls must point to the files on the source node
+	prefix := fmt.Sprintf("%s/api/v1/file/%s/", source, url.PathEscape(req.Username))
+	if !strings.HasPrefix(req.URL, prefix) || !strings.HasPrefix(req.URLThumb, prefix) {
+		_http.RespondWithError(w, http.StatusBadRequest, "signed urls do not match the source node")
+		return
+	}
+	client := n.peerClient(req.SourceID)
+	thumb, status := handler.ParseThumbnailName(req.Filename)
+	if status > 0 {
+		_http.RespondWithError(w, http.StatusBadRequest, "could not parse thumbnail name")
+		return
+	}
+
+	logfields := log.Fields{
+		"source":   req.Source,
+		"username": req.Username,
+		"filename": req.Filename,
+	}
+
+	path := filepath.Join(n.getDataPath(req.Username, pathTypeUser, false), req.Filename)
+	pathThumb := filepath.Join(n.getDataPath(req.Username, pathTypeUser, true), thumb)
+
+	// the file could be stored already (e.g. node was offline). The gateway
+	// reserves the quota of the copy.
+	if !helper.PathExists(path) || n.fileSha1(path) != req.Sha1 {
+		if err := n.downloadFile(client, req.URL, path, req.Sha1); err != nil {
+			logfields["error"] = err.Error()
+			log.WithFields(logfields).Error("could not replicate file")
+			if err == errChecksumMismatch {
+				_http.RespondWithError(w, http.StatusConflict, err.Error())
+				return
+			}
+			_http.RespondWithError(w, http.StatusBadGateway, "could not copy file from source node")
+			return
+		}
+	}
+	if err := n.downloadFile(client, req.URLThumb, pathThumb, ""); err != nil {
+		logfields["error"] = err.Error()
+		log.WithFields(logfields).Error("could not replicate thumbnail")
+		_http.RespondWithError(w, http.StatusBadGateway, "could not copy thumbnail from source node")
+		return
+	}
+
+	// restore the shares of the file
+	if len(req.Groups) > 0 {
+		shares := maps.FilesGroupsMap{Filenames: []string{req.Filename}, Groups: req.Groups}
+		if failed := handler.ShareFiles(n.Config.BasePath, req.Username, shares); len(failed) > 0 {
+			log.WithFields(logfields).Warn("could not restore all shares of replicated file")
+		}
+	}
+
+	log.WithFields(logfields).Info("replicated file")
+	_http.RespondWithJSON(w, http.StatusCreated, "replicated file")
+}
+
+// downloadFile requests the file from the signed url of the source node and
+// writes it to the path. If sha1 is set, the file is only kept if the checksum
+// matches.
+func (n *AppNode) downloadFile(client *http.Client, signedURL string, path string, sha string) error {
+	res, status, msg := _http.SendRequest(client, http.MethodGet, signedURL, "", nil, "")
+	if status > 0 {
+		return errors.New(msg)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	// write into a temporary file, that is renamed after the verification
+	tmp := path + ".part"
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	hash := sha1.New()
+	_, err = io.Copy(io.MultiWriter(dst, hash), res.Body)
+	dst.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if sha != "" && hex.EncodeToString(hash.Sum(nil)) != sha {
+		os.Remove(tmp)
+		return errChecksumMismatch
+	}
+	return os.Rename(tmp, path)
+}
+
+// fileSha1 calculates the checksum of the file (empty if not readable)
+func (n *AppNode) fileSha1(path string) string {
+	file, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+	return helper.GenerateSHA1(file)
+}
+
+// resolvePeer returns the api endpoint of the node at the gateway
+func (n *AppNode) resolvePeer(nodeID string) (string, error) {
+	// refresh keycloaktoken in neccessary
+	n.refreshServiceToken()
+
+	api := fmt.Sprintf("%s/api/v2/infrastructure/node/%s/peer/%s", n.Config.GatewayURL, n.Config.Keycloak.ClientID, url.PathEscape(nodeID))
+	res, status, msg := _http.SendRequest(n.gatewayClient(), http.MethodGet, api, n.ServiceToken.AccessToken, nil, "")
+	if status > 0 {
+		return "", errors.New(msg)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+	var peer maps.NodeEndpoint
+	if err := json.NewDecoder(res.Body).Decode(&peer); err != nil {
+		return "", err
+	}
+	if peer.ID != nodeID || peer.APIEndpoint == "" {
+		return "", errors.New("gateway returned an invalid endpoint")
+	}
+	return peer.APIEndpoint, nil
+}
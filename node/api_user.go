@@ -3,17 +3,12 @@ package node
 import (
 	"encoding/json"
 	"net/http"
-	"strings"
-	"time"
 
 	_http "github.com/mirisbowring/primboard/helper/http"
-	"github.com/mirisbowring/primboard/internal/handler"
-	"github.com/mirisbowring/primboard/internal/models"
 	log "github.com/sirupsen/logrus"
 )
 
 // AuthenticateUser gets called after a user has been authenticated to the gateway
-// creates temporary session symlink to be able to access the files
 func (n *AppNode) authenticateUser(w http.ResponseWriter, r *http.Request) {
 	var token string
 	// get username
@@ -45,27 +40,9 @@ func (n *AppNode) authenticateUser(w http.ResponseWriter, r *http.Request) {
 		_http.RespondWithError(w, http.StatusBadRequest, msg)
 		return
 	}
-	// link user path
-	handler.LinkUser(n.Config.BasePath, n.Config.TargetPath, username, token)
 	_http.RespondWithJSON(w, http.StatusOK, "authentication successfull")
 }
 
-func (n *AppNode) generateSessionCookie(w http.ResponseWriter, r *http.Request) {
-	cookie := http.Cookie{
-		Name:     "keycloak-jwt",
-		Value:    strings.Replace(r.Header.Get("Authorization"), "Bearer ", "", 1),
-		Expires:  time.Now().Add(time.Minute + 5),
-		Path:     "/",
-		Secure:   true,
-		HttpOnly: false,
-		Domain:   "10.101.1.8",
-		SameSite: http.SameSiteLaxMode,
-	}
-	http.SetCookie(w, &cookie)
-
-	_http.RespondWithJSON(w, http.StatusOK, "created cookie")
-}
-
 func (n *AppNode) unauthenticateUser(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
@@ -74,21 +51,16 @@ func (n *AppNode) unauthenticateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// get session for user
-	s := handler.GetSessionByUsername(n.Sessions, username)
-	if s == nil || (s == &models.Session{}) || s.Token == "" {
+	s := n.Sessions.GetByUser(username)
+	if s == nil || s.Token == "" {
 		log.WithFields(log.Fields{
 			"username": username,
-		}).Error("cannot unlink user - no session found")
+		}).Error("cannot unauthenticate user - no session found")
 		_http.RespondWithJSON(w, http.StatusUnauthorized, "no session found for user")
 		return
 	}
-	// unlink the user
-	if status, msg := handler.UnlinkUser(n.Config.TargetPath, s.Token); status > 0 {
-		_http.RespondWithError(w, http.StatusInternalServerError, msg)
-		return
-	}
 	// remove session
-	n.Sessions = handler.RemoveSession(n.Sessions, s.Token)
+	n.Sessions.RemoveByToken(s.Token)
 	// everything went well
 	_http.RespondWithJSON(w, http.StatusOK, "unauthenticated user")
 }
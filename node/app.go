@@ -2,33 +2,48 @@ package node
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/Nerzal/gocloak/v7"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	_http "github.com/mirisbowring/primboard/helper/http"
-	"github.com/mirisbowring/primboard/internal/handler"
+	"github.com/mirisbowring/primboard/helper/pki"
+	"github.com/mirisbowring/primboard/helper/urlsign"
+	"github.com/mirisbowring/primboard/internal/identity"
 	iModels "github.com/mirisbowring/primboard/internal/models"
 	"github.com/mirisbowring/primboard/internal/models/infrastructure"
+	"github.com/mirisbowring/primboard/models/maps"
 	log "github.com/sirupsen/logrus"
 )
 
 // AppNode struct to maintain router
 type AppNode struct {
-	Router             *mux.Router
-	Config             *infrastructure.NodeConfig
-	Ctx                context.Context
-	Sessions           []*iModels.Session
-	HTTPClient         *http.Client
-	KeycloakClient     gocloak.GoCloak
-	KeycloakToken      *gocloak.JWT
-	KeycloakTokenCache map[string]*gocloak.RetrospecTokenResult
+	Router       *mux.Router
+	Config       *infrastructure.NodeConfig
+	Ctx          context.Context
+	Sessions     *iModels.MemorySessionStore
+	HTTPClient   *http.Client
+	Identity     identity.IdentityProvider
+	ServiceToken *identity.Token
+	// inFlight is the number of requests currently handled (queue depth)
+	inFlight int64
+	// mtls is set if the mutual tls with the gateway is enabled
+	mtls *mtls
+	// signingKey verifies the signed file urls (received from the gateway)
+	signingKey []byte
+	// gatewayClientID is the client id of the service account of the gateway
+	gatewayClientID string
 }
 
+// Version of the node (set via ldflags)
+var Version = "dev"
+
 type pathType string
 
 const (
@@ -39,51 +54,68 @@ const (
 // Run starts the application on the passed address with the inherited router
 // WARN: router must be initialized first
 func (n *AppNode) Run(addr string) {
-	log.Fatal(
-		http.ListenAndServe(
-			addr,
-			handlers.CORS(
-				handlers.AllowedHeaders(
-					[]string{
-						"X-Requested-With",
-						"Content-Type",
-						"Authorization",
-					},
-				),
-				handlers.AllowedMethods(
-					[]string{
-						"DELETE",
-						"GET",
-						"POST",
-						"PUT",
-						"HEAD",
-						"OPTIONS",
-					},
-				),
-				handlers.AllowedOrigins(
-					n.Config.AllowedOrigins,
-				),
-				handlers.AllowCredentials(),
-			)(n.Router)))
+	server := &http.Server{
+		Addr:    addr,
+		Handler: n.handler(),
+	}
+	switch {
+	case n.mtls != nil:
+		// the certificate of the node is presented to the gateway, the other
+		// nodes and the users
+		server.TLSConfig = pki.ServerTLSConfig(n.mtls.pool, n.mtls.keypair)
+		log.Fatal(server.ListenAndServeTLS("", ""))
+	case n.Config.TLS:
+		log.Fatal(server.ListenAndServeTLS(
+			n.certificateFile("server.crt"),
+			n.certificateFile("server.key"),
+		))
+	default:
+		log.Fatal(server.ListenAndServe())
+	}
+}
+
+// handler returns the router with the cors handling
+func (n *AppNode) handler() http.Handler {
+	return handlers.CORS(
+		handlers.AllowedHeaders(
+			[]string{
+				"X-Requested-With",
+				"Content-Type",
+				"Authorization",
+			},
+		),
+		handlers.AllowedMethods(
+			[]string{
+				"DELETE",
+				"GET",
+				"POST",
+				"PUT",
+				"HEAD",
+				"OPTIONS",
+			},
+		),
+		handlers.AllowedOrigins(
+			n.Config.AllowedOrigins,
+		),
+		handlers.AllowCredentials(),
+	)(n.Router)
 }
 
 // Initialize initializes application related content
 // - router initialization
 func (n *AppNode) Initialize(config infrastructure.NodeConfig) {
 	log.Info("Starting Initialization")
-	n.KeycloakTokenCache = make(map[string]*gocloak.RetrospecTokenResult)
 	n.Config = &config
+	n.initializeSessionStore()
 	n.Ctx = context.Background()
 	httpClient, tlsConfig := _http.GenerateHTTPClient(n.Config.CaCert, n.Config.TLSInsecure)
 	n.HTTPClient = httpClient
-	n.KeycloakClient = handler.CreateKeycloakClient(tlsConfig, n.Config.Keycloak.URL)
-	n.authenticateToKeycloak(0, 10)
+	n.initializeIdentityProvider(tlsConfig)
+	n.initializeMTLS()
+	n.loginServiceAccount(0, 10)
 
 	n.initializeRoutes()
 
-	// remove obsolete locations (could exist if crashed)
-	// handler.DeleteFiles("/etc/nginx/locations")
-	//
 	resp := n.authenticateToGateway()
 	// if authentication failed due to gateway down (status == 1), retry every
 	// 10 seconds until gateway up
@@ -95,6 +127,13 @@ func (n *AppNode) Initialize(config infrastructure.NodeConfig) {
 		time.Sleep(10 * time.Second)
 		resp = n.authenticateToGateway()
 	}
+
+	if n.Config.Tunnel {
+		go n.runTunnel()
+	}
+	go n.runHeartbeat(time.Duration(n.Config.HeartbeatInterval) * time.Second)
+	go n.runReconciliation(time.Duration(n.Config.ReconcileInterval) * time.Hour)
+	go n.runScrub(time.Duration(n.Config.ScrubInterval) * time.Hour)
 }
 
 func (n *AppNode) methodNotAllowedHandler() http.Handler {
@@ -108,42 +147,40 @@ func (n *AppNode) methodNotAllowedHandler() http.Handler {
 // Authenticate is a middleware to pre-authenticate routes via the session token
 // if logout is true, no new session token is beeing generated
 func (n *AppNode) authenticate(h http.Handler, useCookie bool) http.Handler {
+	return n.authenticateToken(h, false)
+}
+
+// authenticateIntrospect is a middleware for revocation sensitive routes. The
+// token is additionally introspected at keycloak on every request.
+func (n *AppNode) authenticateIntrospect(h http.Handler) http.Handler {
+	return n.authenticateToken(h, true)
+}
+
+// authenticateToken verifies the bearer token and sets the user header
+func (n *AppNode) authenticateToken(h http.Handler, introspect bool) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		log.Warn("accessd")
 		start := time.Now()
-		if cookieAuth, status := _http.ParseQueryBool(w, r, "cookieAuth", true); status == 0 && cookieAuth {
-			if token := _http.ReadCookie(r, "keycloak-jwt"); token != "" {
-				if n.keycloakTokenActive(token) {
-					jwt, claims, err := n.KeycloakClient.DecodeAccessToken(context.Background(), token, n.Config.Keycloak.Realm, "")
-					if err == nil && jwt.Valid {
-						claim := *claims
-						username := claim["preferred_username"].(string)
-						w.Header().Set("user", username)
-						h.ServeHTTP(w, r)
-					} else {
-						_http.RespondWithError(w, http.StatusUnauthorized, "Your cookie is invalid")
-					}
-				}
-			} else {
-				_http.RespondWithError(w, http.StatusUnauthorized, "Your cookie is invalid")
-			}
-		} else {
-			bearer := r.Header.Get("Authorization")
-			bearer = strings.Replace(bearer, "Bearer ", "", 1)
-			if n.keycloakTokenActive(bearer) {
-				jwt, claims, err := n.KeycloakClient.DecodeAccessToken(context.Background(), bearer, n.Config.Keycloak.Realm, "")
-				if err == nil && jwt.Valid {
-					claim := *claims
-					username := claim["preferred_username"].(string)
-					w.Header().Set("user", username)
-					h.ServeHTTP(w, r)
-				} else {
-					_http.RespondWithError(w, http.StatusUnauthorized, "Your session is invalid")
-				}
-			} else {
-				_http.RespondWithError(w, http.StatusUnauthorized, "Your session is invalid")
+		atomic.AddInt64(&n.inFlight, 1)
+		defer atomic.AddInt64(&n.inFlight, -1)
+		bearer := r.Header.Get("Authorization")
+		bearer = strings.Replace(bearer, "Bearer ", "", 1)
+		id, ok := n.verifyToken(bearer, introspect)
+		if !ok {
+			_http.RespondWithError(w, http.StatusUnauthorized, "Your session is invalid")
+			return
+		}
+		if id.ClientID != "" {
+			// service accounts must present their certificate if mtls is
+			// enabled
+			if !n.verifyPeerCertificate(r, id.ClientID) {
+				_http.RespondWithError(w, http.StatusUnauthorized, "peer certificate is invalid")
+				return
 			}
+			w.Header().Set("clientID", id.ClientID)
 		}
+		w.Header().Set("user", id.Username)
+		h.ServeHTTP(w, r)
 
 		log.WithFields(log.Fields{
 			"method":   r.Method,
@@ -154,6 +191,30 @@ func (n *AppNode) authenticate(h http.Handler, useCookie bool) http.Handler {
 	})
 }
 
+// verifyToken verifies the token offline at the identity provider and returns
+// its identity. If introspect is true, the token is additionally
+// introspected at keycloak to detect revoked tokens.
+func (n *AppNode) verifyToken(token string, introspect bool) (*identity.Identity, bool) {
+	id, err := n.Identity.Verify(token)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Debug("could not verify token")
+		return nil, false
+	}
+	if introspect && !n.introspectToken(token) {
+		return nil, false
+	}
+	return id, true
+}
+
+// isGatewayClient returns whether the request has been sent by the service
+// account of the gateway
+func (n *AppNode) isGatewayClient(w http.ResponseWriter) bool {
+	clientID := w.Header().Get("clientID")
+	return clientID != "" && clientID == n.gatewayClientID
+}
+
 // authenticateToGateway authenticates the node against the central gateway
 //
 // 0 -> ok
@@ -161,12 +222,13 @@ func (n *AppNode) authenticate(h http.Handler, useCookie bool) http.Handler {
 // 2 -> could not send request
 // 3 -> unauthorized (token invalid?)
 // 4 -> unexpected status code
+// 5 -> invalid signing key
 func (n *AppNode) authenticateToGateway() int {
 	log.Info("authenticating to gateway")
 
 	api := fmt.Sprintf("%s/api/v2/infrastructure/node/authenticate", n.Config.GatewayURL)
 
-	resp, status, _ := _http.SendRequest(n.HTTPClient, http.MethodPost, api, n.KeycloakToken.AccessToken, nil, "application/json")
+	resp, status, _ := _http.SendRequest(n.gatewayClient(), http.MethodPost, api, n.ServiceToken.AccessToken, nil, "application/json")
 	if status > 0 {
 		return 2
 	}
@@ -180,6 +242,20 @@ func (n *AppNode) authenticateToGateway() int {
 
 	switch resp.StatusCode {
 	case http.StatusOK:
+		var auth maps.NodeAuthentication
+		if err := json.NewDecoder(resp.Body).Decode(&auth); err != nil {
+			logFields["error"] = err.Error()
+			log.WithFields(logFields).Error("could not decode authentication response")
+			return 5
+		}
+		key, err := urlsign.DecodeKey(auth.SigningKey)
+		if err != nil {
+			logFields["error"] = err.Error()
+			log.WithFields(logFields).Error("gateway returned an invalid signing key")
+			return 5
+		}
+		n.signingKey = key
+		n.gatewayClientID = auth.GatewayClientID
 		log.WithFields(logFields).Info("authentication to gateway successful")
 		return 0
 	case http.StatusUnauthorized:
@@ -213,79 +289,80 @@ func (n *AppNode) getDataPath(identifier string, t pathType, thumb bool) string
 	}
 }
 
-// logs the client into the keycloak api and retrieves token
-func (n *AppNode) authenticateToKeycloak(try int, max int) {
+// initializeIdentityProvider creates the configured identity provider (a node
+// of a gateway with local provider uses the gateway as oidc provider)
+func (n *AppNode) initializeIdentityProvider(tlsConfig *tls.Config) {
+	provider, err := identity.New(n.Config.Keycloak, n.HTTPClient, tlsConfig, nil)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"provider": n.Config.Keycloak.Provider,
+			"error":    err.Error(),
+		}).Fatal("could not initialize identity provider")
+	}
+	n.Identity = provider
+}
+
+// loginServiceAccount logs the application in at the identity provider and
+// retrieves the token of its service account
+func (n *AppNode) loginServiceAccount(try int, max int) {
 	ctx, cancel := context.WithCancel(n.Ctx)
 	defer cancel()
-	var err error
-	n.KeycloakToken, err = n.KeycloakClient.LoginClient(ctx, n.Config.Keycloak.ClientID, n.Config.Keycloak.Secret, n.Config.Keycloak.Realm)
+	token, err := n.Identity.Login(ctx)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"clientid": n.Config.Keycloak.ClientID,
-			"realm":    n.Config.Keycloak.Realm,
+			"provider": n.Config.Keycloak.Provider,
 			"error":    err.Error(),
-		}).Error("could not authenticate to keycloak api")
-		// retry (possibly, keycloak not up)
+		}).Error("could not authenticate to identity provider")
+		// retry (possibly, the provider is not up)
 		if try < max {
 			time.Sleep(time.Second * 5)
-			n.authenticateToKeycloak(try+1, max)
+			n.loginServiceAccount(try+1, max)
 		}
+		return
 	}
-	n.keycloakTokenActive(n.KeycloakToken.AccessToken)
+	n.ServiceToken = token
 }
 
-func (n *AppNode) keycloakTokenActive(token string) bool {
-	// check if cached tokens expiry date is in future
-	if val, ok := n.KeycloakTokenCache[token]; ok && int64(*val.Exp) >= time.Now().Unix() {
-		log.Debug("found active token in token cache")
-		return true
-	} else if ok && int64(*val.Exp) < time.Now().Unix() {
-		// cached token expired
-		delete(n.KeycloakTokenCache, token)
-	}
-	// verify token against keycloak
+// introspectToken verifies the token at the identity provider (bypassing the
+// cache)
+func (n *AppNode) introspectToken(token string) bool {
 	ctx, cancel := context.WithCancel(n.Ctx)
 	defer cancel()
-	rptResult, err := n.KeycloakClient.RetrospectToken(ctx, token, n.Config.Keycloak.ClientID, n.Config.Keycloak.Secret, n.Config.Keycloak.Realm)
+	result, err := n.Identity.Introspect(ctx, token)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"error": err.Error(),
-		}).Error("could not retrospect token")
+		}).Error("could not introspect token")
 		return false
 	}
 
 	// check if token active
-	if !*rptResult.Active {
-		log.Debug("token is not active according to keycloak api")
+	if !result.Active {
+		log.Debug("token is not active according to identity provider")
 		return false
 	}
-
-	// cache token
-	n.KeycloakTokenCache[token] = rptResult
-	return *rptResult.Active
+	return true
 }
 
-func (n *AppNode) keycloakRefreshToken() {
-	// no need to refresh if vaid
-	if n.keycloakTokenActive(n.KeycloakToken.AccessToken) {
+// refreshServiceToken refreshes the access token of the service account
+func (n *AppNode) refreshServiceToken() {
+	// no need to refresh if valid
+	if n.ServiceToken.Valid() {
 		log.Debug("token still valid - skipping refresh")
 		return
 	}
 
-	// verify token against keycloak
-	var err error
 	ctx, cancel := context.WithCancel(n.Ctx)
 	defer cancel()
-	n.KeycloakToken, err = n.KeycloakClient.RefreshToken(ctx, n.KeycloakToken.RefreshToken, n.Config.Keycloak.ClientID, n.Config.Keycloak.Secret, n.Config.Keycloak.Realm)
+	token, err := n.Identity.Refresh(ctx, n.ServiceToken)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"error": err.Error(),
 		}).Error("could not refresh token")
 		// possibly, the refresh token is expired -> try to reauthenticate
-		n.authenticateToKeycloak(0, 1)
+		n.loginServiceAccount(0, 1)
 		return
 	}
-
-	// map token to cache
-	n.keycloakTokenActive(n.KeycloakToken.AccessToken)
+	n.ServiceToken = token
 }
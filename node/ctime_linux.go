@@ -0,0 +1,19 @@
+//go:build linux
+// +build linux
+
+package node
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// changeTime returns the last status change of the file (e.g. a new hardlink)
+func changeTime(info os.FileInfo) time.Time {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return info.ModTime()
+	}
+	return time.Unix(int64(stat.Ctim.Sec), int64(stat.Ctim.Nsec))
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package node
+
+import (
+	"os"
+	"time"
+)
+
+// changeTime falls back to the modification time on other platforms
+func changeTime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
@@ -0,0 +1,23 @@
+//go:build !windows
+// +build !windows
+
+package node
+
+import (
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// diskUsage returns the free and total bytes of the filesystem of the path
+func diskUsage(path string) (uint64, uint64) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		log.WithFields(log.Fields{
+			"path":  path,
+			"error": err.Error(),
+		}).Warn("could not read disk usage")
+		return 0, 0
+	}
+	return stat.Bavail * uint64(stat.Bsize), stat.Blocks * uint64(stat.Bsize)
+}
@@ -0,0 +1,9 @@
+//go:build windows
+// +build windows
+
+package node
+
+// diskUsage is not supported on windows
+func diskUsage(path string) (uint64, uint64) {
+	return 0, 0
+}
@@ -0,0 +1,75 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	_http "github.com/mirisbowring/primboard/helper/http"
+	"github.com/mirisbowring/primboard/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultHeartbeatInterval is used if no interval is configured
+const defaultHeartbeatInterval = 30 * time.Second
+
+// runHeartbeat sends the health of the node periodically to the gateway
+func (n *AppNode) runHeartbeat(interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultHeartbeatInterval
+	}
+	n.sendHeartbeat()
+	for range time.Tick(interval) {
+		n.sendHeartbeat()
+	}
+}
+
+// health collects the current health of the node
+func (n *AppNode) health() models.NodeHealth {
+	free, total := diskUsage(n.Config.BasePath)
+	return models.NodeHealth{
+		Version:    Version,
+		DiskFree:   free,
+		DiskTotal:  total,
+		QueueDepth: int(atomic.LoadInt64(&n.inFlight)),
+	}
+}
+
+// sendHeartbeat posts the health of the node to the gateway. If the gateway
+// does not know the node (anymore), the node authenticates again.
+func (n *AppNode) sendHeartbeat() {
+	data, err := json.Marshal(n.health())
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Error("could not marshal health to json")
+		return
+	}
+
+	// refresh keycloaktoken in neccessary
+	n.refreshServiceToken()
+
+	api := fmt.Sprintf("%s/api/v2/infrastructure/node/heartbeat", n.Config.GatewayURL)
+	resp, status, _ := _http.SendRequest(n.gatewayClient(), http.MethodPost, api, n.ServiceToken.AccessToken, bytes.NewReader(data), "application/json")
+	if status > 0 {
+		return
+	}
+	defer resp.Body.Close()
+
+	logFields := log.Fields{
+		"endpoint":    api,
+		"status-code": resp.StatusCode,
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		log.WithFields(logFields).Debug("sent heartbeat to gateway")
+	case http.StatusUnauthorized:
+		log.WithFields(logFields).Warn("gateway rejected heartbeat - authenticating again")
+		n.authenticateToGateway()
+	default:
+		log.WithFields(logFields).Error("unexpected status code")
+	}
+}
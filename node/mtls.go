@@ -0,0 +1,157 @@
+package node
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	_http "github.com/mirisbowring/primboard/helper/http"
+	"github.com/mirisbowring/primboard/helper/pki"
+	"github.com/mirisbowring/primboard/models"
+	"github.com/mirisbowring/primboard/models/maps"
+	log "github.com/sirupsen/logrus"
+)
+
+// mtls holds the certificate of the node issued by the gateway
+type mtls struct {
+	pool    *x509.CertPool
+	keypair *pki.Keypair
+	clients *pki.Clients
+}
+
+// initializeMTLS loads the certificate bundle, that has been issued at the
+// registration of the node, from the certificates directory
+func (n *AppNode) initializeMTLS() {
+	if !n.Config.MTLS {
+		return
+	}
+	logfields := log.Fields{
+		"certificates": n.Config.Certificates,
+	}
+	caPEM, err := ioutil.ReadFile(filepath.Join(n.Config.Certificates, "ca.crt"))
+	if err != nil {
+		logfields["error"] = err.Error()
+		log.WithFields(logfields).Fatal("could not read ca.crt of the certificate bundle")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		log.WithFields(logfields).Fatal("could not parse ca.crt of the certificate bundle")
+	}
+	keypair, err := pki.LoadKeypair(n.certificateFile("node.crt"), n.certificateFile("node.key"))
+	if err != nil {
+		logfields["error"] = err.Error()
+		log.WithFields(logfields).Fatal("could not load node.crt and node.key of the certificate bundle")
+	}
+	if keypair.Leaf().Subject.CommonName != n.Config.Keycloak.ClientID {
+		log.WithFields(logfields).Fatal("certificate has not been issued for this node")
+	}
+	n.mtls = &mtls{
+		pool:    pool,
+		keypair: keypair,
+		clients: pki.NewClients(pool, keypair),
+	}
+	go n.runCertificateRotation(time.Hour)
+}
+
+// certificateFile returns the path of the file in the certificates directory
+func (n *AppNode) certificateFile(name string) string {
+	return filepath.Join(n.Config.Certificates, name)
+}
+
+// gatewayClient returns the client, that is pinned to the certificate of the
+// gateway (or the default client without mtls)
+func (n *AppNode) gatewayClient() *http.Client {
+	if n.mtls == nil {
+		return n.HTTPClient
+	}
+	return n.mtls.clients.Client(pki.RoleGateway, "")
+}
+
+// peerClient returns the client, that is pinned to the certificate of the
+// node (or the default client without mtls)
+func (n *AppNode) peerClient(nodeID string) *http.Client {
+	if n.mtls == nil {
+		return n.HTTPClient
+	}
+	return n.mtls.clients.Client(pki.RoleNode, nodeID)
+}
+
+// verifyPeerCertificate verifies that the service account presents the
+// certificate issued for its client id. The tunnel has been opened to the
+// verified gateway already (it proxies signed urls without credentials only).
+func (n *AppNode) verifyPeerCertificate(r *http.Request, clientID string) bool {
+	if n.mtls == nil || isTunneled(r) {
+		return true
+	}
+	cert, ok := pki.PeerCertificate(r)
+	return ok && cert.Subject.CommonName == clientID
+}
+
+// runCertificateRotation renews the certificate of the node before it
+// expires
+func (n *AppNode) runCertificateRotation(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !n.mtls.keypair.NeedsRenewal() {
+			continue
+		}
+		if err := n.renewCertificate(); err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Error("could not renew node certificate")
+			continue
+		}
+		log.WithFields(log.Fields{
+			"expiry": n.mtls.keypair.Leaf().NotAfter,
+		}).Info("renewed node certificate")
+	}
+}
+
+// renewCertificate lets the gateway sign a new key and replaces the current
+// certificate
+func (n *AppNode) renewCertificate() error {
+	csrPEM, keyPEM, err := pki.GenerateCSR(n.Config.Keycloak.ClientID)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(maps.CertificateRequest{CSR: string(csrPEM)})
+	if err != nil {
+		return err
+	}
+
+	// refresh keycloaktoken in neccessary
+	n.refreshServiceToken()
+
+	api := fmt.Sprintf("%s/api/v2/infrastructure/node/%s/certificate", n.Config.GatewayURL, n.Config.Keycloak.ClientID)
+	res, status, msg := _http.SendRequest(n.gatewayClient(), http.MethodPost, api, n.ServiceToken.AccessToken, bytes.NewReader(data), "application/json")
+	if status > 0 {
+		return fmt.Errorf("could not send request: %s", msg)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+	var bundle models.CertificateBundle
+	if err := json.NewDecoder(res.Body).Decode(&bundle); err != nil {
+		return err
+	}
+
+	// verify the certificate before it replaces the current one
+	certPEM := []byte(bundle.Certificate)
+	if _, err := pki.NewKeypair(certPEM, keyPEM); err != nil {
+		return err
+	}
+	if err := pki.WriteFile(n.certificateFile("node.key"), keyPEM, 0600); err != nil {
+		return err
+	}
+	if err := pki.WriteFile(n.certificateFile("node.crt"), certPEM, 0644); err != nil {
+		return err
+	}
+	return n.mtls.keypair.Set(certPEM, keyPEM)
+}
@@ -0,0 +1,109 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	_http "github.com/mirisbowring/primboard/helper/http"
+	"github.com/mirisbowring/primboard/models"
+	"github.com/mirisbowring/primboard/models/maps"
+	log "github.com/sirupsen/logrus"
+)
+
+// reserveQuota reserves the passed bytes of the user on this node at the
+// gateway. The reservation must be released after the write (see
+// releaseQuota). Writes are refused, if the gateway could not be asked.
+//
+// 0 -> ok || 1 -> refused (response has been written)
+func (n *AppNode) reserveQuota(w http.ResponseWriter, username string, size int64) (*models.Reservation, int) {
+	data, err := json.Marshal(maps.QuotaRequest{Username: username, Size: size, Files: 1})
+	if err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not marshal quota request")
+		return nil, 1
+	}
+
+	// refresh keycloaktoken in neccessary
+	n.refreshServiceToken()
+
+	logfields := log.Fields{
+		"username": username,
+		"size":     size,
+	}
+	api := fmt.Sprintf("%s/api/v2/infrastructure/node/%s/quota", n.Config.GatewayURL, n.Config.Keycloak.ClientID)
+	res, status, msg := _http.SendRequest(n.gatewayClient(), http.MethodPost, api, n.ServiceToken.AccessToken, bytes.NewReader(data), "application/json")
+	if status > 0 {
+		logfields["error"] = msg
+		log.WithFields(logfields).Error("could not verify quota")
+		_http.RespondWithError(w, http.StatusServiceUnavailable, "could not verify quota")
+		return nil, 1
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		var reservation models.Reservation
+		if err := json.NewDecoder(res.Body).Decode(&reservation); err != nil || reservation.ID.IsZero() {
+			log.WithFields(logfields).Error("could not decode quota reservation")
+			_http.RespondWithError(w, http.StatusServiceUnavailable, "could not verify quota")
+			return nil, 1
+		}
+		return &reservation, 0
+	case http.StatusInsufficientStorage:
+		log.WithFields(logfields).Info("quota exceeded")
+		_http.RespondWithError(w, http.StatusInsufficientStorage, "quota exceeded")
+	default:
+		logfields["status"] = res.StatusCode
+		log.WithFields(logfields).Error("could not verify quota")
+		_http.RespondWithError(w, http.StatusServiceUnavailable, "could not verify quota")
+	}
+	return nil, 1
+}
+
+// releaseQuota releases the reservation at the gateway. Reservations, that
+// cannot be released, expire at the gateway.
+func (n *AppNode) releaseQuota(reservation *models.Reservation) {
+	// refresh keycloaktoken in neccessary
+	n.refreshServiceToken()
+
+	logfields := log.Fields{
+		"reservation": reservation.ID.Hex(),
+	}
+	api := fmt.Sprintf("%s/api/v2/infrastructure/node/%s/quota/%s", n.Config.GatewayURL, n.Config.Keycloak.ClientID, reservation.ID.Hex())
+	res, status, msg := _http.SendRequest(n.gatewayClient(), http.MethodDelete, api, n.ServiceToken.AccessToken, nil, "")
+	if status > 0 {
+		logfields["error"] = msg
+		log.WithFields(logfields).Error("could not release quota")
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		logfields["status"] = res.StatusCode
+		log.WithFields(logfields).Error("could not release quota")
+	}
+}
+
+// writtenSize returns the size of the written file. The file is removed if it
+// is larger than the reserved bytes.
+//
+// 0 -> ok || 1 -> refused (response has been written)
+func writtenSize(w http.ResponseWriter, path string, reservation *models.Reservation) (int64, int) {
+	info, err := os.Stat(path)
+	if err != nil {
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not read written file")
+		return 0, 1
+	}
+	if info.Size() > reservation.Bytes {
+		log.WithFields(log.Fields{
+			"path":     path,
+			"size":     info.Size(),
+			"reserved": reservation.Bytes,
+		}).Info("written file exceeds the reserved quota")
+		os.Remove(path)
+		_http.RespondWithError(w, http.StatusInsufficientStorage, "quota exceeded")
+		return 0, 1
+	}
+	return info.Size(), 0
+}
@@ -0,0 +1,297 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mirisbowring/primboard/helper"
+	_http "github.com/mirisbowring/primboard/helper/http"
+	"github.com/mirisbowring/primboard/internal/handler"
+	"github.com/mirisbowring/primboard/models/maps"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultReconcileInterval is used if no interval is configured
+	defaultReconcileInterval = 24 * time.Hour
+	// reconcilePageSize is the page size of the structure requests
+	reconcilePageSize = 500
+	// orphanGracePeriod protects files and shares, that are created but not yet
+	// registered at the gateway
+	orphanGracePeriod = time.Hour
+	// quarantineDir is the directory (below the base path) the orphaned files
+	// are moved to
+	quarantineDir = "quarantine"
+)
+
+// reconcileResult summarizes a reconciliation run
+type reconcileResult struct {
+	Orphans  int
+	Unshared int
+	Linked   int
+	Thumbs   int
+	Missing  []string
+}
+
+// runReconciliation compares the files periodically with the structure of
+// the gateway
+func (n *AppNode) runReconciliation(interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultReconcileInterval
+	}
+	for range time.Tick(interval) {
+		if err := n.reconcile(); err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Error("could not reconcile files with gateway")
+		}
+	}
+}
+
+// reconcile repairs missing shares and thumbnails, quarantines orphaned files,
+// removes orphaned shares and reports media, whose original is missing
+func (n *AppNode) reconcile() error {
+	entries, err := n.fetchStructure()
+	if err != nil {
+		return err
+	}
+
+	// expected files per user and links per group
+	files := make(map[string]map[string]maps.NodeStructureEntry)
+	links := make(map[string]map[string]bool)
+	for _, e := range entries {
+		if handler.ValidateArchiveFile(maps.ArchiveFile{Username: e.Username, Filename: e.Filename}) != nil {
+			continue
+		}
+		if files[e.Username] == nil {
+			files[e.Username] = make(map[string]maps.NodeStructureEntry)
+		}
+		files[e.Username][e.Filename] = e
+		for _, group := range e.Groups {
+			if links[group] == nil {
+				links[group] = make(map[string]bool)
+			}
+			links[group][e.Filename] = true
+		}
+	}
+
+	var result reconcileResult
+	n.reconcileUsers(files, &result)
+	n.reconcileGroups(files, links, &result)
+
+	if len(result.Missing) > 0 {
+		if err := n.reportMissing(result.Missing); err != nil {
+			return err
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"files":    len(entries),
+		"orphans":  result.Orphans,
+		"unshared": result.Unshared,
+		"linked":   result.Linked,
+		"thumbs":   result.Thumbs,
+		"missing":  len(result.Missing),
+	}).Info("reconciled files with gateway")
+	return nil
+}
+
+// reconcileUsers quarantines the orphaned files of the users, restores
+// missing thumbnails and collects the media with missing originals
+func (n *AppNode) reconcileUsers(files map[string]map[string]maps.NodeStructureEntry, result *reconcileResult) {
+	users, _ := handler.GetDirectories(filepath.Join(n.Config.BasePath, "user"))
+	for _, username := range users {
+		own := filepath.Join(n.Config.BasePath, "user", username, "own")
+		_, names := handler.GetDirectories(own)
+		for _, name := range names {
+			if _, ok := files[username][name]; ok || !isOrphan(filepath.Join(own, name)) {
+				continue
+			}
+			if err := n.quarantineFile(username, name); err != nil {
+				log.WithFields(log.Fields{
+					"username": username,
+					"filename": name,
+					"error":    err.Error(),
+				}).Error("could not quarantine orphaned file")
+				continue
+			}
+			result.Orphans++
+		}
+	}
+
+	for username, entries := range files {
+		own := filepath.Join(n.Config.BasePath, "user", username, "own")
+		for name, e := range entries {
+			path := filepath.Join(own, name)
+			if !helper.PathExists(path) {
+				result.Missing = append(result.Missing, e.MediaID)
+				continue
+			}
+			thumb, status := handler.ParseThumbnailName(name)
+			if status > 0 || helper.PathExists(filepath.Join(own, "thumb", thumb)) {
+				continue
+			}
+			// render the missing thumbnail again
+			if rt := handler.CreateThumbnail(path); rt != nil {
+				if handler.CreateFile(filepath.Join(own, "thumb", thumb), rt) == 0 {
+					result.Thumbs++
+				}
+			}
+		}
+	}
+}
+
+// reconcileGroups removes the shares, that are not expected anymore and links
+// the missing shares. Recently created shares are kept, since they may not be
+// contained in the fetched structure yet.
+func (n *AppNode) reconcileGroups(files map[string]map[string]maps.NodeStructureEntry, links map[string]map[string]bool, result *reconcileResult) {
+	groups, _ := handler.GetDirectories(filepath.Join(n.Config.BasePath, "group"))
+	for _, group := range groups {
+		dir := filepath.Join(n.Config.BasePath, "group", group)
+		_, names := handler.GetDirectories(dir)
+		var orphans []string
+		for _, name := range names {
+			// recently shared links may not be contained in the structure yet
+			if !links[group][name] && isOrphan(filepath.Join(dir, name)) {
+				orphans = append(orphans, name)
+			}
+		}
+		if len(orphans) == 0 {
+			continue
+		}
+		shares := maps.FilesGroupsMap{Filenames: orphans, Groups: []string{group}}
+		failed := handler.DeleteShares(n.Config.BasePath, "", shares, nil)
+		result.Unshared += len(orphans) - len(failed)
+	}
+
+	for username, entries := range files {
+		for name, e := range entries {
+			var missing []string
+			for _, group := range e.Groups {
+				if !helper.PathExists(filepath.Join(n.Config.BasePath, "group", group, name)) {
+					missing = append(missing, group)
+				}
+			}
+			if len(missing) == 0 || !helper.PathExists(filepath.Join(n.Config.BasePath, "user", username, "own", name)) {
+				continue
+			}
+			shares := maps.FilesGroupsMap{Filenames: []string{name}, Groups: missing}
+			if failed := handler.ShareFiles(n.Config.BasePath, username, shares); len(failed) == 0 {
+				result.Linked += len(missing)
+			}
+		}
+	}
+}
+
+// quarantineFile removes the shares of the orphaned file and moves the file
+// and its thumbnail to the quarantine directory, so that it can be restored
+// manually
+func (n *AppNode) quarantineFile(username string, name string) error {
+	groups, _ := handler.GetDirectories(filepath.Join(n.Config.BasePath, "group"))
+	shares := maps.FilesGroupsMap{Filenames: []string{name}, Groups: groups}
+	if failed := handler.DeleteShares(n.Config.BasePath, username, shares, nil); len(failed) > 0 {
+		return errors.New("could not delete all shares of the file")
+	}
+
+	own := filepath.Join(n.Config.BasePath, "user", username, "own")
+	target := filepath.Join(n.Config.BasePath, quarantineDir, username)
+	if err := os.MkdirAll(filepath.Join(target, "thumb"), os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.Rename(filepath.Join(own, name), filepath.Join(target, name)); err != nil {
+		return err
+	}
+	thumb, status := handler.ParseThumbnailName(name)
+	if status > 0 || !helper.PathExists(filepath.Join(own, "thumb", thumb)) {
+		return nil
+	}
+	return os.Rename(filepath.Join(own, "thumb", thumb), filepath.Join(target, "thumb", thumb))
+}
+
+// isOrphan returns whether the file or share is old enough to be removed if it
+// is not expected (files currently written or uploaded are kept). Shares are
+// hardlinks, so their age is the last change of the inode.
+func isOrphan(path string) bool {
+	if strings.HasSuffix(path, ".part") {
+		return false
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	changed := changeTime(info)
+	if info.ModTime().After(changed) {
+		changed = info.ModTime()
+	}
+	return time.Since(changed) > orphanGracePeriod
+}
+
+// fetchStructure requests all pages of the structure of this node from the
+// gateway. The reconciliation is aborted if the structure changed while it
+// has been fetched.
+func (n *AppNode) fetchStructure() ([]maps.NodeStructureEntry, error) {
+	var entries []maps.NodeStructureEntry
+	after := ""
+	for {
+		// refresh keycloaktoken in neccessary
+		n.refreshServiceToken()
+
+		api := fmt.Sprintf("%s/api/v2/infrastructure/node/%s/structure?size=%d", n.Config.GatewayURL, n.Config.Keycloak.ClientID, reconcilePageSize)
+		if after != "" {
+			api = fmt.Sprintf("%s&after=%s", api, after)
+		}
+		res, status, msg := _http.SendRequest(n.gatewayClient(), http.MethodGet, api, n.ServiceToken.AccessToken, nil, "")
+		if status > 0 {
+			return nil, errors.New(msg)
+		}
+		var structure maps.NodeStructure
+		err := func() error {
+			defer res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				return fmt.Errorf("unexpected status code %d", res.StatusCode)
+			}
+			return json.NewDecoder(res.Body).Decode(&structure)
+		}()
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, structure.Entries...)
+		if len(structure.Entries) < reconcilePageSize {
+			if int64(len(entries)) != structure.Total {
+				return nil, fmt.Errorf("structure changed while fetching (%d of %d entries)", len(entries), structure.Total)
+			}
+			return entries, nil
+		}
+		after = structure.Entries[len(structure.Entries)-1].MediaID
+	}
+}
+
+// reportMissing sends the ids of the media, whose original is missing, to the
+// gateway
+func (n *AppNode) reportMissing(ids []string) error {
+	data, err := json.Marshal(ids)
+	if err != nil {
+		return err
+	}
+
+	// refresh keycloaktoken in neccessary
+	n.refreshServiceToken()
+
+	api := fmt.Sprintf("%s/api/v2/infrastructure/node/%s/missing", n.Config.GatewayURL, n.Config.Keycloak.ClientID)
+	res, status, msg := _http.SendRequest(n.gatewayClient(), http.MethodPost, api, n.ServiceToken.AccessToken, bytes.NewReader(data), "application/json")
+	if status > 0 {
+		return errors.New(msg)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+	return nil
+}
@@ -17,18 +17,20 @@ func (n *AppNode) initializeRoutes() {
 	n.Router.HandleFunc("/api/v1/", n.index).Methods("GET")
 	// files
 	// rela
+	n.Router.Handle("/api/v1/archive", n.authenticate(http.HandlerFunc(n.archiveFiles), false)).Methods("POST")
 	n.Router.Handle("/api/v1/file", n.authenticate(http.HandlerFunc(n.uploadFile), false)).Methods("POST")
 	n.Router.Handle("/api/v1/file/{username}", n.authenticate(http.HandlerFunc(n.addFile), false)).Methods("POST")
-	n.Router.Handle("/api/v1/file/{username}/{filename}", n.authenticate(http.HandlerFunc(n.deleteFile), false)).Methods("DELETE")
-	n.Router.Handle("/api/v1/file/{identifier}/{filename}", n.authenticate(http.HandlerFunc(n.getFile), false)).Methods("GET").Queries("thumb", "{thumb}", "group", "{group}", "cookieAuth", "{cookieAuth}")
+	n.Router.Handle("/api/v1/file/{username}/{filename}", n.authenticateIntrospect(http.HandlerFunc(n.deleteFile))).Methods("DELETE")
+	n.Router.Handle("/api/v1/file/{identifier}/{filename}", n.authenticateSigned(http.HandlerFunc(n.getFile))).Methods("GET", "HEAD").Queries("thumb", "{thumb}", "group", "{group}")
 	n.Router.Handle("/api/v1/file/{username}/{filename}/share/{group}", n.authenticate(http.HandlerFunc(n.deleteShareForGroup), false)).Methods("DELETE")
-	n.Router.Handle("/api/v1/files/{username}/remove", n.authenticate(http.HandlerFunc(n.deleteFiles), false)).Methods("POST")
+	n.Router.Handle("/api/v1/replicate", n.authenticate(http.HandlerFunc(n.replicateFile), false)).Methods("POST")
+	n.Router.Handle("/api/v1/files/{username}/remove", n.authenticateIntrospect(http.HandlerFunc(n.deleteFiles))).Methods("POST")
 	n.Router.Handle("/api/v1/files/{username}/shares", n.authenticate(http.HandlerFunc(n.shareFiles), false)).Methods("POST")
 	n.Router.Handle("/api/v1/files/{username}/shares/remove", n.authenticate(http.HandlerFunc(n.deleteShares), false)).Methods("POST")
 
-	n.Router.Handle("/api/v1/session", n.authenticate(http.HandlerFunc(n.generateSessionCookie), false)).Methods("GET")
-	n.Router.Handle("/api/v1/user/{username}/authenticate", n.authenticate(http.HandlerFunc(n.authenticateUser), false)).Methods("POST")
-	n.Router.Handle("/api/v1/user/{username}/unauthenticate", n.authenticate(http.HandlerFunc(n.unauthenticateUser), false)).Methods("POST")
+	n.Router.Handle("/api/v1/stats", n.authenticate(http.HandlerFunc(n.getStats), false)).Methods("GET")
+	n.Router.Handle("/api/v1/user/{username}/authenticate", n.authenticateIntrospect(http.HandlerFunc(n.authenticateUser))).Methods("POST")
+	n.Router.Handle("/api/v1/user/{username}/unauthenticate", n.authenticateIntrospect(http.HandlerFunc(n.unauthenticateUser))).Methods("POST")
 }
 
 // Index controller
@@ -0,0 +1,158 @@
+package node
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	_http "github.com/mirisbowring/primboard/helper/http"
+	"github.com/mirisbowring/primboard/models"
+	"github.com/mirisbowring/primboard/models/maps"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultScrubInterval is used if no interval is configured
+	defaultScrubInterval = 7 * 24 * time.Hour
+	// defaultScrubRate is the read rate in MB/s if no rate is configured
+	defaultScrubRate = 10
+)
+
+// runScrub verifies the stored originals periodically
+func (n *AppNode) runScrub(interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultScrubInterval
+	}
+	for range time.Tick(interval) {
+		if err := n.scrub(); err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Error("could not scrub files")
+		}
+	}
+}
+
+// scrub hashes all originals of the node structure and reports the files,
+// that do not match the recorded sha1, to the gateway
+func (n *AppNode) scrub() error {
+	entries, err := n.fetchStructure()
+	if err != nil {
+		return err
+	}
+
+	rate := n.Config.ScrubRate
+	if rate <= 0 {
+		rate = defaultScrubRate
+	}
+
+	var failures []maps.IntegrityFailure
+	var bytesRead int64
+	start := time.Now()
+	for _, e := range entries {
+		path := filepath.Join(n.getDataPath(e.Username, pathTypeUser, false), e.Filename)
+		// missing files are reported by the reconciliation
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		failure := maps.IntegrityFailure{MediaID: e.MediaID, Size: info.Size()}
+
+		sha, read, err := hashFileThrottled(path, int64(rate)*1024*1024)
+		bytesRead += read
+		switch {
+		case err != nil:
+			failure.Reason = models.IntegrityUnreadable
+		case sha == e.Sha1:
+			continue
+		case e.Size > 0 && info.Size() < e.Size:
+			failure.Reason = models.IntegrityTruncated
+			failure.Sha1 = sha
+		default:
+			failure.Reason = models.IntegrityChecksum
+			failure.Sha1 = sha
+		}
+		log.WithFields(log.Fields{
+			"path":   path,
+			"media":  e.MediaID,
+			"reason": failure.Reason,
+		}).Warn("file failed integrity check")
+		failures = append(failures, failure)
+	}
+
+	log.WithFields(log.Fields{
+		"files":    len(entries),
+		"bytes":    bytesRead,
+		"failures": len(failures),
+		"duration": time.Since(start),
+	}).Info("scrubbed files")
+
+	if len(failures) == 0 {
+		return nil
+	}
+	return n.reportIntegrityFailures(failures)
+}
+
+// hashFileThrottled calculates the sha1 of the file without reading faster
+// than the passed bytes per second
+func hashFileThrottled(path string, rate int64) (string, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+	hash := sha1.New()
+	read, err := io.Copy(hash, &throttledReader{r: file, rate: rate, start: time.Now()})
+	if err != nil {
+		return "", read, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), read, nil
+}
+
+// throttledReader limits the average read rate in bytes per second
+type throttledReader struct {
+	r     io.Reader
+	rate  int64
+	read  int64
+	start time.Time
+}
+
+// Read reads from the underlying reader and sleeps if the rate is exceeded
+func (t *throttledReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	t.read += int64(n)
+	expected := time.Duration(float64(t.read) / float64(t.rate) * float64(time.Second))
+	if ahead := expected - time.Since(t.start); ahead > 0 {
+		time.Sleep(ahead)
+	}
+	return n, err
+}
+
+// reportIntegrityFailures sends the failed files to the gateway
+func (n *AppNode) reportIntegrityFailures(failures []maps.IntegrityFailure) error {
+	data, err := json.Marshal(failures)
+	if err != nil {
+		return err
+	}
+
+	// refresh keycloaktoken in neccessary
+	n.refreshServiceToken()
+
+	api := fmt.Sprintf("%s/api/v2/infrastructure/node/%s/integrity", n.Config.GatewayURL, n.Config.Keycloak.ClientID)
+	res, status, msg := _http.SendRequest(n.gatewayClient(), http.MethodPost, api, n.ServiceToken.AccessToken, bytes.NewReader(data), "application/json")
+	if status > 0 {
+		return errors.New(msg)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+	return nil
+}
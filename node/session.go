@@ -1,10 +1,19 @@
 package node
 
 import (
+	"time"
+
 	iModels "github.com/mirisbowring/primboard/internal/models"
 	log "github.com/sirupsen/logrus"
 )
 
+// initializeSessionStore creates the in-memory session store and starts the
+// eviction of expired sessions
+func (n *AppNode) initializeSessionStore() {
+	n.Sessions = iModels.NewMemorySessionStore(time.Duration(n.Config.SessionTTL) * time.Minute)
+	go iModels.RunEviction(n.Sessions, time.Minute)
+}
+
 // AddSession appends a new user session to the node (verfies that session is
 // valid) - Will override session if already exist
 //
@@ -20,36 +29,12 @@ func (n *AppNode) AddSession(username string, token string) (int, string) {
 		log.Error(msg)
 		return 2, msg
 	default:
-		// check if session for user exist already
-		tmp := n.Sessions[:0]
-		for _, session := range n.Sessions {
-			// match found ?
-			if session.User == username {
-				// refresh token
-				session.Token = token
-				return 0, ""
-			}
-			// collect if session is expired
-			if session.IsValid() {
-				tmp = append(tmp, session)
-			}
-		}
-		// invalidate invalid sessions
-		for i := len(tmp); i < len(n.Sessions); i++ {
-			n.Sessions[i] = nil // or the zero value of T
+		s := n.Sessions.GetByUser(username)
+		if s == nil {
+			s = &iModels.Session{User: username}
 		}
-		// clear session slice
-		n.Sessions = iModels.RemoveEmptySessions(n.Sessions)
-		// append new session if did not exist before
-		n.Sessions = append(n.Sessions, &iModels.Session{
-			User:  username,
-			Token: token,
-		})
+		s.Token = token
+		n.Sessions.Put(s)
 		return 0, ""
 	}
 }
-
-// ClearSessions removes the session from tmp store and removes the link
-func ClearSessions(sessions []*iModels.Session) {
-
-}
@@ -0,0 +1,72 @@
+package node
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	_http "github.com/mirisbowring/primboard/helper/http"
+	"github.com/mirisbowring/primboard/helper/urlsign"
+	log "github.com/sirupsen/logrus"
+)
+
+// authenticateSigned is a middleware for the file routes. Requests with a
+// signature are verified against the signing key of the node, all other
+// requests need a bearer token.
+func (n *AppNode) authenticateSigned(h http.Handler) http.Handler {
+	bearer := n.authenticateToken(h, false)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		signature := query.Get(urlsign.ParamSignature)
+		if signature == "" {
+			bearer.ServeHTTP(w, r)
+			return
+		}
+		if len(n.signingKey) == 0 {
+			_http.RespondWithError(w, http.StatusServiceUnavailable, "node did not receive a signing key yet")
+			return
+		}
+
+		vars := mux.Vars(r)
+		claims := urlsign.Claims{
+			Identifier: vars["identifier"],
+			Filename:   vars["filename"],
+			Username:   query.Get(urlsign.ParamUser),
+		}
+		var err error
+		if claims.Group, err = strconv.ParseBool(query.Get("group")); err != nil {
+			_http.RespondWithError(w, http.StatusBadRequest, "could not parse group query")
+			return
+		}
+		if claims.Thumb, err = strconv.ParseBool(query.Get("thumb")); err != nil {
+			_http.RespondWithError(w, http.StatusBadRequest, "could not parse thumb query")
+			return
+		}
+		if claims.Expires, err = strconv.ParseInt(query.Get(urlsign.ParamExpires), 10, 64); err != nil {
+			_http.RespondWithError(w, http.StatusBadRequest, "could not parse expires query")
+			return
+		}
+		now := time.Now()
+		if err := urlsign.Verify(n.signingKey, claims, signature, now); err != nil {
+			log.WithFields(log.Fields{
+				"username": claims.Username,
+				"filename": claims.Filename,
+				"error":    err.Error(),
+			}).Debug("could not verify signed url")
+			_http.RespondWithError(w, http.StatusForbidden, err.Error())
+			return
+		}
+
+		// the url does not change until it expires, so it can be cached (the
+		// thumbnails even by shared caches)
+		visibility := "private"
+		if claims.Thumb {
+			visibility = "public"
+		}
+		w.Header().Set("Cache-Control", fmt.Sprintf("%s, max-age=%d", visibility, claims.Expires-now.Unix()))
+		w.Header().Set("user", claims.Username)
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,66 @@
+package node
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	_http "github.com/mirisbowring/primboard/helper/http"
+	"github.com/mirisbowring/primboard/helper/urlsign"
+	log "github.com/sirupsen/logrus"
+)
+
+// validPathElement returns whether the identifier or filename stays inside of
+// its directory
+func validPathElement(s string) bool {
+	return s != "" && s != "." && s != ".." && !strings.ContainsAny(s, `/\`)
+}
+
+// authorizeFile returns whether the request may read the file. Signed urls
+// have been authorized by the gateway (e.g. for replications by other nodes),
+// the gateway may read every file and users their own files only (group
+// shares require a signed url, because the node does not know the members of
+// the groups).
+func (n *AppNode) authorizeFile(w http.ResponseWriter, r *http.Request, identifier string, group bool) bool {
+	if r.URL.Query().Get(urlsign.ParamSignature) != "" {
+		return true
+	}
+	if n.isGatewayClient(w) {
+		return true
+	}
+	return !group && identifier == _http.GetUsernameFromHeader(w)
+}
+
+// serveFile writes the file with range, conditional and caching support. The
+// file is passed as *os.File, so plain http responses are sent via sendfile.
+func (n *AppNode) serveFile(w http.ResponseWriter, r *http.Request, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			_http.RespondWithError(w, http.StatusNotFound, "file not found")
+			return
+		}
+		log.WithFields(log.Fields{
+			"path":  path,
+			"error": err.Error(),
+		}).Error("could not open file")
+		_http.RespondWithError(w, http.StatusInternalServerError, "could not open file")
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		_http.RespondWithError(w, http.StatusNotFound, "file not found")
+		return
+	}
+
+	// signed urls set the cache control according to their expiry, all other
+	// requests must be revalidated
+	if w.Header().Get("Cache-Control") == "" {
+		w.Header().Set("Cache-Control", "private, no-cache")
+	}
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()))
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
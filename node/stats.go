@@ -0,0 +1,84 @@
+package node
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	_http "github.com/mirisbowring/primboard/helper/http"
+	"github.com/mirisbowring/primboard/internal/handler"
+	"github.com/mirisbowring/primboard/models/maps"
+	log "github.com/sirupsen/logrus"
+)
+
+// getStats returns the storage usage of the users and groups and the free
+// space of the base path (gateway only)
+func (n *AppNode) getStats(w http.ResponseWriter, r *http.Request) {
+	if !n.isGatewayClient(w) {
+		_http.RespondWithError(w, http.StatusForbidden, "only the gateway may access the stats")
+		return
+	}
+	_http.RespondWithJSON(w, http.StatusOK, n.stats())
+}
+
+// stats sums up the files of the user and group directories
+func (n *AppNode) stats() maps.NodeStats {
+	free, total := diskUsage(n.Config.BasePath)
+	stats := maps.NodeStats{
+		DiskFree:  free,
+		DiskTotal: total,
+	}
+
+	users, _ := handler.GetDirectories(filepath.Join(n.Config.BasePath, string(pathTypeUser)))
+	for _, username := range users {
+		s := maps.StorageStats{
+			Identifier: username,
+			Originals:  dirStats(n.getDataPath(username, pathTypeUser, false)),
+			Thumbnails: dirStats(n.getDataPath(username, pathTypeUser, true)),
+		}
+		stats.Originals.Add(s.Originals)
+		stats.Thumbnails.Add(s.Thumbnails)
+		stats.Users = append(stats.Users, s)
+	}
+
+	groups, _ := handler.GetDirectories(filepath.Join(n.Config.BasePath, string(pathTypeGroup)))
+	for _, id := range groups {
+		stats.Groups = append(stats.Groups, maps.StorageStats{
+			Identifier: id,
+			Originals:  dirStats(n.getDataPath(id, pathTypeGroup, false)),
+			Thumbnails: dirStats(n.getDataPath(id, pathTypeGroup, true)),
+		})
+	}
+
+	sort.Slice(stats.Users, func(i, j int) bool {
+		return stats.Users[i].Originals.Bytes > stats.Users[j].Originals.Bytes
+	})
+	sort.Slice(stats.Groups, func(i, j int) bool {
+		return stats.Groups[i].Originals.Bytes > stats.Groups[j].Originals.Bytes
+	})
+	return stats
+}
+
+// dirStats sums up the regular files of the directory (not recursive).
+// Partial downloads are skipped.
+func dirStats(path string) maps.FileStats {
+	var s maps.FileStats
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"path":  path,
+			"error": err.Error(),
+		}).Debug("could not read directory")
+		return s
+	}
+	for _, f := range files {
+		if !f.Mode().IsRegular() || strings.HasSuffix(f.Name(), ".part") {
+			continue
+		}
+		s.Bytes += f.Size()
+		s.Files++
+	}
+	return s
+}
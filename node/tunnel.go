@@ -0,0 +1,101 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	_http "github.com/mirisbowring/primboard/helper/http"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+)
+
+// tunnelRetryInterval is the time to wait before the tunnel is reopened
+const tunnelRetryInterval = 10 * time.Second
+
+// tunnelKey marks the requests received through the tunnel
+type tunnelKey struct{}
+
+// tunnelAddr is the address of both ends of the tunnel
+type tunnelAddr struct{}
+
+func (tunnelAddr) Network() string { return "tunnel" }
+func (tunnelAddr) String() string  { return "gateway" }
+
+// tunnelConn adapts the upgraded connection to a net.Conn (the deadlines are
+// not supported)
+type tunnelConn struct {
+	io.ReadWriteCloser
+}
+
+func (tunnelConn) LocalAddr() net.Addr                { return tunnelAddr{} }
+func (tunnelConn) RemoteAddr() net.Addr               { return tunnelAddr{} }
+func (tunnelConn) SetDeadline(t time.Time) error      { return nil }
+func (tunnelConn) SetReadDeadline(t time.Time) error  { return nil }
+func (tunnelConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// isTunneled returns whether the request has been received through the tunnel
+func isTunneled(r *http.Request) bool {
+	tunneled, _ := r.Context().Value(tunnelKey{}).(bool)
+	return tunneled
+}
+
+// runTunnel keeps the tunnel to the gateway open
+func (n *AppNode) runTunnel() {
+	for {
+		err := n.serveTunnel()
+		log.WithFields(log.Fields{
+			"gateway": n.Config.GatewayURL,
+			"error":   err.Error(),
+		}).Warn("tunnel to gateway closed, reopening in 10 sec")
+		time.Sleep(tunnelRetryInterval)
+	}
+}
+
+// serveTunnel opens the tunnel to the gateway and serves the requests sent
+// through it until the tunnel is closed
+func (n *AppNode) serveTunnel() error {
+	// refresh keycloaktoken in neccessary
+	n.refreshServiceToken()
+
+	api := fmt.Sprintf("%s/api/v2/infrastructure/node/tunnel", n.Config.GatewayURL)
+	req, err := http.NewRequest(http.MethodGet, api, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", n.ServiceToken.AccessToken))
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", _http.TunnelProtocol)
+
+	res, err := n.gatewayClient().Do(req)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		res.Body.Close()
+		return fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+	rwc, ok := res.Body.(io.ReadWriteCloser)
+	if !ok {
+		res.Body.Close()
+		return errors.New("connection has not been upgraded")
+	}
+	defer rwc.Close()
+
+	log.WithFields(log.Fields{
+		"gateway": n.Config.GatewayURL,
+	}).Info("opened tunnel to gateway")
+
+	handler := n.handler()
+	server := &http2.Server{}
+	server.ServeConn(tunnelConn{rwc}, &http2.ServeConnOpts{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tunnelKey{}, true)))
+		}),
+	})
+	return errors.New("connection closed")
+}